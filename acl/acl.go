@@ -0,0 +1,250 @@
+// Package acl provides a datastore wrapper that allows or denies operations
+// by key prefix and operation type, as a guardrail when many components
+// share one datastore handle.
+//
+// For example, to make /public read-only and forbid deletes under /pins:
+//
+//	d := acl.New(child, acl.Policy{
+//		Default: acl.All,
+//		Rules: []acl.Rule{
+//			{Prefix: ds.NewKey("/public"), Allow: acl.Read | acl.List},
+//			{Prefix: ds.NewKey("/pins"), Allow: acl.All &^ acl.Delete},
+//		},
+//	})
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Op is a set of operation types.
+type Op uint8
+
+const (
+	// Read covers Get, Has and GetSize.
+	Read Op = 1 << iota
+	// List covers Query.
+	List
+	// Write covers Put.
+	Write
+	// Delete covers Delete.
+	Delete
+
+	// None allows nothing.
+	None Op = 0
+	// All allows every operation.
+	All = Read | List | Write | Delete
+)
+
+func (o Op) String() string {
+	if o == None {
+		return "none"
+	}
+	var names []string
+	for _, n := range []struct {
+		op   Op
+		name string
+	}{{Read, "read"}, {List, "list"}, {Write, "write"}, {Delete, "delete"}} {
+		if o&n.op != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// ErrPermissionDenied is matched by every PermissionError with errors.Is.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// PermissionError reports a denied operation.
+type PermissionError struct {
+	Op  Op
+	Key ds.Key
+	// Prefix is the rule that denied the operation, or the root key if
+	// the policy default did.
+	Prefix ds.Key
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("acl: %s of %s denied by policy for %s", e.Op, e.Key, e.Prefix)
+}
+
+// Is reports whether target is ErrPermissionDenied.
+func (e *PermissionError) Is(target error) bool {
+	return target == ErrPermissionDenied
+}
+
+// Rule allows a set of operations on the keys under a prefix, including the
+// prefix itself.
+type Rule struct {
+	Prefix ds.Key
+	Allow  Op
+}
+
+// Policy decides which operations are allowed. The rule with the longest
+// prefix covering a key applies; keys no rule covers get Default.
+type Policy struct {
+	Default Op
+	Rules   []Rule
+}
+
+// rule returns the rule applying to key.
+func (p *Policy) rule(key ds.Key) Rule {
+	best := Rule{Prefix: ds.NewKey("/"), Allow: p.Default}
+	bestLen := -1
+	for _, r := range p.Rules {
+		if (r.Prefix.Equal(key) || r.Prefix.IsAncestorOf(key)) && len(r.Prefix.String()) > bestLen {
+			best, bestLen = r, len(r.Prefix.String())
+		}
+	}
+	return best
+}
+
+func (p *Policy) check(op Op, key ds.Key) error {
+	r := p.rule(key)
+	if r.Allow&op == op {
+		return nil
+	}
+	return &PermissionError{Op: op, Key: key, Prefix: r.Prefix}
+}
+
+// Datastore enforces a Policy on a child datastore.
+type Datastore struct {
+	child  ds.Datastore
+	policy Policy
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// New wraps child with policy.
+func New(child ds.Datastore, policy Policy) *Datastore {
+	return &Datastore{child: child, policy: policy}
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	if err := d.policy.check(Write, key); err != nil {
+		return err
+	}
+	return d.child.Put(key, value)
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	if err := d.policy.check(Delete, key); err != nil {
+		return err
+	}
+	return d.child.Delete(key)
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	if err := d.policy.check(Read, key); err != nil {
+		return nil, err
+	}
+	return d.child.Get(key)
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	if err := d.policy.check(Read, key); err != nil {
+		return false, err
+	}
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	if err := d.policy.check(Read, key); err != nil {
+		return -1, err
+	}
+	return d.child.GetSize(key)
+}
+
+// Query implements Datastore.Query. Listing the query prefix must be
+// allowed; results under deeper prefixes that deny listing are left out.
+// Queries returning values also need Read on each result.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	if err := d.policy.check(List, ds.NewKey(q.Prefix)); err != nil {
+		return nil, err
+	}
+	need := List
+	if !q.KeysOnly {
+		need |= Read
+	}
+
+	// Apply limits and offsets after dropping denied entries.
+	inner := q
+	inner.Limit = 0
+	inner.Offset = 0
+	res, err := d.child.Query(inner)
+	if err != nil {
+		return nil, err
+	}
+	res = dsq.NaiveFilter(res, allowed{policy: &d.policy, need: need})
+
+	outer := dsq.Query{Offset: q.Offset, Limit: q.Limit}
+	return dsq.ResultsReplaceQuery(dsq.NaiveQueryApply(outer, res), q), nil
+}
+
+// allowed is a query filter dropping entries the policy hides.
+type allowed struct {
+	policy *Policy
+	need   Op
+}
+
+func (a allowed) Filter(e dsq.Entry) bool {
+	return a.policy.check(a.need, ds.RawKey(e.Key)) == nil
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Batch implements Batching.Batch. Operations are checked as they are
+// added to the batch.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	bds, ok := d.child.(ds.Batching)
+	if !ok {
+		return ds.NewBasicBatch(d), nil
+	}
+	b, err := bds.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &batch{b: b, policy: &d.policy}, nil
+}
+
+type batch struct {
+	b      ds.Batch
+	policy *Policy
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	if err := b.policy.check(Write, key); err != nil {
+		return err
+	}
+	return b.b.Put(key, value)
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	if err := b.policy.check(Delete, key); err != nil {
+		return err
+	}
+	return b.b.Delete(key)
+}
+
+func (b *batch) Commit() error {
+	return b.b.Commit()
+}
+
+// Close implements Datastore.Close
+func (d *Datastore) Close() error {
+	return d.child.Close()
+}
@@ -0,0 +1,101 @@
+package acl
+
+import (
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, New(ds.NewMapDatastore(), Policy{Default: All}))
+}
+
+func newPolicyDS() (*Datastore, ds.Datastore) {
+	child := ds.NewMapDatastore()
+	for _, k := range []string{"/public/a", "/public/b", "/pins/x", "/secret/s", "/other"} {
+		child.Put(ds.NewKey(k), []byte(k))
+	}
+	return New(child, Policy{
+		Default: All,
+		Rules: []Rule{
+			{Prefix: ds.NewKey("/public"), Allow: Read | List},
+			{Prefix: ds.NewKey("/pins"), Allow: All &^ Delete},
+			{Prefix: ds.NewKey("/secret"), Allow: None},
+		},
+	}), child
+}
+
+func TestRules(t *testing.T) {
+	d, _ := newPolicyDS()
+
+	if _, err := d.Get(ds.NewKey("/public/a")); err != nil {
+		t.Fatal(err)
+	}
+	err := d.Put(ds.NewKey("/public/a"), nil)
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("write to /public: %v", err)
+	}
+	var perr *PermissionError
+	if !errors.As(err, &perr) || perr.Op != Write || perr.Prefix.String() != "/public" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+
+	if err := d.Put(ds.NewKey("/pins/y"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ds.NewKey("/pins/x")); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("delete under /pins: %v", err)
+	}
+	if _, err := d.Has(ds.NewKey("/secret/s")); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("read under /secret: %v", err)
+	}
+	// Prefix matching is by path segment.
+	if err := d.Put(ds.NewKey("/publication"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ds.NewKey("/pins/x")); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("batched delete under /pins: %v", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	d, _ := newPolicyDS()
+
+	if _, err := d.Query(dsq.Query{Prefix: "/secret"}); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("listing /secret: %v", err)
+	}
+
+	res, err := d.Query(dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Key == "/secret/s" {
+			t.Fatal("denied key listed")
+		}
+	}
+	if len(entries) != 4 {
+		t.Fatalf("listed %d entries", len(entries))
+	}
+
+	res, err = d.Query(dsq.Query{Limit: 4, KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = res.Rest()
+	if len(entries) != 4 || entries[3].Key != "/public/b" {
+		t.Fatalf("limit applied before filtering: %v", entries)
+	}
+}
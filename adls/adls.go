@@ -0,0 +1,472 @@
+// Package adls implements a Datastore over an Azure Data Lake Storage Gen2
+// filesystem, that is a storage account with a hierarchical namespace,
+// through its DFS endpoint.
+//
+// Keys are stored as directories, mirroring the key, as the fs package
+// does: the value of "/foo/bar" is the file "foo/bar/.dsobject". Unlike a
+// flat blob listing, a directory is a real object, so a whole subtree of
+// keys can be deleted or moved in a single atomic request (DeleteTree,
+// Move), and the names directly below a key listed without walking the
+// keys under them (ListChildren).
+//
+// Path segments hold the bytes of keys outside [A-Za-z0-9_-] escaped as
+// ~XX, as are dots starting or ending a segment, so that a key's own
+// segments never clash with the value file or the ".dstmp" directory
+// values are written through, and so that every path reads the same
+// escaped and unescaped in URLs.
+//
+// TTLs are set as the files' expiry: the service deletes expired values
+// itself.
+package adls
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azdatalake/datalakeerror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azdatalake/directory"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azdatalake/file"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azdatalake/filesystem"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// valueFile is the name of the file holding a key's value inside the
+	// key's directory.
+	valueFile = ".dsobject"
+	// tmpDir is the directory values are written to before being renamed
+	// into place.
+	tmpDir = ".dstmp"
+)
+
+// ErrExists is returned by Move when its destination already exists.
+var ErrExists = errors.New("adls: destination exists")
+
+// Datastore stores keys as directories of a filesystem.
+type Datastore struct {
+	fs *filesystem.Client
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.TTLDatastore = (*Datastore)(nil)
+
+// NewDatastore returns a datastore over fs, which must exist and belong to
+// an account with a hierarchical namespace.
+func NewDatastore(fs *filesystem.Client) *Datastore {
+	return &Datastore{fs: fs}
+}
+
+// dirPath returns the path of key's directory, "" for the root.
+func dirPath(key ds.Key) string {
+	ns := key.Namespaces()
+	for i, n := range ns {
+		ns[i] = escape(n)
+	}
+	return strings.Join(ns, "/")
+}
+
+// filePath returns the path of the file holding key's value.
+func filePath(key ds.Key) string {
+	if dir := dirPath(key); dir != "" {
+		return dir + "/" + valueFile
+	}
+	return valueFile
+}
+
+// keyFor returns the key whose value the file at path holds.
+func keyFor(path string) (ds.Key, bool) {
+	dir := strings.TrimSuffix(path, "/"+valueFile)
+	if dir == path {
+		return ds.Key{}, false
+	}
+	segs := strings.Split(dir, "/")
+	for i, s := range segs {
+		segs[i] = unescape(s)
+	}
+	return ds.KeyWithNamespaces(segs), true
+}
+
+// escape returns the path segment of the key namespace s.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_', c == '-':
+			b.WriteByte(c)
+		case c == '.' && i > 0 && i < len(s)-1:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('~')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+		}
+	}
+	return b.String()
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+// unescape reverses escape.
+func unescape(s string) string {
+	if !strings.Contains(s, "~") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '~' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+func isNotFound(err error) bool {
+	var rerr *azcore.ResponseError
+	return errors.As(err, &rerr) && rerr.StatusCode == http.StatusNotFound
+}
+
+func (d *Datastore) put(ctx context.Context, key ds.Key, value []byte, ttl time.Duration) error {
+	var name [16]byte
+	if _, err := rand.Read(name[:]); err != nil {
+		return err
+	}
+	tmp := d.fs.NewFileClient(tmpDir + "/" + hex.EncodeToString(name[:]))
+	opts := &file.CreateOptions{}
+	if ttl > 0 {
+		opts.Expiry = file.CreateExpiryValues{
+			ExpiryType: file.CreateExpiryTypeRelativeToNow,
+			ExpiresOn:  strconv.FormatInt(milliseconds(ttl), 10),
+		}
+	}
+	if _, err := tmp.Create(ctx, opts); err != nil {
+		return err
+	}
+	err := d.write(ctx, tmp, key, value)
+	if err != nil {
+		tmp.Delete(ctx, nil)
+	}
+	return err
+}
+
+// write writes value to the temporary file tmp, then renames it to key's
+// file, replacing any value before it in one step.
+func (d *Datastore) write(ctx context.Context, tmp *file.Client, key ds.Key, value []byte) error {
+	if len(value) > 0 {
+		if _, err := tmp.AppendData(ctx, 0, streaming.NopCloser(bytes.NewReader(value)), nil); err != nil {
+			return err
+		}
+	}
+	if _, err := tmp.FlushData(ctx, int64(len(value)), &file.FlushDataOptions{Close: to.Ptr(true)}); err != nil {
+		return err
+	}
+	_, err := tmp.Rename(ctx, filePath(key), nil)
+	if datalakeerror.HasCode(err, datalakeerror.RenameDestinationParentPathNotFound) {
+		// Renames do not create the parents of their destination.
+		if _, err := d.fs.NewDirectoryClient(dirPath(key)).Create(ctx, nil); err != nil && !datalakeerror.HasCode(err, datalakeerror.PathAlreadyExists) {
+			return err
+		}
+		_, err = tmp.Rename(ctx, filePath(key), nil)
+	}
+	return err
+}
+
+// milliseconds returns ttl in whole milliseconds, rounded up so that short
+// TTLs still expire.
+func milliseconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+// Put implements Datastore.Put. The value is written to a temporary file
+// and renamed into place, so readers see either the old or the new value.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.put(context.TODO(), key, value, 0)
+}
+
+// Sync implements Datastore.Sync. Writes are durable once they return.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return nil
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	return d.read(context.TODO(), key)
+}
+
+func (d *Datastore) read(ctx context.Context, key ds.Key) ([]byte, error) {
+	resp, err := d.fs.NewFileClient(filePath(key)).DownloadStream(ctx, nil)
+	if isNotFound(err) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (d *Datastore) properties(ctx context.Context, key ds.Key) (file.GetPropertiesResponse, error) {
+	props, err := d.fs.NewFileClient(filePath(key)).GetProperties(ctx, nil)
+	if isNotFound(err) {
+		return props, ds.ErrNotFound
+	}
+	return props, err
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	_, err := d.properties(context.TODO(), key)
+	if err == ds.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	props, err := d.properties(context.TODO(), key)
+	if err != nil {
+		return -1, err
+	}
+	if props.ContentLength == nil {
+		return 0, nil
+	}
+	return int(*props.ContentLength), nil
+}
+
+// Delete implements Datastore.Delete. Deleting a missing key is not an
+// error. The key's directory is removed too if no keys remain under it.
+func (d *Datastore) Delete(key ds.Key) error {
+	ctx := context.TODO()
+	_, err := d.fs.NewFileClient(filePath(key)).Delete(ctx, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dir := dirPath(key); dir != "" {
+		// Fails, as it should, while the directory holds other keys.
+		d.fs.NewDirectoryClient(dir).Delete(ctx, nil)
+	}
+	return nil
+}
+
+// PutWithTTL implements TTL.PutWithTTL
+func (d *Datastore) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
+	return d.put(context.TODO(), key, value, ttl)
+}
+
+// SetTTL implements TTL.SetTTL
+func (d *Datastore) SetTTL(key ds.Key, ttl time.Duration) error {
+	_, err := d.fs.NewFileClient(filePath(key)).SetExpiry(context.TODO(), file.SetExpiryValues{
+		ExpiryType: file.SetExpiryTypeRelativeToNow,
+		ExpiresOn:  strconv.FormatInt(milliseconds(ttl), 10),
+	}, nil)
+	if isNotFound(err) {
+		return ds.ErrNotFound
+	}
+	return err
+}
+
+// GetExpiration implements TTL.GetExpiration. Keys without a TTL return the
+// zero time.
+func (d *Datastore) GetExpiration(key ds.Key) (time.Time, error) {
+	props, err := d.properties(context.TODO(), key)
+	if err != nil || props.ExpiresOn == nil {
+		return time.Time{}, err
+	}
+	return *props.ExpiresOn, nil
+}
+
+// DeleteTree deletes key and every key under it in one atomic request.
+// Deleting a missing tree is not an error.
+func (d *Datastore) DeleteTree(key ds.Key) error {
+	dir := dirPath(key)
+	if dir == "" {
+		return errors.New("adls: cannot delete the root")
+	}
+	_, err := d.fs.NewDirectoryClient(dir).Delete(context.TODO(), nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Move moves src and every key under it to the same paths under dst, in
+// one atomic request. It fails with ErrExists if dst, a key under it, or a
+// directory left by such keys exists, and with ds.ErrNotFound if neither
+// src nor any key under it does.
+func (d *Datastore) Move(src, dst ds.Key) error {
+	from, dest := dirPath(src), dirPath(dst)
+	if from == "" || dest == "" {
+		return errors.New("adls: cannot move the root")
+	}
+	if dest == from || strings.HasPrefix(dest, from+"/") {
+		return errors.New("adls: cannot move a key under itself")
+	}
+	ctx := context.TODO()
+	opts := &directory.RenameOptions{AccessConditions: &directory.AccessConditions{
+		ModifiedAccessConditions: &directory.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)},
+	}}
+	dir := d.fs.NewDirectoryClient(from)
+	_, err := dir.Rename(ctx, dest, opts)
+	if datalakeerror.HasCode(err, datalakeerror.RenameDestinationParentPathNotFound) {
+		if _, err := d.fs.NewDirectoryClient(dirPath(dst.Parent())).Create(ctx, nil); err != nil && !datalakeerror.HasCode(err, datalakeerror.PathAlreadyExists) {
+			return err
+		}
+		_, err = dir.Rename(ctx, dest, opts)
+	}
+	switch {
+	case datalakeerror.HasCode(err, datalakeerror.PathAlreadyExists) || isConditionNotMet(err):
+		return ErrExists
+	case isNotFound(err):
+		return ds.ErrNotFound
+	}
+	return err
+}
+
+func isConditionNotMet(err error) bool {
+	var rerr *azcore.ResponseError
+	return errors.As(err, &rerr) && rerr.StatusCode == http.StatusPreconditionFailed
+}
+
+// ListChildren returns the keys one namespace below key that are keys
+// themselves or have keys under them, with a delimited listing that does
+// not walk the keys further down. They are returned in no particular
+// order.
+func (d *Datastore) ListChildren(key ds.Key) ([]ds.Key, error) {
+	ctx := context.TODO()
+	dir := dirPath(key)
+	opts := &filesystem.ListPathsOptions{}
+	if dir != "" {
+		opts.Prefix = &dir
+	}
+	var children []ds.Key
+	pager := d.fs.NewListPathsPager(false, opts)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if isNotFound(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.Paths {
+			if p.Name == nil || p.IsDirectory == nil || !*p.IsDirectory {
+				continue
+			}
+			name := *p.Name
+			if i := strings.LastIndexByte(name, '/'); i >= 0 {
+				name = name[i+1:]
+			}
+			if name == tmpDir {
+				continue
+			}
+			children = append(children, key.ChildString(unescape(name)))
+		}
+	}
+	return children, nil
+}
+
+// Query implements Datastore.Query. The prefix is pushed down as a
+// recursive listing of its directory; everything else is applied naively.
+// Values, and expirations if asked for, are read one key at a time as the
+// results are consumed.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	prefix := ds.NewKey(q.Prefix)
+	opts := &filesystem.ListPathsOptions{}
+	if dir := dirPath(prefix); dir != "" {
+		opts.Prefix = &dir
+	}
+	pager := d.fs.NewListPathsPager(true, opts)
+
+	var page []*filesystem.Path
+	it := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for {
+				for len(page) > 0 {
+					p := page[0]
+					page = page[1:]
+					if p.Name == nil || p.IsDirectory != nil && *p.IsDirectory {
+						continue
+					}
+					key, ok := keyFor(*p.Name)
+					if !ok || !prefix.IsAncestorOf(key) {
+						continue
+					}
+					e := dsq.Entry{Key: key.String(), Size: -1}
+					if p.ContentLength != nil {
+						e.Size = int(*p.ContentLength)
+					}
+					var err error
+					if !q.KeysOnly {
+						e.Value, err = d.read(ctx, key)
+						if err == ds.ErrNotFound {
+							continue
+						}
+						if err != nil {
+							return dsq.Result{Error: err}, true
+						}
+					}
+					if q.ReturnExpirations {
+						e.Expiration, err = d.GetExpiration(key)
+						if err == ds.ErrNotFound {
+							continue
+						}
+						if err != nil {
+							return dsq.Result{Error: err}, true
+						}
+					}
+					return dsq.Result{Entry: e}, true
+				}
+				if !pager.More() {
+					return dsq.Result{}, false
+				}
+				resp, err := pager.NextPage(ctx)
+				if isNotFound(err) {
+					// The prefix has no directory, so no keys.
+					return dsq.Result{}, false
+				}
+				if err != nil {
+					return dsq.Result{Error: err}, true
+				}
+				page = resp.Paths
+			}
+		},
+		Close: func() error {
+			cancel()
+			return nil
+		},
+	}
+	return dsq.NaiveQueryApply(q, dsq.ResultsFromIterator(q, it)), nil
+}
+
+// Batch implements Batching.Batch. Keys are written one request each.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// Close implements Datastore.Close
+func (d *Datastore) Close() error {
+	return nil
+}
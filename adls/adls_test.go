@@ -0,0 +1,87 @@
+package adls
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azdatalake/filesystem"
+	ds "github.com/ipfs/go-datastore"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestPaths(t *testing.T) {
+	for _, tc := range []struct{ key, path string }{
+		{"/blocks/CIQABC", "blocks/CIQABC/.dsobject"},
+		{"/a b/c%d", "a~20b/c~25d/.dsobject"},
+		{"/.dsobject", "~2Edsobject/.dsobject"},
+		{"/.dstmp/x.y.", "~2Edstmp/x.y~2E/.dsobject"},
+		{"/~7E", "~7E7E/.dsobject"},
+	} {
+		p := filePath(ds.NewKey(tc.key))
+		if p != tc.path {
+			t.Errorf("filePath(%s) = %s, want %s", tc.key, p, tc.path)
+		}
+		k, ok := keyFor(p)
+		if !ok || k.String() != tc.key {
+			t.Errorf("keyFor(%s) = %s, %v, want %s", p, k, ok, tc.key)
+		}
+	}
+	for _, p := range []string{".dsobject", ".dstmp/0123", "a/b"} {
+		if k, ok := keyFor(p); ok {
+			t.Errorf("keyFor(%s) = %s, want no key", p, k)
+		}
+	}
+}
+
+func TestMilliseconds(t *testing.T) {
+	for _, tc := range []struct {
+		ttl  int64
+		want int64
+	}{{1, 1}, {1e6, 1}, {1e6 + 1, 2}, {5e9, 5000}} {
+		if got := milliseconds(time.Duration(tc.ttl)); got != tc.want {
+			t.Errorf("milliseconds(%d) = %d, want %d", tc.ttl, got, tc.want)
+		}
+	}
+}
+
+// TestSuite runs against the filesystem named by ADLS_FILESYSTEM in the
+// account of ADLS_CONNECTION_STRING, which needs a hierarchical namespace.
+// The filesystem is cleared by the suite.
+func TestSuite(t *testing.T) {
+	conn, name := os.Getenv("ADLS_CONNECTION_STRING"), os.Getenv("ADLS_FILESYSTEM")
+	if conn == "" || name == "" {
+		t.Skip("ADLS_CONNECTION_STRING or ADLS_FILESYSTEM not set")
+	}
+	fs, err := filesystem.NewClientFromConnectionString(conn, name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDatastore(fs)
+	dstest.SubtestAll(t, d)
+
+	for _, k := range []string{"/tree/a", "/tree/b/c"} {
+		if err := d.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	children, err := d.ListChildren(ds.NewKey("/tree"))
+	if err != nil || len(children) != 2 {
+		t.Fatalf("got children %v, %v", children, err)
+	}
+	if err := d.Move(ds.NewKey("/tree"), ds.NewKey("/moved/tree")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(ds.NewKey("/moved/tree/b/c")); err != nil || string(v) != "/tree/b/c" {
+		t.Fatalf("got %q, %v after move", v, err)
+	}
+	if err := d.Move(ds.NewKey("/missing"), ds.NewKey("/moved")); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := d.DeleteTree(ds.NewKey("/moved")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Has(ds.NewKey("/moved/tree/a")); err != nil || ok {
+		t.Fatalf("key survived DeleteTree: %v, %v", ok, err)
+	}
+}
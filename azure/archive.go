@@ -0,0 +1,104 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+)
+
+// ErrArchived matches, with errors.Is, the ArchivedErrors of reads of
+// archived values.
+var ErrArchived = errors.New("azure: value is archived")
+
+// ArchivedError is returned by Get and GetReader for a value in the
+// archive tier, which cannot be read until rehydrated to an online tier.
+// Rehydration takes hours.
+type ArchivedError struct {
+	Key ds.Key
+	// Rehydrating is whether the value is being rehydrated, at the
+	// request of this read or an earlier one.
+	Rehydrating bool
+}
+
+func (e *ArchivedError) Error() string {
+	if e.Rehydrating {
+		return fmt.Sprintf("azure: %s is archived and being rehydrated", e.Key)
+	}
+	return fmt.Sprintf("azure: %s is archived", e.Key)
+}
+
+// Is makes ArchivedErrors match ErrArchived.
+func (e *ArchivedError) Is(target error) bool {
+	return target == ErrArchived
+}
+
+// DefaultRehydratePoll is how often a read waiting for a rehydration
+// checks on it.
+const DefaultRehydratePoll = time.Minute
+
+// RehydrateOptions says what reads of archived values do.
+type RehydrateOptions struct {
+	// Tier is the tier reads rehydrate archived values to,
+	// azblob.AccessTierHot or azblob.AccessTierCool. The default,
+	// azblob.AccessTierNone, leaves them archived.
+	Tier azblob.AccessTierType
+	// Wait has reads of values being rehydrated block until the value
+	// is online again, or the read's context ends, instead of returning
+	// an ArchivedError.
+	Wait bool
+	// PollInterval is how often a waiting read checks the value.
+	// Defaults to DefaultRehydratePoll.
+	PollInterval time.Duration
+}
+
+// WithRehydration sets what reads of archived values do. By default they
+// fail with an ArchivedError.
+func WithRehydration(o RehydrateOptions) Option {
+	return func(c *config) {
+		if o.PollInterval <= 0 {
+			o.PollInterval = DefaultRehydratePoll
+		}
+		c.rehydrate = o
+	}
+}
+
+// archived handles a read finding key archived. It starts the value's
+// rehydration and waits for it, as configured, returning nil once the
+// value can be read, and an ArchivedError otherwise.
+func (d *Datastore) archived(ctx context.Context, key ds.Key) error {
+	o := d.config.rehydrate
+	blob := d.keyUrl(key)
+	for {
+		props, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, d.config.cpk)
+		if err != nil {
+			if isError(err, azblob.ServiceCodeBlobNotFound) {
+				return ds.ErrNotFound
+			}
+			return err
+		}
+		if props.AccessTier() != string(azblob.AccessTierArchive) {
+			return nil
+		}
+		rehydrating := props.ArchiveStatus() != ""
+		if !rehydrating && o.Tier != azblob.AccessTierNone {
+			_, err := blob.SetTier(ctx, o.Tier, azblob.LeaseAccessConditions{})
+			if err != nil && !isError(err, azblob.ServiceCodeBlobBeingRehydrated) {
+				return err
+			}
+			rehydrating = true
+		}
+		if !rehydrating || !o.Wait {
+			return &ArchivedError{Key: key, Rehydrating: rehydrating}
+		}
+		select {
+		case <-clock.OrReal(d.config.clock).After(o.PollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
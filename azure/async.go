@@ -0,0 +1,291 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"go.uber.org/multierr"
+)
+
+// WithAsyncPuts has Put return once the value is queued, and upload it in
+// the background with the given number of workers. Sync(prefix) waits for
+// the puts under prefix queued before it and returns those that failed;
+// Close waits for all of them, up to the close timeout.
+//
+// Get, Has and GetSize see queued values at once, and Delete waits for a
+// queued put of its key. Queries, transactions and the other writes see
+// queued values only once they are uploaded, so Sync before relying on
+// them. Puts of a key queued while it is uploading are coalesced: only
+// the latest value is uploaded next.
+//
+// Queued puts are lost if the process dies before uploading them, unless
+// they are logged with WithWriteAheadLog.
+func WithAsyncPuts(workers int) Option {
+	return func(c *config) {
+		c.asyncWorkers = workers
+	}
+}
+
+// asyncPuts queues puts for background workers.
+type asyncPuts struct {
+	d        *Datastore
+	queue    chan ds.Key
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu      sync.Mutex
+	log     *wal // nil without WithWriteAheadLog
+	pending map[ds.Key]*asyncPut
+	failed  map[ds.Key]error
+}
+
+// asyncPut is a key's queued value.
+type asyncPut struct {
+	value   []byte
+	running bool // a worker is uploading the key
+	dirty   bool // value changed since the upload began
+	ctx     context.Context
+	finish  func(error)
+	done    chan struct{} // closed once the key is no longer pending
+}
+
+func newAsyncPuts(d *Datastore, workers int) *asyncPuts {
+	a := &asyncPuts{
+		d:       d,
+		queue:   make(chan ds.Key, workers),
+		stop:    make(chan struct{}),
+		pending: make(map[ds.Key]*asyncPut),
+		failed:  make(map[ds.Key]error),
+	}
+	for i := 0; i < workers; i++ {
+		go a.work()
+	}
+	return a
+}
+
+// put queues value for key, blocking while the queue is full.
+func (a *asyncPuts) put(key ds.Key, value []byte) error {
+	// Begun before logging, so a put refused by Close leaves no record to
+	// replay, and Close waits for the log write before closing the log.
+	opCtx, finish, err := a.d.life.begin(context.Background(), key, true)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	if a.log != nil {
+		if err := a.log.put(key, value); err != nil {
+			a.mu.Unlock()
+			finish(err)
+			return err
+		}
+	}
+	if p, ok := a.pending[key]; ok {
+		p.value = value
+		if p.running {
+			p.dirty = true
+		}
+		a.mu.Unlock()
+		// The pending put keeps Close waiting until it is uploaded.
+		finish(nil)
+		return nil
+	}
+	p := a.add(key, value, opCtx, finish)
+	a.mu.Unlock()
+	return a.send(key, p)
+}
+
+// add records a put of key, which has none pending. The put is in flight
+// for Close, under opCtx, until it is uploaded and finish is called.
+func (a *asyncPuts) add(key ds.Key, value []byte, opCtx context.Context, finish func(error)) *asyncPut {
+	p := &asyncPut{value: value, ctx: opCtx, finish: finish, done: make(chan struct{})}
+	a.pending[key] = p
+	delete(a.failed, key)
+	return p
+}
+
+// send queues the put p of key for a worker.
+func (a *asyncPuts) send(key ds.Key, p *asyncPut) error {
+	// Waiting for room in the queue only stops when Close gives up on
+	// writes: other puts of key may already count on this one.
+	select {
+	case a.queue <- key:
+		return nil
+	case <-p.ctx.Done():
+		// Like a put cancelled while uploading, this one is left in the
+		// log to upload again.
+		a.mu.Lock()
+		delete(a.pending, key)
+		a.mu.Unlock()
+		p.finish(p.ctx.Err())
+		close(p.done)
+		return ErrClosed
+	}
+}
+
+// replay queues the puts a write-ahead log held pending, in order. They
+// are pending once it returns; a goroutine queues them for the workers.
+func (a *asyncPuts) replay(entries []walEntry) error {
+	a.mu.Lock()
+	puts := make([]*asyncPut, len(entries))
+	for i, e := range entries {
+		opCtx, finish, err := a.d.life.begin(context.Background(), e.key, true)
+		if err != nil {
+			a.mu.Unlock()
+			return err
+		}
+		puts[i] = a.add(e.key, e.value, opCtx, finish)
+	}
+	a.mu.Unlock()
+	go func() {
+		for i, e := range entries {
+			a.send(e.key, puts[i])
+		}
+	}()
+	return nil
+}
+
+// logDone logs that key's put was uploaded or failed. A failure is only
+// logged: the put is uploaded again after a restart.
+func (a *asyncPuts) logDone(key ds.Key) {
+	if a.log == nil {
+		return
+	}
+	if err := a.log.done(key); err != nil {
+		a.d.config.logf("azure: write-ahead log of %s failed: %s", key, err)
+	}
+}
+
+func (a *asyncPuts) work() {
+	for {
+		var key ds.Key
+		select {
+		case key = <-a.queue:
+		case <-a.stop:
+			return
+		}
+
+		a.mu.Lock()
+		p := a.pending[key]
+		p.running = true
+		value := p.value
+		a.mu.Unlock()
+		for {
+			err := a.d.put(p.ctx, key, value, azblob.Metadata{})
+			a.mu.Lock()
+			if err == nil && p.dirty {
+				p.dirty = false
+				value = p.value
+				a.mu.Unlock()
+				continue
+			}
+			delete(a.pending, key)
+			// Puts cancelled by Close are reported by Close as
+			// unpersisted, and left in the log to upload again.
+			cancelled := err != nil && a.d.life.writeCtx.Err() != nil
+			if err != nil && !cancelled {
+				a.failed[key] = err
+				a.d.config.logf("azure: asynchronous put of %s failed: %s", key, brief(err))
+			}
+			if !cancelled {
+				a.logDone(key)
+			}
+			a.mu.Unlock()
+			p.finish(err)
+			close(p.done)
+			break
+		}
+	}
+}
+
+// queued returns the value queued for key by an asynchronous put.
+func (d *Datastore) queued(key ds.Key) ([]byte, bool) {
+	if d.async == nil {
+		return nil, false
+	}
+	a := d.async
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if p, ok := a.pending[key]; ok {
+		return p.value, true
+	}
+	return nil, false
+}
+
+// waitQueued waits until no asynchronous put of key is queued.
+func (d *Datastore) waitQueued(ctx context.Context, key ds.Key) error {
+	if d.async == nil {
+		return nil
+	}
+	return d.async.wait(ctx, key)
+}
+
+// wait waits until no put of key is queued.
+func (a *asyncPuts) wait(ctx context.Context, key ds.Key) error {
+	for {
+		a.mu.Lock()
+		p, ok := a.pending[key]
+		a.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sync waits for the puts queued under prefix, returning the errors of
+// those that failed since the last sync.
+func (a *asyncPuts) sync(ctx context.Context, prefix ds.Key) error {
+	a.mu.Lock()
+	var waits []chan struct{}
+	for k, p := range a.pending {
+		if prefix.Equal(k) || prefix.IsAncestorOf(k) {
+			waits = append(waits, p.done)
+		}
+	}
+	a.mu.Unlock()
+	for _, done := range waits {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var keys []ds.Key
+	for k := range a.failed {
+		if prefix.Equal(k) || prefix.IsAncestorOf(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	var errs error
+	for _, k := range keys {
+		errs = multierr.Append(errs, fmt.Errorf("azure: put %s: %w", k, a.failed[k]))
+		delete(a.failed, k)
+	}
+	return errs
+}
+
+// close stops the workers once the lifecycle has drained the queue and
+// closes the log, returning the failures not yet reported by sync. Later
+// calls return nil.
+func (a *asyncPuts) close() error {
+	var err error
+	a.stopOnce.Do(func() {
+		close(a.stop)
+		if a.log != nil {
+			err = a.log.close()
+		}
+	})
+	return multierr.Combine(a.sync(context.Background(), ds.NewKey("/")), err)
+}
@@ -1,57 +1,130 @@
-// Package fs is a simple Datastore implementation that stores keys
-// as directories and files, mirroring the key. That is, the key
-// "/foo/bar" is stored as file "PATH/foo/bar/.dsobject".
-//
-// This means key some segments will not work. For example, the
-// following keys will result in unwanted behavior:
-//
-//     - "/foo/./bar"
-//     - "/foo/../bar"
-//     - "/foo\x00bar"
-//
-// Keys that only differ in case may be confused with each other on
-// case insensitive file systems, for example in OS X.
-//
-// This package is intended for exploratory use, where the user would
-// examine the file system manually, and should only be used with
-// human-friendly, trusted keys. You have been warned.
+// Package azure implements a Datastore backed by an Azure Blob Storage
+// container. Each key is stored as a block blob named by the key string,
+// with the bytes blob names cannot hold escaped, and queries list the
+// container by blob name prefix.
 package azure
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"net/url"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/internal/blobkey"
 	query "github.com/ipfs/go-datastore/query"
+	"github.com/jbenet/goprocess"
 )
 
-// Datastore uses a uses a file per key to store values.
-type datastore struct {
+// Datastore stores each key as a block blob in a container.
+type Datastore struct {
 	containerUrl azblob.ContainerURL
-	putcache     map[string]struct{}
+	credential   pipeline.Factory
+	config       config
+	routes       []route
+
+	ensureMu sync.Mutex
+	ensured  bool
+
+	life  *lifecycle
+	usage diskUsage
+	async *asyncPuts
+	lock  containerLock
+	epoch uint64 // fencing epoch, see AcquireEpoch
 }
 
-// NewDatastore returns a new fs Datastore at given `path`
-func NewDatastore(accountName, accountKey, container string) (ds.Datastore, error) {
-	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", accountName, container))
-	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// NewDatastore returns a Datastore over the given container of the
+// account, authorized as a credential option says: WithSharedKey,
+// WithSAS or WithCredential. Without one, requests are anonymous, which
+// only reads public containers. It makes no requests; the container is
+// created, if need be, before the first write. See EnsureContainer.
+func NewDatastore(accountName, container string, opts ...Option) (*Datastore, error) {
+	cfg := defaultConfig()
+	for _, o := range opts {
+		o(&cfg)
+	}
+	credential, err := cfg.credential(accountName)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := cfg.containerURL(accountName, container, "")
 	if err != nil {
 		return nil, err
 	}
-	curl := azblob.NewContainerURL(*u, azblob.NewPipeline(credential, azblob.PipelineOptions{}))
-	_, err = curl.Create(context.TODO(), azblob.Metadata{}, azblob.PublicAccessNone)
+	curl := azblob.NewContainerURL(*u, cfg.newPipeline(credential))
+	routes, err := cfg.buildRoutes(cfg.routes, accountName, container, credential)
 	if err != nil {
-		if !isError(err, azblob.ServiceCodeContainerAlreadyExists) {
+		return nil, err
+	}
+	d := &Datastore{containerUrl: curl, credential: credential, config: cfg, routes: routes, life: newLifecycle()}
+	if cfg.walPath != "" && cfg.asyncWorkers <= 0 {
+		return nil, errWALWithoutAsync
+	}
+	var log *wal
+	var pending []walEntry
+	if cfg.walPath != "" {
+		if log, pending, err = openWAL(cfg.walPath); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.asyncWorkers > 0 {
+		d.async = newAsyncPuts(d, cfg.asyncWorkers)
+		d.async.log = log
+		if err := d.async.replay(pending); err != nil {
 			return nil, err
 		}
 	}
-	return &datastore{containerUrl: curl}, nil
+	return d, nil
+}
+
+// newPipeline is azblob.NewPipeline for any credential policy, such as
+// the SAS policy, not only azblob's own credentials, retrying and
+// reporting telemetry, tracing, limiting and logging requests as
+// configured.
+func (c *config) newPipeline(credential pipeline.Factory) pipeline.Pipeline {
+	factories := []pipeline.Factory{
+		azblob.NewTelemetryPolicyFactory(c.telemetry),
+		azblob.NewUniqueRequestIDPolicyFactory(),
+		azblob.NewRetryPolicyFactory(c.retry),
+	}
+	if c.tracer != nil {
+		factories = append(factories, c.tracingPolicy())
+	}
+	if c.limiter != nil {
+		factories = append(factories, c.limitingPolicy())
+	}
+	factories = append(factories, identityEncoding, credential)
+	if c.logger != nil {
+		factories = append(factories, c.loggingPolicy())
+	}
+	return pipeline.NewPipeline(append(factories, pipeline.MethodFactoryMarker()), pipeline.Options{HTTPSender: c.httpSender()})
+}
+
+// httpSender returns the policy sending requests with the client set by
+// WithHTTPClient, or nil for azblob's default.
+func (c *config) httpSender() pipeline.Factory {
+	client := c.httpClient
+	if client == nil {
+		return nil
+	}
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			resp, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(resp), err
+		}
+	})
 }
 
 func isError(err error, e azblob.ServiceCodeType) bool {
@@ -63,116 +136,352 @@ func isError(err error, e azblob.ServiceCodeType) bool {
 }
 
 // KeyFilename returns the filename associated with `key`
-func (d *datastore) keyUrl(key ds.Key) azblob.BlockBlobURL {
-	return d.containerUrl.NewBlockBlobURL(key.String())
+func (d *Datastore) keyUrl(key ds.Key) azblob.BlockBlobURL {
+	return d.containerFor(key).NewBlockBlobURL(d.nameFor(key))
+}
+
+// Put implements Datastore.Put. See PutContext.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.PutContext(context.Background(), key, value)
+}
+
+// PutContext stores the given value. Values up to the single-shot
+// threshold are uploaded in one request, larger ones as blocks staged in
+// parallel. With WithAsyncPuts, the value is queued for upload instead.
+func (d *Datastore) PutContext(ctx context.Context, key ds.Key, value []byte) (err error) {
+	ctx, span := d.trace(ctx, "azure.Put", key.Parent().String())
+	span.set("ds.value.size", len(value))
+	defer func() { span.end(err) }()
+	if d.async != nil {
+		return d.async.put(key, value)
+	}
+	ctx, done, err := d.life.begin(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return d.put(ctx, key, value, azblob.Metadata{})
 }
 
-// Put stores the given value.
-func (d *datastore) Put(key ds.Key, value []byte) (err error) {
+func (d *Datastore) put(ctx context.Context, key ds.Key, value []byte, meta azblob.Metadata) error {
+	return d.putIf(ctx, key, value, meta, azblob.BlobAccessConditions{})
+}
+
+// putIf writes value if the blob meets ac, compressed as configured.
+func (d *Datastore) putIf(ctx context.Context, key ds.Key, value []byte, meta azblob.Metadata, ac azblob.BlobAccessConditions) error {
 	blob := d.keyUrl(key)
-	ctx := context.TODO()
-	//block if exists?
-	_, err = blob.Upload(ctx, bytes.NewReader(value), azblob.BlobHTTPHeaders{}, azblob.Metadata{},
-		azblob.BlobAccessConditions{}, azblob.AccessTierNone, nil, azblob.ClientProvidedKeyOptions{})
-	// put into go routine an only block on sync
-	// check _ respoonse.statuscode?
-	return err
+	if err := d.ensureFor(ctx, key); err != nil {
+		return err
+	}
+	value, h, meta, err := d.compress(value, d.stampEpoch(meta))
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < counterRetries; attempt++ {
+		fenced, own, err := d.fence(ctx, blob.BlobURL, ac)
+		if err != nil {
+			return err
+		}
+		if err := d.snapshotBefore(ctx, blob, fenced); err != nil {
+			return err
+		}
+		t := d.config.transfer(key, true, int64(len(value)))
+		if d.config.putStrategy(int64(len(value))) == uploadSingle {
+			err = d.uploadSingleShot(ctx, blob, value, h, meta, fenced, t)
+		} else {
+			err = d.uploadStaged(ctx, blob, value, h, meta, fenced, t)
+		}
+		if !own || !raced(err) {
+			return err
+		}
+	}
+	return ErrContention
 }
 
-// Sync would ensure that any previous Puts done
-// skipping for now
-func (d *datastore) Sync(prefix ds.Key) error {
+// Sync implements Datastore.Sync. With WithAsyncPuts, it waits for the
+// puts under prefix queued before it, returning those that failed since
+// the last Sync; otherwise writes are durable once they return.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	if d.async != nil {
+		return d.async.sync(context.Background(), prefix)
+	}
 	return nil
 }
 
-// Get returns the value for given key
-func (d *datastore) Get(key ds.Key) (value []byte, err error) {
-	blob := d.keyUrl(key)
-	ctx := context.TODO()
-	//presize buffer
-	get, err := blob.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	return d.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value for given key. Reading a value in the
+// archive tier returns an ArchivedError; see WithRehydration. A value not
+// matching its stored MD5 returns a CorruptError; see
+// WithMD5Verification.
+func (d *Datastore) GetContext(ctx context.Context, key ds.Key) (value []byte, err error) {
+	ctx, span := d.trace(ctx, "azure.Get", key.Parent().String())
+	defer func() {
+		span.set("ds.value.size", len(value))
+		span.end(err)
+	}()
+	if v, ok := d.queued(key); ok {
+		return v, nil
+	}
+	ctx, done, err := d.life.begin(ctx, key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { done(err) }()
+
+	value, meta, err := d.download(ctx, key, d.keyUrl(key).BlobURL)
+	for isError(err, azblob.ServiceCodeBlobArchived) {
+		if err := d.archived(ctx, key); err != nil {
+			return nil, err
+		}
+		value, meta, err = d.download(ctx, key, d.keyUrl(key).BlobURL)
+	}
 	if err != nil {
 		if isError(err, azblob.ServiceCodeBlobNotFound) {
 			return nil, ds.ErrNotFound
 		}
 		return nil, err
 	}
-	b := bytes.Buffer{}
-	reader := get.Body(azblob.RetryReaderOptions{})
-	defer reader.Close()
-	b.ReadFrom(reader)
-	return b.Bytes(), nil
+	if d.expired(meta) {
+		return nil, ds.ErrNotFound
+	}
+	return value, nil
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	return d.HasContext(context.Background(), key)
 }
 
-// Has returns whether the datastore has a value for a given key
-func (d *datastore) Has(key ds.Key) (exists bool, err error) {
+// HasContext returns whether the datastore has a value for a given key
+func (d *Datastore) HasContext(ctx context.Context, key ds.Key) (exists bool, err error) {
+	if _, ok := d.queued(key); ok {
+		return true, nil
+	}
+	ctx, done, err := d.life.begin(ctx, key, false)
+	if err != nil {
+		return false, err
+	}
+	defer func() { done(err) }()
+
 	blob := d.keyUrl(key)
-	ctx := context.TODO()
 	//block if exists?
-	_, err = blob.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	prop, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, d.config.cpk)
 	if err != nil {
 		if isError(err, azblob.ServiceCodeBlobNotFound) {
 			return false, nil
 		}
 		return false, err
 	}
-	return true, nil
+	return !d.expired(prop.NewMetadata()), nil
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	return d.GetSizeContext(context.Background(), key)
 }
-func (d *datastore) GetSize(key ds.Key) (size int, err error) {
+
+// GetSizeContext returns the size of the value for given key
+func (d *Datastore) GetSizeContext(ctx context.Context, key ds.Key) (size int, err error) {
+	if v, ok := d.queued(key); ok {
+		return len(v), nil
+	}
+	ctx, done, err := d.life.begin(ctx, key, false)
+	if err != nil {
+		return -1, err
+	}
+	defer func() { done(err) }()
+
 	blob := d.keyUrl(key)
-	ctx := context.TODO()
 	//block if exists?
-	prop, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	prop, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, d.config.cpk)
 	if err != nil {
 		if isError(err, azblob.ServiceCodeBlobNotFound) {
 			return -1, ds.ErrNotFound
 		}
 		return 0, err
 	}
-	fmt.Println(prop.Status())
-	return int(prop.ContentLength()), nil
+	if d.expired(prop.NewMetadata()) {
+		return -1, ds.ErrNotFound
+	}
+	return valueSize(prop.ContentLength(), prop.NewMetadata()), nil
 }
 
-// Delete removes the value for given key
-func (d *datastore) Delete(key ds.Key) (err error) {
-	blob := d.keyUrl(key)
-	ctx := context.TODO()
-	//block if exists?
-	_, err = blob.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
-	if !isError(err, azblob.ServiceCodeBlobNotFound) {
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	return d.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext removes the value for given key
+func (d *Datastore) DeleteContext(ctx context.Context, key ds.Key) (err error) {
+	ctx, span := d.trace(ctx, "azure.Delete", key.Parent().String())
+	defer func() { span.end(err) }()
+	// Deleting first would let a queued put bring the key back.
+	if err := d.waitQueued(ctx, key); err != nil {
 		return err
 	}
-	return nil
+	ctx, done, err := d.life.begin(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return d.deleteBlob(ctx, key)
+}
 
+func (d *Datastore) deleteBlob(ctx context.Context, key ds.Key) error {
+	blob := d.keyUrl(key)
+	for attempt := 0; attempt < counterRetries; attempt++ {
+		ac, own, err := d.fence(ctx, blob.BlobURL, azblob.BlobAccessConditions{})
+		if err != nil {
+			return err
+		}
+		if ac.IfNoneMatch == azblob.ETagAny {
+			return nil // nothing to delete
+		}
+		_, err = blob.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, ac)
+		if own && raced(err) {
+			continue
+		}
+		if !isError(err, azblob.ServiceCodeBlobNotFound) {
+			return err
+		}
+		return nil
+	}
+	return ErrContention
+}
+
+// Query implements Datastore.Query. See QueryContext.
+func (d *Datastore) Query(q query.Query) (query.Results, error) {
+	return d.QueryContext(context.Background(), q)
+}
+
+// QueryContext runs a query, listing and downloading under ctx until the
+// results are closed. When values are returned, the bytes being downloaded
+// or waiting to be consumed are bounded by the query memory budget.
+//
+// Unless the query has filters or orders other than by key, the listing
+// stops once the offset and limit are satisfied, and values are not
+// downloaded for the entries skipped by the offset.
+func (d *Datastore) QueryContext(ctx context.Context, q query.Query) (query.Results, error) {
+	return d.query(ctx, q, nil)
 }
 
-// Query implements Datastore.Query
-func (d *datastore) Query(q query.Query) (query.Results, error) {
+// query runs a query, recording the user metadata of the entries listed
+// in meta, if set.
+func (d *Datastore) query(ctx context.Context, q query.Query, meta *metaIndex) (query.Results, error) {
+	ctx, span := d.trace(ctx, "azure.Query", q.Prefix)
+	caller := ctx
+	opCtx, done, err := d.life.begin(ctx, ds.NewKey(q.Prefix), false)
+	if err != nil {
+		span.end(err)
+		return nil, err
+	}
+	// ctx is cancelled by the caller, by Close, when the results are
+	// closed, or to end the query after a panic.
+	ctx, stop := context.WithCancel(opCtx)
 	results := make(chan query.Result)
-	ctx := context.TODO()
+	// consumerGone is closed once the results are no longer read.
+	consumerGone := make(chan struct{})
+	container := d.containerFor(ds.NewKey(q.Prefix))
+	// send gives up once the query is cancelled.
+	send := func(r query.Result) {
+		select {
+		case results <- r:
+		case <-ctx.Done():
+		}
+	}
+
+	// Without filters or orders, the listing can apply the offset and
+	// limit itself.
+	pushdown := blobkey.PushDown(q) && d.config.shard == nil
+	// A minimal listing leaves out the metadata sizes and expiries are
+	// read from.
+	minimal := q.KeysOnly && !q.ReturnsSizes && d.config.minimalListings && meta == nil
+	within := blobkey.PrefixFilter(q.Prefix)
+	skip, remaining := q.Offset, q.Limit
 
 	go func() {
-		var marker azblob.Marker
 		var wg sync.WaitGroup
-		prefix := ""
-		//todo handle these better by remove /./ and going up a level for /../
-		if !(strings.Contains(q.Prefix, "/./") || strings.Contains(q.Prefix, "/../")) {
-			prefix = q.Prefix
-		}
+		defer func() {
+			wg.Wait()
+			// A query cut short by the caller or by Close ends with an
+			// error, so it cannot be mistaken for a complete one.
+			interrupted := opCtx.Err() != nil
+			stop()
+			done(nil)
+			span.end(nil)
+			if interrupted {
+				err := caller.Err()
+				if err == nil {
+					err = ErrClosed
+				}
+				select {
+				case results <- query.Result{Error: err}:
+				case <-consumerGone:
+				}
+			}
+			close(results)
+		}()
+		defer recoverResult(send, stop)
+
+		var marker azblob.Marker
+		budget := newByteBudget(d.config.queryMemoryBudget, queryParallelism)
+		pages := newPageSizer(q, d.config.listPageSize, d.config.queryMemoryBudget)
+		prefix := d.listPrefix(within)
+	list:
 		for marker.NotDone() {
-			list, err := d.containerUrl.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
-				Prefix: prefix,
+			start := time.Now()
+			segCtx, seg := d.trace(ctx, "azure.ListBlobs", q.Prefix)
+			list, err := container.ListBlobsFlatSegment(segCtx, marker, azblob.ListBlobsSegmentOptions{
+				Prefix:     prefix,
+				MaxResults: pages.next(),
+				Details:    azblob.BlobListingDetails{Metadata: !minimal},
 			})
+			if err == nil {
+				seg.set("az.blob.count", len(list.Segment.BlobItems))
+			}
+			seg.end(err)
 			if err != nil {
-				results <- query.Result{
-					Error: err,
+				if ctx.Err() == nil {
+					send(query.Result{Error: err})
+				}
+				break list
+			}
+			var listed int64
+			for _, blob := range list.Segment.BlobItems {
+				if blob.Properties.ContentLength != nil {
+					listed += *blob.Properties.ContentLength
 				}
-				close(results)
 			}
+			pages.observe(len(list.Segment.BlobItems), listed, time.Since(start))
+
 			for _, blob := range list.Segment.BlobItems {
+				if ctx.Err() != nil {
+					break list
+				}
+				if d.expired(blob.Metadata) {
+					continue
+				}
 				var result query.Result
-				key := ds.NewKey(blob.Name)
+				key, ok := d.keyFor(blob.Name)
+				if !ok {
+					continue
+				}
 				result.Key = key.String()
+				if within != "" && !strings.HasPrefix(result.Key, within) {
+					continue
+				}
+				// Hidden before the offset and limit count entries.
+				if internalKey(key) {
+					continue
+				}
+				if pushdown && skip > 0 {
+					skip--
+					continue
+				}
 				for _, f := range q.Filters {
 					if keyfilter, ok := f.(query.FilterKeyCompare); ok {
 						if !keyfilter.Filter(result.Entry) {
@@ -180,43 +489,97 @@ func (d *datastore) Query(q query.Query) (query.Results, error) {
 						}
 					}
 				}
-				result.Size = int(*blob.Properties.ContentLength)
+				result.Size = -1
+				if !minimal {
+					result.Size = valueSize(*blob.Properties.ContentLength, blob.Metadata)
+					if meta != nil {
+						meta.set(result.Key, userMetadata(blob.Metadata))
+					}
+				}
 
 				if !q.KeysOnly {
+					// Reserving the value's bytes before downloading holds
+					// back the listing once the budget is spent.
+					reserved := budget.acquire(int64(result.Size))
 					wg.Add(1)
 					go func() {
 						defer wg.Done()
-						result.Value, result.Error = d.Get(key)
+						defer budget.release(reserved)
+						defer recoverResult(send, stop)
+						result.Value, result.Error = d.GetContext(ctx, key)
 						//don't trust content length? could verify here
 						//result.Entry.Size = len(result.Entry.Value)
-						results <- result
+						send(result)
 					}()
 				} else {
-					results <- result
+					send(result)
+				}
+				if pushdown && remaining > 0 {
+					if remaining--; remaining == 0 {
+						break list
+					}
 				}
 			}
 			marker = list.NextMarker
 		}
-		wg.Wait()
-		close(results)
-
 	}()
-	r := query.ResultsWithChan(q, results)
-	r = query.NaiveQueryApply(q, r)
+	r := query.ResultsWithProcess(q, func(worker goprocess.Process, out chan<- query.Result) {
+		// Stop listing once the results are closed, rather than leaving
+		// the query blocked on a send nobody will receive.
+		defer close(consumerGone)
+		defer stop()
+		for {
+			select {
+			case <-worker.Closing():
+				return
+			case r, more := <-results:
+				if !more {
+					return
+				}
+				select {
+				case out <- r:
+				case <-worker.Closing():
+					return
+				}
+			}
+		}
+	})
+	naive := q
+	if pushdown {
+		naive.Offset, naive.Limit = 0, 0
+	}
+	r = query.NaiveQueryApply(naive, r)
 
 	return r, nil
 }
 
-func (d *datastore) Close() error {
-	return nil
-}
-
-func (d *datastore) Batch() (ds.Batch, error) {
-	return ds.NewBasicBatch(d), nil
+// recoverResult, deferred by a query goroutine, turns a panic into an
+// error result and ends the query, so one malformed listing entry or blob
+// fails the query instead of the process.
+func recoverResult(send func(query.Result), stop func()) {
+	if r := recover(); r != nil {
+		send(query.Result{Error: fmt.Errorf("azure: query failed: panic: %v", r)})
+		stop()
+	}
 }
 
-// DiskUsage returns the disk size used by the datastore in bytes.
-func (d *datastore) DiskUsage() (uint64, error) {
-	//should we just not implment this?
-	return 100, nil
+// Close stops the datastore. Queries and reads in flight are cancelled,
+// writes in flight are given until the close timeout to finish, and later
+// operations fail with ErrClosed. If writes had to be cancelled, Close
+// returns an *UnpersistedError naming their keys. Puts queued by
+// WithAsyncPuts count as writes in flight; if none had to be cancelled,
+// Close returns the failed puts Sync did not report. The container lock is
+// released if held. Close may be called more than once; later calls
+// return nil.
+func (d *Datastore) Close() error {
+	err := d.life.close(d.config.closeTimeout)
+	if d.async != nil {
+		if aerr := d.async.close(); err == nil {
+			err = aerr
+		}
+	}
+	if lerr := d.ReleaseLock(context.Background()); err == nil {
+		err = lerr
+	}
+	return err
 }
@@ -0,0 +1,1032 @@
+// Package azuretest provides an in-memory Azure Blob Storage emulator, so
+// the azure datastore, and code built on it, can be tested without an
+// account or Azurite.
+//
+// The emulator speaks enough of the Blob REST API for the datastore:
+// container creation, block blob upload, staged blocks and block lists,
+// download, properties, delete, flat listing with markers, ETag
+// conditions, metadata, blob leases, snapshots, server-side copies,
+// batched deletes, access tiers, blob index tags, content MD5s and customer-provided
+// encryption keys, checked by their hashes. Copies complete
+// immediately; rehydrations from the archive tier wait for Rehydrate.
+// Requests are not authenticated. Errors carry the service's error codes,
+// so callers see the same StorageErrors they would from Azure.
+package azuretest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-datastore/clock"
+)
+
+// Emulator is an in-memory Blob service. It implements http.Handler, with
+// containers at /<container> and blobs at /<container>/<blob name>.
+type Emulator struct {
+	// Clock stamps modification times and expires leases. Defaults to
+	// the wall clock.
+	Clock clock.Clock
+
+	mu         sync.Mutex
+	containers map[string]map[string]*blob
+	snapshots  map[snapshotID]*blob
+	etag       uint64
+}
+
+type snapshotID struct {
+	container, name, snapshot string
+}
+
+type blob struct {
+	data     []byte
+	etag     string
+	modified time.Time
+	metadata map[string]string
+	blocks   map[string][]byte // staged, uncommitted blocks
+
+	contentMD5      []byte // as given by the upload, if it gave one
+	contentEncoding string
+
+	keySHA256       string // of the customer-provided key, if encrypted with one
+	encryptionScope string
+
+	tier          azblob.AccessTierType // "" for the account default
+	archiveStatus azblob.ArchiveStatusType
+
+	tags map[string]string // blob index tags
+
+	leaseID      string
+	leaseFor     time.Duration // zero for an infinite lease
+	leaseExpires time.Time
+}
+
+// NewEmulator returns an emulator with no containers.
+func NewEmulator() *Emulator {
+	return &Emulator{
+		Clock:      clock.Real,
+		containers: make(map[string]map[string]*blob),
+		snapshots:  make(map[snapshotID]*blob),
+	}
+}
+
+// NewServer starts an emulator on a local HTTP server. Its URL is the
+// endpoint to give the datastore; Close the server when done.
+//
+// The URL names the host localhost rather than 127.0.0.1: azblob parses
+// URLs on IP hosts as Azurite's, with the account as the first path
+// segment, which would misread blob URLs such as snapshot copy sources.
+func NewServer() (*httptest.Server, *Emulator) {
+	e := NewEmulator()
+	srv := httptest.NewServer(e)
+	srv.URL = strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	return srv, e
+}
+
+// CreateContainer creates a container directly, for tests starting from
+// an existing one.
+func (e *Emulator) CreateContainer(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.containers[name] == nil {
+		e.containers[name] = make(map[string]*blob)
+	}
+}
+
+// Blob returns a copy of a committed blob's content.
+func (e *Emulator) Blob(container, name string) ([]byte, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b, ok := e.containers[container][name]
+	if !ok || b.data == nil {
+		return nil, false
+	}
+	return append([]byte(nil), b.data...), true
+}
+
+// Rehydrate completes the pending rehydration of an archived blob, which
+// the service takes hours to do, reporting whether there was one.
+func (e *Emulator) Rehydrate(container, name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b, ok := e.containers[container][name]
+	if !ok || b.archiveStatus == azblob.ArchiveStatusNone {
+		return false
+	}
+	b.tier = azblob.AccessTierHot
+	if b.archiveStatus == azblob.ArchiveStatusRehydratePendingToCool {
+		b.tier = azblob.AccessTierCool
+	}
+	b.archiveStatus = azblob.ArchiveStatusNone
+	return true
+}
+
+// Tags returns a copy of the index tags of a committed blob.
+func (e *Emulator) Tags(container, name string) (map[string]string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b, ok := e.containers[container][name]
+	if !ok || b.data == nil {
+		return nil, false
+	}
+	tags := make(map[string]string, len(b.tags))
+	for k, v := range b.tags {
+		tags[k] = v
+	}
+	return tags, true
+}
+
+// Corrupt flips a bit of a committed blob's content, leaving its ETag and
+// properties as they were, as bit rot would. It reports whether the blob
+// has content to corrupt.
+func (e *Emulator) Corrupt(container, name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b, ok := e.containers[container][name]
+	if !ok || len(b.data) == 0 {
+		return false
+	}
+	b.data[len(b.data)/2] ^= 1
+	return true
+}
+
+type serviceError struct {
+	status int
+	code   azblob.ServiceCodeType
+}
+
+func fail(status int, code azblob.ServiceCodeType) *serviceError {
+	return &serviceError{status: status, code: code}
+}
+
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.serve(w, r)
+}
+
+// serve handles a request with e.mu held.
+func (e *Emulator) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	container, name := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		container, name = path[:i], path[i+1:]
+	}
+	q := r.URL.Query()
+
+	var err *serviceError
+	switch {
+	case name == "" && q.Get("restype") == "container":
+		err = e.serveContainer(w, r, container)
+	case name == "":
+		err = fail(http.StatusBadRequest, azblob.ServiceCodeInvalidURI)
+	default:
+		err = e.serveBlob(w, r, container, name)
+	}
+	if err != nil {
+		w.Header().Set("x-ms-error-code", string(err.code))
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(err.status)
+		if r.Method != http.MethodHead {
+			fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>%s</Message></Error>", err.code, err.code)
+		}
+	}
+}
+
+func (e *Emulator) serveContainer(w http.ResponseWriter, r *http.Request, container string) *serviceError {
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPut:
+		if e.containers[container] != nil {
+			return fail(http.StatusConflict, azblob.ServiceCodeContainerAlreadyExists)
+		}
+		e.containers[container] = make(map[string]*blob)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete:
+		if e.containers[container] == nil {
+			return fail(http.StatusNotFound, azblob.ServiceCodeContainerNotFound)
+		}
+		delete(e.containers, container)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodGet && q.Get("comp") == "list":
+		return e.list(w, r, container)
+	case r.Method == http.MethodPost && q.Get("comp") == "batch":
+		return e.batch(w, r, container)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if e.containers[container] == nil {
+			return fail(http.StatusNotFound, azblob.ServiceCodeContainerNotFound)
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		return fail(http.StatusBadRequest, azblob.ServiceCodeUnsupportedHTTPVerb)
+	}
+	return nil
+}
+
+// maxBatch is the number of subrequests a batch may carry.
+const maxBatch = 256
+
+// batch serves a Blob Batch request, running each subrequest in turn.
+// Only deletes of blobs in the container are allowed.
+func (e *Emulator) batch(w http.ResponseWriter, r *http.Request, container string) *serviceError {
+	if e.containers[container] == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeContainerNotFound)
+	}
+	mt, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/mixed" {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidHeaderValue)
+	}
+	type subresponse struct {
+		id   string
+		resp *http.Response
+	}
+	var subs []subresponse
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidInput)
+		}
+		sub, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidInput)
+		}
+		if len(subs) == maxBatch {
+			return fail(http.StatusBadRequest, "ExceedsMaxBatchRequestCount")
+		}
+		rec := httptest.NewRecorder()
+		if sub.Method != http.MethodDelete || !strings.HasPrefix(sub.URL.Path, "/"+container+"/") {
+			rec.Header().Set("x-ms-error-code", string(azblob.ServiceCodeInvalidInput))
+			rec.WriteHeader(http.StatusBadRequest)
+		} else {
+			e.serve(rec, sub)
+		}
+		subs = append(subs, subresponse{part.Header.Get("Content-ID"), rec.Result()})
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, s := range subs {
+		part, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {s.id},
+		})
+		s.resp.Write(part)
+	}
+	mw.Close()
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body.Bytes())
+	return nil
+}
+
+type listResult struct {
+	XMLName       xml.Name   `xml:"EnumerationResults"`
+	ContainerName string     `xml:"ContainerName,attr"`
+	Prefix        string     `xml:"Prefix"`
+	Marker        string     `xml:"Marker"`
+	MaxResults    int        `xml:"MaxResults"`
+	Blobs         []listBlob `xml:"Blobs>Blob"`
+	NextMarker    string     `xml:"NextMarker"`
+}
+
+type listBlob struct {
+	Name       string                `xml:"Name"`
+	Snapshot   string                `xml:"Snapshot,omitempty"`
+	Properties azblob.BlobProperties `xml:"Properties"`
+	Metadata   listMetadata          `xml:"Metadata,omitempty"`
+}
+
+// listMetadata encodes metadata as a listing does, one element per name.
+type listMetadata map[string]string
+
+func (m listMetadata) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	if len(m) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, k := range names {
+		if err := enc.EncodeElement(m[k], xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// list serves a flat listing. The marker is the name of the first blob of
+// the next page.
+func (e *Emulator) list(w http.ResponseWriter, r *http.Request, container string) *serviceError {
+	blobs := e.containers[container]
+	if blobs == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeContainerNotFound)
+	}
+	q := r.URL.Query()
+	prefix, marker := q.Get("prefix"), q.Get("marker")
+	max := 5000
+	if s := q.Get("maxresults"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return fail(http.StatusBadRequest, azblob.ServiceCodeOutOfRangeQueryParameterValue)
+		}
+		if n < max {
+			max = n
+		}
+	}
+
+	withMetadata, withSnapshots := false, false
+	for _, include := range strings.Split(q.Get("include"), ",") {
+		withMetadata = withMetadata || include == "metadata"
+		withSnapshots = withSnapshots || include == "snapshots"
+	}
+
+	// A blob's snapshots are listed oldest first, before the blob. Entries
+	// are ordered, and markers given, by name, a tab, then the snapshot,
+	// or "~" for the blob, which sorts after snapshot timestamps.
+	type listed struct {
+		name, snapshot, order string
+		b                     *blob
+	}
+	var entries []listed
+	add := func(name, snapshot string, b *blob) {
+		order := name + "\t~"
+		if snapshot != "" {
+			order = name + "\t" + snapshot
+		}
+		if strings.HasPrefix(name, prefix) && order >= marker {
+			entries = append(entries, listed{name, snapshot, order, b})
+		}
+	}
+	for name, b := range blobs {
+		if b.data != nil {
+			add(name, "", b)
+		}
+	}
+	if withSnapshots {
+		for id, s := range e.snapshots {
+			if id.container == container {
+				add(id.name, id.snapshot, s)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].order < entries[j].order })
+
+	res := listResult{ContainerName: container, Prefix: prefix, Marker: marker, MaxResults: max}
+	if len(entries) > max {
+		res.NextMarker = entries[max].order
+		entries = entries[:max]
+	}
+	for _, entry := range entries {
+		b := entry.b
+		size := int64(len(b.data))
+		var metadata listMetadata
+		if withMetadata {
+			metadata = b.metadata
+		}
+		res.Blobs = append(res.Blobs, listBlob{
+			Name:     entry.name,
+			Snapshot: entry.snapshot,
+			Properties: azblob.BlobProperties{
+				LastModified:  b.modified,
+				Etag:          azblob.ETag(b.etag),
+				ContentLength: &size,
+				BlobType:      azblob.BlobBlockBlob,
+				AccessTier:    b.tier,
+				ArchiveStatus: b.archiveStatus,
+			},
+			Metadata: metadata,
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	return encodeXML(w, res)
+}
+
+func encodeXML(w http.ResponseWriter, v interface{}) *serviceError {
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		return fail(http.StatusInternalServerError, azblob.ServiceCodeInternalError)
+	}
+	return nil
+}
+
+func (e *Emulator) serveBlob(w http.ResponseWriter, r *http.Request, container, name string) *serviceError {
+	blobs := e.containers[container]
+	if blobs == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeContainerNotFound)
+	}
+	b := blobs[name]
+	if b != nil && b.data == nil && r.URL.Query().Get("comp") == "" && r.Method != http.MethodPut {
+		b = nil // only staged blocks so far
+	}
+	if snapshot := r.URL.Query().Get("snapshot"); snapshot != "" {
+		return e.serveSnapshot(w, r, snapshotID{container, name, snapshot})
+	}
+
+	switch comp := r.URL.Query().Get("comp"); {
+	case r.Method == http.MethodPut && comp == "" && r.Header.Get("x-ms-copy-source") != "":
+		return e.copyBlob(w, r, blobs, name, b)
+	case r.Method == http.MethodPut && comp == "snapshot":
+		return e.snapshot(w, r, container, name, b)
+	case r.Method == http.MethodPut && comp == "":
+		return e.putBlob(w, r, blobs, name, b)
+	case r.Method == http.MethodPut && comp == "block":
+		return e.putBlock(w, r, blobs, name, b)
+	case r.Method == http.MethodPut && comp == "blocklist":
+		return e.putBlockList(w, r, name, b)
+	case r.Method == http.MethodPut && comp == "metadata":
+		return e.setMetadata(w, r, b)
+	case r.Method == http.MethodPut && comp == "lease":
+		return e.lease(w, r, b)
+	case r.Method == http.MethodPut && comp == "tier":
+		return e.setTier(w, r, b)
+	case r.Method == http.MethodPut && comp == "tags":
+		return e.setTags(w, r, b)
+	case r.Method == http.MethodGet && comp == "tags":
+		return e.getTags(w, b)
+	case r.Method == http.MethodGet && comp == "":
+		return e.getBlob(w, r, b, true)
+	case r.Method == http.MethodHead:
+		return e.getBlob(w, r, b, false)
+	case r.Method == http.MethodDelete:
+		if b == nil {
+			return fail(http.StatusNotFound, azblob.ServiceCodeBlobNotFound)
+		}
+		if err := checkConditions(r, b); err != nil {
+			return err
+		}
+		if err := e.checkLease(r, b); err != nil {
+			return err
+		}
+		var snapshots []snapshotID
+		for id := range e.snapshots {
+			if id.container == container && id.name == name {
+				snapshots = append(snapshots, id)
+			}
+		}
+		switch r.Header.Get("x-ms-delete-snapshots") {
+		case "":
+			if len(snapshots) > 0 {
+				return fail(http.StatusConflict, azblob.ServiceCodeSnapshotsPresent)
+			}
+		case string(azblob.DeleteSnapshotsOptionInclude):
+		case string(azblob.DeleteSnapshotsOptionOnly):
+			for _, id := range snapshots {
+				delete(e.snapshots, id)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return nil
+		default:
+			return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidHeaderValue)
+		}
+		for _, id := range snapshots {
+			delete(e.snapshots, id)
+		}
+		delete(blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	return fail(http.StatusBadRequest, azblob.ServiceCodeUnsupportedHTTPVerb)
+}
+
+// checkConditions applies If-Match and If-None-Match to a write.
+func checkConditions(r *http.Request, b *blob) *serviceError {
+	exists := b != nil && b.data != nil
+	if m := r.Header.Get("If-Match"); m != "" {
+		if !exists || (m != "*" && m != b.etag) {
+			return fail(http.StatusPreconditionFailed, azblob.ServiceCodeConditionNotMet)
+		}
+	}
+	if m := r.Header.Get("If-None-Match"); m != "" {
+		if m == "*" && exists {
+			return fail(http.StatusConflict, azblob.ServiceCodeBlobAlreadyExists)
+		}
+		if exists && m == b.etag {
+			return fail(http.StatusPreconditionFailed, azblob.ServiceCodeConditionNotMet)
+		}
+	}
+	return nil
+}
+
+// checkLease rejects writes to a leased blob without its lease ID.
+func (e *Emulator) checkLease(r *http.Request, b *blob) *serviceError {
+	if b == nil || !e.leased(b) {
+		return nil
+	}
+	switch r.Header.Get("x-ms-lease-id") {
+	case "":
+		return fail(http.StatusPreconditionFailed, azblob.ServiceCodeLeaseIDMissing)
+	case b.leaseID:
+		return nil
+	}
+	return fail(http.StatusPreconditionFailed, azblob.ServiceCodeLeaseIDMismatchWithBlobOperation)
+}
+
+func (e *Emulator) leased(b *blob) bool {
+	return b.leaseID != "" && (b.leaseFor == 0 || e.Clock.Now().Before(b.leaseExpires))
+}
+
+func (e *Emulator) commit(w http.ResponseWriter, blobs map[string]*blob, name string, b *blob, data []byte, metadata map[string]string) {
+	e.store(w, blobs, name, b, data, metadata)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (e *Emulator) store(w http.ResponseWriter, blobs map[string]*blob, name string, b *blob, data []byte, metadata map[string]string) {
+	if b == nil {
+		b = &blob{}
+		blobs[name] = b
+	}
+	b.data = data
+	b.metadata = metadata
+	b.blocks = nil
+	b.contentMD5, b.contentEncoding = nil, ""
+	b.keySHA256, b.encryptionScope = "", ""
+	b.tags = nil
+	e.touch(w, b)
+}
+
+// touch gives b a new ETag and modification time.
+func (e *Emulator) touch(w http.ResponseWriter, b *blob) {
+	e.etag++
+	b.etag = fmt.Sprintf("\"0x%X\"", e.etag)
+	b.modified = e.Clock.Now()
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Last-Modified", b.modified.UTC().Format(http.TimeFormat))
+}
+
+// requestMetadata returns the x-ms-meta- headers of r, or nil if there
+// are none.
+func requestMetadata(r *http.Request) map[string]string {
+	var metadata map[string]string
+	for k, v := range r.Header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-ms-meta-") && len(v) > 0 {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[strings.TrimPrefix(name, "x-ms-meta-")] = v[0]
+		}
+	}
+	return metadata
+}
+
+func (e *Emulator) setMetadata(w http.ResponseWriter, r *http.Request, b *blob) *serviceError {
+	if b == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeBlobNotFound)
+	}
+	if err := checkConditions(r, b); err != nil {
+		return err
+	}
+	if err := e.checkLease(r, b); err != nil {
+		return err
+	}
+	if err := checkKey(r, b); err != nil {
+		return err
+	}
+	b.metadata = requestMetadata(r)
+	e.touch(w, b)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (e *Emulator) putBlob(w http.ResponseWriter, r *http.Request, blobs map[string]*blob, name string, b *blob) *serviceError {
+	if err := checkConditions(r, b); err != nil {
+		return err
+	}
+	if err := e.checkLease(r, b); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidInput)
+	}
+	if err := checkMD5(r, data); err != nil {
+		return err
+	}
+	e.commit(w, blobs, name, b, data, requestMetadata(r))
+	blobs[name].setUploadProperties(r)
+	return nil
+}
+
+func (e *Emulator) putBlock(w http.ResponseWriter, r *http.Request, blobs map[string]*blob, name string, b *blob) *serviceError {
+	id := r.URL.Query().Get("blockid")
+	if id == "" {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidQueryParameterValue)
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidInput)
+	}
+	if err := checkMD5(r, data); err != nil {
+		return err
+	}
+	if b == nil {
+		b = &blob{}
+		blobs[name] = b
+	}
+	if b.blocks == nil {
+		b.blocks = make(map[string][]byte)
+	}
+	b.blocks[id] = data
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (e *Emulator) putBlockList(w http.ResponseWriter, r *http.Request, name string, b *blob) *serviceError {
+	if err := checkConditions(r, b); err != nil {
+		return err
+	}
+	if err := e.checkLease(r, b); err != nil {
+		return err
+	}
+	var list azblob.BlockLookupList
+	if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidXMLDocument)
+	}
+	if b == nil {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidBlockList)
+	}
+	var data []byte
+	for _, ids := range [][]string{list.Committed, list.Uncommitted, list.Latest} {
+		for _, id := range ids {
+			block, ok := b.blocks[id]
+			if !ok {
+				return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidBlockList)
+			}
+			data = append(data, block...)
+		}
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	// The blob is in the container map already, from its staged blocks.
+	e.commit(w, map[string]*blob{name: b}, name, b, data, requestMetadata(r))
+	b.setUploadProperties(r)
+	return nil
+}
+
+// setUploadProperties gives a newly uploaded blob the tier, content MD5,
+// content encoding and encryption the upload asks for. The service stores the MD5 of a
+// blob without checking it.
+func (b *blob) setUploadProperties(r *http.Request) {
+	b.tier = azblob.AccessTierType(r.Header.Get("x-ms-access-tier"))
+	b.archiveStatus = azblob.ArchiveStatusNone
+	b.contentMD5, _ = base64.StdEncoding.DecodeString(r.Header.Get("x-ms-blob-content-md5"))
+	b.contentEncoding = r.Header.Get("x-ms-blob-content-encoding")
+	b.keySHA256 = r.Header.Get("x-ms-encryption-key-sha256")
+	b.encryptionScope = r.Header.Get("x-ms-encryption-scope")
+	b.tags = nil
+	if q, err := url.ParseQuery(r.Header.Get("x-ms-tags")); err == nil && len(q) > 0 {
+		b.tags = make(map[string]string, len(q))
+		for k, v := range q {
+			b.tags[k] = v[0]
+		}
+	}
+}
+
+// setTags replaces the index tags of a blob. Unlike metadata, tags are
+// not part of the blob's content, so its ETag is kept.
+func (e *Emulator) setTags(w http.ResponseWriter, r *http.Request, b *blob) *serviceError {
+	if b == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeBlobNotFound)
+	}
+	if err := e.checkLease(r, b); err != nil {
+		return err
+	}
+	var tags azblob.BlobTags
+	if err := xml.NewDecoder(r.Body).Decode(&tags); err != nil && err != io.EOF {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidXMLDocument)
+	}
+	b.tags = nil
+	for _, tag := range tags.BlobTagSet {
+		if b.tags == nil {
+			b.tags = make(map[string]string)
+		}
+		b.tags[tag.Key] = tag.Value
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (e *Emulator) getTags(w http.ResponseWriter, b *blob) *serviceError {
+	if b == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeBlobNotFound)
+	}
+	var tags azblob.BlobTags
+	for k, v := range b.tags {
+		tags.BlobTagSet = append(tags.BlobTagSet, azblob.BlobTag{Key: k, Value: v})
+	}
+	sort.Slice(tags.BlobTagSet, func(i, j int) bool { return tags.BlobTagSet[i].Key < tags.BlobTagSet[j].Key })
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	return encodeXML(w, tags)
+}
+
+// codeCustomerKey is the error code of requests for a blob encrypted with
+// a customer-provided key that do not give the key.
+const codeCustomerKey azblob.ServiceCodeType = "BlobUsesCustomerSpecifiedEncryption"
+
+// checkKey rejects requests reading or changing a blob encrypted with a
+// customer-provided key without that key. The key itself is not
+// checked, only its hash.
+func checkKey(r *http.Request, b *blob) *serviceError {
+	if b.keySHA256 != "" && r.Header.Get("x-ms-encryption-key-sha256") != b.keySHA256 {
+		return fail(http.StatusConflict, codeCustomerKey)
+	}
+	return nil
+}
+
+// checkMD5 checks the content of an upload against the transactional
+// Content-MD5 of the request, if it has one.
+func checkMD5(r *http.Request, data []byte) *serviceError {
+	want := r.Header.Get("Content-MD5")
+	if want == "" {
+		return nil
+	}
+	sum := md5.Sum(data)
+	if want != base64.StdEncoding.EncodeToString(sum[:]) {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeMd5Mismatch)
+	}
+	return nil
+}
+
+// setTier moves a blob to another tier. Moving it out of the archive tier
+// starts a rehydration, completed by Rehydrate.
+func (e *Emulator) setTier(w http.ResponseWriter, r *http.Request, b *blob) *serviceError {
+	if b == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeBlobNotFound)
+	}
+	tier := azblob.AccessTierType(r.Header.Get("x-ms-access-tier"))
+	switch tier {
+	case azblob.AccessTierHot, azblob.AccessTierCool, azblob.AccessTierArchive:
+	default:
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidHeaderValue)
+	}
+	if b.tier != azblob.AccessTierArchive || tier == azblob.AccessTierArchive {
+		b.tier = tier
+		b.archiveStatus = azblob.ArchiveStatusNone
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	status := azblob.ArchiveStatusRehydratePendingToHot
+	if tier == azblob.AccessTierCool {
+		status = azblob.ArchiveStatusRehydratePendingToCool
+	}
+	if b.archiveStatus != azblob.ArchiveStatusNone && b.archiveStatus != status {
+		return fail(http.StatusConflict, azblob.ServiceCodeBlobBeingRehydrated)
+	}
+	b.archiveStatus = status
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func (e *Emulator) getBlob(w http.ResponseWriter, r *http.Request, b *blob, body bool) *serviceError {
+	if b == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeBlobNotFound)
+	}
+	if m := r.Header.Get("If-Match"); m != "" && m != "*" && m != b.etag {
+		return fail(http.StatusPreconditionFailed, azblob.ServiceCodeConditionNotMet)
+	}
+	if err := checkKey(r, b); err != nil {
+		return err
+	}
+	if body && b.tier == azblob.AccessTierArchive {
+		return fail(http.StatusConflict, azblob.ServiceCodeBlobArchived)
+	}
+	h := w.Header()
+	if b.keySHA256 != "" {
+		h.Set("x-ms-encryption-key-sha256", b.keySHA256)
+	}
+	if b.encryptionScope != "" {
+		h.Set("x-ms-encryption-scope", b.encryptionScope)
+	}
+	if b.tier != "" {
+		h.Set("x-ms-access-tier", string(b.tier))
+	}
+	if b.archiveStatus != azblob.ArchiveStatusNone {
+		h.Set("x-ms-archive-status", string(b.archiveStatus))
+	}
+	h.Set("ETag", b.etag)
+	h.Set("Last-Modified", b.modified.UTC().Format(http.TimeFormat))
+	h.Set("x-ms-blob-type", string(azblob.BlobBlockBlob))
+	h.Set("Content-Type", "application/octet-stream")
+	if b.contentEncoding != "" {
+		h.Set("Content-Encoding", b.contentEncoding)
+	}
+	for k, v := range b.metadata {
+		h.Set("x-ms-meta-"+k, v)
+	}
+	if e.leased(b) {
+		h.Set("x-ms-lease-state", string(azblob.LeaseStateLeased))
+		h.Set("x-ms-lease-status", string(azblob.LeaseStatusLocked))
+	} else {
+		h.Set("x-ms-lease-state", string(azblob.LeaseStateAvailable))
+		h.Set("x-ms-lease-status", string(azblob.LeaseStatusUnlocked))
+	}
+
+	data := b.data
+	status := http.StatusOK
+	if rng := r.Header.Get("x-ms-range"); rng != "" {
+		var start, end int64
+		n, _ := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+		if n == 0 || start >= int64(len(data)) {
+			return fail(http.StatusRequestedRangeNotSatisfiable, azblob.ServiceCodeInvalidRange)
+		}
+		if n == 1 || end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+		if b.contentMD5 != nil {
+			h.Set("x-ms-blob-content-md5", base64.StdEncoding.EncodeToString(b.contentMD5))
+		}
+	} else if b.contentMD5 != nil {
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(b.contentMD5))
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if body {
+		w.Write(data)
+	}
+	return nil
+}
+
+func (e *Emulator) lease(w http.ResponseWriter, r *http.Request, b *blob) *serviceError {
+	if b == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeBlobNotFound)
+	}
+	id := r.Header.Get("x-ms-lease-id")
+	switch r.Header.Get("x-ms-lease-action") {
+	case "acquire":
+		if e.leased(b) {
+			return fail(http.StatusConflict, azblob.ServiceCodeLeaseAlreadyPresent)
+		}
+		secs, err := strconv.Atoi(r.Header.Get("x-ms-lease-duration"))
+		if err != nil || (secs != -1 && (secs < 15 || secs > 60)) {
+			return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidHeaderValue)
+		}
+		b.leaseID = r.Header.Get("x-ms-proposed-lease-id")
+		if b.leaseID == "" {
+			b.leaseID = uuid.New().String()
+		}
+		b.leaseFor = 0
+		if secs > 0 {
+			b.leaseFor = time.Duration(secs) * time.Second
+			b.leaseExpires = e.Clock.Now().Add(b.leaseFor)
+		}
+		w.Header().Set("x-ms-lease-id", b.leaseID)
+		w.WriteHeader(http.StatusCreated)
+	case "renew":
+		if id != b.leaseID {
+			return fail(http.StatusConflict, azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation)
+		}
+		if b.leaseFor > 0 {
+			b.leaseExpires = e.Clock.Now().Add(b.leaseFor)
+		}
+		w.Header().Set("x-ms-lease-id", b.leaseID)
+		w.WriteHeader(http.StatusOK)
+	case "release":
+		if id != b.leaseID {
+			return fail(http.StatusConflict, azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation)
+		}
+		b.leaseID = ""
+		w.WriteHeader(http.StatusOK)
+	case "break":
+		b.leaseID = ""
+		w.Header().Set("x-ms-lease-time", "0")
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidHeaderValue)
+	}
+	return nil
+}
+
+// snapshot keeps a read-only copy of b, with its properties, and its
+// metadata unless the request gives other metadata.
+func (e *Emulator) snapshot(w http.ResponseWriter, r *http.Request, container, name string, b *blob) *serviceError {
+	if b == nil {
+		return fail(http.StatusNotFound, azblob.ServiceCodeBlobNotFound)
+	}
+	if err := checkConditions(r, b); err != nil {
+		return err
+	}
+	s := &blob{
+		data:            append([]byte(nil), b.data...),
+		etag:            b.etag,
+		modified:        b.modified,
+		metadata:        b.metadata,
+		contentMD5:      b.contentMD5,
+		contentEncoding: b.contentEncoding,
+		keySHA256:       b.keySHA256,
+		encryptionScope: b.encryptionScope,
+		tier:            b.tier,
+	}
+	if m := requestMetadata(r); m != nil {
+		s.metadata = m
+	}
+	// Snapshot IDs are timestamps; the ETag counter keeps them unique.
+	e.etag++
+	id := fmt.Sprintf("%s%07d", e.Clock.Now().UTC().Format("2006-01-02T15:04:05."), e.etag%10000000) + "Z"
+	e.snapshots[snapshotID{container, name, id}] = s
+	w.Header().Set("x-ms-snapshot", id)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (e *Emulator) serveSnapshot(w http.ResponseWriter, r *http.Request, id snapshotID) *serviceError {
+	s, ok := e.snapshots[id]
+	if !ok {
+		return fail(http.StatusNotFound, azblob.ServiceCodeBlobNotFound)
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return e.getBlob(w, r, s, r.Method == http.MethodGet)
+	case http.MethodDelete:
+		delete(e.snapshots, id)
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	return fail(http.StatusBadRequest, azblob.ServiceCodeUnsupportedHTTPVerb)
+}
+
+// copyBlob serves a server-side copy from a blob or snapshot served by
+// this emulator.
+func (e *Emulator) copyBlob(w http.ResponseWriter, r *http.Request, blobs map[string]*blob, name string, b *blob) *serviceError {
+	src, err := url.Parse(r.Header.Get("x-ms-copy-source"))
+	if err != nil {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidHeaderValue)
+	}
+	path := strings.TrimPrefix(src.Path, "/")
+	i := strings.Index(path, "/")
+	if i < 0 {
+		return fail(http.StatusBadRequest, azblob.ServiceCodeInvalidHeaderValue)
+	}
+	srcContainer, srcName := path[:i], path[i+1:]
+
+	var data, contentMD5 []byte
+	var contentEncoding string
+	metadata := requestMetadata(r)
+	if snapshot := src.Query().Get("snapshot"); snapshot != "" {
+		s, ok := e.snapshots[snapshotID{srcContainer, srcName, snapshot}]
+		if !ok {
+			return fail(http.StatusNotFound, azblob.ServiceCodeCannotVerifyCopySource)
+		}
+		data, contentMD5, contentEncoding = s.data, s.contentMD5, s.contentEncoding
+		if metadata == nil {
+			metadata = s.metadata
+		}
+	} else {
+		sb, ok := e.containers[srcContainer][srcName]
+		if !ok || sb.data == nil {
+			return fail(http.StatusNotFound, azblob.ServiceCodeCannotVerifyCopySource)
+		}
+		if m := r.Header.Get("x-ms-source-if-match"); m != "" && m != sb.etag {
+			return fail(http.StatusPreconditionFailed, azblob.ServiceCodeSourceConditionNotMet)
+		}
+		data, contentMD5, contentEncoding = sb.data, sb.contentMD5, sb.contentEncoding
+		if metadata == nil {
+			metadata = sb.metadata
+		}
+	}
+	if err := checkConditions(r, b); err != nil {
+		return err
+	}
+	if err := e.checkLease(r, b); err != nil {
+		return err
+	}
+
+	e.store(w, blobs, name, b, append([]byte(nil), data...), metadata)
+	blobs[name].contentMD5, blobs[name].contentEncoding = contentMD5, contentEncoding
+	w.Header().Set("x-ms-copy-id", uuid.New().String())
+	w.Header().Set("x-ms-copy-status", string(azblob.CopyStatusSuccess))
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
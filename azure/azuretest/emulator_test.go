@@ -0,0 +1,82 @@
+package azuretest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/ipfs/go-datastore/clock"
+)
+
+func newContainer(t *testing.T) (azblob.ContainerURL, *Emulator) {
+	srv, e := NewServer()
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL + "/c")
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{Retry: azblob.RetryOptions{MaxTries: 1}})
+	return azblob.NewContainerURL(*u, p), e
+}
+
+func TestListMarkers(t *testing.T) {
+	ctx := context.Background()
+	c, e := newContainer(t)
+	if _, err := c.NewBlockBlobURL("x").Upload(ctx, bytes.NewReader(nil), azblob.BlobHTTPHeaders{}, nil,
+		azblob.BlobAccessConditions{}, azblob.AccessTierNone, nil, azblob.ClientProvidedKeyOptions{}); err == nil {
+		t.Fatal("upload to a missing container succeeded")
+	}
+	e.CreateContainer("c")
+
+	for i := 0; i < 5; i++ {
+		_, err := c.NewBlockBlobURL(fmt.Sprintf("/p/%d", i)).Upload(ctx, bytes.NewReader([]byte("v")), azblob.BlobHTTPHeaders{}, nil,
+			azblob.BlobAccessConditions{}, azblob.AccessTierNone, nil, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	pages := 0
+	for marker := (azblob.Marker{}); marker.NotDone(); pages++ {
+		list, err := c.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: "/p/", MaxResults: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range list.Segment.BlobItems {
+			names = append(names, b.Name)
+			if *b.Properties.ContentLength != 1 {
+				t.Fatalf("%s listed with size %d", b.Name, *b.Properties.ContentLength)
+			}
+		}
+		marker = list.NextMarker
+	}
+	if len(names) != 5 || pages != 3 {
+		t.Fatalf("listed %v in %d pages", names, pages)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	c, e := newContainer(t)
+	e.CreateContainer("c")
+	m := clock.NewMock(time.Unix(1000, 0))
+	e.Clock = m
+
+	b := c.NewBlockBlobURL("/lock")
+	b.Upload(ctx, bytes.NewReader(nil), azblob.BlobHTTPHeaders{}, nil,
+		azblob.BlobAccessConditions{}, azblob.AccessTierNone, nil, azblob.ClientProvidedKeyOptions{})
+	if _, err := b.AcquireLease(ctx, "", 15, azblob.ModifiedAccessConditions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := b.AcquireLease(ctx, "", 15, azblob.ModifiedAccessConditions{})
+	if serr, ok := err.(azblob.StorageError); !ok || serr.ServiceCode() != azblob.ServiceCodeLeaseAlreadyPresent {
+		t.Fatalf("second acquire: %v", err)
+	}
+
+	m.Advance(15 * time.Second)
+	if _, err := b.AcquireLease(ctx, "", 15, azblob.ModifiedAccessConditions{}); err != nil {
+		t.Fatalf("acquire after expiry: %v", err)
+	}
+}
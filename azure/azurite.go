@@ -0,0 +1,17 @@
+package azure
+
+// The well-known account of Azurite, the Azure Storage emulator, and the
+// endpoint it serves blobs from by default.
+const (
+	AzuriteAccount  = "devstoreaccount1"
+	AzuriteKey      = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	AzuriteEndpoint = "http://127.0.0.1:10000/" + AzuriteAccount
+)
+
+// NewAzuriteDatastore returns a Datastore over the given container of a
+// local Azurite emulator's well-known account, for development and tests.
+// Pass WithEndpoint to reach an emulator elsewhere than AzuriteEndpoint.
+func NewAzuriteDatastore(container string, opts ...Option) (*Datastore, error) {
+	opts = append([]Option{WithEndpoint(AzuriteEndpoint), WithSharedKey(AzuriteKey)}, opts...)
+	return NewDatastore(AzuriteAccount, container, opts...)
+}
@@ -0,0 +1,35 @@
+package azure
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/azure/azuretest"
+)
+
+func TestAzuriteDatastore(t *testing.T) {
+	e := azuretest.NewEmulator()
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	d, err := NewAzuriteDatastore("data", WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Put(ds.NewKey("/a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Has(ds.NewKey("/a")); err != nil || !ok {
+		t.Fatalf("has: %v, %v", ok, err)
+	}
+}
+
+func TestEndpointValidation(t *testing.T) {
+	for _, endpoint := range []string{"127.0.0.1:10000", "ftp://host/account", "http:///account"} {
+		if _, err := NewDatastore(AzuriteAccount, "data", WithSharedKey(AzuriteKey), WithEndpoint(endpoint)); err == nil {
+			t.Errorf("endpoint %q accepted", endpoint)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package azure
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// The PAX records of a backup's entries holding their values' expiry, in
+// Unix nanoseconds, and metadata, one record per entry.
+const (
+	paxExpires = "DSAZURE.expires"
+	paxMeta    = "DSAZURE.meta."
+)
+
+// Backup writes every key and value to w. See BackupContext.
+func (d *Datastore) Backup(w io.Writer) (int, error) {
+	return d.BackupContext(context.Background(), w)
+}
+
+// BackupContext writes every key and value to w as a tar archive and
+// returns the number written. Each value is a file named by its key
+// without the leading slash, with its TTL and metadata as PAX records, so
+// Restore brings them back; the archive can also be read by any tar
+// tool. Keys of containers routed to are included, the blobs of the
+// container lock and fencing epoch counter are not, and values in the
+// archive tier fail the backup.
+//
+// Values are downloaded one at a time, in key order, after the listing of
+// their page. A backup is consistent if the datastore is not written
+// meanwhile, for example by taking it under AcquireLock. With
+// WithAsyncPuts, the queued puts are waited for first.
+func (d *Datastore) BackupContext(ctx context.Context, w io.Writer) (n int, err error) {
+	if d.async != nil {
+		if err := d.async.sync(ctx, ds.NewKey("/")); err != nil && ctx.Err() != nil {
+			return 0, err
+		}
+	}
+	ctx, done, err := d.life.begin(ctx, ds.NewKey("/"), false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { done(err) }()
+
+	tw := tar.NewWriter(w)
+	main := d.routeFor(ds.NewKey("/"))
+	n, err = d.backupRoute(ctx, tw, main, "/")
+	if err != nil {
+		return n, err
+	}
+	for _, r := range d.routes {
+		m, err := d.backupRoute(ctx, tw, r, r.prefix.String()+"/")
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, tw.Close()
+}
+
+// backupRoute writes the keys starting with under that r serves to tw.
+func (d *Datastore) backupRoute(ctx context.Context, tw *tar.Writer, r route, under string) (n int, err error) {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := r.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix:     d.listPrefix(under),
+			MaxResults: d.config.bulkPageSize(),
+		})
+		if err != nil {
+			if isError(err, azblob.ServiceCodeContainerNotFound) {
+				return n, nil
+			}
+			return n, err
+		}
+		for _, blob := range list.Segment.BlobItems {
+			k, ok := d.keyFor(blob.Name)
+			if !ok || !strings.HasPrefix(k.String(), under) || internalKey(k) {
+				continue
+			}
+			// Keys routed elsewhere are backed up from their own route,
+			// even if it shares this container.
+			if !d.routeFor(k).prefix.Equal(r.prefix) {
+				continue
+			}
+			ok, err := d.backupKey(ctx, tw, k, blob.Properties.LastModified)
+			if err != nil {
+				return n, err
+			}
+			if ok {
+				n++
+			}
+		}
+		marker = list.NextMarker
+	}
+	return n, nil
+}
+
+// backupKey writes the value of key to tw, unless it was deleted since
+// listed or has expired.
+func (d *Datastore) backupKey(ctx context.Context, tw *tar.Writer, key ds.Key, modified time.Time) (bool, error) {
+	value, meta, err := d.download(ctx, key, d.keyUrl(key).BlobURL)
+	if isError(err, azblob.ServiceCodeBlobNotFound) || err == nil && d.expired(meta) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("azure: backing up %s: %w", key, err)
+	}
+	records := make(map[string]string)
+	if exp := expiration(meta); !exp.IsZero() {
+		records[paxExpires] = strconv.FormatInt(exp.UnixNano(), 10)
+	}
+	for name, value := range userMetadata(meta) {
+		records[paxMeta+name] = value
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       strings.TrimPrefix(key.String(), "/"),
+		Size:       int64(len(value)),
+		Mode:       0644,
+		ModTime:    modified,
+		PAXRecords: records,
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = tw.Write(value)
+	return err == nil, err
+}
+
+// Restore puts the keys and values of a backup. See RestoreContext.
+func (d *Datastore) Restore(r io.Reader) (int, error) {
+	return d.RestoreContext(context.Background(), r)
+}
+
+// RestoreContext puts the keys and values of a tar archive written by
+// Backup, with their TTLs and metadata, and returns the number put.
+// Existing keys are overwritten; keys missing from the archive are left
+// alone, so restore into an empty container to get the backup back as it
+// was. Values whose TTL ran out since the backup are skipped. Regular
+// files of other archives are restored too, named by their paths.
+//
+// The archive is read in order while up to 16 values are uploaded in
+// parallel. The first failure stops the restore and is returned.
+func (d *Datastore) RestoreContext(ctx context.Context, r io.Reader) (n int, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type restore struct {
+		key   ds.Key
+		value []byte
+		meta  azblob.Metadata
+	}
+	var (
+		mu    sync.Mutex
+		first error
+		wg    sync.WaitGroup
+		work  = make(chan restore)
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if first == nil {
+			first = err
+			cancel()
+		}
+	}
+	for i := 0; i < batchParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range work {
+				if err := d.restoreKey(ctx, w.key, w.value, w.meta); err != nil {
+					fail(err)
+					continue
+				}
+				mu.Lock()
+				n++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	tr := tar.NewReader(r)
+read:
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(err)
+			break
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		meta, err := d.restoredMetadata(h.PAXRecords)
+		if err != nil {
+			fail(fmt.Errorf("azure: restoring %s: %w", h.Name, err))
+			break
+		}
+		if meta == nil {
+			continue
+		}
+		value, err := ioutil.ReadAll(tr)
+		if err != nil {
+			fail(err)
+			break
+		}
+		select {
+		case work <- restore{ds.NewKey("/" + h.Name), value, meta}:
+		case <-ctx.Done():
+			break read
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if first != nil {
+		return n, first
+	}
+	return n, ctx.Err()
+}
+
+// restoredMetadata returns the metadata recorded in the PAX records of a
+// backup entry, or nil if its value has expired.
+func (d *Datastore) restoredMetadata(records map[string]string) (azblob.Metadata, error) {
+	user := make(map[string]string)
+	for name, value := range records {
+		if strings.HasPrefix(name, paxMeta) {
+			user[strings.TrimPrefix(name, paxMeta)] = value
+		}
+	}
+	meta, err := blobMetadata(user)
+	if err != nil {
+		return nil, err
+	}
+	if exp, ok := records[paxExpires]; ok {
+		meta[metaExpires] = exp
+		if d.expired(meta) {
+			return nil, nil
+		}
+	}
+	return meta, nil
+}
+
+func (d *Datastore) restoreKey(ctx context.Context, key ds.Key, value []byte, meta azblob.Metadata) (err error) {
+	ctx, done, err := d.life.begin(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	if err := d.put(ctx, key, value, meta); err != nil {
+		return fmt.Errorf("azure: restoring %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package azure
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/google/uuid"
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// maxBatchDeletes is the Blob Batch request limit.
+	maxBatchDeletes = 256
+	// batchParallelism is the number of uploads and batch requests a
+	// commit has in flight.
+	batchParallelism = 16
+	// batchVersion is the service version batch requests are made with.
+	batchVersion = "2019-12-12"
+)
+
+// Batch implements Batching.Batch. Deletes are committed with the Blob
+// Batch API, 256 per request; the API cannot carry uploads, so puts are
+// uploaded individually. Requests run in parallel.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return &batch{d: d, puts: make(map[ds.Key][]byte), deletes: make(map[ds.Key]struct{})}, nil
+}
+
+type batch struct {
+	d       *Datastore
+	puts    map[ds.Key][]byte
+	deletes map[ds.Key]struct{}
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	delete(b.deletes, key)
+	b.puts[key] = value
+	return nil
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	delete(b.puts, key)
+	b.deletes[key] = struct{}{}
+	return nil
+}
+
+// deleteChunk is one Blob Batch request's worth of deletes, all in the
+// same container.
+type deleteChunk struct {
+	route route
+	keys  []ds.Key
+}
+
+func (b *batch) Commit() error {
+	puts := make([]ds.Key, 0, len(b.puts))
+	for k := range b.puts {
+		puts = append(puts, k)
+	}
+	deletes := make([]ds.Key, 0, len(b.deletes))
+	for k := range b.deletes {
+		// Deleting first would let a queued put bring the key back.
+		if err := b.d.waitQueued(context.Background(), k); err != nil {
+			return err
+		}
+		deletes = append(deletes, k)
+	}
+	chunks := b.d.chunkDeletes(deletes)
+
+	err := forEach(context.Background(), len(puts)+len(chunks), batchParallelism, func(ctx context.Context, i int) error {
+		if i < len(puts) {
+			return b.d.PutContext(ctx, puts[i], b.puts[puts[i]])
+		}
+		c := chunks[i-len(puts)]
+		return b.d.deleteBatch(ctx, c.route, c.keys)
+	})
+	if err != nil {
+		return err
+	}
+	b.puts = make(map[ds.Key][]byte)
+	b.deletes = make(map[ds.Key]struct{})
+	return nil
+}
+
+// chunkDeletes splits keys into Blob Batch requests. Batch requests are
+// made to one container, so the keys are grouped by the container routed
+// to first.
+func (d *Datastore) chunkDeletes(keys []ds.Key) []deleteChunk {
+	byContainer := make(map[string]*deleteChunk)
+	var containers []string
+	for _, k := range keys {
+		r := d.routeFor(k)
+		u := r.container.URL()
+		c, ok := byContainer[u.String()]
+		if !ok {
+			c = &deleteChunk{route: r}
+			byContainer[u.String()] = c
+			containers = append(containers, u.String())
+		}
+		c.keys = append(c.keys, k)
+	}
+	sort.Strings(containers)
+	var chunks []deleteChunk
+	for _, u := range containers {
+		c := byContainer[u]
+		sort.Slice(c.keys, func(i, j int) bool { return c.keys[i].Less(c.keys[j]) })
+		for len(c.keys) > 0 {
+			n := len(c.keys)
+			if n > maxBatchDeletes {
+				n = maxBatchDeletes
+			}
+			chunks = append(chunks, deleteChunk{route: c.route, keys: c.keys[:n]})
+			c.keys = c.keys[n:]
+		}
+	}
+	return chunks
+}
+
+// deleteBatch deletes keys, all in r's container, with one Blob Batch
+// request. Keys already missing are not an error. If only some of the
+// keys failed, it returns KeyErrors naming them.
+func (d *Datastore) deleteBatch(ctx context.Context, r route, keys []ds.Key) (err error) {
+	ctx, done, err := d.life.beginKeys(ctx, true, keys...)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	if d.Epoch() != 0 {
+		// Subrequests cannot be conditioned on what fencing checked.
+		errs := make(KeyErrors)
+		for _, k := range keys {
+			err := d.deleteBlob(ctx, k)
+			if err == ErrStaleEpoch {
+				// It fences off every key alike.
+				return err
+			}
+			if err != nil {
+				errs[k] = err
+			}
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	}
+
+	var cred pipeline.Factory = azblob.NewAnonymousCredential()
+	if r.credential != nil {
+		cred = r.credential
+	}
+	boundary := "batch_" + uuid.New().String()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	for i, k := range keys {
+		sub, err := signedDelete(ctx, cred, r.container.NewBlobURL(d.nameFor(k)))
+		if err != nil {
+			return err
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/http"},
+			"Content-Transfer-Encoding": {"binary"},
+			"Content-ID":                {strconv.Itoa(i)},
+		})
+		if err != nil {
+			return err
+		}
+		part.Write(sub)
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	u := r.container.URL()
+	q := u.Query()
+	q.Set("restype", "container")
+	q.Set("comp", "batch")
+	u.RawQuery = q.Encode()
+	req, err := pipeline.NewRequest(http.MethodPost, u, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+boundary)
+	req.Header.Set("x-ms-version", batchVersion)
+	resp, err := d.config.newPipeline(cred).Do(ctx, nil, req)
+	if err != nil {
+		return err
+	}
+	hresp := resp.Response()
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("azure: batch delete: %s %s", hresp.Status, hresp.Header.Get("x-ms-error-code"))
+	}
+	return parseBatchResponse(hresp, keys)
+}
+
+// signedDelete returns the HTTP/1.1 text of a delete subrequest for blob,
+// authorized by cred as the request itself would be.
+func signedDelete(ctx context.Context, cred pipeline.Factory, blob azblob.BlobURL) ([]byte, error) {
+	u := blob.URL()
+	req, err := pipeline.NewRequest(http.MethodDelete, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Deleting a key deletes its versions, as Delete does.
+	req.Header.Set("x-ms-delete-snapshots", string(azblob.DeleteSnapshotsOptionInclude))
+	sign := cred.New(pipeline.PolicyFunc(func(context.Context, pipeline.Request) (pipeline.Response, error) {
+		return nil, nil
+	}), &pipeline.PolicyOptions{})
+	if _, err := sign.Do(ctx, req); err != nil {
+		return nil, err
+	}
+	var sub bytes.Buffer
+	fmt.Fprintf(&sub, "DELETE %s HTTP/1.1\r\n", req.URL.RequestURI())
+	req.Header.Set("Content-Length", "0")
+	if err := req.Header.Write(&sub); err != nil {
+		return nil, err
+	}
+	sub.WriteString("\r\n")
+	return sub.Bytes(), nil
+}
+
+// parseBatchResponse checks the subresponses of a batch delete, returning
+// the failures as KeyErrors.
+func parseBatchResponse(resp *http.Response, keys []ds.Key) error {
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("azure: batch delete: %w", err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	errs := make(KeyErrors)
+	seen := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("azure: batch delete: %w", err)
+		}
+		i, err := strconv.Atoi(part.Header.Get("Content-ID"))
+		if err != nil || i < 0 || i >= len(keys) {
+			return fmt.Errorf("azure: batch delete: bad subresponse id %q", part.Header.Get("Content-ID"))
+		}
+		sub, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return fmt.Errorf("azure: batch delete: %w", err)
+		}
+		io.Copy(ioutil.Discard, sub.Body)
+		sub.Body.Close()
+		seen++
+
+		code := sub.Header.Get("x-ms-error-code")
+		if sub.StatusCode == http.StatusAccepted || code == string(azblob.ServiceCodeBlobNotFound) {
+			continue
+		}
+		errs[keys[i]] = fmt.Errorf("%s %s", sub.Status, code)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if seen != len(keys) {
+		return fmt.Errorf("azure: batch delete: %d subresponses for %d deletes", seen, len(keys))
+	}
+	return nil
+}
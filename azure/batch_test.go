@@ -0,0 +1,34 @@
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+func TestSignedDelete(t *testing.T) {
+	cred, err := azblob.NewSharedKeyCredential("main", base64.StdEncoding.EncodeToString([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://main.blob.core.windows.net/data")
+	blob := azblob.NewContainerURL(*u, azblob.NewPipeline(cred, azblob.PipelineOptions{})).NewBlobURL("/a b")
+
+	sub, err := signedDelete(context.Background(), cred, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(sub)
+	for _, want := range []string{"DELETE /data//a%20b HTTP/1.1\r\n", "Authorization: SharedKey main:", "x-ms-date: ", "Content-Length: 0\r\n"} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("subrequest missing %q:\n%s", want, s)
+		}
+	}
+	if !strings.HasSuffix(s, "\r\n\r\n") {
+		t.Fatalf("subrequest not terminated:\n%s", s)
+	}
+}
@@ -0,0 +1,52 @@
+package azure
+
+import "sync"
+
+// queryParallelism caps concurrent value downloads in a query, however
+// small the values are.
+const queryParallelism = 16
+
+// byteBudget bounds the bytes, and the number of holders, in flight at
+// once. A single reservation larger than the whole budget is let through
+// alone rather than blocking forever.
+type byteBudget struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int64
+	used    int64
+	holders int
+	max     int
+}
+
+func newByteBudget(limit int64, maxHolders int) *byteBudget {
+	b := &byteBudget{limit: limit, max: maxHolders}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes are available and returns the amount
+// reserved, to be passed to release.
+func (b *byteBudget) acquire(n int64) int64 {
+	if n > b.limit {
+		n = b.limit
+	}
+	if n < 0 {
+		n = 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.holders > 0 && (b.used+n > b.limit || b.holders >= b.max) {
+		b.cond.Wait()
+	}
+	b.used += n
+	b.holders++
+	return n
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.holders--
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,69 @@
+package azure
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestByteBudget(t *testing.T) {
+	b := newByteBudget(100, 4)
+
+	var inFlight, peak int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		reserved := b.acquire(30)
+		n := atomic.AddInt64(&inFlight, reserved)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&inFlight, -reserved)
+			b.release(reserved)
+		}()
+	}
+	wg.Wait()
+	if peak > 100 {
+		t.Fatalf("peak of %d bytes in flight exceeds the budget", peak)
+	}
+}
+
+func TestByteBudgetOversized(t *testing.T) {
+	b := newByteBudget(10, 4)
+	done := make(chan int64)
+	go func() { done <- b.acquire(1000) }()
+	select {
+	case n := <-done:
+		if n != 10 {
+			t.Fatalf("reserved %d, want the whole budget", n)
+		}
+		b.release(n)
+	case <-time.After(time.Second):
+		t.Fatal("oversized reservation blocked on an idle budget")
+	}
+}
+
+func TestByteBudgetHolders(t *testing.T) {
+	b := newByteBudget(1000, 2)
+	b.acquire(0)
+	b.acquire(0)
+	acquired := make(chan struct{})
+	go func() {
+		b.acquire(0)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired past the holder limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.release(0)
+	<-acquired
+}
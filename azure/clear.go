@@ -0,0 +1,94 @@
+package azure
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Clear deletes every key under prefix. See ClearContext.
+func (d *Datastore) Clear(prefix ds.Key) (int, error) {
+	return d.ClearContext(context.Background(), prefix)
+}
+
+// ClearContext deletes every key under prefix, or every key for "/", and
+// returns the number deleted. The keys are listed a page at a time and
+// each page deleted with Blob Batch requests, 256 keys per request, run
+// in parallel, rather than with a request per key. Containers routed to
+// below prefix are cleared too; the containers themselves are kept, as
+// are the blobs of the container lock and the fencing epoch counter.
+//
+// Keys written while Clear runs may or may not survive it. With
+// WithAsyncPuts, the puts queued under prefix are waited for first; their
+// failures no longer matter and are not reported by a later Sync.
+func (d *Datastore) ClearContext(ctx context.Context, prefix ds.Key) (n int, err error) {
+	if d.async != nil {
+		if err := d.async.sync(ctx, prefix); err != nil && ctx.Err() != nil {
+			return 0, err
+		}
+	}
+	ctx, done, err := d.life.begin(ctx, prefix, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { done(err) }()
+
+	under := prefix.String()
+	if under != "/" {
+		under += "/"
+	}
+	n, err = d.clearRoute(ctx, d.routeFor(prefix), under)
+	if err != nil {
+		return n, err
+	}
+	for _, r := range d.routes {
+		if prefix.IsAncestorOf(r.prefix) {
+			m, err := d.clearRoute(ctx, r, r.prefix.String()+"/")
+			n += m
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// clearRoute deletes the keys starting with under from r's container.
+func (d *Datastore) clearRoute(ctx context.Context, r route, under string) (n int, err error) {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := r.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix:     d.listPrefix(under),
+			MaxResults: d.config.bulkPageSize(),
+		})
+		if err != nil {
+			if isError(err, azblob.ServiceCodeContainerNotFound) {
+				return n, nil
+			}
+			return n, err
+		}
+		var keys []ds.Key
+		for _, blob := range list.Segment.BlobItems {
+			k, ok := d.keyFor(blob.Name)
+			if !ok || !strings.HasPrefix(k.String(), under) || internalKey(k) {
+				continue
+			}
+			keys = append(keys, k)
+		}
+		chunks := (len(keys) + maxBatchDeletes - 1) / maxBatchDeletes
+		err = forEach(ctx, chunks, batchParallelism, func(ctx context.Context, i int) error {
+			end := (i + 1) * maxBatchDeletes
+			if end > len(keys) {
+				end = len(keys)
+			}
+			return d.deleteBatch(ctx, r, keys[i*maxBatchDeletes:end])
+		})
+		if err != nil {
+			return n, err
+		}
+		n += len(keys)
+		marker = list.NextMarker
+	}
+	return n, nil
+}
@@ -0,0 +1,175 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrClosed is returned by operations started after Close.
+var ErrClosed = errors.New("azure: datastore closed")
+
+// DefaultCloseTimeout is how long Close waits for writes in flight.
+const DefaultCloseTimeout = 30 * time.Second
+
+// WithCloseTimeout sets how long Close waits for writes in flight before
+// cancelling them.
+func WithCloseTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		if timeout > 0 {
+			c.closeTimeout = timeout
+		}
+	}
+}
+
+// UnpersistedError is returned by Close when writes were still in flight
+// at its deadline and failed once cancelled. The values of those keys are
+// unknown: each may hold the old value or the new one.
+type UnpersistedError struct {
+	Keys []ds.Key
+}
+
+func (e *UnpersistedError) Error() string {
+	keys := make([]string, len(e.Keys))
+	for i, k := range e.Keys {
+		keys[i] = k.String()
+	}
+	return fmt.Sprintf("azure: %d writes not persisted before close: %s", len(keys), strings.Join(keys, ", "))
+}
+
+// lifecycle tracks the operations in flight so Close can stop them.
+// Reads and listings are cancelled as soon as Close is called; writes are
+// given until the close timeout to finish.
+type lifecycle struct {
+	readCtx     context.Context
+	cancelReads func()
+	writeCtx    context.Context
+	cancelWrite func()
+
+	mu          sync.Mutex
+	closed      bool
+	fence       error // returned by writes while set, see fenceWrites
+	ops         sync.WaitGroup
+	unpersisted []ds.Key
+}
+
+func newLifecycle() *lifecycle {
+	l := &lifecycle{}
+	l.readCtx, l.cancelReads = context.WithCancel(context.Background())
+	l.writeCtx, l.cancelWrite = context.WithCancel(context.Background())
+	return l
+}
+
+// begin registers an operation, returning the context it runs under and a
+// function to call with its result when it is done. The context is
+// cancelled when either ctx or Close cancels the operation. Writes are
+// recorded as unpersisted if they fail after Close cancelled them.
+func (l *lifecycle) begin(ctx context.Context, key ds.Key, write bool) (context.Context, func(error), error) {
+	return l.beginKeys(ctx, write, key)
+}
+
+// beginKeys is begin for an operation writing several keys at once.
+func (l *lifecycle) beginKeys(ctx context.Context, write bool, keys ...ds.Key) (context.Context, func(error), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, nil, ErrClosed
+	}
+	if write && l.fence != nil {
+		return nil, nil, l.fence
+	}
+	l.ops.Add(1)
+	life := l.readCtx
+	if write {
+		life = l.writeCtx
+	}
+	ctx, cancel := withLife(ctx, life)
+	return ctx, func(err error) {
+		cancel()
+		if write && err != nil && l.writeCtx.Err() != nil {
+			l.mu.Lock()
+			l.unpersisted = append(l.unpersisted, keys...)
+			l.mu.Unlock()
+		}
+		l.ops.Done()
+	}, nil
+}
+
+// fenceWrites has writes begun from now on fail with err, or lets them
+// through again if err is nil. Writes in flight are not stopped.
+func (l *lifecycle) fenceWrites(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fence = err
+}
+
+// detach returns a context cancelled with ctx or when Close cancels reads,
+// for work Close should stop but not wait for, such as a stream left open
+// by the caller. cancel must be called once the work is done.
+func (l *lifecycle) detach(ctx context.Context) (context.Context, func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, nil, ErrClosed
+	}
+	ctx, cancel := withLife(ctx, l.readCtx)
+	return ctx, cancel, nil
+}
+
+// withLife returns a context cancelled with either ctx or life.
+func withLife(ctx, life context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-life.Done():
+			cancel()
+		case <-finished:
+		}
+	}()
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() { close(finished) })
+		cancel()
+	}
+}
+
+// close stops new operations, cancels reads, and waits up to timeout for
+// writes before cancelling them too.
+func (l *lifecycle) close(timeout time.Duration) error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	l.cancelReads()
+	drained := make(chan struct{})
+	go func() {
+		l.ops.Wait()
+		close(drained)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-drained:
+	case <-t.C:
+		l.cancelWrite()
+		<-drained
+	}
+	l.cancelWrite()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.unpersisted) > 0 {
+		return &UnpersistedError{Keys: l.unpersisted}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestLifecycleClose(t *testing.T) {
+	l := newLifecycle()
+
+	readCtx, readDone, err := l.begin(context.Background(), ds.NewKey("/r"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slowCtx, slowDone, _ := l.begin(context.Background(), ds.NewKey("/slow"), true)
+	_, fastDone, _ := l.begin(context.Background(), ds.NewKey("/fast"), true)
+
+	// Reads stop at once; the fast write finishes inside the deadline and
+	// the slow one only fails once cancelled.
+	go func() {
+		<-readCtx.Done()
+		readDone(readCtx.Err())
+		fastDone(nil)
+		<-slowCtx.Done()
+		slowDone(slowCtx.Err())
+	}()
+
+	err = l.close(50 * time.Millisecond)
+	var uerr *UnpersistedError
+	if !errors.As(err, &uerr) || len(uerr.Keys) != 1 || uerr.Keys[0].String() != "/slow" {
+		t.Fatalf("unexpected close error %v", err)
+	}
+	if _, _, err := l.begin(context.Background(), ds.NewKey("/late"), true); err != ErrClosed {
+		t.Fatalf("operation after close: %v", err)
+	}
+	if err := l.close(time.Second); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+}
+
+func TestLifecycleCallerCancel(t *testing.T) {
+	l := newLifecycle()
+	ctx, cancel := context.WithCancel(context.Background())
+	opCtx, done, err := l.begin(ctx, ds.NewKey("/w"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	<-opCtx.Done()
+	done(opCtx.Err())
+
+	// Writes the caller cancelled are the caller's to report.
+	if err := l.close(time.Second); err != nil {
+		t.Fatalf("unexpected close error %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package azure
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is a codec values are compressed with. It is recorded as
+// the blob's Content-Encoding.
+type Compression string
+
+const (
+	// NoCompression stores values as they are.
+	NoCompression Compression = ""
+	// Gzip compresses values with gzip.
+	Gzip Compression = "gzip"
+	// Zstd compresses values with Zstandard, faster and usually smaller
+	// than gzip, though fewer other tools read it.
+	Zstd Compression = "zstd"
+)
+
+// metaSize is the blob metadata entry holding the uncompressed size of a
+// compressed value.
+const metaSize = "dssize"
+
+// WithCompression has puts compress values with c. Reads decompress
+// values by the encoding recorded with each, whatever the option, so
+// compression can be turned on or changed over existing data. Values that
+// do not shrink are stored as they are, as are values PutReader streams.
+func WithCompression(c Compression) Option {
+	return func(cfg *config) {
+		cfg.compression = c
+	}
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCodec returns the shared zstd encoder and decoder, whose EncodeAll
+// and DecodeAll are safe for concurrent use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compress returns value as it is to be stored, with the headers and
+// metadata recording its encoding and size. meta is not modified.
+func (d *Datastore) compress(value []byte, meta azblob.Metadata) ([]byte, azblob.BlobHTTPHeaders, azblob.Metadata, error) {
+	var compressed []byte
+	switch d.config.compression {
+	case NoCompression:
+		return value, azblob.BlobHTTPHeaders{}, meta, nil
+	case Gzip:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write(value)
+		if err := w.Close(); err != nil {
+			return nil, azblob.BlobHTTPHeaders{}, nil, err
+		}
+		compressed = b.Bytes()
+	case Zstd:
+		enc, _ := zstdCodec()
+		compressed = enc.EncodeAll(value, nil)
+	default:
+		return nil, azblob.BlobHTTPHeaders{}, nil, fmt.Errorf("azure: unsupported compression %q", d.config.compression)
+	}
+	if len(compressed) >= len(value) {
+		return value, azblob.BlobHTTPHeaders{}, meta, nil
+	}
+	withSize := make(azblob.Metadata, len(meta)+1)
+	for k, v := range meta {
+		withSize[k] = v
+	}
+	withSize[metaSize] = strconv.Itoa(len(value))
+	return compressed, azblob.BlobHTTPHeaders{ContentEncoding: string(d.config.compression)}, withSize, nil
+}
+
+// decompress returns the value of key stored with the given encoding.
+func decompress(key ds.Key, encoding string, stored []byte) ([]byte, error) {
+	switch Compression(encoding) {
+	case NoCompression, "identity":
+		return stored, nil
+	case Zstd:
+		_, dec := zstdCodec()
+		value, err := dec.DecodeAll(stored, nil)
+		if err != nil {
+			return nil, fmt.Errorf("azure: decompressing %s: %w", key, err)
+		}
+		return value, nil
+	}
+	r, err := decompressReader(key, encoding, ioutil.NopCloser(bytes.NewReader(stored)))
+	if err != nil {
+		return nil, err
+	}
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("azure: decompressing %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// decompressReader returns a stream of the value of key read from r,
+// stored with the given encoding. Closing it closes r.
+func decompressReader(key ds.Key, encoding string, r io.ReadCloser) (io.ReadCloser, error) {
+	switch Compression(encoding) {
+	case NoCompression, "identity":
+		return r, nil
+	case Gzip:
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("azure: decompressing %s: %w", key, err)
+		}
+		return &decompressingReader{Reader: z, closer: r}, nil
+	case Zstd:
+		z, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("azure: decompressing %s: %w", key, err)
+		}
+		return &decompressingReader{Reader: z, closer: r, done: z.Close}, nil
+	}
+	r.Close()
+	return nil, fmt.Errorf("azure: %s has unsupported content encoding %q", key, encoding)
+}
+
+// decompressingReader closes the compressed stream along with the
+// decompressor.
+type decompressingReader struct {
+	io.Reader
+	closer io.Closer
+	done   func()
+}
+
+func (r *decompressingReader) Close() error {
+	if r.done != nil {
+		r.done()
+	}
+	return r.closer.Close()
+}
+
+// valueSize returns the size of a value stored as length bytes with meta,
+// before any compression.
+func valueSize(length int64, meta azblob.Metadata) int {
+	if n, err := strconv.Atoi(meta[metaSize]); err == nil {
+		return n
+	}
+	return int(length)
+}
+
+// identityEncoding asks for responses as stored. Without it, Go's HTTP
+// transport asks for gzip and transparently decompresses gzip-encoded
+// values, which breaks their MD5 checks and ranged downloads.
+var identityEncoding = pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+	return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		request.Header.Set("Accept-Encoding", "identity")
+		return next.Do(ctx, request)
+	}
+})
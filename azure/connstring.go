@@ -0,0 +1,96 @@
+package azure
+
+import (
+	"fmt"
+	"strings"
+)
+
+// connectionString holds the settings of an Azure Storage connection
+// string the datastore uses.
+type connectionString struct {
+	account  string
+	key      string
+	sas      string
+	endpoint string // blob endpoint, or "" for https://<account>.blob.<suffix>
+	suffix   string // endpoint suffix, or "" for the public cloud's
+}
+
+// parseConnectionString parses the standard Azure Storage connection
+// string format, such as
+//
+//	DefaultEndpointsProtocol=https;AccountName=name;AccountKey=key;EndpointSuffix=core.windows.net
+//
+// including BlobEndpoint, SharedAccessSignature and
+// UseDevelopmentStorage. Setting names are case-insensitive.
+func parseConnectionString(s string) (connectionString, error) {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i <= 0 {
+			return connectionString{}, fmt.Errorf("azure: invalid connection string setting %q", part)
+		}
+		settings[strings.ToLower(part[:i])] = part[i+1:]
+	}
+
+	if strings.EqualFold(settings["usedevelopmentstorage"], "true") {
+		endpoint := AzuriteEndpoint
+		if proxy := settings["developmentstorageproxyuri"]; proxy != "" {
+			endpoint = strings.TrimSuffix(proxy, "/") + ":10000/" + AzuriteAccount
+		}
+		return connectionString{account: AzuriteAccount, key: AzuriteKey, endpoint: endpoint}, nil
+	}
+
+	cs := connectionString{
+		account:  settings["accountname"],
+		key:      settings["accountkey"],
+		sas:      settings["sharedaccesssignature"],
+		endpoint: strings.TrimSuffix(settings["blobendpoint"], "/"),
+	}
+	if suffix := settings["endpointsuffix"]; suffix != "" && suffix != PublicCloudSuffix {
+		cs.suffix = suffix
+	}
+	if protocol := settings["defaultendpointsprotocol"]; cs.endpoint == "" && cs.account != "" && protocol == "http" {
+		suffix := cs.suffix
+		if suffix == "" {
+			suffix = PublicCloudSuffix
+		}
+		cs.endpoint = fmt.Sprintf("http://%s.blob.%s", cs.account, suffix)
+	}
+	switch {
+	case cs.sas != "":
+		if cs.account == "" && cs.endpoint == "" {
+			return connectionString{}, fmt.Errorf("azure: connection string with a SAS needs AccountName or BlobEndpoint")
+		}
+	case cs.account == "" || cs.key == "":
+		return connectionString{}, fmt.Errorf("azure: connection string needs AccountName and AccountKey, or SharedAccessSignature")
+	}
+	return cs, nil
+}
+
+// NewDatastoreFromConnectionString returns a Datastore over the given
+// container, reached and authorized as an Azure Storage connection string
+// describes, such as one held in AZURE_STORAGE_CONNECTION_STRING. Account
+// keys, SAS tokens, custom endpoints and UseDevelopmentStorage=true for
+// Azurite are supported. Options given override the connection string's
+// endpoint settings.
+func NewDatastoreFromConnectionString(connStr, container string, opts ...Option) (*Datastore, error) {
+	cs, err := parseConnectionString(connStr)
+	if err != nil {
+		return nil, err
+	}
+	if cs.suffix != "" {
+		opts = append([]Option{WithEndpointSuffix(cs.suffix)}, opts...)
+	}
+	if cs.endpoint != "" {
+		opts = append([]Option{WithEndpoint(cs.endpoint)}, opts...)
+	}
+	cred := WithSharedKey(cs.key)
+	if cs.sas != "" {
+		cred = WithSAS(cs.sas)
+	}
+	return NewDatastore(cs.account, container, append([]Option{cred}, opts...)...)
+}
@@ -0,0 +1,93 @@
+package azure
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/azure/azuretest"
+)
+
+func TestParseConnectionString(t *testing.T) {
+	cases := []struct {
+		in   string
+		want connectionString
+		err  bool
+	}{
+		{
+			in:   "DefaultEndpointsProtocol=https;AccountName=acct;AccountKey=a2V5==;EndpointSuffix=core.windows.net",
+			want: connectionString{account: "acct", key: "a2V5=="},
+		},
+		{
+			in:   "accountname=acct;accountkey=a2V5;EndpointSuffix=core.chinacloudapi.cn;",
+			want: connectionString{account: "acct", key: "a2V5", suffix: "core.chinacloudapi.cn"},
+		},
+		{
+			in:   "DefaultEndpointsProtocol=http;AccountName=acct;AccountKey=a2V5",
+			want: connectionString{account: "acct", key: "a2V5", endpoint: "http://acct.blob.core.windows.net"},
+		},
+		{
+			in:   "DefaultEndpointsProtocol=http;AccountName=acct;AccountKey=a2V5;EndpointSuffix=core.usgovcloudapi.net",
+			want: connectionString{account: "acct", key: "a2V5", endpoint: "http://acct.blob.core.usgovcloudapi.net", suffix: "core.usgovcloudapi.net"},
+		},
+		{
+			in:   "AccountName=acct;AccountKey=a2V5;BlobEndpoint=https://blobs.example.com/",
+			want: connectionString{account: "acct", key: "a2V5", endpoint: "https://blobs.example.com"},
+		},
+		{
+			in:   "BlobEndpoint=https://acct.blob.core.windows.net;SharedAccessSignature=sv=2019-12-12&sig=abc%3D",
+			want: connectionString{sas: "sv=2019-12-12&sig=abc%3D", endpoint: "https://acct.blob.core.windows.net"},
+		},
+		{
+			in:   "UseDevelopmentStorage=true",
+			want: connectionString{account: AzuriteAccount, key: AzuriteKey, endpoint: "http://127.0.0.1:10000/devstoreaccount1"},
+		},
+		{
+			in:   "UseDevelopmentStorage=true;DevelopmentStorageProxyUri=http://azurite",
+			want: connectionString{account: AzuriteAccount, key: AzuriteKey, endpoint: "http://azurite:10000/devstoreaccount1"},
+		},
+		{in: "AccountName=acct", err: true},
+		{in: "SharedAccessSignature=sig=abc", err: true},
+		{in: "AccountName=acct;AccountKey", err: true},
+		{in: "", err: true},
+	}
+	for _, c := range cases {
+		got, err := parseConnectionString(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q: got %+v, want %+v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestDatastoreFromConnectionString(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	d, err := NewDatastoreFromConnectionString(
+		"DefaultEndpointsProtocol=http;AccountName=devstore;AccountKey="+AzuriteKey+";BlobEndpoint="+srv.URL, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	k := ds.NewKey("/a")
+	if err := d.Put(k, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(k); err != nil || !bytes.Equal(v, []byte("1")) {
+		t.Fatalf("got %q, %v", v, err)
+	}
+}
@@ -0,0 +1,62 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// EnsureContainer creates the datastore's container if it does not exist.
+// Writes call it before their first request, so calling it directly is
+// only needed to surface setup problems early.
+//
+// It is safe to call concurrently, including from other processes: a
+// container created by someone else counts as success. Credentials allowed
+// to write blobs but not to create containers, such as a SAS scoped to the
+// container, are taken to mean the container already exists. Once it has
+// succeeded it returns nil without further requests; failures are retried
+// on the next call. Routed containers are never created.
+//
+// For a sharded datastore it also checks the container was created with
+// the same shard function, returning ErrShardingMismatch if not.
+func (d *Datastore) EnsureContainer(ctx context.Context) error {
+	d.ensureMu.Lock()
+	defer d.ensureMu.Unlock()
+	if d.ensured {
+		return nil
+	}
+
+	_, err := d.containerUrl.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
+	switch {
+	case err == nil, isError(err, azblob.ServiceCodeContainerAlreadyExists), isForbidden(err):
+	default:
+		return err
+	}
+	if err := d.checkSharding(ctx); err != nil {
+		return err
+	}
+	d.ensured = true
+	return nil
+}
+
+// ensureFor makes sure the container holding key exists before it is
+// written.
+func (d *Datastore) ensureFor(ctx context.Context, key ds.Key) error {
+	c := d.containerFor(key)
+	u, main := c.URL(), d.containerUrl.URL()
+	if u.String() != main.String() {
+		return nil
+	}
+	return d.EnsureContainer(ctx)
+}
+
+func isForbidden(err error) bool {
+	var serr azblob.StorageError
+	if errors.As(err, &serr) && serr.Response() != nil {
+		return serr.Response().StatusCode == http.StatusForbidden
+	}
+	return false
+}
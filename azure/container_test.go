@@ -0,0 +1,58 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+func TestEnsureContainer(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		code   string
+		ok     bool
+	}{
+		{"created", http.StatusCreated, "", true},
+		{"exists", http.StatusConflict, string(azblob.ServiceCodeContainerAlreadyExists), true},
+		{"forbidden", http.StatusForbidden, "AuthorizationPermissionMismatch", true},
+		{"deleting", http.StatusConflict, string(azblob.ServiceCodeContainerBeingDeleted), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				if tc.code != "" {
+					w.Header().Set("x-ms-error-code", tc.code)
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer srv.Close()
+
+			u, _ := url.Parse(srv.URL + "/data")
+			pipeline := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+				Retry: azblob.RetryOptions{MaxTries: 1},
+			})
+			d := &Datastore{containerUrl: azblob.NewContainerURL(*u, pipeline)}
+
+			for i := 0; i < 2; i++ {
+				err := d.EnsureContainer(context.Background())
+				if (err == nil) != tc.ok {
+					t.Fatalf("unexpected result %v", err)
+				}
+			}
+			want := int32(1)
+			if !tc.ok {
+				want = 2 // failures are retried
+			}
+			if n := atomic.LoadInt32(&requests); n != want {
+				t.Fatalf("made %d requests, want %d", n, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrContention is returned by IncrementBy when the counter kept changing
+// underneath it for every retry.
+var ErrContention = errors.New("azure: counter update retries exhausted")
+
+// counterRetries bounds the compare-and-swap attempts of one increment.
+const counterRetries = 10
+
+// IncrementBy atomically adds delta to the counter stored at key and
+// returns the new value. A missing counter starts at zero. Counters are
+// stored as decimal text, so they can be read with Get or Counter.
+//
+// Each attempt reads the counter and writes it back conditioned on the
+// ETag it read; a concurrent update fails the write and the attempt is
+// retried after a short randomized backoff.
+func (d *Datastore) IncrementBy(key ds.Key, delta int64) (n int64, err error) {
+	ctx, done, err := d.life.begin(context.Background(), key, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { done(err) }()
+
+	backoff := 10 * time.Millisecond
+	for i := 0; i < counterRetries; i++ {
+		var current int64
+		value, etag, err := d.getWithETag(ctx, key)
+		switch err {
+		case nil:
+			if current, err = parseCounter(key, value); err != nil {
+				return 0, err
+			}
+		case ds.ErrNotFound:
+			// etag is ETagNone, or that of an expired value.
+		default:
+			return 0, err
+		}
+
+		next := current + delta
+		err = d.putIfMatch(ctx, key, []byte(strconv.FormatInt(next, 10)), etag)
+		if err == nil {
+			return next, nil
+		}
+		if err != ErrETagMismatch {
+			return 0, err
+		}
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+	}
+	return 0, ErrContention
+}
+
+// Counter returns the value of the counter at key, or zero if it does not
+// exist.
+func (d *Datastore) Counter(key ds.Key) (int64, error) {
+	value, err := d.Get(key)
+	if err == ds.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return parseCounter(key, value)
+}
+
+func parseCounter(key ds.Key, value []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("azure: %s is not a counter: %w", key, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,17 @@
+package azure
+
+import (
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestParseCounter(t *testing.T) {
+	k := ds.NewKey("/c")
+	if n, err := parseCounter(k, []byte("-42")); err != nil || n != -42 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if _, err := parseCounter(k, []byte("not a number")); err == nil {
+		t.Fatal("expected an error for a non-counter value")
+	}
+}
@@ -0,0 +1,35 @@
+package azure
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// WithCustomerProvidedKey has the service encrypt values at rest with key,
+// a 32-byte AES-256 key sent with every request rather than one managed by
+// Microsoft or kept in Key Vault. The service does not keep the key: values
+// written with it can only be read with it, so losing it loses them.
+// Azure only accepts the key over HTTPS. It replaces WithEncryptionScope.
+func WithCustomerProvidedKey(key []byte) Option {
+	return func(c *config) {
+		sum := sha256.Sum256(key)
+		encoded := base64.StdEncoding.EncodeToString(key)
+		hash := base64.StdEncoding.EncodeToString(sum[:])
+		c.cpk = azblob.ClientProvidedKeyOptions{
+			EncryptionKey:       &encoded,
+			EncryptionKeySha256: &hash,
+			EncryptionAlgorithm: azblob.EncryptionAlgorithmAES256,
+		}
+	}
+}
+
+// WithEncryptionScope has values written encrypted under the named
+// encryption scope of the account instead of the container's default.
+// Reads need no scope. It replaces WithCustomerProvidedKey.
+func WithEncryptionScope(scope string) Option {
+	return func(c *config) {
+		c.cpk = azblob.ClientProvidedKeyOptions{EncryptionScope: &scope}
+	}
+}
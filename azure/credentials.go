@@ -0,0 +1,33 @@
+package azure
+
+import (
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// WithSharedKey authorizes requests with the account key.
+func WithSharedKey(accountKey string) Option {
+	return func(c *config) {
+		c.credential = func(accountName string) (pipeline.Factory, error) {
+			return azblob.NewSharedKeyCredential(accountName, accountKey)
+		}
+	}
+}
+
+// WithCredential authorizes requests with cred, such as an
+// azblob.TokenCredential for Azure AD.
+func WithCredential(cred azblob.Credential) Option {
+	return func(c *config) {
+		c.credential = func(string) (pipeline.Factory, error) {
+			return cred, nil
+		}
+	}
+}
+
+// NewDatastoreWithKey returns a Datastore over the given container
+// authorized by the account key.
+//
+// Deprecated: use NewDatastore with WithSharedKey.
+func NewDatastoreWithKey(accountName, accountKey, container string, opts ...Option) (*Datastore, error) {
+	return NewDatastore(accountName, container, append([]Option{WithSharedKey(accountKey)}, opts...)...)
+}
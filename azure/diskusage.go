@@ -0,0 +1,99 @@
+package azure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// DiskUsageMode selects how DiskUsage accounts for the container.
+type DiskUsageMode int
+
+const (
+	// DiskUsageApproximate reports the total of the last listing of the
+	// container, relisting in the background once it is older than the
+	// max age. DiskUsage never waits on a listing: until the first one
+	// completes it reports zero.
+	DiskUsageApproximate DiskUsageMode = iota
+	// DiskUsageExact lists the whole container on every call, which can
+	// take minutes for a container of millions of blobs.
+	DiskUsageExact
+)
+
+// DefaultDiskUsageMaxAge is how old an approximate disk usage may get
+// before it is refreshed.
+const DefaultDiskUsageMaxAge = 10 * time.Minute
+
+// WithDiskUsage sets how DiskUsage is accounted for, and, for
+// DiskUsageApproximate, the age after which the total is refreshed. Zero
+// keeps the default max age.
+func WithDiskUsage(mode DiskUsageMode, maxAge time.Duration) Option {
+	return func(c *config) {
+		c.diskUsageMode = mode
+		if maxAge > 0 {
+			c.diskUsageMaxAge = maxAge
+		}
+	}
+}
+
+// diskUsage is the last measured size of the container.
+type diskUsage struct {
+	mu         sync.Mutex
+	bytes      uint64
+	measured   time.Time
+	refreshing bool
+}
+
+// DiskUsage returns the bytes stored in the datastore's container, summed
+// over a listing of its blobs, exactly or approximately as configured with
+// WithDiskUsage. Keys routed to other containers are not counted.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	if d.config.diskUsageMode == DiskUsageExact {
+		return d.measureUsage(context.Background())
+	}
+
+	u := &d.usage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.refreshing && time.Since(u.measured) > d.config.diskUsageMaxAge {
+		u.refreshing = true
+		go func() {
+			n, err := d.measureUsage(context.Background())
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			if err == nil {
+				u.bytes, u.measured = n, time.Now()
+			} else {
+				d.config.logf("azure: refreshing disk usage: %s", brief(err))
+			}
+			u.refreshing = false
+		}()
+	}
+	return u.bytes, nil
+}
+
+// measureUsage lists the container, summing the blob sizes.
+func (d *Datastore) measureUsage(ctx context.Context) (total uint64, err error) {
+	ctx, done, err := d.life.begin(ctx, ds.NewKey("/"), false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { done(err) }()
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := d.containerUrl.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{MaxResults: d.config.bulkPageSize()})
+		if err != nil {
+			return 0, err
+		}
+		for _, blob := range list.Segment.BlobItems {
+			if blob.Properties.ContentLength != nil {
+				total += uint64(*blob.Properties.ContentLength)
+			}
+		}
+		marker = list.NextMarker
+	}
+	return total, nil
+}
@@ -0,0 +1,220 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// downloadRetries is how many times a chunked download restarts when the
+// value changes under it, and by default how many times a download is
+// resumed after a failed read.
+const downloadRetries = 3
+
+// WithRetryReaderOptions sets how downloads recover from reads failing
+// partway through a value's body, as on a flaky network: up to
+// MaxRetryRequests times, each resuming from the last byte read with a
+// new request for the rest. Zero keeps the default of 3 and a negative
+// value turns resuming off. TreatEarlyCloseAsError stops a body closed
+// before its end from being resumed. NotifyFailedRead, if set, is told of
+// each failed read; otherwise they are logged with WithLogger.
+func WithRetryReaderOptions(o azblob.RetryReaderOptions) Option {
+	return func(c *config) {
+		c.readRetry = o
+	}
+}
+
+// retryReader returns the options to read downloaded bodies with.
+func (c *config) retryReader() azblob.RetryReaderOptions {
+	o := c.readRetry
+	switch {
+	case o.MaxRetryRequests == 0:
+		o.MaxRetryRequests = downloadRetries
+	case o.MaxRetryRequests < 0:
+		o.MaxRetryRequests = 0
+	}
+	if o.NotifyFailedRead == nil && c.logger != nil {
+		o.NotifyFailedRead = func(failures int, err error, offset, count int64, willRetry bool) {
+			c.logf("azure: read %d of a download failed at byte %d, retrying %v: %v", failures, offset, willRetry, err)
+		}
+	}
+	// Resumed reads of an encrypted value need its key.
+	o.ClientProvidedKeyOptions = c.cpk
+	return o
+}
+
+// DefaultDownloadChunkSize is the size of the ranges large values are
+// downloaded in.
+const DefaultDownloadChunkSize = 8 * mib
+
+// WithDownloadChunkSize has Get download values larger than size as ranges
+// of that size, fetched in parallel with as many requests as uploads stage
+// blocks with. The first range is fetched alone, so values that fit in it
+// still take one request.
+func WithDownloadChunkSize(size int64) Option {
+	return func(c *config) {
+		if size > 0 {
+			c.downloadChunkSize = size
+		}
+	}
+}
+
+// download returns the value of key held by blob, the key's blob or a
+// snapshot of it, and its metadata. Values larger than
+// the download chunk size are fetched in ranges in parallel, all
+// conditioned on the ETag of the first, so a value replaced during the
+// download is fetched again rather than mixed. The value is verified
+// against its stored MD5 and decompressed.
+func (d *Datastore) download(ctx context.Context, key ds.Key, blob azblob.BlobURL) (value []byte, meta azblob.Metadata, err error) {
+	chunk := d.config.downloadChunkSize
+	for try := 0; ; try++ {
+		first, err := blob.Download(ctx, 0, chunk, azblob.BlobAccessConditions{}, false, d.config.cpk)
+		if isError(err, azblob.ServiceCodeInvalidRange) {
+			// An empty blob has no range to return.
+			first, err = blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, d.config.cpk)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		meta = first.NewMetadata()
+		stored := first.BlobContentMD5()
+		if first.ContentRange() == "" {
+			stored = first.ContentMD5()
+		}
+		encoding := first.ContentEncoding()
+		size, err := blobSize(first)
+		if err != nil {
+			first.Response().Body.Close()
+			return nil, nil, err
+		}
+		value = make([]byte, size)
+		t := d.config.transfer(key, false, size)
+		body := first.Body(d.config.retryReader())
+		n, err := io.ReadFull(t.reader(body), value[:min64(size, chunk)])
+		body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if int64(n) == size {
+			return d.decode(key, value, meta, stored, encoding)
+		}
+
+		cond := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: first.ETag()}}
+		err = azblob.DoBatchTransfer(ctx, azblob.BatchTransferOptions{
+			OperationName: "download",
+			TransferSize:  size - int64(n),
+			ChunkSize:     chunk,
+			Parallelism:   uint16(d.config.parallelism()),
+			Operation: func(offset, count int64, ctx context.Context) error {
+				offset += int64(n)
+				get, err := blob.Download(ctx, offset, count, cond, false, d.config.cpk)
+				if err != nil {
+					return err
+				}
+				body := get.Body(d.config.retryReader())
+				defer body.Close()
+				_, err = io.ReadFull(t.reader(body), value[offset:offset+count])
+				return err
+			},
+		})
+		if isError(err, azblob.ServiceCodeConditionNotMet) && try < downloadRetries {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return d.decode(key, value, meta, stored, encoding)
+	}
+}
+
+// decode verifies a downloaded value against its stored MD5 and
+// decompresses it.
+func (d *Datastore) decode(key ds.Key, value []byte, meta azblob.Metadata, stored []byte, encoding string) ([]byte, azblob.Metadata, error) {
+	if err := d.verify(key, value, stored); err != nil {
+		return nil, nil, err
+	}
+	value, err := decompress(key, encoding, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, meta, nil
+}
+
+// blobSize returns the size of the whole blob a download is part of.
+func blobSize(get *azblob.DownloadResponse) (int64, error) {
+	cr := get.ContentRange()
+	if cr == "" {
+		return get.ContentLength(), nil
+	}
+	// bytes <start>-<end>/<size>
+	i := strings.LastIndex(cr, "/")
+	size, err := strconv.ParseInt(cr[i+1:], 10, 64)
+	if i < 0 || err != nil {
+		return 0, fmt.Errorf("azure: bad Content-Range %q", cr)
+	}
+	return size, nil
+}
+
+// GetReader returns the value for key as a stream, so large values need
+// not be held in memory. See GetReaderContext.
+func (d *Datastore) GetReader(key ds.Key) (io.ReadCloser, error) {
+	return d.GetReaderContext(context.Background(), key)
+}
+
+// GetReaderContext returns the value for key as a stream read under ctx.
+// A read that fails part way is resumed from where it stopped. The reader
+// must be closed. Close on the datastore does not wait for open readers,
+// but fails their further reads. Archived values are handled as by
+// GetContext. A value not matching its stored MD5 fails the read that
+// reaches its end with a CorruptError.
+func (d *Datastore) GetReaderContext(ctx context.Context, key ds.Key) (io.ReadCloser, error) {
+	ctx, cancel, err := d.life.detach(ctx)
+	if err != nil {
+		return nil, err
+	}
+	get, err := d.keyUrl(key).Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, d.config.cpk)
+	for isError(err, azblob.ServiceCodeBlobArchived) {
+		if err := d.archived(ctx, key); err != nil {
+			cancel()
+			return nil, err
+		}
+		get, err = d.keyUrl(key).Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, d.config.cpk)
+	}
+	if err != nil {
+		cancel()
+		if isError(err, azblob.ServiceCodeBlobNotFound) {
+			return nil, ds.ErrNotFound
+		}
+		return nil, err
+	}
+	if d.expired(get.NewMetadata()) {
+		get.Response().Body.Close()
+		cancel()
+		return nil, ds.ErrNotFound
+	}
+	body := get.Body(d.config.retryReader())
+	counted := d.config.transfer(key, false, get.ContentLength()).reader(body)
+	r, err := decompressReader(key, get.ContentEncoding(), d.verifyReader(key, readCloser{counted, body}, get.ContentMD5()))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &blobReader{ReadCloser: r, cancel: cancel}, nil
+}
+
+// blobReader ends the download's context when it is closed.
+type blobReader struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (r *blobReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
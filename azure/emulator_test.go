@@ -0,0 +1,2832 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/azure/azuretest"
+	"github.com/ipfs/go-datastore/clock"
+	"github.com/ipfs/go-datastore/flatfs"
+	"github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+// newEmulated returns a datastore backed by a fresh emulator.
+func newEmulated(t *testing.T, opts ...Option) (*Datastore, *azuretest.Emulator) {
+	t.Helper()
+	srv, e := azuretest.NewServer()
+	t.Cleanup(srv.Close)
+	key := base64.StdEncoding.EncodeToString([]byte("emulated"))
+	d, err := NewDatastore("devstore", "data", append(opts, WithSharedKey(key), WithEndpoint(srv.URL))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, e
+}
+
+func TestEmulatedSuite(t *testing.T) {
+	d, _ := newEmulated(t)
+	dstest.SubtestAll(t, d)
+}
+
+func TestEmulatedFeatures(t *testing.T) {
+	d, e := newEmulated(t, WithUploadThresholds(1024, 256))
+
+	// Values over the single-shot threshold are staged as blocks.
+	big := bytes.Repeat([]byte("0123456789"), 300)
+	if err := d.Put(ds.NewKey("/big"), big); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := e.Blob("data", "/big"); !ok || !bytes.Equal(got, big) {
+		t.Fatal("staged upload not committed")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := d.IncrementBy(ds.NewKey("/count"), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := d.Counter(ds.NewKey("/count")); err != nil || n != 6 {
+		t.Fatalf("counter is %d, %v", n, err)
+	}
+
+	var keys []ds.Key
+	for i := 0; i < listThreshold+1; i++ {
+		k := ds.NewKey(fmt.Sprintf("/many/%d", i))
+		keys = append(keys, k)
+		if i%2 == 0 {
+			d.Put(k, nil)
+		}
+	}
+	found, err := d.HasMany(append(keys, ds.NewKey("/big")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		if found[k] != (i%2 == 0) {
+			t.Fatalf("HasMany reported %s as %v", k, found[k])
+		}
+	}
+	if !found[ds.NewKey("/big")] {
+		t.Fatal("HasMany missed a key checked on its own")
+	}
+
+	s, err := d.NewSemaphore(ds.NewKey("/sem"), 1, 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.TryAcquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TryAcquire(context.Background()); err != ErrNoSlot {
+		t.Fatalf("second acquire: %v", err)
+	}
+	if err := p.Release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmulatedFork(t *testing.T) {
+	d, e := newEmulated(t)
+	for i := 0; i < 40; i++ {
+		d.Put(ds.NewKey(fmt.Sprintf("/src/%d", i)), []byte(fmt.Sprint(i)))
+	}
+	d.Put(ds.NewKey("/srcother"), []byte("x"))
+
+	for _, snapshot := range []bool{false, true} {
+		dst := ds.NewKey(fmt.Sprintf("/dst-%v", snapshot))
+		n, err := d.Fork(context.Background(), ds.NewKey("/src"), dst, ForkOptions{Parallelism: 4, Snapshot: snapshot})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 40 {
+			t.Fatalf("forked %d keys, want 40", n)
+		}
+		for i := 0; i < 40; i++ {
+			name := dst.ChildString(fmt.Sprint(i)).String()
+			if got, ok := e.Blob("data", name); !ok || string(got) != fmt.Sprint(i) {
+				t.Fatalf("%s is %q, %v", name, got, ok)
+			}
+		}
+		if has, _ := d.Has(dst.ChildString("other")); has {
+			t.Fatal("forked a sibling of the prefix")
+		}
+	}
+
+	if _, err := d.Fork(context.Background(), ds.NewKey("/src"), ds.NewKey("/src/copy"), ForkOptions{}); err == nil {
+		t.Fatal("expected overlapping prefixes to be rejected")
+	}
+}
+
+func TestEmulatedContext(t *testing.T) {
+	d, _ := newEmulated(t)
+	k := ds.NewKey("/a")
+	if err := d.PutContext(context.Background(), k, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.GetContext(ctx, k); err == nil {
+		t.Fatal("expected a cancelled get to fail")
+	}
+	if err := d.DeleteContext(ctx, k); err == nil {
+		t.Fatal("expected a cancelled delete to fail")
+	}
+	if err := d.PutReaderContext(ctx, k, bytes.NewReader([]byte("2")), -1); err == nil {
+		t.Fatal("expected a cancelled streamed put to fail")
+	}
+	if v, err := d.GetContext(context.Background(), k); err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	res, err := d.QueryContext(ctx, query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := res.Rest(); err != context.Canceled {
+		t.Fatalf("cancelled query returned %d entries, %v", len(entries), err)
+	}
+}
+
+func TestEmulatedQueryInterrupted(t *testing.T) {
+	d, _ := newEmulated(t, WithListPageSize(5))
+	for i := 0; i < 20; i++ {
+		d.Put(ds.NewKey(fmt.Sprint(i)), nil)
+	}
+
+	// Closing the results early ends the query.
+	res, err := d.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := <-res.Next(); r.Error != nil {
+		t.Fatal(r.Error)
+	}
+	if err := res.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A query cut short by Close reports it instead of ending early.
+	res, err = d.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := <-res.Next(); r.Error != nil {
+		t.Fatal(r.Error)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var last error
+	for r := range res.Next() {
+		last = r.Error
+	}
+	if last != ErrClosed {
+		t.Fatalf("query ended with %v, want ErrClosed", last)
+	}
+}
+
+func TestEmulatedBatch(t *testing.T) {
+	d, e := newEmulated(t)
+	for i := 0; i < maxBatchDeletes+10; i++ {
+		d.Put(ds.NewKey(fmt.Sprintf("/old/%d", i)), []byte("x"))
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxBatchDeletes+10; i++ {
+		b.Delete(ds.NewKey(fmt.Sprintf("/old/%d", i)))
+	}
+	b.Delete(ds.NewKey("/never-written"))
+	for i := 0; i < 20; i++ {
+		b.Put(ds.NewKey(fmt.Sprintf("/new/%d", i)), []byte(fmt.Sprint(i)))
+	}
+	b.Put(ds.NewKey("/old/0"), []byte("kept"))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < maxBatchDeletes+10; i++ {
+		if _, ok := e.Blob("data", fmt.Sprintf("/old/%d", i)); ok {
+			t.Fatalf("/old/%d not deleted", i)
+		}
+	}
+	if got, ok := e.Blob("data", "/old/0"); !ok || string(got) != "kept" {
+		t.Fatalf("a put after a delete in the batch left %q, %v", got, ok)
+	}
+	for i := 0; i < 20; i++ {
+		if got, ok := e.Blob("data", fmt.Sprintf("/new/%d", i)); !ok || string(got) != fmt.Sprint(i) {
+			t.Fatalf("/new/%d is %q, %v", i, got, ok)
+		}
+	}
+}
+
+func TestEmulatedBatchAfterAsyncPut(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			time.Sleep(300 * time.Millisecond)
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithAsyncPuts(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// The container is created before the put is queued, so the slow
+	// upload is the only one in flight.
+	if err := d.EnsureContainer(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	k := ds.NewKey("/queued")
+	if err := d.Put(k, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Delete(k)
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(ds.NewKey("/")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Has(k); err != nil || ok {
+		t.Fatalf("queued put overtook the batched delete: %v, %v", ok, err)
+	}
+}
+
+func TestEmulatedHasManyCrowdedParent(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var lists, heads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("comp") == "list":
+			atomic.AddInt32(&lists, 1)
+		case r.Method == http.MethodHead:
+			atomic.AddInt32(&heads, 1)
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The keys asked about are few next to the subtree under their parent.
+	values := make(map[ds.Key][]byte)
+	for i := 0; i < listThreshold*listPerKey; i++ {
+		values[ds.NewKey(fmt.Sprintf("/crowd/deep/%d", i))] = nil
+	}
+	var keys []ds.Key
+	for i := 0; i < listThreshold; i++ {
+		k := ds.NewKey(fmt.Sprintf("/crowd/%d", i))
+		keys = append(keys, k)
+		if i%2 == 0 {
+			values[k] = nil
+		}
+	}
+	if err := d.PutMany(values); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&lists, 0)
+	atomic.StoreInt32(&heads, 0)
+	found, err := d.HasMany(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		if found[k] != (i%2 == 0) {
+			t.Fatalf("HasMany reported %s as %v", k, found[k])
+		}
+	}
+	if n := atomic.LoadInt32(&lists); n != 1 {
+		t.Fatalf("expected the listing to stop after one page, got %d", n)
+	}
+	if n := atomic.LoadInt32(&heads); n != listThreshold {
+		t.Fatalf("expected each key checked on its own, got %d requests", n)
+	}
+}
+
+func TestEmulatedHasManyQueued(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			time.Sleep(300 * time.Millisecond)
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithAsyncPuts(listThreshold))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.EnsureContainer(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []ds.Key
+	for i := 0; i < listThreshold; i++ {
+		k := ds.NewKey(fmt.Sprintf("/queued/%d", i))
+		keys = append(keys, k)
+		if err := d.Put(k, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err := d.HasMany(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if !found[k] {
+			t.Fatalf("HasMany missed queued put of %s", k)
+		}
+	}
+}
+
+func TestEmulatedPutMany(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/bad/") {
+			w.Header().Set("x-ms-error-code", "AuthorizationPermissionMismatch")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	values := make(map[ds.Key][]byte)
+	for i := 0; i < 100; i++ {
+		values[ds.NewKey(fmt.Sprintf("/good/%d", i))] = []byte{byte(i)}
+	}
+	bad := []ds.Key{ds.NewKey("/bad/a"), ds.NewKey("/bad/b")}
+	for _, k := range bad {
+		values[k] = []byte("x")
+	}
+
+	err = d.PutMany(values)
+	kerrs, ok := err.(KeyErrors)
+	if !ok || len(kerrs) != len(bad) {
+		t.Fatalf("expected errors for %v, got %v", bad, err)
+	}
+	for _, k := range bad {
+		if !isError(kerrs[k], "AuthorizationPermissionMismatch") {
+			t.Fatalf("%s failed with %v", k, kerrs[k])
+		}
+	}
+	// The failures do not stop the other puts.
+	for i := 0; i < 100; i++ {
+		if v, ok := e.Blob("data", fmt.Sprintf("/good/%d", i)); !ok || !bytes.Equal(v, []byte{byte(i)}) {
+			t.Fatalf("/good/%d not stored: %v, %v", i, v, ok)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = d.PutManyContext(ctx, map[ds.Key][]byte{ds.NewKey("/late"): nil})
+	if kerrs, ok := err.(KeyErrors); !ok || kerrs[ds.NewKey("/late")] != context.Canceled {
+		t.Fatalf("put after cancel: %v", err)
+	}
+}
+
+func TestEmulatedGetMany(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/bad/") {
+			w.Header().Set("x-ms-error-code", "AuthorizationPermissionMismatch")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var keys []ds.Key
+	for i := 0; i < 100; i++ {
+		k := ds.NewKey(fmt.Sprintf("/blocks/%d", i))
+		keys = append(keys, k)
+		if i%10 != 0 {
+			if err := d.Put(k, []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	bad := ds.NewKey("/bad/a")
+	if err := d.Put(bad, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := d.GetMany(append(keys, bad))
+	if kerrs, ok := err.(KeyErrors); !ok || len(kerrs) != 1 || !isError(kerrs[bad], "AuthorizationPermissionMismatch") {
+		t.Fatalf("expected an error for %s, got %v", bad, err)
+	}
+	// Missing keys are left out, without failing.
+	if len(values) != 90 {
+		t.Fatalf("expected 90 values, got %d", len(values))
+	}
+	for i, k := range keys {
+		v, ok := values[k]
+		if ok != (i%10 != 0) || ok && !bytes.Equal(v, []byte{byte(i)}) {
+			t.Fatalf("%s read as %v, %v", k, v, ok)
+		}
+	}
+
+	if values, err := d.GetMany(keys[1:3]); err != nil || len(values) != 2 {
+		t.Fatalf("get of stored keys: %v, %v", values, err)
+	}
+}
+
+func TestEmulatedDeleteMany(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	e.CreateContainer("locked")
+	var batches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("comp") == "batch" {
+			atomic.AddInt32(&batches, 1)
+			if strings.Contains(r.URL.Path, "/locked") {
+				w.Header().Set("x-ms-error-code", "AuthorizationPermissionMismatch")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL),
+		WithRoutes(Route{Prefix: ds.NewKey("/locked"), Container: "locked"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var keys []ds.Key
+	for i := 0; i < maxBatchDeletes+10; i++ {
+		k := ds.NewKey(fmt.Sprintf("/gc/%d", i))
+		keys = append(keys, k)
+		if err := d.Put(k, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locked := ds.NewKey("/locked/a")
+	if err := d.Put(locked, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, ds.NewKey("/never-written"), locked)
+
+	err = d.DeleteMany(keys)
+	kerrs, ok := err.(KeyErrors)
+	if !ok || len(kerrs) != 1 || kerrs[locked] == nil {
+		t.Fatalf("expected an error for %s, got %v", locked, err)
+	}
+	// Two requests for the data container, one for the locked one.
+	if n := atomic.LoadInt32(&batches); n != 3 {
+		t.Fatalf("%d batch requests", n)
+	}
+	for i := 0; i < maxBatchDeletes+10; i++ {
+		if _, ok := e.Blob("data", fmt.Sprintf("/gc/%d", i)); ok {
+			t.Fatalf("/gc/%d not deleted", i)
+		}
+	}
+	if _, ok := e.Blob("locked", "/locked/a"); !ok {
+		t.Fatal("key whose request failed deleted")
+	}
+}
+
+func TestEmulatedDiskUsage(t *testing.T) {
+	exact, _ := newEmulated(t, WithDiskUsage(DiskUsageExact, 0), WithListPageSize(2))
+	for i := 0; i < 5; i++ {
+		exact.Put(ds.NewKey(fmt.Sprint(i)), make([]byte, 100))
+	}
+	if n, err := exact.DiskUsage(); err != nil || n != 500 {
+		t.Fatalf("exact usage %d, %v", n, err)
+	}
+
+	approx, _ := newEmulated(t, WithDiskUsage(DiskUsageApproximate, time.Hour))
+	approx.Put(ds.NewKey("/a"), make([]byte, 100))
+	if n, _ := approx.DiskUsage(); n != 0 {
+		t.Fatalf("approximate usage %d before the first listing", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if n, _ := approx.DiskUsage(); n == 100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("approximate usage never measured")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Within the max age the last total is reported.
+	approx.Put(ds.NewKey("/b"), make([]byte, 100))
+	if n, _ := approx.DiskUsage(); n != 100 {
+		t.Fatalf("approximate usage refreshed early: %d", n)
+	}
+}
+
+func TestEmulatedGetReader(t *testing.T) {
+	d, _ := newEmulated(t, WithUploadThresholds(1024, 256))
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := d.PutReader(ds.NewKey("/big"), bytes.NewReader(big), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := d.GetReader(ds.NewKey("/big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("streamed %d bytes, %v", len(got), err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.GetReader(ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Fatalf("missing key: %v", err)
+	}
+
+	// Close does not wait for readers left open.
+	r, err = d.GetReader(ds.NewKey("/big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetReader(ds.NewKey("/big")); err != ErrClosed {
+		t.Fatalf("GetReader after Close: %v", err)
+	}
+}
+
+func TestEmulatedTTL(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1000, 0))
+	d, _ := newEmulated(t, WithClock(clk), WithUploadThresholds(1024, 256))
+	short, long, plain := ds.NewKey("/short"), ds.NewKey("/long"), ds.NewKey("/plain")
+	if err := d.PutWithTTL(short, []byte("s"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// Staged uploads carry the expiry too.
+	if err := d.PutWithTTL(long, bytes.Repeat([]byte("l"), 2000), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	d.Put(plain, []byte("p"))
+
+	if exp, err := d.GetExpiration(short); err != nil || !exp.Equal(time.Unix(1060, 0)) {
+		t.Fatalf("expiration %v, %v", exp, err)
+	}
+	if exp, err := d.GetExpiration(plain); err != nil || !exp.IsZero() {
+		t.Fatalf("expiration without a TTL %v, %v", exp, err)
+	}
+
+	clk.Advance(2 * time.Minute)
+	if _, err := d.Get(short); err != ds.ErrNotFound {
+		t.Fatalf("expired get: %v", err)
+	}
+	if has, _ := d.Has(short); has {
+		t.Fatal("expired key reported present")
+	}
+	if _, err := d.GetSize(short); err != ds.ErrNotFound {
+		t.Fatalf("expired size: %v", err)
+	}
+	if err := d.SetTTL(short, time.Hour); err != ds.ErrNotFound {
+		t.Fatalf("SetTTL on an expired key: %v", err)
+	}
+	res, err := d.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := res.Rest()
+	if len(entries) != 2 {
+		t.Fatalf("query returned %v", entries)
+	}
+	if v, err := d.Get(long); err != nil || len(v) != 2000 {
+		t.Fatalf("unexpired get: %d bytes, %v", len(v), err)
+	}
+
+	// SetTTL extends a live key, and a plain Put clears its TTL.
+	if err := d.SetTTL(long, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(90 * time.Minute)
+	if has, _ := d.Has(long); !has {
+		t.Fatal("SetTTL did not extend the key")
+	}
+	d.Put(short, []byte("again"))
+	clk.Advance(24 * time.Hour)
+	if v, err := d.Get(short); err != nil || string(v) != "again" {
+		t.Fatalf("rewritten key: %q, %v", v, err)
+	}
+	if n, err := d.IncrementBy(long, 1); err != nil || n != 1 {
+		t.Fatalf("counter over an expired key: %d, %v", n, err)
+	}
+}
+
+func TestEmulatedSetTTLContention(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var sets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Query().Get("comp") == "metadata" {
+			atomic.AddInt32(&sets, 1)
+			w.Header().Set("x-ms-error-code", "ConditionNotMet")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	k := ds.NewKey("/k")
+	if err := d.Put(k, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	// The blob changes underneath every attempt.
+	if err := d.SetTTL(k, time.Hour); err != ErrContention {
+		t.Fatalf("SetTTL got %v, want ErrContention", err)
+	}
+	if n := atomic.LoadInt32(&sets); n != counterRetries {
+		t.Fatalf("set metadata %d times, want %d", n, counterRetries)
+	}
+}
+
+func TestEmulatedTxn(t *testing.T) {
+	d, _ := newEmulated(t)
+	a, b, c := ds.NewKey("/a"), ds.NewKey("/b"), ds.NewKey("/c")
+	d.Put(a, []byte("1"))
+	d.Put(b, []byte("2"))
+
+	// A read-modify-write commits when nothing changed underneath it.
+	tx, _ := d.NewTransaction(false)
+	v, err := tx.Get(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Put(a, append(v, '+'))
+	tx.Delete(b)
+	if v, _ := tx.Get(a); string(v) != "1+" {
+		t.Fatalf("transaction does not see its own write: %q", v)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := d.Get(a); string(v) != "1+" {
+		t.Fatalf("committed %q", v)
+	}
+	if has, _ := d.Has(b); has {
+		t.Fatal("delete not committed")
+	}
+
+	// A change to a key read, even one only read, fails the commit and
+	// writes nothing.
+	tx, _ = d.NewTransaction(false)
+	tx.Get(a)
+	if has, _ := tx.Has(c); has {
+		t.Fatal("absent key reported present")
+	}
+	tx.Put(b, []byte("from txn"))
+	d.Put(c, []byte("other writer"))
+	if err := tx.Commit(); err != ErrConflict {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if has, _ := d.Has(b); has {
+		t.Fatal("conflicting transaction wrote")
+	}
+
+	tx, _ = d.NewTransaction(false)
+	tx.Get(a)
+	tx.Put(a, []byte("lost update"))
+	d.Put(a, []byte("concurrent"))
+	if err := tx.Commit(); err != ErrConflict {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if v, _ := d.Get(a); string(v) != "concurrent" {
+		t.Fatalf("concurrent write overwritten: %q", v)
+	}
+
+	ro, _ := d.NewTransaction(true)
+	if err := ro.Put(a, nil); err == nil {
+		t.Fatal("read-only transaction accepted a write")
+	}
+}
+
+func TestEmulatedRetry(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var mu sync.Mutex
+	failures := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := failures > 0
+		if fail {
+			failures--
+		}
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	failNext := func(n int) {
+		mu.Lock()
+		failures = n
+		mu.Unlock()
+	}
+
+	retry := azblob.RetryOptions{MaxTries: 3, RetryDelay: time.Millisecond, MaxRetryDelay: time.Millisecond}
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithRetryOptions(retry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	failNext(2)
+	if err := d.Put(ds.NewKey("/a"), []byte("1")); err != nil {
+		t.Fatalf("put not retried: %v", err)
+	}
+	failNext(3)
+	if _, err := d.Get(ds.NewKey("/a")); err == nil {
+		t.Fatal("get succeeded after exhausting its tries")
+	}
+}
+
+func TestEmulatedRequestOptions(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var mu sync.Mutex
+	var last *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		last = r
+		mu.Unlock()
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	lastRequest := func() *http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+
+	d, err := NewDatastoreWithKey("devstore", "a2V5", "data", WithEndpoint(srv.URL),
+		WithAccessTier(azblob.AccessTierCool), WithTelemetry("ipfs-test/1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Put(ds.NewKey("/a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	r := lastRequest()
+	if tier := r.Header.Get("x-ms-access-tier"); tier != "Cool" {
+		t.Errorf("uploaded to tier %q", tier)
+	}
+	if ua := r.Header.Get("User-Agent"); !strings.HasPrefix(ua, "ipfs-test/1.0 ") {
+		t.Errorf("user agent %q", ua)
+	}
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "SharedKey devstore:") {
+		t.Errorf("authorization %q", auth)
+	}
+
+	// Without a credential option requests are anonymous.
+	anon, err := NewDatastore("devstore", "data", WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+	if _, err := anon.Get(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if auth := lastRequest().Header.Get("Authorization"); auth != "" {
+		t.Errorf("anonymous request authorized with %q", auth)
+	}
+}
+
+func TestEmulatedLegacyNames(t *testing.T) {
+	d, e := newEmulated(t)
+	ctx := context.Background()
+	if err := d.EnsureContainer(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Blobs written before escaping, named by their keys as is.
+	upload := func(name, value string) {
+		t.Helper()
+		_, err := d.containerUrl.NewBlockBlobURL(name).Upload(ctx, strings.NewReader(value), azblob.BlobHTTPHeaders{},
+			azblob.Metadata{}, azblob.BlobAccessConditions{}, azblob.AccessTierNone, nil, d.config.cpk)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload("/legacy/a%41", "a")
+	upload("/legacy/50%off", "b")
+
+	keys := func() []string {
+		t.Helper()
+		res, err := d.Query(query.Query{Prefix: "/legacy", KeysOnly: true, Orders: []query.Order{query.OrderByKey{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Key)
+		}
+		return got
+	}
+	// They are listed under their keys, but not read by them.
+	if got := fmt.Sprint(keys()); got != "[/legacy/50%off /legacy/a%41]" {
+		t.Fatalf("legacy blobs listed as %s", got)
+	}
+	if _, err := d.Get(ds.RawKey("/legacy/a%41")); err != ds.ErrNotFound {
+		t.Fatalf("legacy blob read before migrating: %v", err)
+	}
+
+	// A key written again since keeps its new value.
+	upload("/legacy/new%41", "old")
+	if err := d.Put(ds.RawKey("/legacy/new%41"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := d.MigrateLegacyNames(ctx); err != nil || n != 3 {
+		t.Fatalf("migrated %d blobs: %v", n, err)
+	}
+	for k, want := range map[string]string{"/legacy/a%41": "a", "/legacy/50%off": "b", "/legacy/new%41": "new"} {
+		if v, err := d.Get(ds.RawKey(k)); err != nil || string(v) != want {
+			t.Fatalf("%s after migrating: %q, %v", k, v, err)
+		}
+		if _, ok := e.Blob("data", k); ok {
+			t.Fatalf("legacy blob %s not deleted", k)
+		}
+	}
+	if got := fmt.Sprint(keys()); got != "[/legacy/50%off /legacy/a%41 /legacy/new%41]" {
+		t.Fatalf("migrated blobs listed as %s", got)
+	}
+	if n, err := d.MigrateLegacyNames(ctx); err != nil || n != 0 {
+		t.Fatalf("migrated %d blobs again: %v", n, err)
+	}
+}
+
+func TestEmulatedEscaping(t *testing.T) {
+	d, _ := newEmulated(t)
+	keys := []ds.Key{
+		ds.RawKey("/esc/100%"),
+		ds.RawKey(`/esc/a\b`),
+		ds.RawKey("/esc/ctl\x01\n"),
+		ds.RawKey("/esc/dot./x."),
+		ds.RawKey("/esc/bad\xff"),
+		ds.RawKey("/esc" + strings.Repeat("/d", 300)),
+	}
+	for i, k := range keys {
+		if err := d.Put(k, []byte{byte(i)}); err != nil {
+			t.Fatalf("put %q: %v", k, err)
+		}
+	}
+	for i, k := range keys {
+		v, err := d.Get(k)
+		if err != nil || !bytes.Equal(v, []byte{byte(i)}) {
+			t.Fatalf("get %q: %v, %v", k, v, err)
+		}
+	}
+	res, err := d.Query(query.Query{Prefix: "/esc", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, e := range entries {
+		got[e.Key] = true
+	}
+	for _, k := range keys {
+		if !got[k.String()] {
+			t.Errorf("query did not list %q", k)
+		}
+	}
+	if len(entries) != len(keys) {
+		t.Errorf("query listed %d keys, want %d", len(entries), len(keys))
+	}
+
+	res, err = d.Query(query.Query{Prefix: "/esc/dot.", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := res.Rest(); err != nil || len(entries) != 1 {
+		t.Errorf("prefix /esc/dot. listed %d keys, %v", len(entries), err)
+	}
+}
+
+func TestEmulatedSharding(t *testing.T) {
+	srv, e := azuretest.NewServer()
+	defer srv.Close()
+	open := func(opts ...Option) *Datastore {
+		d, err := NewDatastore("devstore", "data", append(opts, WithSharedKey("a2V5"), WithEndpoint(srv.URL))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	nextToLast, _ := flatfs.NextToLast(2)
+	prefix, _ := flatfs.Prefix(2)
+	d := open(WithSharding(nextToLast))
+	dstest.SubtestAll(t, d)
+
+	keys := []ds.Key{ds.NewKey("/blocks/CIQAB"), ds.NewKey("/blocks/CIQCD"), ds.NewKey("/other/x")}
+	for _, k := range keys {
+		if err := d.Put(k, []byte(k.String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := e.Blob("data", "/QA/blocks/CIQAB"); !ok {
+		t.Fatal("key not stored under its shard")
+	}
+	res, err := d.Query(query.Query{Prefix: "/blocks", Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "/blocks/CIQAB" || entries[1].Key != "/blocks/CIQCD" {
+		t.Fatalf("query listed %v", entries)
+	}
+	if n, err := d.Fork(context.Background(), ds.NewKey("/blocks"), ds.NewKey("/copy"), ForkOptions{}); err != nil || n != 2 {
+		t.Fatalf("fork: %d, %v", n, err)
+	}
+	if v, err := d.Get(ds.NewKey("/copy/CIQCD")); err != nil || string(v) != "/blocks/CIQCD" {
+		t.Fatalf("forked value %q, %v", v, err)
+	}
+
+	if err := open(WithSharding(nextToLast)).EnsureContainer(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := open(WithSharding(prefix)).Put(ds.NewKey("/a"), nil); err != ErrShardingMismatch {
+		t.Fatalf("put with another shard function: %v", err)
+	}
+}
+
+func TestEmulatedAsyncPuts(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/bad/") {
+			w.Header().Set("x-ms-error-code", "AuthorizationPermissionMismatch")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithAsyncPuts(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		k := ds.NewKey(fmt.Sprintf("/good/%d", i))
+		if err := d.Put(k, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		// Queued values are read back at once.
+		if v, err := d.Get(k); err != nil || !bytes.Equal(v, []byte{byte(i)}) {
+			t.Fatalf("get %s: %v, %v", k, v, err)
+		}
+	}
+	if err := d.Put(ds.NewKey("/bad/x"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(ds.NewKey("/good")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if _, ok := e.Blob("data", fmt.Sprintf("/good/%d", i)); !ok {
+			t.Fatalf("/good/%d not uploaded by Sync", i)
+		}
+	}
+	if err := d.Sync(ds.NewKey("/bad")); err == nil {
+		t.Fatal("failed put not reported")
+	}
+	if err := d.Sync(ds.NewKey("/bad")); err != nil {
+		t.Fatalf("failed put reported twice: %v", err)
+	}
+
+	// Delete is not overtaken by the put it follows.
+	k := ds.NewKey("/good/0")
+	if err := d.Put(k, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(ds.NewKey("/")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Has(k); err != nil || ok {
+		t.Fatalf("deleted key present: %v, %v", ok, err)
+	}
+
+	// Close uploads what is still queued.
+	if err := d.Put(ds.NewKey("/last"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Blob("data", "/last"); !ok {
+		t.Fatal("queued put not uploaded by Close")
+	}
+	if err := d.Put(ds.NewKey("/late"), nil); err != ErrClosed {
+		t.Fatalf("put after close: %v", err)
+	}
+}
+
+func TestEmulatedWriteAheadLog(t *testing.T) {
+	if _, err := NewDatastore("devstore", "data", WithWriteAheadLog("log")); err != errWALWithoutAsync {
+		t.Fatalf("log without async puts: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "wal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "log")
+
+	// The first process never gets its puts through before it dies.
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(stuck.Close)
+	t.Cleanup(func() { close(release) })
+	crashed, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(stuck.URL),
+		WithAsyncPuts(8), WithWriteAheadLog(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := crashed.Put(ds.NewKey(fmt.Sprintf("/k/%d", i)), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crashed.Put(ds.NewKey("/k/0"), []byte("latest"))
+
+	// The next one queues them again before serving reads.
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL),
+		WithAsyncPuts(2), WithWriteAheadLog(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(ds.NewKey("/k/0")); err != nil || string(v) != "latest" {
+		t.Fatalf("replayed put not read back: %q, %v", v, err)
+	}
+	if err := d.Sync(ds.NewKey("/")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 5; i++ {
+		if v, ok := e.Blob("data", fmt.Sprintf("/k/%d", i)); !ok || !bytes.Equal(v, []byte{byte(i)}) {
+			t.Fatalf("/k/%d not uploaded after replay: %v, %v", i, v, ok)
+		}
+	}
+	if v, _ := e.Blob("data", "/k/0"); string(v) != "latest" {
+		t.Fatalf("/k/0 uploaded as %q", v)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Fatalf("log not truncated once uploaded: %v, %v", fi, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A put after Close is refused before it is logged.
+	if err := d.Put(ds.NewKey("/late"), []byte("v")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+	if pending, err := readWAL(path); err != nil || len(pending) != 0 {
+		t.Fatalf("put after Close was logged: %v, %v", pending, err)
+	}
+}
+
+func TestEmulatedWriteAheadLogClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "log")
+
+	// The put of /cancelled hangs until Close gives up on it; the others
+	// go through.
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	hang := int32(1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/cancelled") && atomic.LoadInt32(&hang) == 1 {
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		e.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	open := func() *Datastore {
+		d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL),
+			WithAsyncPuts(2), WithWriteAheadLog(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	d := open()
+	d.config.closeTimeout = 200 * time.Millisecond
+	if err := d.EnsureContainer(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/cancelled"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/fast"), []byte("f")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(ds.NewKey("/fast")); err != nil {
+		t.Fatal(err)
+	}
+	var uerr *UnpersistedError
+	if err := d.Close(); !errors.As(err, &uerr) {
+		t.Fatalf("expected the hanging put to be cancelled, got %v", err)
+	}
+
+	// Only the cancelled put is left to replay, and it is.
+	pending, err := readWAL(path)
+	if err != nil || len(pending) != 1 || pending[0].key.String() != "/cancelled" {
+		t.Fatalf("log holds %v, %v", pending, err)
+	}
+	atomic.StoreInt32(&hang, 0)
+	d = open()
+	defer d.Close()
+	if err := d.Sync(ds.NewKey("/")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := e.Blob("data", "/cancelled"); string(v) != "c" {
+		t.Fatalf("cancelled put replayed as %q", v)
+	}
+}
+
+func TestEmulatedChunkedDownload(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var mu sync.Mutex
+	var ranges []string
+	var onRange func(string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("x-ms-range"); r.Method == http.MethodGet && rng != "" {
+			mu.Lock()
+			ranges = append(ranges, rng)
+			hook := onRange
+			mu.Unlock()
+			if hook != nil {
+				hook(rng)
+			}
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	requests := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := len(ranges)
+		ranges = nil
+		return n
+	}
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithDownloadChunkSize(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, c := range []struct{ size, requests int }{{0, 1}, {999, 1}, {1000, 1}, {1001, 2}, {10500, 11}} {
+		k := ds.NewKey(fmt.Sprintf("/v%d", c.size))
+		value := bytes.Repeat([]byte("0123456789abcdefg"), c.size/17+1)[:c.size]
+		if err := d.Put(k, value); err != nil {
+			t.Fatal(err)
+		}
+		requests()
+		got, err := d.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Fatalf("%d byte value corrupted", c.size)
+		}
+		if n := requests(); n != c.requests {
+			t.Errorf("%d byte value took %d ranged requests, want %d", c.size, n, c.requests)
+		}
+	}
+
+	// A value replaced mid-download is downloaded again, not mixed.
+	k := ds.NewKey("/changing")
+	old, replacement := bytes.Repeat([]byte("a"), 5000), bytes.Repeat([]byte("b"), 5000)
+	if err := d.Put(k, old); err != nil {
+		t.Fatal(err)
+	}
+	var once sync.Once
+	mu.Lock()
+	onRange = func(rng string) {
+		if !strings.HasPrefix(rng, "bytes=0-") {
+			once.Do(func() {
+				if err := d.Put(k, replacement); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+	mu.Unlock()
+	got, err := d.Get(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, replacement) {
+		t.Fatal("value replaced mid-download was mixed or stale")
+	}
+}
+
+func TestEmulatedArchive(t *testing.T) {
+	srv, e := azuretest.NewServer()
+	defer srv.Close()
+	open := func(opts ...Option) *Datastore {
+		d, err := NewDatastore("devstore", "data", append(opts, WithSharedKey("a2V5"), WithEndpoint(srv.URL))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	k := ds.NewKey("/cold")
+	if err := open(WithAccessTier(azblob.AccessTierArchive)).Put(k, []byte("frozen")); err != nil {
+		t.Fatal(err)
+	}
+
+	var archived *ArchivedError
+	d := open()
+	if _, err := d.Get(k); !errors.Is(err, ErrArchived) || !errors.As(err, &archived) || archived.Rehydrating {
+		t.Fatalf("get of archived value: %v", err)
+	}
+	if _, err := d.GetReader(k); !errors.Is(err, ErrArchived) {
+		t.Fatalf("reader of archived value: %v", err)
+	}
+	if ok, err := d.Has(k); err != nil || !ok {
+		t.Fatalf("has: %v, %v", ok, err)
+	}
+
+	rehydrate := open(WithRehydration(RehydrateOptions{Tier: azblob.AccessTierHot}))
+	if _, err := rehydrate.Get(k); !errors.As(err, &archived) || !archived.Rehydrating {
+		t.Fatalf("get starting rehydration: %v", err)
+	}
+	if _, err := d.Get(k); !errors.As(err, &archived) || !archived.Rehydrating {
+		t.Fatalf("get during rehydration: %v", err)
+	}
+
+	slow := open(WithRehydration(RehydrateOptions{Tier: azblob.AccessTierHot, Wait: true, PollInterval: time.Hour}))
+	// A cancel rather than a deadline: azblob cuts short tries of
+	// requests with less than a second left.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := slow.GetContext(ctx, k); err != context.Canceled {
+		t.Fatalf("waiting get outlived its context: %v", err)
+	}
+
+	wait := open(WithRehydration(RehydrateOptions{Tier: azblob.AccessTierHot, Wait: true, PollInterval: time.Millisecond}))
+	got := make(chan error, 1)
+	go func() {
+		v, err := wait.Get(k)
+		if err == nil && string(v) != "frozen" {
+			err = fmt.Errorf("got %q", v)
+		}
+		got <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if !e.Rehydrate("data", "/cold") {
+		t.Fatal("no rehydration pending")
+	}
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(k); err != nil || string(v) != "frozen" {
+		t.Fatalf("get after rehydration: %q, %v", v, err)
+	}
+}
+
+func TestEmulatedPutIfAbsent(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1000, 0))
+	d, _ := newEmulated(t, WithClock(clk), WithUploadThresholds(1024, 256))
+
+	k := ds.NewKey("/immutable")
+	if ok, err := d.PutIfAbsent(k, []byte("first")); err != nil || !ok {
+		t.Fatalf("first put: %v, %v", ok, err)
+	}
+	if ok, err := d.PutIfAbsent(k, []byte("second")); err != nil || ok {
+		t.Fatalf("second put: %v, %v", ok, err)
+	}
+	if v, _ := d.Get(k); string(v) != "first" {
+		t.Fatalf("value replaced by %q", v)
+	}
+
+	// Staged uploads are conditioned too.
+	large := ds.NewKey("/large")
+	for i, want := range []bool{true, false} {
+		if ok, err := d.PutIfAbsent(large, bytes.Repeat([]byte{byte(i)}, 2000)); err != nil || ok != want {
+			t.Fatalf("large put %d: %v, %v", i, ok, err)
+		}
+	}
+	if v, _ := d.Get(large); v[0] != 0 {
+		t.Fatal("large value replaced")
+	}
+
+	// An expired value is absent.
+	short := ds.NewKey("/short")
+	if err := d.PutWithTTL(short, []byte("old"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(2 * time.Minute)
+	if ok, err := d.PutIfAbsent(short, []byte("new")); err != nil || !ok {
+		t.Fatalf("put over expired value: %v, %v", ok, err)
+	}
+	if v, err := d.Get(short); err != nil || string(v) != "new" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	// Of concurrent writers exactly one succeeds.
+	race := ds.NewKey("/race")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := d.PutIfAbsent(race, []byte{byte(i)})
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Fatalf("%d writers succeeded", winners)
+	}
+}
+
+func TestEmulatedCompareAndSwap(t *testing.T) {
+	d, _ := newEmulated(t)
+	k := ds.NewKey("/head")
+	if err := d.EnsureContainer(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, none, err := d.GetWithETag(k)
+	if err != ds.ErrNotFound {
+		t.Fatalf("get of absent key: %v", err)
+	}
+	if err := d.PutIfMatch(k, []byte("0"), none); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutIfMatch(k, []byte("x"), none); err != ErrETagMismatch {
+		t.Fatalf("put expecting no value: %v", err)
+	}
+	v, first, err := d.GetWithETag(k)
+	if err != nil || string(v) != "0" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if err := d.PutIfMatch(k, []byte("1"), first); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutIfMatch(k, []byte("x"), first); err != ErrETagMismatch {
+		t.Fatalf("put with a stale ETag: %v", err)
+	}
+	if err := d.DeleteIfMatch(k, first); err != ErrETagMismatch {
+		t.Fatalf("delete with a stale ETag: %v", err)
+	}
+
+	// Concurrent read-modify-write loops lose no updates.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				for {
+					v, etag, err := d.GetWithETag(k)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					n, _ := strconv.Atoi(string(v))
+					err = d.PutIfMatch(k, []byte(strconv.Itoa(n+1)), etag)
+					if err == nil {
+						break
+					}
+					if err != ErrETagMismatch {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	v, last, err := d.GetWithETag(k)
+	if err != nil || string(v) != "41" {
+		t.Fatalf("counter at %q, %v", v, err)
+	}
+	if err := d.DeleteIfMatch(k, last); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(k); has {
+		t.Fatal("deleted key present")
+	}
+}
+
+func TestEmulatedMetadata(t *testing.T) {
+	d, _ := newEmulated(t)
+	k := ds.NewKey("/tagged")
+	if err := d.EnsureContainer(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, meta := range []map[string]string{
+		{"1st": "x"},
+		{"has-dash": "x"},
+		{"dsexpires": "0"},
+		{"DSMine": "x"},
+		{"note": "line\nbreak"},
+		{"Same": "a", "same": "b"},
+	} {
+		if err := d.PutWithMetadata(k, []byte("v"), meta); err == nil {
+			t.Errorf("put with metadata %v succeeded", meta)
+		}
+	}
+
+	if err := d.PutWithMetadata(k, []byte("v"), map[string]string{"Owner": "alice", "n_2": "7"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTTL(k, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := d.GetMetadata(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta) != 2 || meta["owner"] != "alice" || meta["n_2"] != "7" {
+		t.Fatalf("got metadata %v", meta)
+	}
+
+	if err := d.Put(ds.NewKey("/plain"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.QueryWithMetadata(context.Background(), query.Query{KeysOnly: true, Orders: []query.Order{query.OrderByKeyDescending{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("listed %d entries", len(entries))
+	}
+	for _, e := range entries {
+		switch e.Key {
+		case "/tagged":
+			if len(e.Metadata) != 2 || e.Metadata["owner"] != "alice" {
+				t.Errorf("listed metadata %v", e.Metadata)
+			}
+		case "/plain":
+			if e.Metadata != nil {
+				t.Errorf("listed metadata %v for a plain put", e.Metadata)
+			}
+		}
+	}
+
+	// A plain put replaces the metadata with the value.
+	if err := d.Put(k, []byte("w")); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := d.GetMetadata(k); err != nil || meta != nil {
+		t.Fatalf("metadata after put: %v, %v", meta, err)
+	}
+	if _, err := d.GetMetadata(ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Fatalf("metadata of a missing key: %v", err)
+	}
+}
+
+func TestEmulatedIntegrity(t *testing.T) {
+	d, e := newEmulated(t, WithUploadThresholds(1024, 256), WithDownloadChunkSize(1000))
+	for _, size := range []int{10, 5000} {
+		k := ds.NewKey(fmt.Sprintf("/v%d", size))
+		value := bytes.Repeat([]byte("x"), size)
+		if err := d.Put(k, value); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := d.Get(k); err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("get of %d bytes: %v", size, err)
+		}
+		if !e.Corrupt("data", k.String()) {
+			t.Fatal("nothing to corrupt")
+		}
+		_, err := d.Get(k)
+		var corrupt *CorruptError
+		if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) || corrupt.Key != k {
+			t.Fatalf("get of corrupt %d bytes: %v", size, err)
+		}
+		r, err := d.GetReader(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(r)
+		r.Close()
+		if !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("read of corrupt %d bytes: %v", size, err)
+		}
+	}
+
+	unchecked, e := newEmulated(t, WithMD5Verification(false))
+	k := ds.NewKey("/unchecked")
+	if err := unchecked.Put(k, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	e.Corrupt("data", k.String())
+	if got, err := unchecked.Get(k); err != nil || string(got) == "value" {
+		t.Fatalf("unchecked get of corrupt value: %q, %v", got, err)
+	}
+}
+
+func TestEmulatedCustomerProvidedKey(t *testing.T) {
+	srv, _ := azuretest.NewServer()
+	defer srv.Close()
+	open := func(opts ...Option) *Datastore {
+		d, err := NewDatastore("devstore", "data", append(opts, WithSharedKey("a2V5"), WithEndpoint(srv.URL))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	key := bytes.Repeat([]byte{7}, 32)
+	d := open(WithCustomerProvidedKey(key), WithUploadThresholds(1024, 256))
+	if err := d.EnsureContainer(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	small, large := ds.NewKey("/small"), ds.NewKey("/large")
+	if err := d.PutWithMetadata(small, []byte("v"), map[string]string{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(large, bytes.Repeat([]byte("x"), 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTTL(small, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for k, size := range map[ds.Key]int{small: 1, large: 5000} {
+		if v, err := d.Get(k); err != nil || len(v) != size {
+			t.Fatalf("get %s: %d bytes, %v", k, len(v), err)
+		}
+		if n, err := d.GetSize(k); err != nil || n != size {
+			t.Fatalf("size of %s: %d, %v", k, n, err)
+		}
+	}
+	if meta, err := d.GetMetadata(small); err != nil || meta["a"] != "b" {
+		t.Fatalf("metadata: %v, %v", meta, err)
+	}
+	if _, err := d.Fork(context.Background(), ds.NewKey("/"), ds.NewKey("/copy"), ForkOptions{}); err == nil {
+		t.Fatal("fork of values under a customer-provided key succeeded")
+	}
+
+	// Without the key, or with another, values cannot be read.
+	for _, other := range []*Datastore{open(), open(WithCustomerProvidedKey(bytes.Repeat([]byte{8}, 32)))} {
+		if _, err := other.Get(small); err == nil || err == ds.ErrNotFound {
+			t.Fatalf("get without the key: %v", err)
+		}
+	}
+
+	scoped := open(WithEncryptionScope("scope"))
+	if err := scoped.Put(ds.NewKey("/scoped"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := open().Get(ds.NewKey("/scoped")); err != nil || string(v) != "v" {
+		t.Fatalf("get of a scoped value: %q, %v", v, err)
+	}
+}
+
+func TestEmulatedCompression(t *testing.T) {
+	for _, c := range []Compression{Gzip, Zstd} {
+		t.Run(string(c), func(t *testing.T) {
+			srv, e := azuretest.NewServer()
+			defer srv.Close()
+			open := func(opts ...Option) *Datastore {
+				d, err := NewDatastore("devstore", "data", append(opts, WithSharedKey("a2V5"), WithEndpoint(srv.URL),
+					WithUploadThresholds(1024, 256), WithDownloadChunkSize(300))...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { d.Close() })
+				return d
+			}
+			d := open(WithCompression(c))
+			values := map[ds.Key][]byte{
+				ds.NewKey("/small"): bytes.Repeat([]byte(`{"node":"a","edges":[]}`), 20),
+				ds.NewKey("/large"): bytes.Repeat([]byte(`{"node":"b","edges":["c","d"]}`), 1000),
+				ds.NewKey("/tiny"):  []byte("x"),
+			}
+			for k, v := range values {
+				if err := d.Put(k, v); err != nil {
+					t.Fatal(err)
+				}
+				stored, _ := e.Blob("data", k.String())
+				if compressed := len(stored) < len(v); compressed != (len(v) > 1) {
+					t.Fatalf("%s: stored %d bytes for %d", k, len(stored), len(v))
+				}
+			}
+
+			// Values read back whole whatever the reader's compression.
+			for _, r := range []*Datastore{d, open()} {
+				for k, v := range values {
+					if got, err := r.Get(k); err != nil || !bytes.Equal(got, v) {
+						t.Fatalf("get %s: %d bytes, %v", k, len(got), err)
+					}
+					if n, err := r.GetSize(k); err != nil || n != len(v) {
+						t.Fatalf("size of %s: %d, %v", k, n, err)
+					}
+					rd, err := r.GetReader(k)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, err := ioutil.ReadAll(rd)
+					rd.Close()
+					if err != nil || !bytes.Equal(got, v) {
+						t.Fatalf("read %s: %d bytes, %v", k, len(got), err)
+					}
+					if got, _, err := r.GetWithETag(k); err != nil || !bytes.Equal(got, v) {
+						t.Fatalf("get %s with ETag: %d bytes, %v", k, len(got), err)
+					}
+				}
+				res, err := r.Query(query.Query{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries, err := res.Rest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, en := range entries {
+					v := values[ds.NewKey(en.Key)]
+					if en.Size != len(v) || !bytes.Equal(en.Value, v) {
+						t.Fatalf("query entry %s: size %d, %d bytes", en.Key, en.Size, len(en.Value))
+					}
+				}
+			}
+		})
+	}
+}
+
+// recordedSpan is a span recorded by recordingTracer.
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *recordedSpan) RecordError(err error)                      { s.err = err }
+func (s *recordedSpan) End()                                       { s.ended = true }
+
+type spanKey struct{}
+
+// recordingTracer records the spans it starts, and the tracer name asked for.
+type recordingTracer struct {
+	mu    sync.Mutex
+	name  string
+	spans []*recordedSpan
+}
+
+func (r *recordingTracer) Tracer(name string) Tracer {
+	r.name = name
+	return r
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	s := &recordedSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// take returns the spans recorded so far and forgets them.
+func (r *recordingTracer) take() []*recordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := r.spans
+	r.spans = nil
+	return spans
+}
+
+func TestEmulatedTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	d, _ := newEmulated(t, WithTracerProvider(tracer))
+	if tracer.name != tracerName {
+		t.Fatalf("tracer %q", tracer.name)
+	}
+	k := ds.NewKey("/photos/a")
+
+	// op runs f and returns the operation's span and the others recorded,
+	// checking that each request it made has a span under it.
+	op := func(name string, f func() error) (*recordedSpan, []*recordedSpan) {
+		t.Helper()
+		err := f()
+		var root *recordedSpan
+		requests := 0
+		spans := tracer.take()
+		for _, s := range spans {
+			if !s.ended {
+				t.Fatalf("%s: span %s not ended", name, s.name)
+			}
+			if s.name == name {
+				root = s
+				continue
+			}
+			if strings.HasPrefix(s.name, "azure ") {
+				requests++
+				if s.parent == nil || s.attrs["http.status_code"] == nil {
+					t.Fatalf("%s: request span %s: %v", name, s.name, s.attrs)
+				}
+				if _, ok := s.attrs["az.request_id"]; !ok {
+					t.Fatalf("%s: request span without a request id", name)
+				}
+				if u := s.attrs["http.url"].(string); strings.Contains(u, "?") {
+					t.Fatalf("%s: request URL %s has a query", name, u)
+				}
+			}
+		}
+		if root == nil || requests == 0 {
+			t.Fatalf("%s: span %v with %d requests", name, root, requests)
+		}
+		if root.attrs["ds.key.prefix"] != "/photos" {
+			t.Fatalf("%s: prefix %v", name, root.attrs["ds.key.prefix"])
+		}
+		if err != nil && err != ds.ErrNotFound {
+			t.Fatal(err)
+		}
+		return root, spans
+	}
+
+	put, _ := op("azure.Put", func() error { return d.Put(k, []byte("value")) })
+	if put.attrs["ds.value.size"] != 5 || put.err != nil {
+		t.Fatalf("put span %v, %v", put.attrs, put.err)
+	}
+	get, _ := op("azure.Get", func() error { _, err := d.Get(k); return err })
+	if get.attrs["ds.value.size"] != 5 {
+		t.Fatalf("get span %v", get.attrs)
+	}
+	_, spans := op("azure.Query", func() error {
+		res, err := d.Query(query.Query{Prefix: "/photos"})
+		if err != nil {
+			return err
+		}
+		_, err = res.Rest()
+		return err
+	})
+	listed := 0
+	for _, s := range spans {
+		if s.name == "azure.ListBlobs" {
+			listed += s.attrs["az.blob.count"].(int)
+		}
+	}
+	if listed != 1 {
+		t.Fatalf("listing spans counted %d blobs", listed)
+	}
+	op("azure.Delete", func() error { return d.Delete(k) })
+	missing, _ := op("azure.Get", func() error { _, err := d.Get(k); return err })
+	if missing.err != nil {
+		t.Fatalf("missing key recorded as an error: %v", missing.err)
+	}
+}
+
+func TestEmulatedLogger(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/bad/") {
+			w.Header().Set("x-ms-error-code", "AuthorizationPermissionMismatch")
+			w.Header().Set("x-ms-request-id", "req-1")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	var buf bytes.Buffer
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithAsyncPuts(1),
+		WithLogger(log.New(&buf, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Expected statuses, such as a missing key, are not logged.
+	if _, err := d.Get(ds.NewKey("/missing")); err != ds.ErrNotFound {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/bad/x"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(ds.NewKey("/bad")); err == nil {
+		t.Fatal("failed put not reported")
+	}
+	logged := buf.String()
+	if strings.Contains(logged, "missing") {
+		t.Fatalf("missing key logged: %s", logged)
+	}
+	if !strings.Contains(logged, "PUT") || !strings.Contains(logged, "403 request req-1") {
+		t.Fatalf("failed request not logged: %s", logged)
+	}
+	if !strings.Contains(logged, "asynchronous put of /bad/x failed: AuthorizationPermissionMismatch (403)") {
+		t.Fatalf("failed asynchronous put not logged: %s", logged)
+	}
+	if strings.Contains(logged, "?") {
+		t.Fatalf("query string logged: %s", logged)
+	}
+}
+
+func TestEmulatedRequestLimits(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var mu sync.Mutex
+	var inFlight, peak int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		e.ServeHTTP(w, r)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL),
+		WithMaxConcurrentRequests(3), WithRequestRate(1000, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := d.Put(ds.NewKey(fmt.Sprintf("/k/%d", i)), []byte("v")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if peak > 3 {
+		t.Fatalf("%d requests in flight at once", peak)
+	}
+}
+
+func TestEmulatedMount(t *testing.T) {
+	srv, e := azuretest.NewServer()
+	defer srv.Close()
+	m, err := NewMount("devstore", []ContainerMount{
+		{Prefix: ds.NewKey("/blocks"), Container: "blocks"},
+		{Prefix: ds.NewKey("/pins"), Container: "pins", Options: []Option{WithAccessTier(azblob.AccessTierCool)}},
+	}, WithSharedKey("a2V5"), WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.EnsureContainers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"/blocks/a", "/pins/b"} {
+		if err := m.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, ok := e.Blob("blocks", "/a"); !ok || string(v) != "/blocks/a" {
+		t.Fatalf("block stored as %q, %v", v, ok)
+	}
+	if _, ok := e.Blob("pins", "/b"); !ok {
+		t.Fatal("pin not stored in its container")
+	}
+	if err := m.Put(ds.NewKey("/other"), nil); err == nil {
+		t.Fatal("put outside every mount succeeded")
+	}
+
+	res, err := m.Query(query.Query{KeysOnly: true, Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "/blocks/a" || entries[1].Key != "/pins/b" {
+		t.Fatalf("query over both mounts: %v", entries)
+	}
+	if d, ok := m.Mounted(ds.NewKey("/pins")); !ok || d.config.tier != azblob.AccessTierCool {
+		t.Fatal("mount's own options not applied")
+	}
+
+	if _, err := NewMount("devstore", []ContainerMount{
+		{Prefix: ds.NewKey("/a"), Container: "x"},
+		{Prefix: ds.NewKey("/a"), Container: "y"},
+	}, WithSharedKey("a2V5"), WithEndpoint(srv.URL)); err == nil {
+		t.Fatal("prefix mounted twice")
+	}
+}
+
+func TestEmulatedVersions(t *testing.T) {
+	d, _ := newEmulated(t, WithVersioning(), WithCompression(Gzip))
+	k := ds.NewKey("/head")
+	values := []string{"first", strings.Repeat("second ", 50), "third"}
+	for _, v := range values {
+		if err := d.Put(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := d.Versions(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("%d versions of 3 puts", len(versions))
+	}
+	for i, v := range versions {
+		if v.Size != len(values[i]) {
+			t.Fatalf("version %d: size %d of %d", i, v.Size, len(values[i]))
+		}
+		got, err := d.GetVersion(k, v.ID)
+		if err != nil || string(got) != values[i] {
+			t.Fatalf("version %d: %q, %v", i, got, err)
+		}
+	}
+	if v, err := d.Get(k); err != nil || string(v) != "third" {
+		t.Fatalf("current value %q, %v", v, err)
+	}
+	if _, err := d.GetVersion(k, "2000-01-01T00:00:00.0000000Z"); err != ds.ErrNotFound {
+		t.Fatalf("missing version: %v", err)
+	}
+
+	if err := d.DeleteVersion(k, versions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := d.Versions(k); len(versions) != 1 {
+		t.Fatalf("%d versions after deleting one", len(versions))
+	}
+
+	// Creating a key keeps nothing; other keys' versions are not listed.
+	other := ds.NewKey("/head2")
+	if err := d.Put(other, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := d.Versions(other); len(versions) != 0 {
+		t.Fatalf("new key has versions %v", versions)
+	}
+
+	// Deletes, batched or not, take the versions with them.
+	b, _ := d.Batch()
+	b.Delete(k)
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := d.Versions(k); len(versions) != 0 {
+		t.Fatalf("versions of a deleted key: %v", versions)
+	}
+	if err := d.Put(other, []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(other); err != nil {
+		t.Fatal(err)
+	}
+
+	plain, _ := newEmulated(t)
+	plain.Put(k, []byte("a"))
+	plain.Put(k, []byte("b"))
+	if versions, _ := plain.Versions(k); len(versions) != 0 {
+		t.Fatalf("versions kept without versioning: %v", versions)
+	}
+}
+
+func TestEmulatedLock(t *testing.T) {
+	srv, _ := azuretest.NewServer()
+	defer srv.Close()
+	clk := clock.NewMock(time.Unix(1000, 0))
+	open := func(opts ...Option) *Datastore {
+		d, err := NewDatastore("devstore", "data", append(opts, WithSharedKey("a2V5"), WithEndpoint(srv.URL))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	a, b := open(WithClock(clk)), open()
+	ctx := context.Background()
+
+	if err := a.AcquireLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AcquireLock(ctx); err != nil {
+		t.Fatalf("reacquiring a held lock: %v", err)
+	}
+	if err := b.AcquireLock(ctx); err != ErrLocked {
+		t.Fatalf("acquiring a lock held by another: %v", err)
+	}
+	if err := a.ReleaseLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AcquireLock(ctx); err != nil {
+		t.Fatalf("acquiring a released lock: %v", err)
+	}
+	// Close releases the lock.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AcquireLock(ctx); err != nil {
+		t.Fatalf("acquiring the lock of a closed datastore: %v", err)
+	}
+
+	// Once the lease is broken, the next renewal finds it gone and writes
+	// are fenced off.
+	if _, err := a.keyUrl(LockKey).BreakLease(ctx, 0, azblob.ModifiedAccessConditions{}); err != nil {
+		t.Fatal(err)
+	}
+	k := ds.NewKey("/k")
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Put(k, []byte("v")) != ErrLockLost {
+		if time.Now().After(deadline) {
+			t.Fatal("writes not fenced off after the lock was lost")
+		}
+		clk.Advance(lockRenewal)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := a.Get(k); err != nil && err != ds.ErrNotFound {
+		t.Fatalf("read fenced off: %v", err)
+	}
+	if err := a.ReleaseLock(ctx); err != nil {
+		t.Fatalf("releasing a lost lock: %v", err)
+	}
+	if err := a.Put(k, []byte("v")); err != nil {
+		t.Fatalf("write after release: %v", err)
+	}
+}
+
+func TestEmulatedFencing(t *testing.T) {
+	srv, e := azuretest.NewServer()
+	defer srv.Close()
+	open := func() *Datastore {
+		d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithUploadThresholds(1024, 256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	a, b := open(), open()
+	ctx := context.Background()
+	k := ds.NewKey("/head")
+
+	// Unfenced, nothing is checked.
+	if err := a.Put(k, []byte("unfenced")); err != nil {
+		t.Fatal(err)
+	}
+	if ea, err := a.AcquireEpoch(); err != nil || ea != 1 {
+		t.Fatalf("first epoch: %d, %v", ea, err)
+	}
+	if eb, err := b.AcquireEpoch(); err != nil || eb != 2 {
+		t.Fatalf("second epoch: %d, %v", eb, err)
+	}
+	if v, _ := e.Blob("data", EpochKey.String()); string(v) != "2" {
+		t.Fatalf("counter stored as %q", v)
+	}
+	if err := a.CheckEpoch(ctx); err != ErrStaleEpoch {
+		t.Fatalf("stale writer's check: %v", err)
+	}
+	if err := b.CheckEpoch(ctx); err != nil {
+		t.Fatalf("current writer's check: %v", err)
+	}
+
+	// The newer writer replaces the unfenced value, after which the stale
+	// writer can neither replace nor delete it, by any route.
+	if err := b.Put(k, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Put(k, []byte("a")); err != ErrStaleEpoch {
+		t.Fatalf("stale put: %v", err)
+	}
+	if err := a.Put(k, bytes.Repeat([]byte("a"), 2000)); err != ErrStaleEpoch {
+		t.Fatalf("stale staged put: %v", err)
+	}
+	if err := a.PutReader(k, strings.NewReader("a"), 1); err != ErrStaleEpoch {
+		t.Fatalf("stale put from a reader: %v", err)
+	}
+	if err := a.Delete(k); err != ErrStaleEpoch {
+		t.Fatalf("stale delete: %v", err)
+	}
+	if err := a.SetTTL(k, time.Hour); err != ErrStaleEpoch {
+		t.Fatalf("stale TTL: %v", err)
+	}
+	batch, _ := a.Batch()
+	batch.Delete(k)
+	if err := batch.Commit(); err != ErrStaleEpoch {
+		t.Fatalf("stale batch delete: %v", err)
+	}
+	if v, _ := b.Get(k); string(v) != "b" {
+		t.Fatalf("value changed by the stale writer to %q", v)
+	}
+	if meta, _ := b.GetMetadata(k); meta != nil {
+		t.Fatalf("epoch shown as user metadata: %v", meta)
+	}
+
+	// Acquiring again makes a writer current.
+	if ea, err := a.AcquireEpoch(); err != nil || ea != 3 {
+		t.Fatalf("third epoch: %d, %v", ea, err)
+	}
+	if err := a.Put(k, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(k, []byte("b")); err != ErrStaleEpoch {
+		t.Fatalf("put after a newer epoch: %v", err)
+	}
+	batch, _ = a.Batch()
+	batch.Delete(k)
+	batch.Delete(ds.NewKey("/missing"))
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.Blob("data", k.String()); ok {
+		t.Fatal("fenced batch delete left the value")
+	}
+}
+
+func TestEmulatedClear(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	e.CreateContainer("pins")
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL),
+		WithRoutes(Route{Prefix: ds.NewKey("/a/pins"), AccountName: "devstore", AccountKey: "a2V5", Container: "pins"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ctx := context.Background()
+
+	batch, _ := d.Batch()
+	for i := 0; i < 600; i++ {
+		batch.Put(ds.NewKey(fmt.Sprintf("/a/%04d", i)), []byte("v"))
+	}
+	for _, k := range []string{"/a", "/a/pins/x", "/ab", "/b/c"} {
+		batch.Put(ds.NewKey(k), []byte("v"))
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AcquireLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	n, err := d.Clear(ds.NewKey("/a"))
+	if err != nil || n != 601 {
+		t.Fatalf("cleared %d keys: %v", n, err)
+	}
+	if requests > 10 {
+		t.Fatalf("clearing 601 keys took %d requests", requests)
+	}
+	if _, ok := e.Blob("pins", "/a/pins/x"); ok {
+		t.Fatal("routed container under the prefix not cleared")
+	}
+	for _, k := range []string{"/a", "/ab", "/b/c"} {
+		if ok, _ := d.Has(ds.NewKey(k)); !ok {
+			t.Fatalf("%s outside the prefix cleared", k)
+		}
+	}
+
+	if n, err := d.Clear(ds.NewKey("/")); err != nil || n != 3 {
+		t.Fatalf("cleared %d keys: %v", n, err)
+	}
+	if _, ok := e.Blob("data", LockKey.String()); !ok {
+		t.Fatal("lock blob cleared")
+	}
+	if err := d.Put(ds.NewKey("/new"), []byte("v")); err != nil {
+		t.Fatalf("write after clearing a locked container: %v", err)
+	}
+}
+
+func TestEmulatedInternalKeysHidden(t *testing.T) {
+	d, e := newEmulated(t)
+	ctx := context.Background()
+	if err := d.AcquireLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.AcquireEpoch(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/a", "/b", "/c"} {
+		if err := d.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []ds.Key{LockKey, EpochKey} {
+		if _, ok := e.Blob("data", k.String()); !ok {
+			t.Fatalf("%s not stored", k)
+		}
+	}
+
+	// Both sort before the keys, and must not count against the offset
+	// or limit, whether or not the listing applies them.
+	for _, tc := range []struct {
+		q    query.Query
+		want []string
+	}{
+		{query.Query{KeysOnly: true}, []string{"/a", "/b", "/c"}},
+		{query.Query{KeysOnly: true, Limit: 2}, []string{"/a", "/b"}},
+		{query.Query{KeysOnly: true, Offset: 1, Limit: 1}, []string{"/b"}},
+		{query.Query{Orders: []query.Order{query.OrderByValue{}}, Limit: 2}, []string{"/a", "/b"}},
+	} {
+		res, err := d.Query(tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Key)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.q, tc.want, got)
+		}
+	}
+}
+
+func TestEmulatedMinimalKeyListings(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var withMetadata int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("comp") == "list" && strings.Contains(r.URL.Query().Get("include"), "metadata") {
+			atomic.AddInt32(&withMetadata, 1)
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithMinimalKeyListings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.PutWithMetadata(ds.NewKey("/tagged"), []byte("value"), map[string]string{"owner": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Size != -1 {
+		t.Fatalf("minimal listing returned %+v", entries)
+	}
+	if withMetadata != 0 {
+		t.Fatal("minimal listing asked for metadata")
+	}
+
+	// Asking for sizes lists in full.
+	res, err = d.Query(query.Query{KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Size != 5 {
+		t.Fatalf("full listing returned %+v", entries)
+	}
+	if withMetadata == 0 {
+		t.Fatal("listing with sizes did not ask for metadata")
+	}
+
+	// So does asking for metadata.
+	mres, err := d.QueryWithMetadata(context.Background(), query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mentries, err := mres.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mentries) != 1 || mentries[0].Metadata["owner"] != "alice" {
+		t.Fatalf("listing with metadata returned %+v", mentries)
+	}
+}
+
+func TestEmulatedQueryAbandoned(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var lists, gets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("comp") == "list":
+			atomic.AddInt32(&lists, 1)
+		case r.Method == http.MethodGet:
+			atomic.AddInt32(&gets, 1)
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithListPageSize(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for i := 0; i < 200; i++ {
+		d.Put(ds.NewKey(fmt.Sprintf("/%03d", i)), []byte("v"))
+	}
+
+	settled := func() (int32, int32) {
+		time.Sleep(50 * time.Millisecond)
+		return atomic.LoadInt32(&lists), atomic.LoadInt32(&gets)
+	}
+	for name, abandon := range map[string]func(query.Results, func()){
+		"closed":    func(res query.Results, _ func()) { res.Close() },
+		"cancelled": func(_ query.Results, cancel func()) { cancel() },
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		res, err := d.QueryContext(ctx, query.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := <-res.Next(); r.Error != nil {
+			t.Fatal(r.Error)
+		}
+		abandon(res, cancel)
+		l, g := settled()
+		if l2, g2 := settled(); l2 != l || g2 != g || l > 3 {
+			t.Errorf("%s query kept working: %d then %d listings, %d then %d downloads", name, l, l2, g, g2)
+		}
+		cancel()
+		res.Close()
+		atomic.StoreInt32(&lists, 0)
+		atomic.StoreInt32(&gets, 0)
+	}
+}
+
+func TestEmulatedCloseTwice(t *testing.T) {
+	d, e := newEmulated(t, WithAsyncPuts(2))
+	k := ds.NewKey("/queued")
+	if err := d.Put(k, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	// The first Close flushes the queued put; the second has nothing left.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := e.Blob("data", k.String()); !ok || string(v) != "v" {
+		t.Fatalf("queued put not flushed by close: %q, %v", v, ok)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	if err := d.Put(k, []byte("w")); err != ErrClosed {
+		t.Fatalf("put after close: %v", err)
+	}
+	if _, err := d.Get(k); err != ErrClosed {
+		t.Fatalf("get after close: %v", err)
+	}
+}
+
+// countingTransport counts the requests it sends.
+type countingTransport struct {
+	n int32
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.n, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestEmulatedHTTPClient(t *testing.T) {
+	transport := &countingTransport{}
+	d, _ := newEmulated(t, WithHTTPClient(&http.Client{Transport: transport}))
+	k := ds.NewKey("/k")
+	if err := d.Put(k, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(k); err != nil || string(v) != "v" {
+		t.Fatalf("get through the client: %q, %v", v, err)
+	}
+	if atomic.LoadInt32(&transport.n) == 0 {
+		t.Fatal("requests not sent with the client")
+	}
+}
+
+// truncatingWriter cuts a response body off after limit bytes by aborting
+// the connection.
+type truncatingWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *truncatingWriter) Write(b []byte) (int, error) {
+	if len(b) > w.limit {
+		w.ResponseWriter.Write(b[:w.limit])
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.limit -= len(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func TestEmulatedRetryReader(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var truncate int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Query().Get("comp") == "" && atomic.CompareAndSwapInt32(&truncate, 1, 0) {
+			w = &truncatingWriter{ResponseWriter: w, limit: 100}
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	open := func(opts ...Option) *Datastore {
+		d, err := NewDatastore("devstore", "data", append(opts, WithSharedKey("a2V5"), WithEndpoint(srv.URL))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	value := bytes.Repeat([]byte("0123456789"), 100)
+	k := ds.NewKey("/k")
+	var failed int32
+	d := open(WithRetryReaderOptions(azblob.RetryReaderOptions{
+		NotifyFailedRead: func(int, error, int64, int64, bool) { atomic.AddInt32(&failed, 1) },
+	}))
+	if err := d.Put(k, value); err != nil {
+		t.Fatal(err)
+	}
+
+	// A body cut off partway is resumed from where it stopped.
+	atomic.StoreInt32(&truncate, 1)
+	if v, err := d.Get(k); err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("resumed get: %d bytes, %v", len(v), err)
+	}
+	if failed != 1 {
+		t.Fatalf("%d failed reads notified", failed)
+	}
+
+	noResume := open(WithRetryReaderOptions(azblob.RetryReaderOptions{MaxRetryRequests: -1}))
+	atomic.StoreInt32(&truncate, 1)
+	if _, err := noResume.Get(k); err == nil {
+		t.Fatal("get without resuming survived a cut off body")
+	}
+}
+
+func TestEmulatedProgress(t *testing.T) {
+	type report struct {
+		upload             bool
+		transferred, total int64
+	}
+	var mu sync.Mutex
+	reports := make(map[string][]report)
+	d, _ := newEmulated(t, WithUploadThresholds(1024, 256), WithDownloadChunkSize(512),
+		WithProgress(func(key ds.Key, upload bool, transferred, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports[key.String()] = append(reports[key.String()], report{upload, transferred, total})
+		}))
+	// last returns the final report of key's transfers in one direction,
+	// checking the counts only grew.
+	last := func(key string, upload bool) report {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		var r report
+		for _, next := range reports[key] {
+			if next.upload != upload {
+				continue
+			}
+			if next.transferred < r.transferred {
+				t.Fatalf("%s progress went back from %d to %d", key, r.transferred, next.transferred)
+			}
+			r = next
+		}
+		delete(reports, key)
+		return r
+	}
+
+	small, big := ds.NewKey("/small"), ds.NewKey("/big")
+	bigValue := bytes.Repeat([]byte("0123456789"), 300)
+	if err := d.Put(small, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(big, bigValue); err != nil {
+		t.Fatal(err)
+	}
+	if r := last("/small", true); r.transferred != 5 || r.total != 5 {
+		t.Fatalf("single-shot upload ended at %+v", r)
+	}
+	if r := last("/big", true); r.transferred != 3000 || r.total != 3000 {
+		t.Fatalf("staged upload ended at %+v", r)
+	}
+
+	if _, err := d.Get(big); err != nil {
+		t.Fatal(err)
+	}
+	if r := last("/big", false); r.transferred != 3000 || r.total != 3000 {
+		t.Fatalf("chunked download ended at %+v", r)
+	}
+	rc, err := d.GetReader(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(rc)
+	rc.Close()
+	if r := last("/big", false); r.transferred != 3000 || r.total != 3000 {
+		t.Fatalf("streamed download ended at %+v", r)
+	}
+	if err := d.PutReader(big, bytes.NewReader(bigValue), -1); err != nil {
+		t.Fatal(err)
+	}
+	if r := last("/big", true); r.transferred != 3000 || r.total != -1 {
+		t.Fatalf("streamed upload ended at %+v", r)
+	}
+}
+
+func TestEmulatedLifecycleTTL(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1000, 0))
+	d, e := newEmulated(t, WithClock(clk), WithUploadThresholds(1024, 256), WithLifecycleTTL(1, 7, 30))
+	tag := func(name string) string {
+		t.Helper()
+		tags, ok := e.Tags("data", name)
+		if !ok {
+			t.Fatalf("%s missing", name)
+		}
+		return tags[tagTTLDays]
+	}
+
+	if err := d.PutWithTTL(ds.NewKey("/hour"), []byte("h"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Staged uploads are tagged too, rounded up to the next rule.
+	if err := d.PutWithTTL(ds.NewKey("/week"), bytes.Repeat([]byte("w"), 2000), 6*24*time.Hour+time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutWithTTL(ds.NewKey("/year"), []byte("y"), 365*24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/plain"), []byte("p")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"/hour": "1", "/week": "7", "/year": "", "/plain": ""} {
+		if got := tag(name); got != want {
+			t.Fatalf("%s tagged %q, want %q", name, got, want)
+		}
+	}
+
+	if err := d.SetTTL(ds.NewKey("/hour"), 20*24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := tag("/hour"); got != "30" {
+		t.Fatalf("retagged %q", got)
+	}
+	if err := d.SetTTL(ds.NewKey("/hour"), 400*24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := tag("/hour"); got != "" {
+		t.Fatalf("untagged %q", got)
+	}
+	// Overwriting without a TTL drops the tag.
+	if err := d.Put(ds.NewKey("/week"), []byte("w")); err != nil {
+		t.Fatal(err)
+	}
+	if got := tag("/week"); got != "" {
+		t.Fatalf("overwrite tagged %q", got)
+	}
+
+	b, err := d.LifecyclePolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var policy struct {
+		Rules []struct {
+			Name       string
+			Definition struct {
+				Filters struct {
+					PrefixMatch    []string
+					BlobIndexMatch []struct{ Name, Op, Value string }
+				}
+				Actions struct {
+					BaseBlob struct {
+						Delete struct{ DaysAfterModificationGreaterThan int }
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(b, &policy); err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 3 {
+		t.Fatalf("%d rules", len(policy.Rules))
+	}
+	rule := policy.Rules[1].Definition
+	if policy.Rules[1].Name != "dsttl7d" || rule.Filters.PrefixMatch[0] != "data/" ||
+		rule.Filters.BlobIndexMatch[0].Name != tagTTLDays || rule.Filters.BlobIndexMatch[0].Value != "7" ||
+		rule.Actions.BaseBlob.Delete.DaysAfterModificationGreaterThan != 7 {
+		t.Fatalf("rule %s", b)
+	}
+
+	// Without the option nothing is tagged.
+	plain, e2 := newEmulated(t)
+	if err := plain.PutWithTTL(ds.NewKey("/hour"), []byte("h"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if tags, _ := e2.Tags("data", "/hour"); len(tags) != 0 {
+		t.Fatalf("tagged %v without the option", tags)
+	}
+}
+
+func TestEmulatedBackupRestore(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1000, 0))
+	srv, e := azuretest.NewServer()
+	defer srv.Close()
+	e.CreateContainer("pins")
+	d, err := NewDatastore("devstore", "data", WithSharedKey("a2V5"), WithEndpoint(srv.URL), WithClock(clk),
+		WithUploadThresholds(1024, 256),
+		WithRoutes(Route{Prefix: ds.NewKey("/pins"), AccountName: "devstore", AccountKey: "a2V5", Container: "pins"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ctx := context.Background()
+
+	big := bytes.Repeat([]byte("0123456789"), 300)
+	for k, v := range map[string][]byte{"/a": []byte("a"), "/b/c": big, "/pins/p": []byte("p")} {
+		if err := d.Put(ds.NewKey(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.PutWithMetadata(ds.NewKey("/meta"), []byte("m"), map[string]string{"owner": "me"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutWithTTL(ds.NewKey("/soon"), []byte("s"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutWithTTL(ds.NewKey("/later"), []byte("l"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutWithTTL(ds.NewKey("/gone"), []byte("g"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AcquireLock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(2 * time.Second)
+
+	var archive bytes.Buffer
+	n, err := d.Backup(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Fatalf("backed up %d keys", n)
+	}
+
+	// Restore into another account, once the short TTL has run out.
+	clk.Advance(time.Minute)
+	restored, _ := newEmulated(t, WithClock(clk))
+	if n, err := restored.Restore(bytes.NewReader(archive.Bytes())); err != nil || n != 5 {
+		t.Fatalf("restored %d keys: %v", n, err)
+	}
+	for k, want := range map[string][]byte{"/a": []byte("a"), "/b/c": big, "/pins/p": []byte("p"), "/later": []byte("l")} {
+		if v, err := restored.Get(ds.NewKey(k)); err != nil || !bytes.Equal(v, want) {
+			t.Fatalf("%s restored as %q, %v", k, v, err)
+		}
+	}
+	for _, k := range []string{"/soon", "/gone", LockKey.String()} {
+		if has, _ := restored.Has(ds.NewKey(k)); has {
+			t.Fatalf("%s restored", k)
+		}
+	}
+	if exp, err := restored.GetExpiration(ds.NewKey("/later")); err != nil || !exp.Equal(time.Unix(1000+3600, 0)) {
+		t.Fatalf("restored expiration %v, %v", exp, err)
+	}
+	if meta, err := restored.GetMetadata(ds.NewKey("/meta")); err != nil || meta["owner"] != "me" {
+		t.Fatalf("restored metadata %v, %v", meta, err)
+	}
+
+	if _, err := restored.Restore(strings.NewReader("not a tar archive, but long enough to have a header block")); err == nil {
+		t.Fatal("restored garbage")
+	}
+}
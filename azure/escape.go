@@ -0,0 +1,107 @@
+package azure
+
+import (
+	"context"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/internal/blobkey"
+)
+
+// maxBlobSegments is the number of path segments a blob name may have.
+const maxBlobSegments = blobkey.MaxSegments
+
+// blobName returns the name of the blob holding key, escaped as
+// blobkey.Escape describes.
+func blobName(key ds.Key) string {
+	return escapeBlobName(key.String())
+}
+
+// blobKey returns the key stored in the named blob.
+func blobKey(name string) ds.Key {
+	return ds.NewKey(unescapeBlobName(name))
+}
+
+// escapeBlobName escapes a key string, or a key prefix to list by.
+func escapeBlobName(s string) string {
+	return blobkey.Escape(s)
+}
+
+// unescapeBlobName reverses escapeBlobName.
+func unescapeBlobName(name string) string {
+	return blobkey.Unescape(name)
+}
+
+// MigrateLegacyNames renames the blobs written before keys were escaped
+// whose names escaping changes, such as those of keys holding '%' or '\',
+// to the names their keys escape to, and returns the number renamed.
+// Until they are renamed, such blobs are listed under the keys they were
+// written with, but Get, Has, Put and Delete of those keys miss them.
+//
+// Each blob is copied within its container, then deleted. A blob already
+// written under the escaped name since is kept, and the legacy one only
+// deleted. Writes of the keys concerned should wait for the migration.
+func (d *Datastore) MigrateLegacyNames(ctx context.Context) (n int, err error) {
+	ctx, done, err := d.life.begin(ctx, ds.NewKey("/"), true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { done(err) }()
+
+	for _, r := range append([]route{d.routeFor(ds.NewKey("/"))}, d.routes...) {
+		m, err := d.migrateRoute(ctx, r)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// migrateRoute renames the legacy blobs of r's container.
+func (d *Datastore) migrateRoute(ctx context.Context, r route) (n int, err error) {
+	var legacy []string
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := r.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			MaxResults: d.config.bulkPageSize(),
+		})
+		if err != nil {
+			if isError(err, azblob.ServiceCodeContainerNotFound) {
+				return 0, nil
+			}
+			return 0, err
+		}
+		for _, blob := range list.Segment.BlobItems {
+			if k, ok := d.keyFor(blob.Name); ok && d.nameFor(k) != blob.Name {
+				legacy = append(legacy, blob.Name)
+			}
+		}
+		marker = list.NextMarker
+	}
+
+	for _, name := range legacy {
+		k, _ := d.keyFor(name)
+		dst := r.container.NewBlobURL(d.nameFor(k))
+		_, err := dst.GetProperties(ctx, azblob.BlobAccessConditions{}, d.config.cpk)
+		switch {
+		case isError(err, azblob.ServiceCodeBlobNotFound):
+			// As in Fork, a source read with a SAS needs the token in its
+			// URL.
+			src := r.container.NewBlobURL(name).URL()
+			if sas, ok := r.credential.(*sasCredential); ok {
+				src = sas.sign(ctx, src)
+			}
+			if err := copyBlob(ctx, dst, src); err != nil {
+				return n, err
+			}
+		case err != nil:
+			return n, err
+		}
+		_, err = r.container.NewBlobURL(name).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+		if err != nil && !isError(err, azblob.ServiceCodeBlobNotFound) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,56 @@
+package azure
+
+import (
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestBlobName(t *testing.T) {
+	cases := map[string]string{
+		"/a/b":         "/a/b",
+		"/100%":        "/100%25",
+		`/a\b`:         "/a%5Cb",
+		"/a\x00\n":     "/a%00%0A",
+		"/a./b.":       "/a%2E/b%2E",
+		"/a.b/...":     "/a.b/..%2E",
+		"/caf\xc3\xa9": "/caf\xc3\xa9",
+		"/bad\xff":     "/bad%FF",
+		"/%41":         "/%2541",
+	}
+	for key, want := range cases {
+		k := ds.RawKey(key)
+		if got := blobName(k); got != want {
+			t.Errorf("blobName(%q) = %q, want %q", key, got, want)
+		}
+		if got := blobKey(want); !got.Equal(k) {
+			t.Errorf("blobKey(%q) = %q, want %q", want, got, key)
+		}
+	}
+
+	deep := ds.RawKey(strings.Repeat("/x", 300))
+	name := blobName(deep)
+	if n := strings.Count(name, "/"); n != maxBlobSegments-1 {
+		t.Errorf("deep key escaped to %d segments", n+1)
+	}
+	if !blobKey(name).Equal(deep) {
+		t.Errorf("deep key does not round-trip")
+	}
+
+	// Escaped prefixes list the keys under them.
+	for _, key := range []string{"/a./b", "/a/b.", `/x\/y`, deep.String()} {
+		k := ds.RawKey(key)
+		parent := k.Parent().String() + "/"
+		if !strings.HasPrefix(blobName(k), escapeBlobName(parent)) {
+			t.Errorf("%q escapes to %q, not under %q", key, blobName(k), escapeBlobName(parent))
+		}
+	}
+
+	// Names not written escaped are kept as is.
+	for _, name := range []string{"/50%off", "/a%41", "/a%2f"} {
+		if got := blobKey(name); got.String() != name {
+			t.Errorf("blobKey(%q) = %q", name, got)
+		}
+	}
+}
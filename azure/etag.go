@@ -0,0 +1,165 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrETagMismatch is returned by the conditional writes when the value
+// changed since its ETag was read.
+var ErrETagMismatch = errors.New("azure: blob was modified concurrently")
+
+// GetWithETag returns a value and the ETag identifying that version of it,
+// for a later PutIfMatch or DeleteIfMatch. See GetWithETagContext.
+func (d *Datastore) GetWithETag(key ds.Key) ([]byte, azblob.ETag, error) {
+	return d.GetWithETagContext(context.Background(), key)
+}
+
+// GetWithETagContext returns a value and the ETag identifying that version
+// of it. If key has no value, it returns ds.ErrNotFound and an ETag that
+// PutIfMatch takes to mean the key must still have none: azblob.ETagNone,
+// or the ETag of an expired value. With WithAsyncPuts, a queued put of key
+// is waited for first.
+func (d *Datastore) GetWithETagContext(ctx context.Context, key ds.Key) (value []byte, etag azblob.ETag, err error) {
+	if err := d.waitQueued(ctx, key); err != nil {
+		return nil, azblob.ETagNone, err
+	}
+	ctx, done, err := d.life.begin(ctx, key, false)
+	if err != nil {
+		return nil, azblob.ETagNone, err
+	}
+	defer func() { done(err) }()
+	return d.getWithETag(ctx, key)
+}
+
+// PutIfMatch stores value only if the value of key is still the version
+// etag identifies, returning ErrETagMismatch otherwise. Pass
+// azblob.ETagNone to store value only if key has none. See
+// PutIfMatchContext.
+func (d *Datastore) PutIfMatch(key ds.Key, value []byte, etag azblob.ETag) error {
+	return d.PutIfMatchContext(context.Background(), key, value, etag)
+}
+
+// PutIfMatchContext stores value only if the value of key is still the
+// version etag identifies, returning ErrETagMismatch otherwise. Reading
+// with GetWithETag and writing with PutIfMatch, retrying on a mismatch,
+// updates a value atomically, as for counters or head pointers.
+func (d *Datastore) PutIfMatchContext(ctx context.Context, key ds.Key, value []byte, etag azblob.ETag) (err error) {
+	if err := d.waitQueued(ctx, key); err != nil {
+		return err
+	}
+	ctx, done, err := d.life.begin(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return d.putIfMatch(ctx, key, value, etag)
+}
+
+// DeleteIfMatch deletes key only if its value is still the version etag
+// identifies, returning ErrETagMismatch otherwise, including when it has
+// no value. See DeleteIfMatchContext.
+func (d *Datastore) DeleteIfMatch(key ds.Key, etag azblob.ETag) error {
+	return d.DeleteIfMatchContext(context.Background(), key, etag)
+}
+
+// DeleteIfMatchContext deletes key only if its value is still the version
+// etag identifies, returning ErrETagMismatch otherwise, including when it
+// has no value.
+func (d *Datastore) DeleteIfMatchContext(ctx context.Context, key ds.Key, etag azblob.ETag) (err error) {
+	if err := d.waitQueued(ctx, key); err != nil {
+		return err
+	}
+	ctx, done, err := d.life.begin(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return d.deleteIfMatch(ctx, key, etag)
+}
+
+// getWithETag returns a value and the ETag identifying that version of it.
+// An expired value is not found, but its ETag is returned so it can be
+// overwritten.
+func (d *Datastore) getWithETag(ctx context.Context, key ds.Key) ([]byte, azblob.ETag, error) {
+	get, err := d.keyUrl(key).Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, d.config.cpk)
+	if err != nil {
+		if isError(err, azblob.ServiceCodeBlobNotFound) {
+			return nil, azblob.ETagNone, ds.ErrNotFound
+		}
+		return nil, azblob.ETagNone, err
+	}
+	if d.expired(get.NewMetadata()) {
+		get.Response().Body.Close()
+		return nil, get.ETag(), ds.ErrNotFound
+	}
+	reader := get.Body(d.config.retryReader())
+	defer reader.Close()
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(reader); err != nil {
+		return nil, azblob.ETagNone, err
+	}
+	if err := d.verify(key, b.Bytes(), get.ContentMD5()); err != nil {
+		return nil, azblob.ETagNone, err
+	}
+	value, err := decompress(key, get.ContentEncoding(), b.Bytes())
+	if err != nil {
+		return nil, azblob.ETagNone, err
+	}
+	return value, get.ETag(), nil
+}
+
+// putIfMatch writes value only if the blob's ETag is still etag, or, for
+// ETagNone, only if the blob does not exist. It returns ErrETagMismatch
+// otherwise.
+func (d *Datastore) putIfMatch(ctx context.Context, key ds.Key, value []byte, etag azblob.ETag) error {
+	var mac azblob.ModifiedAccessConditions
+	if etag == azblob.ETagNone {
+		mac.IfNoneMatch = azblob.ETagAny
+	} else {
+		mac.IfMatch = etag
+	}
+	err := d.putIf(ctx, key, value, azblob.Metadata{}, azblob.BlobAccessConditions{ModifiedAccessConditions: mac})
+	if isError(err, azblob.ServiceCodeConditionNotMet) || isError(err, azblob.ServiceCodeBlobAlreadyExists) {
+		return ErrETagMismatch
+	}
+	return err
+}
+
+// deleteIfMatch deletes the blob only if its ETag is still etag. It
+// returns ErrETagMismatch otherwise, including when the blob is gone.
+func (d *Datastore) deleteIfMatch(ctx context.Context, key ds.Key, etag azblob.ETag) error {
+	blob := d.keyUrl(key)
+	ac, _, err := d.fence(ctx, blob.BlobURL, azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: etag},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = blob.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, ac)
+	if isError(err, azblob.ServiceCodeConditionNotMet) || isError(err, azblob.ServiceCodeBlobNotFound) {
+		return ErrETagMismatch
+	}
+	return err
+}
+
+// statWithETag returns the size of a value and the ETag identifying that
+// version of it. Like getWithETag, an expired value is not found but has
+// its ETag returned.
+func (d *Datastore) statWithETag(ctx context.Context, key ds.Key) (int, azblob.ETag, error) {
+	props, err := d.keyUrl(key).GetProperties(ctx, azblob.BlobAccessConditions{}, d.config.cpk)
+	if err != nil {
+		if isError(err, azblob.ServiceCodeBlobNotFound) {
+			return -1, azblob.ETagNone, ds.ErrNotFound
+		}
+		return -1, azblob.ETagNone, err
+	}
+	if d.expired(props.NewMetadata()) {
+		return -1, props.ETag(), ds.ErrNotFound
+	}
+	return valueSize(props.ContentLength(), props.NewMetadata()), props.ETag(), nil
+}
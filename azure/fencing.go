@@ -0,0 +1,226 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// EpochKey is the key of the counter blob handing out fencing epochs. Like
+// LockKey, it is hidden from queries.
+var EpochKey = ds.NewKey("/.epoch")
+
+// ErrStaleEpoch is returned by writes of a fenced datastore once a newer
+// epoch has been acquired by another writer.
+var ErrStaleEpoch = errors.New("azure: write fenced off by a newer epoch")
+
+// metaEpoch is the metadata entry recording the epoch a value was written
+// under.
+const metaEpoch = "dsepoch"
+
+// epochLease is how long the counter blob is leased while an epoch is
+// taken from it, the shortest lease the service grants.
+const epochLease = 15 * time.Second
+
+// AcquireEpoch takes the next fencing epoch, turning fencing on. See
+// AcquireEpochContext.
+func (d *Datastore) AcquireEpoch() (uint64, error) {
+	return d.AcquireEpochContext(context.Background())
+}
+
+// AcquireEpochContext takes the next epoch from the counter at EpochKey,
+// under a lease so concurrent writers each get their own, and turns
+// fencing on for writes of this datastore, for containers several writers
+// share on purpose. Writers taking over from one that may still be
+// running, such as a failover replica, acquire a newer epoch first.
+//
+// Once fenced, every write records its epoch in the value's metadata, and
+// replaces or deletes a value only if it was not written under a newer
+// epoch, failing with ErrStaleEpoch otherwise. The check and the write are
+// joined by the value's ETag, so a stale writer cannot slip in between.
+// It costs a request per write. Values written by newer writers are safe
+// from stale ones; keys only a stale writer has written are not, so a
+// writer should also CheckEpoch before acting on what it read.
+//
+// Blob batch deletes cannot be conditioned, so a fenced Batch deletes its
+// keys one by one. A PutReader streaming a value that another write of
+// its key races fails with ErrETagMismatch, as the value cannot be read
+// again to retry.
+func (d *Datastore) AcquireEpochContext(ctx context.Context) (epoch uint64, err error) {
+	ctx, done, err := d.life.begin(ctx, EpochKey, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { done(err) }()
+
+	blob := d.keyUrl(EpochKey)
+	leaseID, err := d.leaseEpochCounter(ctx, blob)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.ReleaseLease(context.Background(), leaseID, azblob.ModifiedAccessConditions{})
+
+	current, err := d.readEpoch(ctx, blob)
+	if err != nil {
+		return 0, err
+	}
+	epoch = current + 1
+	_, err = blob.Upload(ctx, strings.NewReader(strconv.FormatUint(epoch, 10)), azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+		azblob.BlobAccessConditions{LeaseAccessConditions: azblob.LeaseAccessConditions{LeaseID: leaseID}},
+		azblob.AccessTierNone, nil, d.config.cpk)
+	if err != nil {
+		return 0, err
+	}
+	atomic.StoreUint64(&d.epoch, epoch)
+	return epoch, nil
+}
+
+// leaseEpochCounter leases the counter blob, creating it if need be, and
+// waiting out other writers taking an epoch.
+func (d *Datastore) leaseEpochCounter(ctx context.Context, blob azblob.BlockBlobURL) (string, error) {
+	backoff := 10 * time.Millisecond
+	for i := 0; i < counterRetries; i++ {
+		resp, err := blob.AcquireLease(ctx, "", int32(epochLease/time.Second), azblob.ModifiedAccessConditions{})
+		switch {
+		case err == nil:
+			return resp.LeaseID(), nil
+		case isError(err, azblob.ServiceCodeLeaseAlreadyPresent):
+			time.Sleep(backoff)
+			backoff *= 2
+		case isError(err, azblob.ServiceCodeBlobNotFound) || isError(err, azblob.ServiceCodeContainerNotFound):
+			if err := d.ensureFor(ctx, EpochKey); err != nil {
+				return "", err
+			}
+			_, err = blob.Upload(ctx, strings.NewReader("0"), azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+				azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}},
+				azblob.AccessTierNone, nil, d.config.cpk)
+			if err != nil && !isError(err, azblob.ServiceCodeBlobAlreadyExists) {
+				return "", err
+			}
+		default:
+			return "", err
+		}
+	}
+	return "", ErrContention
+}
+
+// readEpoch returns the last epoch handed out by the counter blob.
+func (d *Datastore) readEpoch(ctx context.Context, blob azblob.BlockBlobURL) (uint64, error) {
+	get, err := blob.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, d.config.cpk)
+	if err != nil {
+		if isError(err, azblob.ServiceCodeBlobNotFound) || isError(err, azblob.ServiceCodeContainerNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	body := get.Body(d.config.retryReader())
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	epoch, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("azure: %s is not an epoch counter: %w", EpochKey, err)
+	}
+	return epoch, nil
+}
+
+// Epoch returns the epoch writes are fenced with, or zero if fencing is
+// off.
+func (d *Datastore) Epoch() uint64 {
+	return atomic.LoadUint64(&d.epoch)
+}
+
+// CheckEpoch returns ErrStaleEpoch if another writer has acquired an epoch
+// newer than this datastore's. It is nil if fencing is off.
+func (d *Datastore) CheckEpoch(ctx context.Context) (err error) {
+	epoch := d.Epoch()
+	if epoch == 0 {
+		return nil
+	}
+	ctx, done, err := d.life.begin(ctx, EpochKey, false)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+
+	current, err := d.readEpoch(ctx, d.keyUrl(EpochKey))
+	if err != nil {
+		return err
+	}
+	if current > epoch {
+		return ErrStaleEpoch
+	}
+	return nil
+}
+
+// stampEpoch returns meta with the epoch recorded, if fencing.
+func (d *Datastore) stampEpoch(meta azblob.Metadata) azblob.Metadata {
+	epoch := d.Epoch()
+	if epoch == 0 {
+		return meta
+	}
+	stamped := make(azblob.Metadata, len(meta)+1)
+	for name, value := range meta {
+		stamped[name] = value
+	}
+	stamped[metaEpoch] = strconv.FormatUint(epoch, 10)
+	return stamped
+}
+
+// checkEpoch returns ErrStaleEpoch if meta records a newer epoch than this
+// datastore's. Values without one were written unfenced and may be
+// replaced.
+func (d *Datastore) checkEpoch(meta azblob.Metadata) error {
+	written, err := strconv.ParseUint(meta[metaEpoch], 10, 64)
+	if err == nil && written > d.Epoch() {
+		return ErrStaleEpoch
+	}
+	return nil
+}
+
+// fence checks, if fencing, that the value of blob was not written under a
+// newer epoch. If ac has no ETag condition, it returns ac conditioned on
+// the value checked, so the write cannot replace another written since,
+// and reports that it did so the write can be retried should that happen.
+func (d *Datastore) fence(ctx context.Context, blob azblob.BlobURL, ac azblob.BlobAccessConditions) (azblob.BlobAccessConditions, bool, error) {
+	if d.Epoch() == 0 {
+		return ac, false, nil
+	}
+	own := ac.IfMatch == azblob.ETagNone && ac.IfNoneMatch == azblob.ETagNone
+	props, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, d.config.cpk)
+	switch {
+	case isError(err, azblob.ServiceCodeBlobNotFound) || isError(err, azblob.ServiceCodeContainerNotFound):
+		if own {
+			ac.IfNoneMatch = azblob.ETagAny
+		}
+	case err != nil:
+		return ac, false, err
+	default:
+		if err := d.checkEpoch(props.NewMetadata()); err != nil {
+			return ac, false, err
+		}
+		if own {
+			ac.IfMatch = props.ETag()
+		}
+	}
+	return ac, own, nil
+}
+
+// raced reports whether err is a write failing the condition fence added,
+// because another write of the key came in between.
+func raced(err error) bool {
+	return isError(err, azblob.ServiceCodeConditionNotMet) || isError(err, azblob.ServiceCodeBlobAlreadyExists)
+}
@@ -0,0 +1,186 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// DefaultForkParallelism is the number of copies Fork runs at once.
+const DefaultForkParallelism = 32
+
+// ForkOptions configures Fork.
+type ForkOptions struct {
+	// Parallelism is the number of copies in flight. Defaults to
+	// DefaultForkParallelism.
+	Parallelism int
+	// Snapshot snapshots every source blob before copying any, and copies
+	// from the snapshots. Without it each blob is copied as it is when its
+	// copy starts, so writes made during a long fork can leave the clone
+	// mixing old and new values; with it the clone reflects the sources
+	// as of the snapshot pass, which is much shorter. The snapshots are
+	// deleted afterwards.
+	Snapshot bool
+}
+
+// Fork clones every key under src to the same path under dst, using
+// server-side copies so no value passes through the caller. It returns
+// the number of keys copied. Existing keys under dst are overwritten;
+// src and dst may not overlap.
+//
+// Routes apply as usual, but a copy between containers of different
+// accounts needs the source to be readable by the destination, such as a
+// route with a SAS. Values encrypted with a customer-provided key cannot
+// be copied by the service, so Fork fails with WithCustomerProvidedKey.
+func (d *Datastore) Fork(ctx context.Context, src, dst ds.Key, opts ForkOptions) (n int, err error) {
+	if src.Equal(dst) || src.IsAncestorOf(dst) || dst.IsAncestorOf(src) {
+		return 0, fmt.Errorf("azure: cannot fork %s into overlapping %s", src, dst)
+	}
+	if d.config.cpk.EncryptionKey != nil {
+		return 0, errors.New("azure: cannot fork values encrypted with a customer-provided key")
+	}
+	ctx, done, err := d.life.begin(ctx, dst, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { done(err) }()
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = DefaultForkParallelism
+	}
+
+	names, _, err := d.listNames(ctx, src, 0)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(names))
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		if err := d.ensureFor(ctx, dst); err != nil {
+			return 0, err
+		}
+	}
+
+	snapshots := make(map[string]string, len(keys))
+	if opts.Snapshot {
+		var mu sync.Mutex
+		err := forEach(ctx, len(keys), opts.Parallelism, func(ctx context.Context, i int) error {
+			k := keys[i]
+			resp, err := d.keyUrl(ds.RawKey(k)).CreateSnapshot(ctx, azblob.Metadata{}, azblob.BlobAccessConditions{}, d.config.cpk)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			snapshots[k] = resp.Snapshot()
+			mu.Unlock()
+			return nil
+		})
+		defer d.deleteSnapshots(snapshots)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = forEach(ctx, len(keys), opts.Parallelism, func(ctx context.Context, i int) error {
+		k := keys[i]
+		source := d.keyUrl(ds.RawKey(k)).BlobURL
+		if s, ok := snapshots[k]; ok {
+			source = source.WithSnapshot(s)
+		}
+		// A source read with a SAS needs the token in its URL, since the
+		// service reads it, not this client.
+		sourceURL := source.URL()
+		if sas, ok := d.routeFor(ds.RawKey(k)).credential.(*sasCredential); ok {
+			sourceURL = sas.sign(ctx, sourceURL)
+		}
+		target := ds.NewKey(dst.String() + strings.TrimPrefix(k, src.String()))
+		return copyBlob(ctx, d.keyUrl(target).BlobURL, sourceURL)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// copyBlob starts a server-side copy and waits for it to complete.
+func copyBlob(ctx context.Context, dst azblob.BlobURL, src url.URL) error {
+	resp, err := dst.StartCopyFromURL(ctx, src, azblob.Metadata{}, azblob.ModifiedAccessConditions{},
+		azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil)
+	if err != nil {
+		return err
+	}
+	status := resp.CopyStatus()
+	for wait := 50 * time.Millisecond; status == azblob.CopyStatusPending; wait *= 2 {
+		if wait > 2*time.Second {
+			wait = 2 * time.Second
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		props, err := dst.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return err
+		}
+		status = props.CopyStatus()
+	}
+	if status != azblob.CopyStatusSuccess {
+		return fmt.Errorf("azure: copy from %s ended %s", src.Path, status)
+	}
+	return nil
+}
+
+func (d *Datastore) deleteSnapshots(snapshots map[string]string) {
+	ctx := context.Background()
+	for k, s := range snapshots {
+		d.keyUrl(ds.RawKey(k)).WithSnapshot(s).Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	}
+}
+
+// forEach calls fn for 0 through n-1 with at most parallelism calls at
+// once, stopping at the first error.
+func forEach(ctx context.Context, n, parallelism int, fn func(context.Context, int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+		sem   = make(chan struct{}, parallelism)
+	)
+	for i := 0; i < n; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			if err := fn(ctx, i); err != nil {
+				once.Do(func() { first = err; cancel() })
+			}
+		}(i)
+	}
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
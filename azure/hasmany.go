@@ -0,0 +1,188 @@
+package azure
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"go.uber.org/multierr"
+)
+
+const (
+	// hasParallelism caps the property requests HasMany, and the
+	// downloads GetMany, have in flight.
+	hasParallelism = 32
+	// listThreshold is the number of keys sharing a parent at which
+	// HasMany lists the parent instead of checking each key.
+	listThreshold = 64
+	// listPerKey bounds the blobs HasMany lists under a parent, per key
+	// the listing answers. Parents holding more, such as the root of a
+	// large container, have their keys checked one at a time instead.
+	listPerKey = 16
+)
+
+// HasMany reports which of keys exist. See HasManyContext.
+func (d *Datastore) HasMany(keys []ds.Key) (map[ds.Key]bool, error) {
+	return d.HasManyContext(context.Background(), keys)
+}
+
+// HasManyContext reports which of keys exist. Keys sharing a parent with
+// many others are answered by listing that parent, unless the datastore
+// is sharded or the parent holds many more blobs than the keys asked
+// about; the rest are checked with bounded parallel property requests.
+// This replaces thousands of serial Has calls when verifying large key
+// sets.
+func (d *Datastore) HasManyContext(ctx context.Context, keys []ds.Key) (map[ds.Key]bool, error) {
+	ctx, done, err := d.life.begin(ctx, ds.RawKey("/"), false)
+	if err != nil {
+		return nil, err
+	}
+	defer done(nil)
+
+	found := make(map[ds.Key]bool, len(keys))
+	for _, k := range keys {
+		found[k] = false
+	}
+	lists, heads := d.planHasMany(keys)
+
+	var (
+		mu   sync.Mutex
+		errs error
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, hasParallelism)
+	)
+	fail := func(err error) {
+		mu.Lock()
+		errs = multierr.Append(errs, err)
+		mu.Unlock()
+	}
+
+	for parent, want := range lists {
+		parent, want := parent, want
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			present, complete, err := d.listNames(ctx, parent, len(want)*listPerKey)
+			if err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !complete {
+				heads = append(heads, want...)
+				return
+			}
+			for _, k := range want {
+				// Listings do not see puts still queued.
+				_, queued := d.queued(k)
+				found[k] = present[k.String()] || queued
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, k := range heads {
+		k := k
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			exists, err := d.HasContext(ctx, k)
+			if err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			found[k] = exists
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if errs != nil {
+		return nil, errs
+	}
+	return found, nil
+}
+
+// planHasMany splits keys into parents worth listing, with the keys each
+// answers, and keys to check one at a time. A parent is only listed when
+// its keys live in the same container as the parent itself.
+func (d *Datastore) planHasMany(keys []ds.Key) (map[ds.Key][]ds.Key, []ds.Key) {
+	byParent := make(map[ds.Key][]ds.Key)
+	for _, k := range keys {
+		p := k.Parent()
+		byParent[p] = append(byParent[p], k)
+	}
+
+	lists := make(map[ds.Key][]ds.Key)
+	var heads []ds.Key
+	for p, ks := range byParent {
+		if len(ks) < listThreshold || !d.sameContainer(p, ks) || d.config.shard != nil {
+			heads = append(heads, ks...)
+			continue
+		}
+		lists[p] = ks
+	}
+	return lists, heads
+}
+
+func (d *Datastore) sameContainer(parent ds.Key, keys []ds.Key) bool {
+	c := d.containerFor(parent)
+	u := c.URL()
+	for _, k := range keys {
+		kc := d.containerFor(k)
+		ku := kc.URL()
+		if ku.String() != u.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// listNames returns the keys of the blobs under parent, and whether that
+// is all of them: given a positive limit, the listing stops once it has
+// listed more blobs than that.
+func (d *Datastore) listNames(ctx context.Context, parent ds.Key, limit int) (map[string]bool, bool, error) {
+	container := d.containerFor(parent)
+	prefix := parent.String()
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	names := make(map[string]bool)
+	listed := 0
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		page := d.config.bulkPageSize()
+		if limit > 0 {
+			if listed > limit {
+				return nil, false, nil
+			}
+			if rest := limit - listed + 1; rest < int(page) {
+				page = int32(rest)
+			}
+		}
+		list, err := container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix:     d.listPrefix(prefix),
+			MaxResults: page,
+			Details:    azblob.BlobListingDetails{Metadata: true},
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		listed += len(list.Segment.BlobItems)
+		for _, blob := range list.Segment.BlobItems {
+			if d.expired(blob.Metadata) {
+				continue
+			}
+			if k, ok := d.keyFor(blob.Name); ok && strings.HasPrefix(k.String(), prefix) {
+				names[k.String()] = true
+			}
+		}
+		marker = list.NextMarker
+	}
+	return names, limit <= 0 || listed <= limit, nil
+}
@@ -0,0 +1,47 @@
+package azure
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestPlanHasMany(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("secret"))
+	cred, err := azblob.NewSharedKeyCredential("main", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	routes, err := cfg.buildRoutes([]Route{
+		{Prefix: ds.NewKey("/split/routed"), SAS: "?sig=abc"},
+	}, "main", "data", cred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://main.blob.core.windows.net/data")
+	d := &Datastore{
+		containerUrl: azblob.NewContainerURL(*u, azblob.NewPipeline(cred, azblob.PipelineOptions{})),
+		routes:       routes,
+	}
+
+	var keys []ds.Key
+	for i := 0; i < listThreshold; i++ {
+		keys = append(keys, ds.NewKey(fmt.Sprintf("/blocks/%d", i)))
+		keys = append(keys, ds.NewKey(fmt.Sprintf("/split/%d", i)))
+	}
+	keys = append(keys, ds.NewKey("/split/routed"), ds.NewKey("/few/a"), ds.NewKey("/few/b"))
+
+	lists, heads := d.planHasMany(keys)
+	if len(lists) != 1 || len(lists[ds.NewKey("/blocks")]) != listThreshold {
+		t.Fatalf("unexpected lists %v", lists)
+	}
+	// /split holds a key routed elsewhere, so it is not listed.
+	if len(heads) != listThreshold+3 {
+		t.Fatalf("%d keys checked individually", len(heads))
+	}
+}
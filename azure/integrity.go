@@ -0,0 +1,91 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrCorrupt matches, with errors.Is, the CorruptErrors of reads of values
+// that fail their integrity check.
+var ErrCorrupt = errors.New("azure: value is corrupt")
+
+// CorruptError is returned by reads of a value whose content does not
+// match the MD5 stored with it when it was put, as after bit rot or an
+// incomplete upload.
+type CorruptError struct {
+	Key ds.Key
+	// Want is the stored MD5 and Got the MD5 of the content read.
+	Want, Got []byte
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("azure: %s is corrupt: content MD5 %x, stored %x", e.Key, e.Got, e.Want)
+}
+
+// Is makes CorruptErrors match ErrCorrupt.
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// WithMD5Verification sets whether reads check values against the MD5
+// stored with them, returning a CorruptError on a mismatch. On by
+// default. Puts store the MD5 of values either way, except for values
+// streamed by PutReader without a known size, and values without one are
+// not checked.
+func WithMD5Verification(verify bool) Option {
+	return func(c *config) {
+		c.verifyMD5 = verify
+	}
+}
+
+// contentMD5 returns the MD5 of value.
+func contentMD5(value []byte) []byte {
+	sum := md5.Sum(value)
+	return sum[:]
+}
+
+// verify checks value against the MD5 stored with it, if there is one.
+func (d *Datastore) verify(key ds.Key, value, stored []byte) error {
+	if !d.config.verifyMD5 || len(stored) == 0 {
+		return nil
+	}
+	if got := contentMD5(value); !bytes.Equal(got, stored) {
+		return &CorruptError{Key: key, Want: stored, Got: got}
+	}
+	return nil
+}
+
+// verifyingReader checks a streamed value against its stored MD5 when
+// the stream ends, failing the last read on a mismatch.
+type verifyingReader struct {
+	io.ReadCloser
+	key    ds.Key
+	stored []byte
+	hash   hash.Hash
+}
+
+// verifyReader returns r checked against stored, if there is an MD5 to
+// check.
+func (d *Datastore) verifyReader(key ds.Key, r io.ReadCloser, stored []byte) io.ReadCloser {
+	if !d.config.verifyMD5 || len(stored) == 0 {
+		return r
+	}
+	return &verifyingReader{ReadCloser: r, key: key, stored: stored, hash: md5.New()}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := r.hash.Sum(nil); !bytes.Equal(got, r.stored) {
+			return n, &CorruptError{Key: r.key, Want: r.stored, Got: got}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,119 @@
+package azure
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// tagTTLDays is the blob index tag naming the lifecycle rule that deletes
+// a value with a TTL, by the days after its last write it is deleted.
+const tagTTLDays = "dsttldays"
+
+// DefaultLifecycleDays are the TTLs, in days, that WithLifecycleTTL tags
+// values for when given none.
+var DefaultLifecycleDays = []int{1, 2, 3, 7, 14, 30, 60, 90, 180, 365}
+
+// WithLifecycleTTL tags the values written with a TTL for lifecycle
+// management rules, which delete them on the service side, at no request
+// cost, rather than leaving expired values in the container until
+// overwritten. Install the rules given by LifecyclePolicy in the storage
+// account's management policy.
+//
+// A rule deletes the values tagged for it a whole number of days after
+// they were last written, so a TTL is rounded up to the nearest of days,
+// or DefaultLifecycleDays if none are given, and values whose TTL is
+// longer than all of them are not tagged. Tags need an account with blob
+// index support, and a SAS used with them the tag permission.
+func WithLifecycleTTL(days ...int) Option {
+	if len(days) == 0 {
+		days = DefaultLifecycleDays
+	}
+	var buckets []int
+	for _, n := range days {
+		if n > 0 {
+			buckets = append(buckets, n)
+		}
+	}
+	sort.Ints(buckets)
+	return func(c *config) {
+		c.lifecycleDays = buckets
+	}
+}
+
+// lifecycleTags returns the index tags of a value with the given
+// metadata: the rule its expiry falls under, or none.
+func (d *Datastore) lifecycleTags(meta azblob.Metadata) azblob.BlobTagsMap {
+	exp := expiration(meta)
+	if len(d.config.lifecycleDays) == 0 || exp.IsZero() {
+		return nil
+	}
+	left := exp.Sub(d.now())
+	days := int((left + 24*time.Hour - 1) / (24 * time.Hour))
+	for _, n := range d.config.lifecycleDays {
+		if n >= days {
+			return azblob.BlobTagsMap{tagTTLDays: strconv.Itoa(n)}
+		}
+	}
+	return nil
+}
+
+// LifecyclePolicy returns the lifecycle management policy deleting the
+// values WithLifecycleTTL tags in this datastore's container, as the JSON
+// the Azure portal and CLI take, for example with
+//
+//	az storage account management-policy create --policy @policy.json
+//
+// It replaces the account's policy, so merge its rules into any existing
+// one. The service applies its rules about once a day, so values go some
+// time after they expire; they read as missing in between. Snapshots kept
+// by WithVersioning are not deleted, nor are routed containers' values.
+func (d *Datastore) LifecyclePolicy() ([]byte, error) {
+	container := azblob.NewBlobURLParts(d.containerUrl.URL()).ContainerName
+	var policy lifecyclePolicy
+	for _, n := range d.config.lifecycleDays {
+		var rule lifecycleRule
+		rule.Enabled = true
+		rule.Name = "dsttl" + strconv.Itoa(n) + "d"
+		rule.Type = "Lifecycle"
+		rule.Definition.Filters.BlobTypes = []string{"blockBlob"}
+		rule.Definition.Filters.PrefixMatch = []string{container + "/"}
+		rule.Definition.Filters.BlobIndexMatch = []lifecycleTagFilter{{Name: tagTTLDays, Op: "==", Value: strconv.Itoa(n)}}
+		rule.Definition.Actions.BaseBlob.Delete.DaysAfterModificationGreaterThan = n
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return json.MarshalIndent(policy, "", "  ")
+}
+
+type lifecyclePolicy struct {
+	Rules []lifecycleRule `json:"rules"`
+}
+
+type lifecycleRule struct {
+	Enabled    bool   `json:"enabled"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Definition struct {
+		Filters struct {
+			BlobTypes      []string             `json:"blobTypes"`
+			PrefixMatch    []string             `json:"prefixMatch"`
+			BlobIndexMatch []lifecycleTagFilter `json:"blobIndexMatch"`
+		} `json:"filters"`
+		Actions struct {
+			BaseBlob struct {
+				Delete struct {
+					DaysAfterModificationGreaterThan int `json:"daysAfterModificationGreaterThan"`
+				} `json:"delete"`
+			} `json:"baseBlob"`
+		} `json:"actions"`
+	} `json:"definition"`
+}
+
+type lifecycleTagFilter struct {
+	Name  string `json:"name"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
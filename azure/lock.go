@@ -0,0 +1,151 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+)
+
+// LockKey is the key of the blob whose lease is the container lock. It is
+// stored like any other key, but hidden from queries and left alone by
+// Clear and Backup.
+var LockKey = ds.NewKey("/.lock")
+
+// internalKey reports whether k is one of the keys the datastore keeps its
+// own state under, LockKey and EpochKey.
+func internalKey(k ds.Key) bool {
+	return k.Equal(LockKey) || k.Equal(EpochKey)
+}
+
+var (
+	// ErrLocked is returned by AcquireLock when another holder has the
+	// container lock.
+	ErrLocked = errors.New("azure: container locked by another holder")
+	// ErrLockLost is returned by writes once the container lock could not
+	// be renewed, as another holder may have taken it since.
+	ErrLockLost = errors.New("azure: container lock lost")
+)
+
+const (
+	// lockLease is how long the container lock's lease lasts unrenewed.
+	lockLease = 30 * time.Second
+	// lockRenewal is how often the lease is renewed.
+	lockRenewal = 10 * time.Second
+)
+
+// containerLock is the state of the container lock held by a Datastore.
+type containerLock struct {
+	mu      sync.Mutex
+	leaseID string
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// AcquireLock takes the container lock, so that only one datastore at a
+// time owns the container, like the repo.lock of flatfs. It returns
+// ErrLocked if another holder has it, and nil if this datastore does.
+//
+// The lock is a lease on the blob at LockKey, renewed in the background
+// until ReleaseLock or Close. A holder that stops renewing, by crashing or
+// losing its connection, loses the lock within 30 seconds. If renewal
+// fails for that long, the lock is treated as lost: writes fail with
+// ErrLockLost until the lock is released or acquired again.
+func (d *Datastore) AcquireLock(ctx context.Context) error {
+	l := &d.lock
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		return nil
+	}
+
+	blob := d.keyUrl(LockKey)
+	for created := false; ; created = true {
+		resp, err := blob.AcquireLease(ctx, "", int32(lockLease/time.Second), azblob.ModifiedAccessConditions{})
+		switch {
+		case err == nil:
+			l.leaseID = resp.LeaseID()
+			l.stop, l.stopped = make(chan struct{}), make(chan struct{})
+			d.life.fenceWrites(nil)
+			go d.renewLock(l.leaseID, l.stop, l.stopped)
+			return nil
+		case isError(err, azblob.ServiceCodeLeaseAlreadyPresent):
+			return ErrLocked
+		case (isError(err, azblob.ServiceCodeBlobNotFound) || isError(err, azblob.ServiceCodeContainerNotFound)) && !created:
+			if err := d.ensureFor(ctx, LockKey); err != nil {
+				return err
+			}
+			_, err = blob.Upload(ctx, bytes.NewReader(nil), azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+				azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}},
+				azblob.AccessTierNone, nil, d.config.cpk)
+			if err != nil && !isError(err, azblob.ServiceCodeBlobAlreadyExists) {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// renewLock renews the lease until stop is closed, fencing writes off if
+// it cannot for as long as the lease lasts, or is told the lease is gone.
+func (d *Datastore) renewLock(leaseID string, stop, stopped chan struct{}) {
+	defer close(stopped)
+	clk := clock.OrReal(d.config.clock)
+	blob := d.keyUrl(LockKey)
+	renewed := clk.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-clk.After(lockRenewal):
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		timer := time.AfterFunc(lockRenewal, cancel)
+		_, err := blob.RenewLease(ctx, leaseID, azblob.ModifiedAccessConditions{})
+		timer.Stop()
+		cancel()
+		switch {
+		case err == nil:
+			renewed = clk.Now()
+			continue
+		case isError(err, azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation),
+			isError(err, azblob.ServiceCodeLeaseNotPresentWithLeaseOperation),
+			isError(err, azblob.ServiceCodeBlobNotFound),
+			clk.Now().Sub(renewed) >= lockLease:
+		default:
+			d.config.logf("azure: renewing container lock: %s", brief(err))
+			continue
+		}
+		d.config.logf("azure: container lock lost: %s", brief(err))
+		d.life.fenceWrites(ErrLockLost)
+		return
+	}
+}
+
+// ReleaseLock releases the container lock, if this datastore holds it.
+// Releasing a lock that was lost is not an error.
+func (d *Datastore) ReleaseLock(ctx context.Context) error {
+	l := &d.lock
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == nil {
+		return nil
+	}
+	close(l.stop)
+	<-l.stopped
+	l.stop, l.stopped = nil, nil
+	d.life.fenceWrites(nil)
+
+	_, err := d.keyUrl(LockKey).ReleaseLease(ctx, l.leaseID, azblob.ModifiedAccessConditions{})
+	if isError(err, azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation) ||
+		isError(err, azblob.ServiceCodeLeaseNotPresentWithLeaseOperation) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// slowRequest is how long a request takes before it is logged as slow.
+const slowRequest = 3 * time.Second
+
+// Logger receives the datastore's diagnostics: failed and slow requests
+// to Azure, and failures of background work no caller sees, such as an
+// asynchronous put or a disk usage refresh. A *log.Logger is a Logger.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// WithLogger sends diagnostics to l. By default they are discarded:
+// errors are returned to callers, and nothing is written to stderr or
+// syslog.
+func WithLogger(l Logger) Option {
+	return func(c *config) {
+		c.logger = l
+	}
+}
+
+// logf logs a diagnostic, if there is a logger.
+func (c *config) logf(format string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, args...)
+	}
+}
+
+// loggingPolicy returns the pipeline policy logging requests that fail,
+// other than with the statuses the datastore expects, such as a missing
+// blob, or that are slow. It replaces azblob's request log policy, which
+// writes errors to stderr or syslog whatever the options. The query
+// string is left out of the logged path, as it can hold a SAS.
+func (c *config) loggingPolicy() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			start := time.Now()
+			resp, err := next.Do(ctx, request)
+			took := time.Since(start)
+			path := request.URL.Host + request.URL.Path
+
+			status := 0
+			if err == nil {
+				status = resp.Response().StatusCode
+			} else if serr, ok := err.(azblob.StorageError); ok && serr.Response() != nil {
+				status = serr.Response().StatusCode
+			}
+			switch {
+			case err != nil && status == 0:
+				if ctx.Err() == nil {
+					c.logf("azure: %s %s failed after %v: %v", request.Method, path, took, err)
+				}
+			case failed(status):
+				c.logf("azure: %s %s: %d %s after %v", request.Method, path, status, requestID(resp, err), took)
+			case took > slowRequest:
+				c.logf("azure: %s %s: slow, %d after %v", request.Method, path, status, took)
+			}
+			return resp, err
+		}
+	})
+}
+
+// failed reports whether a response status is an error the datastore
+// does not expect in normal operation.
+func failed(status int) bool {
+	switch status {
+	case http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed,
+		http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+		return false
+	}
+	return status >= 400
+}
+
+// brief returns err on one line. A StorageError's own message spans
+// many, dumping the request and response.
+func brief(err error) string {
+	var serr azblob.StorageError
+	if errors.As(err, &serr) {
+		if r := serr.Response(); r != nil {
+			return fmt.Sprintf("%s (%d)", serr.ServiceCode(), r.StatusCode)
+		}
+		return string(serr.ServiceCode())
+	}
+	return err.Error()
+}
+
+// requestID returns the x-ms-request-id of a response, to look it up with
+// Azure support.
+func requestID(resp pipeline.Response, err error) string {
+	var r *http.Response
+	if resp != nil {
+		r = resp.Response()
+	}
+	if serr, ok := err.(azblob.StorageError); ok && r == nil {
+		r = serr.Response()
+	}
+	if r == nil {
+		return ""
+	}
+	return "request " + r.Header.Get("x-ms-request-id")
+}
@@ -0,0 +1,178 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// KeyErrors is returned by the bulk operations when some of their keys
+// failed, with the error of each. The keys it does not hold succeeded.
+type KeyErrors map[ds.Key]error
+
+func (e KeyErrors) Error() string {
+	keys := make([]ds.Key, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	// A few are enough to go on; thousands would bury the message.
+	const shown = 3
+	msgs := make([]string, 0, shown)
+	for _, k := range keys {
+		if len(msgs) == shown {
+			msgs = append(msgs, "...")
+			break
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %s", k, brief(e[k])))
+	}
+	return fmt.Sprintf("azure: %d keys failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// eachKey calls fn for each of keys, parallelism at a time, and returns
+// the errors of those that failed as KeyErrors, or nil. Keys not yet
+// started when ctx is done fail with its error.
+func eachKey(ctx context.Context, keys []ds.Key, parallelism int, fn func(context.Context, ds.Key) error) error {
+	errs := make(KeyErrors)
+	for i, err := range eachIndex(ctx, len(keys), parallelism, func(ctx context.Context, i int) error {
+		return fn(ctx, keys[i])
+	}) {
+		errs[keys[i]] = err
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// eachIndex calls fn for each index up to n, parallelism at a time, and
+// returns the errors of those that failed. Unlike forEach, a failure does
+// not stop the others; indexes not yet started when ctx is done fail with
+// its error.
+func eachIndex(ctx context.Context, n, parallelism int, fn func(context.Context, int) error) map[int]error {
+	var (
+		mu   sync.Mutex
+		errs = make(map[int]error)
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, parallelism)
+	)
+	fail := func(i int, err error) {
+		mu.Lock()
+		errs[i] = err
+		mu.Unlock()
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			fail(i, err)
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			if err := fn(ctx, i); err != nil {
+				fail(i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// PutMany stores values. See PutManyContext.
+func (d *Datastore) PutMany(values map[ds.Key][]byte) error {
+	return d.PutManyContext(context.Background(), values)
+}
+
+// PutManyContext stores values, uploading up to 16 at once, each as Put
+// would. Unlike a Batch commit, it does not stop at the first failure:
+// if any keys failed, it returns KeyErrors naming them, and the rest are
+// stored.
+func (d *Datastore) PutManyContext(ctx context.Context, values map[ds.Key][]byte) error {
+	keys := make([]ds.Key, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	return eachKey(ctx, keys, batchParallelism, func(ctx context.Context, k ds.Key) error {
+		return d.PutContext(ctx, k, values[k])
+	})
+}
+
+// GetMany returns the values of keys. See GetManyContext.
+func (d *Datastore) GetMany(keys []ds.Key) (map[ds.Key][]byte, error) {
+	return d.GetManyContext(context.Background(), keys)
+}
+
+// GetManyContext returns the values of keys, downloading up to 32 at
+// once, each as Get would. Keys that do not exist are left out of the
+// values rather than failing. If any keys failed, it returns KeyErrors
+// naming them along with the values of the rest.
+func (d *Datastore) GetManyContext(ctx context.Context, keys []ds.Key) (map[ds.Key][]byte, error) {
+	var mu sync.Mutex
+	values := make(map[ds.Key][]byte, len(keys))
+	err := eachKey(ctx, keys, hasParallelism, func(ctx context.Context, k ds.Key) error {
+		v, err := d.GetContext(ctx, k)
+		if err == ds.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		values[k] = v
+		mu.Unlock()
+		return nil
+	})
+	return values, err
+}
+
+// DeleteMany removes keys. See DeleteManyContext.
+func (d *Datastore) DeleteMany(keys []ds.Key) error {
+	return d.DeleteManyContext(context.Background(), keys)
+}
+
+// DeleteManyContext removes keys with the Blob Batch API, as a Batch
+// commit does: 256 per request, up to 16 requests at once. Keys already
+// missing are not an error. Unlike a Batch commit, it does not stop at
+// the first failure: if any keys failed, it returns KeyErrors naming
+// them, and the rest are deleted. A request failing as a whole fails
+// each of its keys.
+func (d *Datastore) DeleteManyContext(ctx context.Context, keys []ds.Key) error {
+	errs := make(KeyErrors)
+	// Deleting first would let a queued put bring a key back.
+	deletes := keys[:0:0]
+	for _, k := range keys {
+		if err := d.waitQueued(ctx, k); err != nil {
+			errs[k] = err
+			continue
+		}
+		deletes = append(deletes, k)
+	}
+
+	chunks := d.chunkDeletes(deletes)
+	for i, err := range eachIndex(ctx, len(chunks), batchParallelism, func(ctx context.Context, i int) error {
+		return d.deleteBatch(ctx, chunks[i].route, chunks[i].keys)
+	}) {
+		if kerrs, ok := err.(KeyErrors); ok {
+			for k, err := range kerrs {
+				errs[k] = err
+			}
+			continue
+		}
+		for _, k := range chunks[i].keys {
+			errs[k] = err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
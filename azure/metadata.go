@@ -0,0 +1,224 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// reservedMetaPrefix starts the names of the metadata entries the
+// datastore keeps for itself, such as a key's expiry.
+const reservedMetaPrefix = "ds"
+
+// PutWithMetadata stores value with meta attached. See
+// PutWithMetadataContext.
+func (d *Datastore) PutWithMetadata(key ds.Key, value []byte, meta map[string]string) error {
+	return d.PutWithMetadataContext(context.Background(), key, value, meta)
+}
+
+// PutWithMetadataContext stores value with meta attached, as the blob's
+// user metadata. Names must be identifiers, letters, digits and
+// underscores not starting with a digit, and not start with "ds", which is
+// reserved; they are case-insensitive and read back in lower case. Values
+// must be printable ASCII. Azure limits the metadata of a blob to 8 KiB.
+//
+// The metadata belongs to the value: a later Put, or PutWithTTL, replaces
+// both. With WithAsyncPuts, a queued put of key is waited for first.
+func (d *Datastore) PutWithMetadataContext(ctx context.Context, key ds.Key, value []byte, meta map[string]string) (err error) {
+	m, err := blobMetadata(meta)
+	if err != nil {
+		return err
+	}
+	if err := d.waitQueued(ctx, key); err != nil {
+		return err
+	}
+	ctx, done, err := d.life.begin(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return d.put(ctx, key, value, m)
+}
+
+// GetMetadata returns the metadata stored with the value of key. See
+// GetMetadataContext.
+func (d *Datastore) GetMetadata(key ds.Key) (map[string]string, error) {
+	return d.GetMetadataContext(context.Background(), key)
+}
+
+// GetMetadataContext returns the metadata stored with the value of key
+// by PutWithMetadata, with names in lower case, or nil if it has none.
+// It does not download the value. QueryWithMetadata lists the same
+// metadata along with the keys.
+func (d *Datastore) GetMetadataContext(ctx context.Context, key ds.Key) (meta map[string]string, err error) {
+	if _, ok := d.queued(key); ok {
+		// The queued put replaces whatever metadata is stored.
+		return nil, nil
+	}
+	ctx, done, err := d.life.begin(ctx, key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { done(err) }()
+
+	props, err := d.keyUrl(key).GetProperties(ctx, azblob.BlobAccessConditions{}, d.config.cpk)
+	if err != nil {
+		if isError(err, azblob.ServiceCodeBlobNotFound) {
+			return nil, ds.ErrNotFound
+		}
+		return nil, err
+	}
+	stored := props.NewMetadata()
+	if d.expired(stored) {
+		return nil, ds.ErrNotFound
+	}
+	return userMetadata(stored), nil
+}
+
+// MetadataResult is a result of QueryWithMetadata.
+type MetadataResult struct {
+	query.Result
+	// Metadata is the metadata stored with the value by PutWithMetadata,
+	// as GetMetadata returns it: nil if it has none.
+	Metadata map[string]string
+}
+
+// MetadataResults are the results of QueryWithMetadata.
+type MetadataResults struct {
+	results query.Results
+	meta    *metaIndex
+}
+
+// QueryWithMetadata runs a query as QueryContext does, returning the
+// metadata stored with each value alongside its entry, read from the same
+// listing. Listings always include metadata, whatever
+// WithMinimalKeyListings says.
+func (d *Datastore) QueryWithMetadata(ctx context.Context, q query.Query) (*MetadataResults, error) {
+	meta := &metaIndex{byKey: make(map[string]map[string]string)}
+	r, err := d.query(ctx, q, meta)
+	if err != nil {
+		return nil, err
+	}
+	return &MetadataResults{results: r, meta: meta}, nil
+}
+
+// Next returns the next result, waiting for it, or false once there are
+// no more.
+func (r *MetadataResults) Next() (MetadataResult, bool) {
+	res, ok := r.results.NextSync()
+	if !ok {
+		return MetadataResult{}, false
+	}
+	m := MetadataResult{Result: res}
+	if res.Error == nil {
+		m.Metadata = r.meta.take(res.Key)
+	}
+	return m, true
+}
+
+// Rest returns the remaining results, stopping at the first error.
+func (r *MetadataResults) Rest() ([]MetadataResult, error) {
+	var rest []MetadataResult
+	for {
+		m, ok := r.Next()
+		if !ok {
+			return rest, nil
+		}
+		if m.Error != nil {
+			return rest, m.Error
+		}
+		rest = append(rest, m)
+	}
+}
+
+// Close ends the query.
+func (r *MetadataResults) Close() error {
+	return r.results.Close()
+}
+
+// metaIndex holds the metadata of the keys a query listed until their
+// results are read, after any filters and orders applied to them.
+type metaIndex struct {
+	mu    sync.Mutex
+	byKey map[string]map[string]string
+}
+
+func (m *metaIndex) set(key string, meta map[string]string) {
+	if meta == nil {
+		return
+	}
+	m.mu.Lock()
+	m.byKey[key] = meta
+	m.mu.Unlock()
+}
+
+func (m *metaIndex) take(key string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meta := m.byKey[key]
+	delete(m.byKey, key)
+	return meta
+}
+
+// blobMetadata validates meta and returns it as blob metadata.
+func blobMetadata(meta map[string]string) (azblob.Metadata, error) {
+	m := make(azblob.Metadata, len(meta))
+	for name, value := range meta {
+		lower := strings.ToLower(name)
+		if !isIdentifier(lower) {
+			return nil, fmt.Errorf("azure: invalid metadata name %q", name)
+		}
+		if strings.HasPrefix(lower, reservedMetaPrefix) {
+			return nil, fmt.Errorf("azure: metadata name %q is reserved", name)
+		}
+		if _, ok := m[lower]; ok {
+			return nil, fmt.Errorf("azure: duplicate metadata name %q", name)
+		}
+		for i := 0; i < len(value); i++ {
+			if value[i] < 0x20 || value[i] > 0x7e {
+				return nil, fmt.Errorf("azure: invalid metadata value for %q", name)
+			}
+		}
+		m[lower] = value
+	}
+	return m, nil
+}
+
+// userMetadata returns the entries of meta not reserved by the datastore,
+// or nil if there are none.
+func userMetadata(meta azblob.Metadata) map[string]string {
+	var user map[string]string
+	for name, value := range meta {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, reservedMetaPrefix) {
+			continue
+		}
+		if user == nil {
+			user = make(map[string]string)
+		}
+		user[name] = value
+	}
+	return user
+}
+
+// isIdentifier reports whether s is a valid metadata name.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
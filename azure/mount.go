@@ -0,0 +1,79 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/mount"
+	"go.uber.org/multierr"
+)
+
+// ContainerMount mounts a container at a key prefix. Keys under Prefix are
+// stored in Container with the prefix removed.
+type ContainerMount struct {
+	Prefix    ds.Key
+	Container string
+	// Options are applied after those shared by every mount, for settings
+	// of this container alone, such as its own SAS or access tier.
+	Options []Option
+}
+
+// Mount is a datastore over several containers of an account, each
+// mounted at a key prefix, e.g. /blocks in one container and /pins in
+// another. A key lives in the container mounted at the longest prefix
+// covering it; queries over a parent of several mounts list them all, in
+// order. Closing it closes every container's datastore.
+type Mount struct {
+	*mount.Datastore
+	mounts map[ds.Key]*Datastore
+}
+
+// NewMount opens a Datastore for each container, with opts followed by the
+// mount's own options, and mounts them. Like NewDatastore it makes no
+// requests: each container is created before its first write. See
+// EnsureContainers.
+func NewMount(accountName string, mounts []ContainerMount, opts ...Option) (*Mount, error) {
+	m := &Mount{mounts: make(map[ds.Key]*Datastore, len(mounts))}
+	var children []mount.Mount
+	for _, cm := range mounts {
+		if _, dup := m.mounts[cm.Prefix]; dup {
+			m.close()
+			return nil, fmt.Errorf("azure: %s mounted twice", cm.Prefix)
+		}
+		d, err := NewDatastore(accountName, cm.Container, append(append([]Option{}, opts...), cm.Options...)...)
+		if err != nil {
+			m.close()
+			return nil, fmt.Errorf("azure: mounting %s at %s: %w", cm.Container, cm.Prefix, err)
+		}
+		m.mounts[cm.Prefix] = d
+		children = append(children, mount.Mount{Prefix: cm.Prefix, Datastore: d})
+	}
+	m.Datastore = mount.New(children)
+	return m, nil
+}
+
+// Mounted returns the datastore of the container mounted at prefix.
+func (m *Mount) Mounted(prefix ds.Key) (*Datastore, bool) {
+	d, ok := m.mounts[prefix]
+	return d, ok
+}
+
+// EnsureContainers creates every mounted container that does not exist.
+// See EnsureContainer.
+func (m *Mount) EnsureContainers(ctx context.Context) error {
+	var errs error
+	for prefix, d := range m.mounts {
+		if err := d.EnsureContainer(ctx); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("azure: container at %s: %w", prefix, err))
+		}
+	}
+	return errs
+}
+
+// close closes the datastores opened so far, when NewMount fails.
+func (m *Mount) close() {
+	for _, d := range m.mounts {
+		d.Close()
+	}
+}
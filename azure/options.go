@@ -0,0 +1,227 @@
+package azure
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/ipfs/go-datastore/clock"
+	"github.com/ipfs/go-datastore/flatfs"
+)
+
+const (
+	mib = 1 << 20
+
+	// DefaultSingleShotMax is the largest value uploaded in one request.
+	DefaultSingleShotMax = 32 * mib
+	// DefaultBlockSize is the size of the blocks staged for larger values.
+	DefaultBlockSize = 8 * mib
+	// DefaultMemoryBudget bounds the bytes buffered by one upload.
+	DefaultMemoryBudget = 64 * mib
+	// DefaultQueryMemoryBudget bounds the value bytes in flight in one
+	// query.
+	DefaultQueryMemoryBudget = 64 * mib
+)
+
+// Option configures a Datastore.
+type Option func(*config)
+
+type config struct {
+	singleShotMax int64
+	blockSize     int64
+	memoryBudget  int64
+
+	queryMemoryBudget int64
+
+	routes []Route
+
+	closeTimeout time.Duration
+
+	endpoint       string
+	endpointSuffix string
+
+	listPageSize    int
+	minimalListings bool
+
+	diskUsageMode   DiskUsageMode
+	diskUsageMaxAge time.Duration
+
+	clock clock.Clock
+
+	sasRefresh      SASRefresher
+	sasRefreshEvery time.Duration
+
+	retry      azblob.RetryOptions
+	telemetry  azblob.TelemetryOptions
+	httpClient *http.Client
+	tier       azblob.AccessTierType
+
+	credential func(accountName string) (pipeline.Factory, error)
+
+	shard *flatfs.ShardFunc
+
+	asyncWorkers int
+	walPath      string
+
+	downloadChunkSize int64
+	readRetry         azblob.RetryReaderOptions
+
+	rehydrate RehydrateOptions
+
+	verifyMD5 bool
+
+	cpk azblob.ClientProvidedKeyOptions
+
+	compression Compression
+
+	tracer Tracer
+
+	logger Logger
+
+	limiter *limiter
+
+	versioning bool
+
+	progress Progress
+
+	lifecycleDays []int
+}
+
+func defaultConfig() config {
+	return config{
+		singleShotMax: DefaultSingleShotMax,
+		blockSize:     DefaultBlockSize,
+		memoryBudget:  DefaultMemoryBudget,
+
+		downloadChunkSize: DefaultDownloadChunkSize,
+
+		queryMemoryBudget: DefaultQueryMemoryBudget,
+
+		closeTimeout: DefaultCloseTimeout,
+
+		endpointSuffix: PublicCloudSuffix,
+
+		diskUsageMaxAge: DefaultDiskUsageMaxAge,
+
+		tier: azblob.AccessTierNone,
+
+		credential: func(string) (pipeline.Factory, error) {
+			return azblob.NewAnonymousCredential(), nil
+		},
+
+		clock: clock.Real,
+
+		verifyMD5: true,
+	}
+}
+
+// WithUploadThresholds sets the largest value uploaded in a single request
+// and the block size used to stage larger values. Both are capped at the
+// service limits; zero keeps the default.
+func WithUploadThresholds(singleShotMax, blockSize int64) Option {
+	return func(c *config) {
+		if singleShotMax > 0 {
+			c.singleShotMax = min64(singleShotMax, azblob.BlockBlobMaxUploadBlobBytes)
+		}
+		if blockSize > 0 {
+			c.blockSize = min64(blockSize, azblob.BlockBlobMaxStageBlockBytes)
+		}
+	}
+}
+
+// WithMemoryBudget bounds the bytes a single upload holds in memory at once,
+// which sets how many blocks are staged in parallel and whether PutReader
+// buffers a value or streams it.
+func WithMemoryBudget(bytes int64) Option {
+	return func(c *config) {
+		if bytes > 0 {
+			c.memoryBudget = bytes
+		}
+	}
+}
+
+// WithQueryMemoryBudget bounds the value bytes a query holds at once,
+// counting values being downloaded and those waiting to be consumed. Once
+// it is spent the listing pauses until the caller reads more results.
+func WithQueryMemoryBudget(bytes int64) Option {
+	return func(c *config) {
+		if bytes > 0 {
+			c.queryMemoryBudget = bytes
+		}
+	}
+}
+
+// WithEndpoint serves the account from endpoint instead of
+// https://<account>.blob.core.windows.net, for emulators such as Azurite or
+// azuretest. endpoint is an http or https URL, such as
+// http://127.0.0.1:10000/devstoreaccount1 for Azurite, which serves the
+// account in the path. Containers are reached at endpoint/<container>,
+// including those of routes to other accounts.
+func WithEndpoint(endpoint string) Option {
+	return func(c *config) {
+		c.endpoint = endpoint
+	}
+}
+
+// Endpoint suffixes of the Azure clouds, for WithEndpointSuffix.
+const (
+	PublicCloudSuffix       = "core.windows.net"
+	ChinaCloudSuffix        = "core.chinacloudapi.cn"
+	USGovernmentCloudSuffix = "core.usgovcloudapi.net"
+	GermanCloudSuffix       = "core.cloudapi.de"
+)
+
+// WithEndpointSuffix serves accounts from https://<account>.blob.<suffix>
+// instead of the public cloud's https://<account>.blob.core.windows.net,
+// for the national clouds such as Azure China. WithEndpoint takes
+// precedence.
+func WithEndpointSuffix(suffix string) Option {
+	return func(c *config) {
+		if suffix != "" {
+			c.endpointSuffix = suffix
+		}
+	}
+}
+
+// WithRetryOptions sets how requests are retried: the number of tries, the
+// timeout of each, the delays between them and a read-only secondary host
+// to retry reads against. Zero fields keep azblob's defaults of 4 tries
+// of at most a minute each, with exponential delays from 4s up to 2m;
+// RetryDelay and MaxRetryDelay must be set together.
+func WithRetryOptions(o azblob.RetryOptions) Option {
+	return func(c *config) {
+		c.retry = o
+	}
+}
+
+// WithTelemetry prefixes the User-Agent of requests with value, such as an
+// application name and version, to tell its traffic apart in storage
+// analytics.
+func WithTelemetry(value string) Option {
+	return func(c *config) {
+		c.telemetry.Value = value
+	}
+}
+
+// WithHTTPClient sends requests with client instead of azblob's default,
+// for a transport of one's own: a proxy other than the one the
+// environment's HTTPS_PROXY names, TLS settings such as a corporate root
+// CA, or connection pool and keep-alive limits. The client's Timeout
+// should be left unset, as WithRetryOptions times each try and large
+// downloads can run far longer. Routes' containers use it too.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) {
+		c.httpClient = client
+	}
+}
+
+// WithAccessTier uploads values to the given access tier, such as
+// azblob.AccessTierCool for data read rarely, instead of the account's
+// default tier. Values in the archive tier cannot be read until
+// rehydrated.
+func WithAccessTier(tier azblob.AccessTierType) Option {
+	return func(c *config) {
+		c.tier = tier
+	}
+}
@@ -0,0 +1,129 @@
+package azure
+
+import (
+	"time"
+
+	"github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// maxPageSize is the most blobs the service returns in one listing.
+	maxPageSize = 5000
+	minPageSize = 16
+
+	// Pages answered faster than fastPage grow and those slower than
+	// slowPage shrink, keeping each round trip responsive without paying
+	// for many small ones.
+	fastPage = 250 * time.Millisecond
+	slowPage = 2 * time.Second
+)
+
+// WithListPageSize fixes the number of blobs requested per listing page,
+// turning off adaptive sizing. Zero keeps adaptive sizing. Queries with a
+// limit needing fewer blobs ask for just those. The other listings, of
+// Clear, HasMany, Versions and the disk usage scan, use it too in place of
+// the service's largest page.
+func WithListPageSize(n int) Option {
+	return func(c *config) {
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		c.listPageSize = n
+	}
+}
+
+// bulkPageSize returns the page size of listings enumerating every blob
+// under a prefix.
+func (c *config) bulkPageSize() int32 {
+	if c.listPageSize > 0 {
+		return int32(c.listPageSize)
+	}
+	return maxPageSize
+}
+
+// WithMinimalKeyListings lists keys-only queries that do not ask for sizes
+// without the blobs' metadata, which is most of a listing's payload once
+// values carry user metadata or TTLs, trimming the transfer and latency
+// of enumerating large containers. Their entries then have a Size of -1
+// and no Metadata, and expired keys are listed with the live ones, so it
+// suits containers not using TTLs. Queries setting ReturnsSizes or
+// returning values are listed in full.
+func WithMinimalKeyListings() Option {
+	return func(c *config) {
+		c.minimalListings = true
+	}
+}
+
+// pageSizer picks the size of each listing page of a query. A query with
+// a limit starts with pages just big enough to satisfy it; other queries
+// start with bulk pages. Sizes then follow the observed page latency, and
+// queries returning values are kept to pages whose values fit the query
+// memory budget, since a bigger page would only wait on the budget.
+type pageSizer struct {
+	fixed  int
+	size   int
+	budget int64
+	last   int // size of the page last requested
+
+	entries int64
+	bytes   int64
+}
+
+func newPageSizer(q query.Query, fixed int, budget int64) *pageSizer {
+	p := &pageSizer{fixed: fixed, size: 1000}
+	if !q.KeysOnly {
+		p.size, p.budget = 250, budget
+	}
+	if q.Limit > 0 {
+		p.size = q.Offset + q.Limit
+		if len(q.Filters) > 0 {
+			// Filtered entries do not count towards the limit.
+			p.size *= 2
+		}
+	}
+	p.size = clampPage(p.size)
+	if q.Limit > 0 && p.fixed > p.size {
+		p.fixed = p.size
+	}
+	return p
+}
+
+func clampPage(n int) int {
+	switch {
+	case n < minPageSize:
+		return minPageSize
+	case n > maxPageSize:
+		return maxPageSize
+	}
+	return n
+}
+
+// next returns the size of the next page to request.
+func (p *pageSizer) next() int32 {
+	if p.fixed > 0 {
+		return int32(p.fixed)
+	}
+	size := p.size
+	if p.budget > 0 && p.entries > 0 {
+		avg := p.bytes / p.entries
+		if avg > 0 && int64(size) > p.budget/avg {
+			size = int(p.budget / avg)
+		}
+	}
+	p.last = clampPage(size)
+	return int32(p.last)
+}
+
+// observe records a page of n blobs totalling bytes that took latency to
+// list.
+func (p *pageSizer) observe(n int, bytes int64, latency time.Duration) {
+	p.entries += int64(n)
+	p.bytes += bytes
+	full := n >= p.last
+	switch {
+	case latency > slowPage:
+		p.size = clampPage(p.size / 2)
+	case latency < fastPage && full:
+		p.size = clampPage(p.size * 2)
+	}
+}
@@ -0,0 +1,53 @@
+package azure
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestPageSizer(t *testing.T) {
+	if n := newPageSizer(query.Query{Limit: 10, KeysOnly: true}, 0, 0).next(); n != minPageSize {
+		t.Fatalf("limited query starts with %d", n)
+	}
+	if n := newPageSizer(query.Query{Limit: 100, Offset: 50, KeysOnly: true}, 0, 0).next(); n != 150 {
+		t.Fatalf("limit plus offset starts with %d", n)
+	}
+	if n := newPageSizer(query.Query{KeysOnly: true}, 0, 0).next(); n != 1000 {
+		t.Fatalf("bulk scan starts with %d", n)
+	}
+	if n := newPageSizer(query.Query{}, 40, 0).next(); n != 40 {
+		t.Fatalf("fixed size ignored: %d", n)
+	}
+	if n := newPageSizer(query.Query{Limit: 20, KeysOnly: true}, 500, 0).next(); n != 20 {
+		t.Fatalf("fixed size not cut to the limit: %d", n)
+	}
+	if n := newPageSizer(query.Query{Limit: 2000, KeysOnly: true}, 500, 0).next(); n != 500 {
+		t.Fatalf("fixed size grown to the limit: %d", n)
+	}
+	if n := (&config{}).bulkPageSize(); n != maxPageSize {
+		t.Fatalf("bulk listings default to pages of %d", n)
+	}
+
+	p := newPageSizer(query.Query{KeysOnly: true}, 0, 0)
+	p.observe(int(p.next()), 0, 10*time.Millisecond)
+	if n := p.next(); n != 2000 {
+		t.Fatalf("fast full page grew to %d", n)
+	}
+	p.observe(100, 0, 10*time.Millisecond)
+	if n := p.next(); n != 2000 {
+		t.Fatalf("partial page changed size to %d", n)
+	}
+	p.observe(int(p.next()), 0, 3*time.Second)
+	if n := p.next(); n != 1000 {
+		t.Fatalf("slow page shrank to %d", n)
+	}
+
+	// 1MiB values against a 64MiB budget.
+	p = newPageSizer(query.Query{}, 0, 64<<20)
+	p.observe(int(p.next()), int64(p.next())<<20, 10*time.Millisecond)
+	if n := p.next(); n != 64 {
+		t.Fatalf("large values allowed pages of %d", n)
+	}
+}
@@ -0,0 +1,106 @@
+package azure
+
+import (
+	"io"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Progress is told how a transfer of a key's value is going: the bytes of
+// the stored value sent, for an upload, or received so far, out of total,
+// or -1 if the total is unknown. Values are counted as stored, after any
+// compression.
+type Progress func(key ds.Key, upload bool, transferred, total int64)
+
+// WithProgress has fn follow the uploads of Put and PutReader and the
+// downloads of Get and GetReader as their bytes go, to drive progress bars
+// or detect stalled transfers. Calls for one transfer are made one at a
+// time, but those of different transfers run concurrently, so fn must be
+// safe for concurrent use and quick. A request that is retried counts its
+// bytes again from where it restarts.
+func WithProgress(fn Progress) Option {
+	return func(c *config) {
+		c.progress = fn
+	}
+}
+
+// transfer tracks the progress of one transfer. A nil transfer, as
+// returned without WithProgress, tracks nothing.
+type transfer struct {
+	fn     Progress
+	key    ds.Key
+	upload bool
+	total  int64
+
+	mu   sync.Mutex
+	done int64
+}
+
+// transfer starts tracking a transfer of key's value of total bytes.
+func (c *config) transfer(key ds.Key, upload bool, total int64) *transfer {
+	if c.progress == nil {
+		return nil
+	}
+	return &transfer{fn: c.progress, key: key, upload: upload, total: total}
+}
+
+// add counts n more bytes transferred, or less if n is negative, as when
+// a request rewinds its body to be retried.
+func (t *transfer) add(n int64) {
+	if t == nil || n == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done += n
+	t.fn(t.key, t.upload, t.done, t.total)
+}
+
+// reader counts the bytes read from r.
+func (t *transfer) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &progressReader{r: r, t: t}
+}
+
+// readSeeker counts the bytes read from r, taking back those read again
+// after a seek back for a retry.
+func (t *transfer) readSeeker(r io.ReadSeeker) io.ReadSeeker {
+	if t == nil {
+		return r
+	}
+	return &progressReader{r: r, t: t}
+}
+
+// progressReader reports its position as of each read, not each seek, as
+// requests seek to the end of their body to size it.
+type progressReader struct {
+	r        io.Reader
+	t        *transfer
+	pos      int64
+	reported int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.pos += int64(n)
+	p.t.add(p.pos - p.reported)
+	p.reported = p.pos
+	return n, err
+}
+
+func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := p.r.(io.Seeker).Seek(offset, whence)
+	if err == nil {
+		p.pos = pos
+	}
+	return pos, err
+}
+
+// readCloser reads from a counting reader and closes what it reads.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,46 @@
+package azure
+
+import (
+	"context"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// PutIfAbsent stores value only if key has none, reporting whether it did.
+// See PutIfAbsentContext.
+func (d *Datastore) PutIfAbsent(key ds.Key, value []byte) (bool, error) {
+	return d.PutIfAbsentContext(context.Background(), key, value)
+}
+
+// PutIfAbsentContext stores value only if key has none, reporting whether
+// it did. The upload is conditioned on the blob not existing, so of
+// concurrent writers exactly one succeeds, and content-addressed values
+// already stored are not replaced. An expired value counts as absent.
+// With WithAsyncPuts, a queued value counts as present.
+func (d *Datastore) PutIfAbsentContext(ctx context.Context, key ds.Key, value []byte) (stored bool, err error) {
+	if _, ok := d.queued(key); ok {
+		return false, nil
+	}
+	ctx, done, err := d.life.begin(ctx, key, true)
+	if err != nil {
+		return false, err
+	}
+	defer func() { done(err) }()
+
+	etag := azblob.ETagNone
+	for {
+		err := d.putIfMatch(ctx, key, value, etag)
+		if err != ErrETagMismatch {
+			return err == nil, err
+		}
+		// Present, unless it expired: then replace that version only.
+		_, etag, err = d.statWithETag(ctx, key)
+		switch {
+		case err == nil:
+			return false, nil
+		case err != ds.ErrNotFound:
+			return false, err
+		}
+	}
+}
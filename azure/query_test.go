@@ -0,0 +1,125 @@
+package azure
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/azure/azuretest"
+	"github.com/ipfs/go-datastore/query"
+)
+
+func TestRecoverResult(t *testing.T) {
+	results := make(chan query.Result, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(results)
+		defer recoverResult(func(r query.Result) { results <- r }, func() { close(stopped) })
+		var props *struct{ ContentLength *int64 }
+		_ = *props.ContentLength
+	}()
+
+	r, ok := <-results
+	if !ok || r.Error == nil || !strings.Contains(r.Error.Error(), "panic") {
+		t.Fatalf("panic not reported: %+v", r)
+	}
+	<-stopped
+}
+
+func TestQueryPushdown(t *testing.T) {
+	e := azuretest.NewEmulator()
+	var lists, gets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("comp") == "list":
+			atomic.AddInt32(&lists, 1)
+		case r.Method == http.MethodGet:
+			atomic.AddInt32(&gets, 1)
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	key := base64.StdEncoding.EncodeToString([]byte("emulated"))
+	d, err := NewDatastore("devstore", "data", WithSharedKey(key), WithEndpoint(srv.URL), WithListPageSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for i := 0; i < 100; i++ {
+		d.Put(ds.NewKey(fmt.Sprintf("/a/%03d", i)), []byte(fmt.Sprint(i)))
+	}
+	d.Put(ds.NewKey("/a"), nil)
+	d.Put(ds.NewKey("/ab"), nil)
+
+	atomic.StoreInt32(&lists, 0)
+	atomic.StoreInt32(&gets, 0)
+	res, err := d.Query(query.Query{Prefix: "/a", Offset: 15, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	sort.Strings(keys)
+	if got := strings.Join(keys, " "); got != "/a/015 /a/016 /a/017" {
+		t.Fatalf("got %s", got)
+	}
+	if n := atomic.LoadInt32(&lists); n != 2 {
+		t.Fatalf("listed %d pages, want 2", n)
+	}
+	if n := atomic.LoadInt32(&gets); n != 3 {
+		t.Fatalf("downloaded %d values, want 3", n)
+	}
+
+	// Filters need every entry, so the offset and limit apply afterwards.
+	res, err = d.Query(query.Query{
+		Prefix:  "/a",
+		Filters: []query.Filter{query.FilterValueCompare{Op: query.Equal, Value: []byte("50")}},
+		Limit:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := res.Rest(); err != nil || len(entries) != 1 || entries[0].Key != "/a/050" {
+		t.Fatalf("filtered query got %v, %v", entries, err)
+	}
+}
+
+func TestQueryOrderedNotPushedDown(t *testing.T) {
+	d, _ := newEmulated(t)
+	for _, k := range []string{"/a-", "/a.", "/b"} {
+		if err := d.Put(ds.NewKey(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "/a." escapes to "/a%2E", which is listed before "/a-", so the
+	// listing cannot apply the offset and limit of an ordered query.
+	for _, c := range []struct {
+		offset int
+		want   string
+	}{{0, "/a-"}, {1, "/a."}, {2, "/b"}} {
+		res, err := d.Query(query.Query{Orders: []query.Order{query.OrderByKey{}}, Offset: c.offset, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Key != c.want {
+			t.Fatalf("offset %d got %v, want %s", c.offset, entries, c.want)
+		}
+	}
+}
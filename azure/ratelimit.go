@@ -0,0 +1,125 @@
+package azure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/ipfs/go-datastore/clock"
+)
+
+// WithRequestRate limits the requests made to Azure to rate a second, in
+// bursts of up to burst, so a busy node stays under the storage account's
+// throttling limits instead of being answered with 503s that its retries
+// make worse. The limit is shared by every operation of the datastore,
+// and each retry counts as a request. Requests over the limit wait, or
+// fail once their context is done.
+func WithRequestRate(rate float64, burst int) Option {
+	return func(c *config) {
+		if rate <= 0 {
+			return
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		l := c.limits()
+		l.rate, l.burst = rate, float64(burst)
+	}
+}
+
+// WithMaxConcurrentRequests limits the requests to Azure in flight at once
+// to n, across every operation of the datastore. A request holds its place
+// until its response arrives; a download's body is read after.
+func WithMaxConcurrentRequests(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.limits().slots = make(chan struct{}, n)
+		}
+	}
+}
+
+// limits returns the request limiter, creating it for the options that
+// set it up.
+func (c *config) limits() *limiter {
+	if c.limiter == nil {
+		c.limiter = &limiter{}
+	}
+	return c.limiter
+}
+
+// limiter is a token bucket for the request rate and a semaphore for
+// concurrent requests.
+type limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	slots chan struct{}
+}
+
+// wait waits for a token and a slot, returning the function releasing the
+// slot.
+func (l *limiter) wait(ctx context.Context, clk clock.Clock) (func(), error) {
+	if l.rate > 0 {
+		if delay := l.reserve(clk.Now()); delay > 0 {
+			select {
+			case <-clk.After(delay):
+			case <-ctx.Done():
+				l.mu.Lock()
+				l.tokens++
+				l.mu.Unlock()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reserve takes a token, returning how long to wait for it to be due.
+// Waiting requests hold tokens in advance, leaving the bucket negative,
+// so they are let through in order at the rate.
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		l.tokens = l.burst
+	} else if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// limitingPolicy returns the pipeline policy holding each request, and
+// each retry, to the limits.
+func (c *config) limitingPolicy() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			release, err := c.limiter.wait(ctx, c.clock)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			return next.Do(ctx, request)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package azure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore/clock"
+)
+
+func TestLimiterRate(t *testing.T) {
+	var c config
+	WithRequestRate(10, 2)(&c)
+	clk := clock.NewMock(time.Unix(0, 0))
+	ctx := context.Background()
+
+	// The burst goes through at once.
+	for i := 0; i < 2; i++ {
+		if _, err := c.limiter.wait(ctx, clk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		c.limiter.wait(ctx, clk)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("request over the burst not held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clk.Advance(100 * time.Millisecond)
+	<-done
+
+	// A request given up on returns its token.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.limiter.wait(cancelled, clk); err != context.Canceled {
+		t.Fatalf("cancelled wait: %v", err)
+	}
+	clk.Advance(100 * time.Millisecond)
+	if delay := c.limiter.reserve(clk.Now()); delay != 0 {
+		t.Fatalf("token of a cancelled wait not returned: delay %v", delay)
+	}
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	var c config
+	WithMaxConcurrentRequests(1)(&c)
+	ctx := context.Background()
+
+	release, err := c.limiter.wait(ctx, clock.Real)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.limiter.wait(timeout, clock.Real); err != context.DeadlineExceeded {
+		t.Fatalf("second request: %v", err)
+	}
+	release()
+	if _, err := c.limiter.wait(ctx, clock.Real); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,120 @@
+package azure
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Route sends the keys under Prefix to a container reached with their own
+// credentials, for example a SAS token granting only read access, or a
+// container in another storage account. Empty fields inherit the
+// datastore's account, container and key.
+type Route struct {
+	Prefix      ds.Key
+	AccountName string
+	AccountKey  string
+	Container   string
+	// SAS is a shared access signature query string. When set it is used
+	// instead of any account key.
+	SAS string
+}
+
+// WithRoutes adds per-prefix routes. The route with the longest prefix
+// covering a key is used for it. Routed containers are not created.
+//
+// Queries are answered by the route covering the query prefix, so a query
+// over a parent of a route whose container is elsewhere does not list that
+// route's keys. NewMount instead gives each prefix a datastore of its own,
+// whose container is created and whose keys are listed by such queries.
+func WithRoutes(routes ...Route) Option {
+	return func(c *config) {
+		c.routes = append(c.routes, routes...)
+	}
+}
+
+type route struct {
+	prefix     ds.Key
+	container  azblob.ContainerURL
+	credential pipeline.Factory
+}
+
+// containerURL returns the URL of a container, under the configured
+// endpoint if there is one.
+func (c *config) containerURL(accountName, container, sas string) (*url.URL, error) {
+	base := fmt.Sprintf("https://%s.blob.%s", accountName, strings.Trim(c.endpointSuffix, "."))
+	if c.endpoint != "" {
+		base = strings.TrimSuffix(c.endpoint, "/")
+	}
+	u, err := url.Parse(base + "/" + container)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("azure: endpoint %q is not an http or https URL", base)
+	}
+	u.RawQuery = strings.TrimPrefix(sas, "?")
+	return u, nil
+}
+
+// buildRoutes resolves route specs against the datastore's defaults.
+func (c *config) buildRoutes(specs []Route, accountName, container string, defaultCred pipeline.Factory) ([]route, error) {
+	var routes []route
+	for _, r := range specs {
+		account, name := accountName, container
+		if r.AccountName != "" {
+			account = r.AccountName
+		}
+		if r.Container != "" {
+			name = r.Container
+		}
+
+		var cred pipeline.Factory
+		switch {
+		case r.SAS != "":
+			cred = azblob.NewAnonymousCredential()
+		case r.AccountKey != "":
+			skc, err := azblob.NewSharedKeyCredential(account, r.AccountKey)
+			if err != nil {
+				return nil, fmt.Errorf("azure: route %s: %w", r.Prefix, err)
+			}
+			cred = skc
+		case account == accountName:
+			cred = defaultCred
+		default:
+			return nil, fmt.Errorf("azure: route %s to account %s needs an account key or SAS", r.Prefix, account)
+		}
+
+		u, err := c.containerURL(account, name, r.SAS)
+		if err != nil {
+			return nil, fmt.Errorf("azure: route %s: %w", r.Prefix, err)
+		}
+		routes = append(routes, route{
+			prefix:     r.Prefix,
+			container:  azblob.NewContainerURL(*u, c.newPipeline(cred)),
+			credential: cred,
+		})
+	}
+	return routes, nil
+}
+
+// containerFor returns the container holding key.
+func (d *Datastore) containerFor(key ds.Key) azblob.ContainerURL {
+	return d.routeFor(key).container
+}
+
+// routeFor returns the route covering key, the datastore's own container
+// if no configured route does.
+func (d *Datastore) routeFor(key ds.Key) route {
+	best, bestLen := route{prefix: ds.NewKey("/"), container: d.containerUrl, credential: d.credential}, -1
+	for _, r := range d.routes {
+		if (r.prefix.Equal(key) || r.prefix.IsAncestorOf(key)) && len(r.prefix.String()) > bestLen {
+			best, bestLen = r, len(r.prefix.String())
+		}
+	}
+	return best
+}
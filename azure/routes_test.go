@@ -0,0 +1,77 @@
+package azure
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestRoutes(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("secret"))
+	cred, err := azblob.NewSharedKeyCredential("main", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	routes, err := cfg.buildRoutes([]Route{
+		{Prefix: ds.NewKey("/public"), SAS: "?sv=2020&sig=abc"},
+		{Prefix: ds.NewKey("/public/archive"), AccountName: "cold", AccountKey: key, Container: "archive"},
+	}, "main", "data", cred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://main.blob.core.windows.net/data")
+	d := &Datastore{
+		containerUrl: azblob.NewContainerURL(*u, azblob.NewPipeline(cred, azblob.PipelineOptions{})),
+		routes:       routes,
+	}
+
+	for _, tc := range []struct {
+		key  string
+		want string
+	}{
+		{"/private/x", "https://main.blob.core.windows.net/data"},
+		{"/publication", "https://main.blob.core.windows.net/data"},
+		{"/public", "https://main.blob.core.windows.net/data?sv=2020&sig=abc"},
+		{"/public/x", "https://main.blob.core.windows.net/data?sv=2020&sig=abc"},
+		{"/public/archive/x", "https://cold.blob.core.windows.net/archive"},
+	} {
+		c := d.containerFor(ds.NewKey(tc.key))
+		got := c.URL()
+		if got.String() != tc.want {
+			t.Errorf("%s routed to %s, want %s", tc.key, got.String(), tc.want)
+		}
+	}
+
+	if _, err := cfg.buildRoutes([]Route{{Prefix: ds.NewKey("/x"), AccountName: "other"}}, "main", "data", cred); err == nil {
+		t.Fatal("expected an error routing to another account without credentials")
+	}
+}
+
+func TestEndpointSuffix(t *testing.T) {
+	cases := []struct {
+		opts []Option
+		want string
+	}{
+		{nil, "https://acct.blob.core.windows.net/data"},
+		{[]Option{WithEndpointSuffix(ChinaCloudSuffix)}, "https://acct.blob.core.chinacloudapi.cn/data"},
+		{[]Option{WithEndpointSuffix(USGovernmentCloudSuffix)}, "https://acct.blob.core.usgovcloudapi.net/data"},
+		{[]Option{WithEndpointSuffix(GermanCloudSuffix), WithEndpoint("http://localhost:10000/acct")}, "http://localhost:10000/acct/data"},
+	}
+	for _, c := range cases {
+		cfg := defaultConfig()
+		for _, o := range c.opts {
+			o(&cfg)
+		}
+		u, err := cfg.containerURL("acct", "data", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.String() != c.want {
+			t.Errorf("got %s, want %s", u, c.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// SASRefresher returns a fresh SAS token, for example from a secret store
+// or a service minting short-lived tokens.
+type SASRefresher func(ctx context.Context) (string, error)
+
+// NewSASDatastore returns a Datastore over the given container authorized
+// by a shared access signature instead of the account key, so it can be
+// given only the permissions it needs, for a limited time. sas is the
+// token's query string, for a container or the whole account; it needs
+// read, write, delete and list permissions on the container. A container
+// SAS cannot create the container, so the container must exist.
+//
+// Tokens expire: pass WithSASRefresh to have the datastore fetch new ones.
+//
+// It is NewDatastore with WithSAS(sas).
+func NewSASDatastore(accountName, container, sas string, opts ...Option) (*Datastore, error) {
+	return NewDatastore(accountName, container, append([]Option{WithSAS(sas)}, opts...)...)
+}
+
+// WithSAS authorizes requests with a shared access signature, the token's
+// query string.
+func WithSAS(sas string) Option {
+	return func(c *config) {
+		c.credential = func(string) (pipeline.Factory, error) {
+			return newSASCredential(sas, c.sasRefresh, c.sasRefreshEvery)
+		}
+	}
+}
+
+// WithSASRefresh has a SAS datastore call refresh for a new token every
+// interval. The new token is used from the next request; if refreshing
+// fails, the current token stays in use and refresh is retried sooner.
+func WithSASRefresh(refresh SASRefresher, interval time.Duration) Option {
+	return func(c *config) {
+		c.sasRefresh, c.sasRefreshEvery = refresh, interval
+	}
+}
+
+// sasCredential is a pipeline policy adding the current SAS token to each
+// request's query.
+type sasCredential struct {
+	refresh SASRefresher
+	every   time.Duration
+
+	mu    sync.Mutex
+	token url.Values
+	due   time.Time
+}
+
+func newSASCredential(sas string, refresh SASRefresher, every time.Duration) (*sasCredential, error) {
+	token, err := parseSAS(sas)
+	if err != nil {
+		return nil, err
+	}
+	c := &sasCredential{refresh: refresh, every: every, token: token}
+	if refresh != nil && every > 0 {
+		c.due = time.Now().Add(every)
+	}
+	return c, nil
+}
+
+func parseSAS(sas string) (url.Values, error) {
+	token, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("azure: invalid SAS token: %w", err)
+	}
+	if token.Get("sig") == "" {
+		return nil, fmt.Errorf("azure: SAS token has no signature")
+	}
+	return token, nil
+}
+
+// current returns the token to use, refreshing it first when due.
+func (c *sasCredential) current(ctx context.Context) url.Values {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.due.IsZero() || time.Now().Before(c.due) {
+		return c.token
+	}
+	sas, err := c.refresh(ctx)
+	if err == nil {
+		var token url.Values
+		if token, err = parseSAS(sas); err == nil {
+			c.token = token
+			c.due = time.Now().Add(c.every)
+			return c.token
+		}
+	}
+	c.due = time.Now().Add(c.every / 10)
+	return c.token
+}
+
+// sign returns u with the current token in its query.
+func (c *sasCredential) sign(ctx context.Context, u url.URL) url.URL {
+	q := u.Query()
+	for k, v := range c.current(ctx) {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u
+}
+
+// New implements pipeline.Factory.
+func (c *sasCredential) New(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.Policy {
+	return pipeline.PolicyFunc(func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		*request.URL = c.sign(ctx, *request.URL)
+		return next.Do(ctx, request)
+	})
+}
@@ -0,0 +1,96 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/azure/azuretest"
+)
+
+func TestSASDatastore(t *testing.T) {
+	e := azuretest.NewEmulator()
+	e.CreateContainer("data")
+	var mu sync.Mutex
+	var sigs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("SAS request carried an Authorization header")
+		}
+		mu.Lock()
+		sigs = append(sigs, r.URL.Query().Get("sig"))
+		mu.Unlock()
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	lastSig := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return sigs[len(sigs)-1]
+	}
+
+	refreshes := 0
+	refresh := func(context.Context) (string, error) {
+		refreshes++
+		if refreshes == 2 {
+			return "", errors.New("secret store down")
+		}
+		return fmt.Sprintf("sv=2019-12-12&sp=rwdl&sig=fresh%d", refreshes), nil
+	}
+	d, err := NewSASDatastore("devstore", "data", "?sv=2019-12-12&sp=rwdl&sig=first",
+		WithEndpoint(srv.URL), WithSASRefresh(refresh, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	k := ds.NewKey("/a")
+	if err := d.Put(k, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if sig := lastSig(); sig != "first" {
+		t.Fatalf("request signed with %q", sig)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := d.Get(k); err != nil {
+		t.Fatal(err)
+	}
+	if sig := lastSig(); sig != "fresh1" {
+		t.Fatalf("refreshed token not used: %q", sig)
+	}
+
+	// A failed refresh keeps the current token.
+	time.Sleep(30 * time.Millisecond)
+	if _, err := d.Has(k); err != nil {
+		t.Fatal(err)
+	}
+	if sig := lastSig(); sig != "fresh1" {
+		t.Fatalf("after a failed refresh signed with %q", sig)
+	}
+
+	b, _ := d.Batch()
+	b.Delete(k)
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(k); has {
+		t.Fatal("batched delete with a SAS not applied")
+	}
+}
+
+func TestParseSAS(t *testing.T) {
+	if _, err := NewSASDatastore("a", "c", "sv=2019-12-12&sp=r"); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("expected a missing signature error, got %v", err)
+	}
+	if _, err := NewSASDatastore("a", "c", "sig=%zz"); err == nil {
+		t.Fatal("expected an invalid token error")
+	}
+}
@@ -0,0 +1,155 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrNoSlot is returned by TryAcquire when every slot is leased.
+var ErrNoSlot = errors.New("azure: no semaphore slot available")
+
+// Semaphore is a counting semaphore shared by every process using the same
+// container and prefix. Each of its slots is an empty blob under the prefix;
+// holding a slot means holding the blob's lease. A holder that stops
+// renewing loses its slot when the lease expires.
+//
+// The slot blobs are stored like any other key, so they show up in queries
+// over the prefix.
+type Semaphore struct {
+	d        *Datastore
+	prefix   ds.Key
+	slots    int
+	duration time.Duration
+
+	// RetryInterval is how long Acquire waits between rounds over the
+	// slots.
+	RetryInterval time.Duration
+}
+
+// Permit is a held semaphore slot.
+type Permit struct {
+	s       *Semaphore
+	slot    int
+	leaseID string
+}
+
+// NewSemaphore returns a semaphore of the given number of slots under
+// prefix. Leases last for duration, which must be between 15 and 60
+// seconds, or negative for leases that never expire.
+func (d *Datastore) NewSemaphore(prefix ds.Key, slots int, duration time.Duration) (*Semaphore, error) {
+	if slots <= 0 {
+		return nil, fmt.Errorf("azure: semaphore needs at least one slot")
+	}
+	if duration >= 0 && (duration < 15*time.Second || duration > 60*time.Second) {
+		return nil, fmt.Errorf("azure: lease duration %v outside 15s to 60s", duration)
+	}
+	return &Semaphore{
+		d:             d,
+		prefix:        prefix,
+		slots:         slots,
+		duration:      duration,
+		RetryInterval: time.Second,
+	}, nil
+}
+
+func (s *Semaphore) slotBlob(slot int) azblob.BlockBlobURL {
+	return s.d.keyUrl(s.prefix.ChildString(fmt.Sprintf("slot-%d", slot)))
+}
+
+func (s *Semaphore) leaseSeconds() int32 {
+	if s.duration < 0 {
+		return -1
+	}
+	return int32(s.duration / time.Second)
+}
+
+// TryAcquire takes a free slot without waiting, returning ErrNoSlot if
+// there is none.
+func (s *Semaphore) TryAcquire(ctx context.Context) (*Permit, error) {
+	// Starting at a random slot spreads contending processes out.
+	start := rand.Intn(s.slots)
+	for i := 0; i < s.slots; i++ {
+		slot := (start + i) % s.slots
+		leaseID, err := s.tryLease(ctx, slot)
+		if err != nil {
+			return nil, err
+		}
+		if leaseID != "" {
+			return &Permit{s: s, slot: slot, leaseID: leaseID}, nil
+		}
+	}
+	return nil, ErrNoSlot
+}
+
+// tryLease leases one slot, creating its blob on first use. It returns an
+// empty lease ID if the slot is held.
+func (s *Semaphore) tryLease(ctx context.Context, slot int) (string, error) {
+	blob := s.slotBlob(slot)
+	for created := false; ; created = true {
+		resp, err := blob.AcquireLease(ctx, "", s.leaseSeconds(), azblob.ModifiedAccessConditions{})
+		switch {
+		case err == nil:
+			return resp.LeaseID(), nil
+		case isError(err, azblob.ServiceCodeLeaseAlreadyPresent):
+			return "", nil
+		case (isError(err, azblob.ServiceCodeBlobNotFound) || isError(err, azblob.ServiceCodeContainerNotFound)) && !created:
+			if err := s.d.ensureFor(ctx, s.prefix); err != nil {
+				return "", err
+			}
+			_, err = blob.Upload(ctx, bytes.NewReader(nil), azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+				azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}},
+				azblob.AccessTierNone, nil, s.d.config.cpk)
+			if err != nil && !isError(err, azblob.ServiceCodeBlobAlreadyExists) {
+				return "", err
+			}
+		default:
+			return "", err
+		}
+	}
+}
+
+// Acquire takes a slot, waiting until one is free or ctx is done.
+func (s *Semaphore) Acquire(ctx context.Context) (*Permit, error) {
+	for {
+		p, err := s.TryAcquire(ctx)
+		if err != ErrNoSlot {
+			return p, err
+		}
+		t := time.NewTimer(s.RetryInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Slot returns the index of the held slot.
+func (p *Permit) Slot() int {
+	return p.slot
+}
+
+// Renew extends the permit's lease by the semaphore's lease duration. It
+// fails if the lease has expired and the slot was taken by another holder.
+func (p *Permit) Renew(ctx context.Context) error {
+	_, err := p.s.slotBlob(p.slot).RenewLease(ctx, p.leaseID, azblob.ModifiedAccessConditions{})
+	return err
+}
+
+// Release frees the slot. Releasing an expired permit is not an error.
+func (p *Permit) Release(ctx context.Context) error {
+	_, err := p.s.slotBlob(p.slot).ReleaseLease(ctx, p.leaseID, azblob.ModifiedAccessConditions{})
+	if isError(err, azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation) ||
+		isError(err, azblob.ServiceCodeLeaseNotPresentWithLeaseOperation) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package azure
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestNewSemaphoreValidation(t *testing.T) {
+	d := &Datastore{}
+	prefix := ds.NewKey("/sem")
+	for _, tc := range []struct {
+		slots    int
+		duration time.Duration
+		ok       bool
+	}{
+		{1, 15 * time.Second, true},
+		{4, 60 * time.Second, true},
+		{4, -1, true},
+		{0, 30 * time.Second, false},
+		{4, 10 * time.Second, false},
+		{4, 2 * time.Minute, false},
+	} {
+		s, err := d.NewSemaphore(prefix, tc.slots, tc.duration)
+		if (err == nil) != tc.ok {
+			t.Errorf("NewSemaphore(%d, %v): %v", tc.slots, tc.duration, err)
+		}
+		if err == nil && tc.duration < 0 && s.leaseSeconds() != -1 {
+			t.Errorf("infinite lease encoded as %d", s.leaseSeconds())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/flatfs"
+)
+
+// shardingBlob records the shard function of a sharded container, as the
+// SHARDING file does for flatfs.
+const shardingBlob = "_README/shard"
+
+// ErrShardingMismatch is returned when writing to a container with a shard
+// function other than the one it was created with.
+var ErrShardingMismatch = errors.New("azure: shard function does not match the existing container")
+
+// WithSharding stores each key under a virtual directory chosen by shard,
+// one of the flatfs shard functions, such as flatfs.NextToLast(2) for
+// CIDs: the key "/CIQAB" is stored in the blob "/QA/CIQAB". Huge flat
+// keyspaces are then spread over a balanced set of prefixes.
+//
+// The shard function is recorded in a _README/shard blob when the
+// container is first written and must match on every later write of a
+// sharded datastore; an unsharded datastore does not check it. Keys
+// are no longer listed in order, so queries list the whole container,
+// whatever their prefix, and cannot stop early at their limit.
+func WithSharding(shard *flatfs.ShardFunc) Option {
+	return func(c *config) {
+		c.shard = shard
+	}
+}
+
+// Shard returns the datastore's shard function, nil if it is not sharded.
+func (d *Datastore) Shard() *flatfs.ShardFunc {
+	return d.config.shard
+}
+
+// nameFor returns the name of the blob holding key.
+func (d *Datastore) nameFor(key ds.Key) string {
+	if d.config.shard == nil {
+		return blobName(key)
+	}
+	dir := d.config.shard.Dir(strings.TrimPrefix(key.String(), "/"))
+	return escapeBlobName("/" + strings.Replace(dir, "/", "_", -1) + key.String())
+}
+
+// keyFor returns the key stored in the named blob, false for blobs that
+// hold none, such as the _README/shard blob.
+func (d *Datastore) keyFor(name string) (ds.Key, bool) {
+	if !strings.HasPrefix(name, "/") {
+		return ds.Key{}, false
+	}
+	if d.config.shard == nil {
+		return blobKey(name), true
+	}
+	name = unescapeBlobName(name)
+	i := strings.Index(name[1:], "/")
+	if i < 0 {
+		return ds.Key{}, false
+	}
+	return ds.NewKey(name[i+1:]), true
+}
+
+// listPrefix returns the blob name prefix to list the keys under prefix,
+// a clean key ending in '/' or "" for all keys.
+func (d *Datastore) listPrefix(prefix string) string {
+	if d.config.shard != nil {
+		return "/"
+	}
+	return escapeBlobName(prefix)
+}
+
+// checkSharding makes sure a sharded datastore's container records its
+// shard function, recording it in a new container.
+func (d *Datastore) checkSharding(ctx context.Context) error {
+	if d.config.shard == nil {
+		return nil
+	}
+	blob := d.containerUrl.NewBlockBlobURL(shardingBlob)
+	want := d.config.shard.String()
+	for {
+		get, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, d.config.cpk)
+		if err == nil {
+			body := get.Body(d.config.retryReader())
+			b, err := ioutil.ReadAll(body)
+			body.Close()
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(string(b)) != want {
+				return ErrShardingMismatch
+			}
+			return nil
+		}
+		if !isError(err, azblob.ServiceCodeBlobNotFound) {
+			return err
+		}
+		_, err = blob.Upload(ctx, bytes.NewReader([]byte(want+"\n")), azblob.BlobHTTPHeaders{}, azblob.Metadata{},
+			azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}},
+			azblob.AccessTierNone, nil, d.config.cpk)
+		if err == nil {
+			return nil
+		}
+		// Another writer recorded a shard function first: check it.
+		if !isError(err, azblob.ServiceCodeBlobAlreadyExists) && !isError(err, azblob.ServiceCodeConditionNotMet) {
+			return err
+		}
+	}
+}
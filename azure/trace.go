@@ -0,0 +1,103 @@
+package azure
+
+import (
+	"context"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// tracerName is the instrumentation name the tracer is requested with.
+const tracerName = "github.com/ipfs/go-datastore/azure"
+
+// TracerProvider provides the Tracer spans are started with. It has the
+// shape of OpenTelemetry's trace.TracerProvider, without depending on
+// it: an OpenTelemetry provider plugs in through a small adapter whose
+// spans set attributes with attribute.String, attribute.Int and so on.
+type TracerProvider interface {
+	Tracer(name string) Tracer
+}
+
+// Tracer starts spans.
+type Tracer interface {
+	// Start starts a span as a child of any span in ctx, returning a
+	// context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation being traced. Values set as attributes are
+// strings or ints.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// WithTracerProvider traces datastore operations with tracers from p.
+// Put, Get, Delete and Query each have a span, with the key's parent or
+// the query's prefix as ds.key.prefix and the value's size as
+// ds.value.size; queries have a child span for each listing segment, with
+// the number of blobs listed as az.blob.count. Every request to Azure has
+// a span of its own, under the operation's, with its method, path, status
+// and x-ms-request-id, so a slow operation can be traced to the requests,
+// and retries, it made.
+func WithTracerProvider(p TracerProvider) Option {
+	return func(c *config) {
+		c.tracer = p.Tracer(tracerName)
+	}
+}
+
+// span is a Span that may be nil, for when tracing is off.
+type span struct {
+	s Span
+}
+
+// trace starts a span for an operation on the keys under prefix.
+func (d *Datastore) trace(ctx context.Context, name string, prefix string) (context.Context, span) {
+	if d.config.tracer == nil {
+		return ctx, span{}
+	}
+	ctx, s := d.config.tracer.Start(ctx, name)
+	s.SetAttribute("ds.key.prefix", prefix)
+	return ctx, span{s}
+}
+
+func (s span) set(key string, value interface{}) {
+	if s.s != nil {
+		s.s.SetAttribute(key, value)
+	}
+}
+
+// end ends the span, recording err unless it only reports a missing key.
+func (s span) end(err error) {
+	if s.s == nil {
+		return
+	}
+	if err != nil && err != ds.ErrNotFound {
+		s.s.RecordError(err)
+	}
+	s.s.End()
+}
+
+// tracingPolicy returns the pipeline policy giving every request a span.
+// The query string is left out of the recorded path, as it can hold a
+// SAS.
+func (c *config) tracingPolicy() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			ctx, s := c.tracer.Start(ctx, "azure "+request.Method)
+			s.SetAttribute("http.method", request.Method)
+			s.SetAttribute("http.url", request.URL.Scheme+"://"+request.URL.Host+request.URL.Path)
+			resp, err := next.Do(ctx, request)
+			if resp != nil && resp.Response() != nil {
+				s.SetAttribute("http.status_code", resp.Response().StatusCode)
+				s.SetAttribute("az.request_id", resp.Response().Header.Get("x-ms-request-id"))
+			}
+			if err != nil {
+				s.RecordError(err)
+			}
+			s.End()
+			return resp, err
+		}
+	})
+}
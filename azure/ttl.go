@@ -0,0 +1,134 @@
+package azure
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+)
+
+// metaExpires is the blob metadata entry holding a key's expiry, in Unix
+// nanoseconds.
+const metaExpires = "dsexpires"
+
+var _ ds.TTLDatastore = (*Datastore)(nil)
+
+// WithClock sets the clock TTLs are measured against. Defaults to the wall
+// clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) {
+		cfg.clock = clock.OrReal(c)
+	}
+}
+
+// PutWithTTL implements TTL.PutWithTTL. The expiry is kept in the blob's
+// metadata; expired blobs read as missing but stay in the container until
+// overwritten or deleted, for example by a lifecycle management rule; see
+// WithLifecycleTTL.
+func (d *Datastore) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) (err error) {
+	ctx, done, err := d.life.begin(context.Background(), key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return d.put(ctx, key, value, d.expiresIn(ttl))
+}
+
+// SetTTL implements TTL.SetTTL. Expired keys are not found. It returns
+// ErrContention if the blob kept changing underneath it for every retry.
+func (d *Datastore) SetTTL(key ds.Key, ttl time.Duration) (err error) {
+	ctx, done, err := d.life.begin(context.Background(), key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return d.setTTL(ctx, key, ttl)
+}
+
+func (d *Datastore) setTTL(ctx context.Context, key ds.Key, ttl time.Duration) error {
+	blob := d.keyUrl(key)
+	for attempt := 0; attempt < counterRetries; attempt++ {
+		props, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, d.config.cpk)
+		if err != nil {
+			if isError(err, azblob.ServiceCodeBlobNotFound) {
+				return ds.ErrNotFound
+			}
+			return err
+		}
+		if d.expired(props.NewMetadata()) {
+			return ds.ErrNotFound
+		}
+		if err := d.checkEpoch(props.NewMetadata()); err != nil {
+			return err
+		}
+		// The value's other metadata is kept. The ETag condition keeps a
+		// concurrent Put's metadata from being replaced by this TTL.
+		meta := d.stampEpoch(props.NewMetadata())
+		for name, value := range d.expiresIn(ttl) {
+			meta[name] = value
+		}
+		_, err = blob.SetMetadata(ctx, meta, azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: props.ETag()},
+		}, d.config.cpk)
+		if isError(err, azblob.ServiceCodeConditionNotMet) {
+			continue
+		}
+		if err != nil || len(d.config.lifecycleDays) == 0 {
+			return err
+		}
+		// Setting the metadata restarted the rules' count of days, and the
+		// value is retagged for the rule of its new TTL, or untagged.
+		_, err = blob.SetTags(ctx, nil, nil, nil, nil, nil, nil, d.lifecycleTags(meta))
+		return err
+	}
+	return ErrContention
+}
+
+// GetExpiration implements TTL.GetExpiration. Keys without a TTL return the
+// zero time.
+func (d *Datastore) GetExpiration(key ds.Key) (exp time.Time, err error) {
+	ctx, done, err := d.life.begin(context.Background(), key, false)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() { done(err) }()
+
+	props, err := d.keyUrl(key).GetProperties(ctx, azblob.BlobAccessConditions{}, d.config.cpk)
+	if err != nil {
+		if isError(err, azblob.ServiceCodeBlobNotFound) {
+			return time.Time{}, ds.ErrNotFound
+		}
+		return time.Time{}, err
+	}
+	meta := props.NewMetadata()
+	if d.expired(meta) {
+		return time.Time{}, ds.ErrNotFound
+	}
+	return expiration(meta), nil
+}
+
+func (d *Datastore) expiresIn(ttl time.Duration) azblob.Metadata {
+	return azblob.Metadata{metaExpires: strconv.FormatInt(d.now().Add(ttl).UnixNano(), 10)}
+}
+
+// expiration returns the expiry recorded in meta, or the zero time.
+func expiration(meta azblob.Metadata) time.Time {
+	n, err := strconv.ParseInt(meta[metaExpires], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func (d *Datastore) expired(meta azblob.Metadata) bool {
+	exp := expiration(meta)
+	return !exp.IsZero() && !exp.After(d.now())
+}
+
+// now reads the configured clock.
+func (d *Datastore) now() time.Time {
+	return clock.OrReal(d.config.clock).Now()
+}
@@ -0,0 +1,199 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// ErrConflict is returned by Txn.Commit when a key the transaction read
+// or wrote was changed by someone else.
+var ErrConflict = errors.New("azure: transaction conflict")
+
+var errReadOnly = errors.New("azure: cannot write in a read-only transaction")
+
+// txnParallelism is the number of checks and writes a commit has in
+// flight.
+const txnParallelism = 16
+
+var _ ds.TxnDatastore = (*Datastore)(nil)
+
+// NewTransaction implements TxnDatastore.NewTransaction. Transactions are
+// optimistic: they record the ETag of every key they read, and Commit
+// fails with ErrConflict if any of those keys has changed since.
+//
+// Blob storage has no multi-blob commit, so Commit first checks every key
+// read, then writes each key conditioned on the ETag read for it. A
+// conflict found by the checks writes nothing; one that lands between
+// the checks and the writes is still detected, but writes to other keys
+// may already have been applied.
+func (d *Datastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	return &txn{
+		d:        d,
+		readOnly: readOnly,
+		reads:    make(map[ds.Key]azblob.ETag),
+		ops:      make(map[ds.Key]txnOp),
+	}, nil
+}
+
+type txnOp struct {
+	value  []byte
+	delete bool
+}
+
+// txn records the ETag of every key it reads, azblob.ETagNone for keys
+// that were absent.
+type txn struct {
+	d        *Datastore
+	readOnly bool
+	reads    map[ds.Key]azblob.ETag
+	ops      map[ds.Key]txnOp
+}
+
+// record keeps the first ETag seen for key, the version the transaction
+// depends on.
+func (t *txn) record(key ds.Key, etag azblob.ETag) {
+	if _, seen := t.reads[key]; !seen {
+		t.reads[key] = etag
+	}
+}
+
+func (t *txn) Get(key ds.Key) ([]byte, error) {
+	if o, ok := t.ops[key]; ok {
+		if o.delete {
+			return nil, ds.ErrNotFound
+		}
+		return o.value, nil
+	}
+	value, etag, err := t.d.getWithETag(context.Background(), key)
+	if err != nil && err != ds.ErrNotFound {
+		return nil, err
+	}
+	t.record(key, etag)
+	return value, err
+}
+
+func (t *txn) Has(key ds.Key) (bool, error) {
+	_, err := t.GetSize(key)
+	switch err {
+	case nil:
+		return true, nil
+	case ds.ErrNotFound:
+		return false, nil
+	}
+	return false, err
+}
+
+func (t *txn) GetSize(key ds.Key) (int, error) {
+	if o, ok := t.ops[key]; ok {
+		if o.delete {
+			return -1, ds.ErrNotFound
+		}
+		return len(o.value), nil
+	}
+	size, etag, err := t.d.statWithETag(context.Background(), key)
+	if err != nil && err != ds.ErrNotFound {
+		return -1, err
+	}
+	t.record(key, etag)
+	return size, err
+}
+
+// Query runs against the committed state; it does not observe the
+// transaction's own writes and does not participate in conflict checks.
+func (t *txn) Query(q dsq.Query) (dsq.Results, error) {
+	return t.d.Query(q)
+}
+
+func (t *txn) Put(key ds.Key, value []byte) error {
+	if t.readOnly {
+		return errReadOnly
+	}
+	t.ops[key] = txnOp{value: value}
+	return nil
+}
+
+func (t *txn) Delete(key ds.Key) error {
+	if t.readOnly {
+		return errReadOnly
+	}
+	t.ops[key] = txnOp{delete: true}
+	return nil
+}
+
+// Commit implements Txn.Commit. Keys written without being read are
+// written unconditionally.
+func (t *txn) Commit() error {
+	if len(t.ops) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+
+	var checks []ds.Key
+	for k := range t.reads {
+		checks = append(checks, k)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Less(checks[j]) })
+	err := forEach(ctx, len(checks), txnParallelism, func(ctx context.Context, i int) error {
+		_, etag, err := t.d.statWithETag(ctx, checks[i])
+		if err != nil && err != ds.ErrNotFound {
+			return err
+		}
+		if etag != t.reads[checks[i]] {
+			return ErrConflict
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	writes := make([]ds.Key, 0, len(t.ops))
+	for k := range t.ops {
+		writes = append(writes, k)
+	}
+	sort.Slice(writes, func(i, j int) bool { return writes[i].Less(writes[j]) })
+	err = forEach(ctx, len(writes), txnParallelism, func(ctx context.Context, i int) error {
+		return t.write(ctx, writes[i])
+	})
+	if err == ErrETagMismatch {
+		err = ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	t.ops = make(map[ds.Key]txnOp)
+	return nil
+}
+
+// write applies the operation on key, conditioned on the version read.
+func (t *txn) write(ctx context.Context, key ds.Key) (err error) {
+	ctx, done, err := t.d.life.begin(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+
+	o := t.ops[key]
+	etag, read := t.reads[key]
+	switch {
+	case !read && o.delete:
+		return t.d.deleteBlob(ctx, key)
+	case !read:
+		return t.d.put(ctx, key, o.value, azblob.Metadata{})
+	case o.delete && etag == azblob.ETagNone:
+		return nil // absent when read, and the checks found it still is
+	case o.delete:
+		return t.d.deleteIfMatch(ctx, key, etag)
+	}
+	return t.d.putIfMatch(ctx, key, o.value, etag)
+}
+
+func (t *txn) Discard() {
+	t.ops = make(map[ds.Key]txnOp)
+	t.reads = make(map[ds.Key]azblob.ETag)
+}
@@ -0,0 +1,196 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/google/uuid"
+	ds "github.com/ipfs/go-datastore"
+)
+
+type uploadStrategy int
+
+const (
+	// uploadSingle sends the whole value in one Put Blob request.
+	uploadSingle uploadStrategy = iota
+	// uploadStaged stages blocks of an in-memory value in parallel and
+	// commits the block list.
+	uploadStaged
+	// uploadStream reads the value through a bounded set of buffers,
+	// staging each as it fills.
+	uploadStream
+)
+
+func (s uploadStrategy) String() string {
+	switch s {
+	case uploadSingle:
+		return "single"
+	case uploadStaged:
+		return "staged"
+	default:
+		return "stream"
+	}
+}
+
+// putStrategy picks the strategy for a value already held in memory, which
+// never needs streaming.
+func (c *config) putStrategy(size int64) uploadStrategy {
+	if size <= c.singleShotMax {
+		return uploadSingle
+	}
+	return uploadStaged
+}
+
+// readerStrategy picks the strategy for a value read from a stream of the
+// given size, or -1 if unknown. Values are only buffered whole when they
+// fit the memory budget.
+func (c *config) readerStrategy(size int64) uploadStrategy {
+	switch {
+	case size < 0 || size > c.memoryBudget:
+		return uploadStream
+	case size <= c.singleShotMax:
+		return uploadSingle
+	default:
+		return uploadStaged
+	}
+}
+
+// parallelism is the number of blocks that may be in flight within the
+// memory budget.
+func (c *config) parallelism() int {
+	n := c.memoryBudget / c.blockSize
+	if n < 1 {
+		return 1
+	}
+	if n > 64 {
+		return 64
+	}
+	return int(n)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (d *Datastore) uploadSingleShot(ctx context.Context, blob azblob.BlockBlobURL, value []byte, h azblob.BlobHTTPHeaders, meta azblob.Metadata, ac azblob.BlobAccessConditions, t *transfer) error {
+	h.ContentMD5 = contentMD5(value)
+	_, err := blob.Upload(ctx, t.readSeeker(bytes.NewReader(value)), h, meta,
+		ac, d.config.tier, d.lifecycleTags(meta), d.config.cpk)
+	return err
+}
+
+// uploadStaged stages value in blocks and commits them, under ac. Block
+// IDs are unique per upload so concurrent writers of one key cannot mix
+// blocks. Each block is checked by the service against its MD5, and the
+// blob is given the MD5 of the whole value.
+func (d *Datastore) uploadStaged(ctx context.Context, blob azblob.BlockBlobURL, value []byte, h azblob.BlobHTTPHeaders, meta azblob.Metadata, ac azblob.BlobAccessConditions, t *transfer) error {
+	size := int64(len(value))
+	blockSize := d.config.blockSize
+	if size > blockSize*azblob.BlockBlobMaxBlocks {
+		return fmt.Errorf("azure: value of %d bytes exceeds %d blocks of %d bytes", size, azblob.BlockBlobMaxBlocks, blockSize)
+	}
+	n := int((size + blockSize - 1) / blockSize)
+	ids := make([]string, n)
+	upload := uuid.New().String()
+	for i := range ids {
+		ids[i] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%06d", upload, i)))
+	}
+
+	err := azblob.DoBatchTransfer(ctx, azblob.BatchTransferOptions{
+		OperationName: "uploadStaged",
+		TransferSize:  size,
+		ChunkSize:     blockSize,
+		Parallelism:   uint16(d.config.parallelism()),
+		Operation: func(offset, count int64, ctx context.Context) error {
+			block := value[offset : offset+count]
+			_, err := blob.StageBlock(ctx, ids[offset/blockSize], t.readSeeker(bytes.NewReader(block)),
+				azblob.LeaseAccessConditions{}, contentMD5(block), d.config.cpk)
+			return err
+		},
+	})
+	if err != nil {
+		return err
+	}
+	h.ContentMD5 = contentMD5(value)
+	_, err = blob.CommitBlockList(ctx, ids, h, meta,
+		ac, d.config.tier, d.lifecycleTags(meta), d.config.cpk)
+	return err
+}
+
+func (d *Datastore) uploadStream(ctx context.Context, blob azblob.BlockBlobURL, r io.Reader, meta azblob.Metadata, ac azblob.BlobAccessConditions, t *transfer) error {
+	// Bytes are counted as they are buffered, a block ahead of the network.
+	_, err := azblob.UploadStreamToBlockBlob(ctx, t.reader(r), blob, azblob.UploadStreamToBlockBlobOptions{
+		BufferSize:       int(d.config.blockSize),
+		MaxBuffers:       d.config.parallelism(),
+		Metadata:         meta,
+		AccessConditions: ac,
+
+		ClientProvidedKeyOptions: d.config.cpk,
+	})
+	return err
+}
+
+// PutReader stores the value read from r. See PutReaderContext.
+func (d *Datastore) PutReader(key ds.Key, r io.Reader, size int64) error {
+	return d.PutReaderContext(context.Background(), key, r, size)
+}
+
+// PutReaderContext stores the value read from r. size is the value's
+// length, or -1 if unknown. Values that fit the memory budget are read
+// into memory and uploaded like Put; others are streamed through at most
+// the budget's worth of buffers, staged as blocks.
+func (d *Datastore) PutReaderContext(ctx context.Context, key ds.Key, r io.Reader, size int64) (err error) {
+	ctx, done, err := d.life.begin(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+
+	blob := d.keyUrl(key)
+	if err := d.ensureFor(ctx, key); err != nil {
+		return err
+	}
+	ac, own, err := d.fence(ctx, blob.BlobURL, azblob.BlobAccessConditions{})
+	if err != nil {
+		return err
+	}
+	if own {
+		// The value cannot be read again to retry a lost race.
+		defer func() {
+			if raced(err) {
+				err = ErrETagMismatch
+			}
+		}()
+	}
+	if err := d.snapshotBefore(ctx, blob, ac); err != nil {
+		return err
+	}
+	strategy := d.config.readerStrategy(size)
+	if strategy == uploadStream {
+		return d.uploadStream(ctx, blob, r, d.stampEpoch(azblob.Metadata{}), ac, d.config.transfer(key, true, size))
+	}
+
+	value, err := ioutil.ReadAll(io.LimitReader(r, size+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(value)) != size {
+		return fmt.Errorf("azure: read %d bytes for %s, expected %d", len(value), key, size)
+	}
+	value, h, meta, err := d.compress(value, d.stampEpoch(azblob.Metadata{}))
+	if err != nil {
+		return err
+	}
+	if strategy == uploadSingle {
+		return d.uploadSingleShot(ctx, blob, value, h, meta, ac, d.config.transfer(key, true, int64(len(value))))
+	}
+	return d.uploadStaged(ctx, blob, value, h, meta, ac, d.config.transfer(key, true, int64(len(value))))
+}
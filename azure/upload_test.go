@@ -0,0 +1,52 @@
+package azure
+
+import (
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+func TestUploadStrategy(t *testing.T) {
+	c := defaultConfig()
+	WithUploadThresholds(4*mib, 2*mib)(&c)
+	WithMemoryBudget(16 * mib)(&c)
+
+	for _, tc := range []struct {
+		size          int64
+		put, fromRead uploadStrategy
+	}{
+		{0, uploadSingle, uploadSingle},
+		{4 * mib, uploadSingle, uploadSingle},
+		{4*mib + 1, uploadStaged, uploadStaged},
+		{16 * mib, uploadStaged, uploadStaged},
+		{16*mib + 1, uploadStaged, uploadStream},
+	} {
+		if got := c.putStrategy(tc.size); got != tc.put {
+			t.Errorf("put of %d bytes: %s, want %s", tc.size, got, tc.put)
+		}
+		if got := c.readerStrategy(tc.size); got != tc.fromRead {
+			t.Errorf("reader of %d bytes: %s, want %s", tc.size, got, tc.fromRead)
+		}
+	}
+	if got := c.readerStrategy(-1); got != uploadStream {
+		t.Errorf("reader of unknown size: %s", got)
+	}
+	if p := c.parallelism(); p != 8 {
+		t.Errorf("parallelism %d, want 8", p)
+	}
+}
+
+func TestUploadThresholdsCapped(t *testing.T) {
+	c := defaultConfig()
+	WithUploadThresholds(1<<40, 1<<40)(&c)
+	if c.singleShotMax != azblob.BlockBlobMaxUploadBlobBytes {
+		t.Errorf("single shot max %d", c.singleShotMax)
+	}
+	if c.blockSize != azblob.BlockBlobMaxStageBlockBytes {
+		t.Errorf("block size %d", c.blockSize)
+	}
+	WithMemoryBudget(1)(&c)
+	if p := c.parallelism(); p != 1 {
+		t.Errorf("parallelism %d with a tiny budget", p)
+	}
+}
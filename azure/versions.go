@@ -0,0 +1,141 @@
+package azure
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// WithVersioning has every write that replaces a value first snapshot the
+// blob, keeping the value it replaces as a version of the key. Versions
+// lists them and GetVersion reads one back, to recover a clobbered value.
+// Each overwrite costs one more request, and each version is billed for
+// the blocks it does not share with the current value.
+//
+// Snapshots cannot outlive their blob: deleting a key deletes its
+// versions too. DeleteVersion removes versions no longer wanted.
+func WithVersioning() Option {
+	return func(c *config) {
+		c.versioning = true
+	}
+}
+
+// Version is a past value of a key, kept in a snapshot of its blob.
+type Version struct {
+	// ID identifies the version: the time its snapshot was taken, in the
+	// service's format.
+	ID string
+	// Modified is when the value was written.
+	Modified time.Time
+	// Size is the value's size, before any compression.
+	Size int
+}
+
+// snapshotBefore snapshots the value of blob before a write replaces it,
+// if versioning is on. A write only replacing a matching value snapshots
+// only that value; one creating a new key has nothing to keep.
+func (d *Datastore) snapshotBefore(ctx context.Context, blob azblob.BlockBlobURL, ac azblob.BlobAccessConditions) error {
+	if !d.config.versioning || ac.IfNoneMatch == azblob.ETagAny {
+		return nil
+	}
+	cond := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: ac.IfMatch}}
+	_, err := blob.CreateSnapshot(ctx, azblob.Metadata{}, cond, d.config.cpk)
+	if isError(err, azblob.ServiceCodeBlobNotFound) || isError(err, azblob.ServiceCodeConditionNotMet) {
+		// The write itself fails on an unmet condition.
+		return nil
+	}
+	return err
+}
+
+// Versions returns the versions of key. See VersionsContext.
+func (d *Datastore) Versions(key ds.Key) ([]Version, error) {
+	return d.VersionsContext(context.Background(), key)
+}
+
+// VersionsContext returns the versions kept of key with WithVersioning,
+// oldest first. The current value is not among them.
+func (d *Datastore) VersionsContext(ctx context.Context, key ds.Key) (versions []Version, err error) {
+	ctx, done, err := d.life.begin(ctx, key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { done(err) }()
+
+	name := d.nameFor(key)
+	container := d.containerFor(key)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix:     name,
+			MaxResults: d.config.bulkPageSize(),
+			Details:    azblob.BlobListingDetails{Snapshots: true, Metadata: true},
+		})
+		if err != nil {
+			if isError(err, azblob.ServiceCodeContainerNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, blob := range list.Segment.BlobItems {
+			if blob.Name != name || blob.Snapshot == "" {
+				continue
+			}
+			var length int64
+			if blob.Properties.ContentLength != nil {
+				length = *blob.Properties.ContentLength
+			}
+			versions = append(versions, Version{
+				ID:       blob.Snapshot,
+				Modified: blob.Properties.LastModified,
+				Size:     valueSize(length, blob.Metadata),
+			})
+		}
+		marker = list.NextMarker
+	}
+	return versions, nil
+}
+
+// GetVersion returns the value of key as of a version. See
+// GetVersionContext.
+func (d *Datastore) GetVersion(key ds.Key, id string) ([]byte, error) {
+	return d.GetVersionContext(context.Background(), key, id)
+}
+
+// GetVersionContext returns the value of key kept as the version id,
+// verified and decompressed like a current value, or ds.ErrNotFound if
+// there is no such version. Restoring it is a Put of the value returned.
+func (d *Datastore) GetVersionContext(ctx context.Context, key ds.Key, id string) (value []byte, err error) {
+	ctx, done, err := d.life.begin(ctx, key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { done(err) }()
+
+	value, _, err = d.download(ctx, key, d.keyUrl(key).WithSnapshot(id).BlobURL)
+	if isError(err, azblob.ServiceCodeBlobNotFound) {
+		return nil, ds.ErrNotFound
+	}
+	return value, err
+}
+
+// DeleteVersion deletes a version of key. See DeleteVersionContext.
+func (d *Datastore) DeleteVersion(key ds.Key, id string) error {
+	return d.DeleteVersionContext(context.Background(), key, id)
+}
+
+// DeleteVersionContext deletes the version id of key. Deleting a version
+// that does not exist is not an error.
+func (d *Datastore) DeleteVersionContext(ctx context.Context, key ds.Key, id string) (err error) {
+	ctx, done, err := d.life.begin(ctx, key, true)
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+
+	_, err = d.keyUrl(key).WithSnapshot(id).Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	if isError(err, azblob.ServiceCodeBlobNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,186 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// WithWriteAheadLog logs the puts queued by WithAsyncPuts to the file at
+// path, so those not yet uploaded when the process dies, or when Close
+// gives up on them, are queued again by the next NewDatastore given the
+// same log, before it returns. Until they are uploaded, Get, Has and
+// GetSize see their values as with any queued put. Puts that fail are
+// not logged again: Sync reports them.
+//
+// Each Put appends its value to the log and fsyncs it before returning,
+// which bounds async puts by the local disk instead of Azure. Once no put
+// is queued, the log is truncated. A log must not be shared by datastores
+// open at the same time.
+func WithWriteAheadLog(path string) Option {
+	return func(c *config) {
+		c.walPath = path
+	}
+}
+
+var errWALWithoutAsync = errors.New("azure: WithWriteAheadLog requires WithAsyncPuts")
+
+// Operations of write-ahead log records.
+const (
+	walPut  byte = 'p' // a put of the value queued
+	walDone byte = 'd' // the key's queued put uploaded, failed or dropped
+)
+
+// wal is the write-ahead log of queued puts. Each record is the length
+// and CRC-32 of its body, four bytes each, then the body: the operation,
+// the key's length as a uvarint, the key and, for puts, the value. A
+// record cut short by a crash ends the log.
+type wal struct {
+	f    *os.File
+	size int64
+	// open holds the keys with a put logged and not done since, including
+	// those Close gave up on, which must outlive a truncation.
+	open map[ds.Key]bool
+}
+
+// walEntry is a put found pending in a log, in the order it was logged.
+type walEntry struct {
+	key   ds.Key
+	value []byte
+}
+
+// openWAL opens the log at path, creating it if need be, and returns the
+// puts it holds that were never done. The log is rewritten with only
+// those, so what a crash cut short is dropped.
+func openWAL(path string) (*wal, []walEntry, error) {
+	pending, err := readWAL(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, nil, err
+	}
+	w := &wal{f: tmp, open: make(map[ds.Key]bool)}
+	for _, e := range pending {
+		if err := w.write(walPut, e.key, e.value); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, nil, err
+		}
+		w.open[e.key] = true
+	}
+	if err = tmp.Sync(); err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+	return w, pending, nil
+}
+
+// readWAL returns the pending puts of the log at path, in log order. A
+// missing log has none.
+func readWAL(path string) ([]walEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var order []ds.Key
+	values := make(map[ds.Key][]byte)
+	for len(b) >= 8 {
+		n := binary.BigEndian.Uint32(b)
+		sum := binary.BigEndian.Uint32(b[4:])
+		if uint64(len(b)-8) < uint64(n) {
+			break
+		}
+		body := b[8 : 8+n]
+		b = b[8+n:]
+		if crc32.ChecksumIEEE(body) != sum || len(body) < 1 {
+			break
+		}
+		klen, m := binary.Uvarint(body[1:])
+		if m <= 0 || uint64(len(body)-1-m) < klen {
+			break
+		}
+		key := ds.RawKey(string(body[1+m : 1+m+int(klen)]))
+		switch body[0] {
+		case walPut:
+			if _, ok := values[key]; !ok {
+				order = append(order, key)
+			}
+			values[key] = body[1+m+int(klen):]
+		case walDone:
+			delete(values, key)
+		}
+	}
+	var pending []walEntry
+	for _, k := range order {
+		if v, ok := values[k]; ok {
+			pending = append(pending, walEntry{key: k, value: v})
+			// A key put again after being done is listed once.
+			delete(values, k)
+		}
+	}
+	return pending, nil
+}
+
+// write appends a record.
+func (w *wal) write(op byte, key ds.Key, value []byte) error {
+	k := key.String()
+	var buf bytes.Buffer
+	var hdr [8]byte
+	buf.Write(hdr[:])
+	buf.WriteByte(op)
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(k)))])
+	buf.WriteString(k)
+	buf.Write(value)
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-8))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[8:]))
+	if _, err := w.f.WriteAt(b, w.size); err != nil {
+		return err
+	}
+	w.size += int64(len(b))
+	return nil
+}
+
+// put logs a put of value, durably.
+func (w *wal) put(key ds.Key, value []byte) error {
+	if err := w.write(walPut, key, value); err != nil {
+		return err
+	}
+	w.open[key] = true
+	return w.f.Sync()
+}
+
+// done logs that key's put was uploaded or failed. It need not be
+// durable: a put found pending again is uploaded again. If no other put
+// is left undone, the log is truncated instead.
+func (w *wal) done(key ds.Key) error {
+	delete(w.open, key)
+	if len(w.open) == 0 {
+		if err := w.f.Truncate(0); err != nil {
+			return err
+		}
+		w.size = 0
+		return nil
+	}
+	return w.write(walDone, key, nil)
+}
+
+func (w *wal) close() error {
+	return w.f.Close()
+}
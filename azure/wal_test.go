@@ -0,0 +1,69 @@
+package azure
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+
+	w, pending, err := openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("new log has %d pending puts", len(pending))
+	}
+	a, b, c := ds.NewKey("/a"), ds.NewKey("/b"), ds.NewKey("/c")
+	w.put(a, []byte("a1"))
+	w.put(b, []byte("b"))
+	w.put(a, []byte("a2"))
+	w.put(c, nil)
+	w.done(b)
+	w.close()
+
+	// A record cut short by a crash is dropped.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	for i := 0; i < 2; i++ {
+		w, pending, err = openWAL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.close()
+		if len(pending) != 2 || !pending[0].key.Equal(a) || string(pending[0].value) != "a2" ||
+			!pending[1].key.Equal(c) || len(pending[1].value) != 0 {
+			t.Fatalf("reopen %d: unexpected pending puts %v", i, pending)
+		}
+	}
+
+	w, _, err = openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A put left undone, as by Close, keeps the log from being truncated.
+	w.done(a)
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+		t.Fatalf("expected log kept while /c is undone: %v, %v", fi, err)
+	}
+	w.done(c)
+	w.close()
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Fatalf("expected log truncated once empty: %v, %v", fi, err)
+	}
+}
@@ -0,0 +1,390 @@
+// Package bloom provides a datastore wrapper that keeps a bloom filter of the
+// keys in the wrapped datastore, answering negative Has, Get and GetSize
+// calls without touching the child.
+//
+// The filter is persisted in the child datastore under IndexKey on Close
+// (and optionally on an interval), and loaded on startup, so a fresh process
+// does not have to list the whole datastore before it can answer negative
+// lookups. An index written by Close is trusted immediately. An index written
+// on an interval, or no index at all, is warmed from a keys-only listing in
+// the background; until warming completes, negative lookups fall through to
+// the child.
+//
+// The index only stays accurate when every write goes through this wrapper.
+// Keys removed from the child still test positive until the filter is
+// rebuilt, which only costs a round trip. Rebuild relists the child into a
+// fresh filter, resized for the keys it holds.
+package bloom
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// IndexKey is the key the filter is persisted under in the child datastore.
+// It is hidden from query results.
+var IndexKey = ds.NewKey("/.bloom")
+
+// Options configures the filter.
+type Options struct {
+	// ExpectedKeys sizes the filter. Defaults to 1<<20.
+	ExpectedKeys int
+	// FalsePositiveRate is the target rate at ExpectedKeys. Defaults to 0.01.
+	FalsePositiveRate float64
+	// PersistInterval, when non-zero, periodically writes the index to the
+	// child in addition to writing it on Close.
+	PersistInterval time.Duration
+}
+
+// errClosed is returned by Rebuild when the datastore is closed under it.
+var errClosed = errors.New("bloom: datastore closed")
+
+// Datastore wraps a datastore with a bloom filter of its keys.
+type Datastore struct {
+	child ds.Datastore
+	opts  Options
+
+	mu      sync.RWMutex
+	filter  *filter
+	trusted bool    // filter covers every key in child
+	next    *filter // filter being rebuilt, also given new keys
+
+	// writes is held shared by writes from adding their keys until they
+	// reach the child, so Rebuild can wait out those it might miss.
+	writes    sync.RWMutex
+	rebuildMu sync.Mutex
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	wg        sync.WaitGroup
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// New wraps child, loading the persisted index if there is one.
+func New(child ds.Datastore, opts Options) (*Datastore, error) {
+	if opts.ExpectedKeys <= 0 {
+		opts.ExpectedKeys = 1 << 20
+	}
+	d := &Datastore{
+		child:   child,
+		opts:    opts,
+		closing: make(chan struct{}),
+	}
+
+	buf, err := child.Get(IndexKey)
+	switch err {
+	case nil:
+		f, clean, uerr := unmarshalFilter(buf)
+		if uerr == nil {
+			d.filter = f
+			d.trusted = clean
+		}
+	case ds.ErrNotFound:
+	default:
+		return nil, err
+	}
+	if d.filter == nil {
+		d.filter = newFilter(opts.ExpectedKeys, opts.FalsePositiveRate)
+	}
+
+	if d.trusted {
+		// Downgrade the stored copy so a crash before the next Close
+		// forces a warm instead of trusting a stale index.
+		if err := d.persist(false); err != nil {
+			return nil, err
+		}
+	} else {
+		d.wg.Add(1)
+		go d.warm()
+	}
+
+	if opts.PersistInterval > 0 {
+		d.wg.Add(1)
+		go d.persistLoop(opts.PersistInterval)
+	}
+	return d, nil
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.child}
+}
+
+// warm adds every key in the child to the filter.
+func (d *Datastore) warm() {
+	defer d.wg.Done()
+	res, err := d.child.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	for {
+		select {
+		case <-d.closing:
+			return
+		case r, ok := <-res.Next():
+			if !ok {
+				d.mu.Lock()
+				d.trusted = true
+				d.mu.Unlock()
+				return
+			}
+			if r.Error != nil {
+				return
+			}
+			d.mu.Lock()
+			d.filter.add(r.Key)
+			d.mu.Unlock()
+		}
+	}
+}
+
+func (d *Datastore) persistLoop(interval time.Duration) {
+	defer d.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.closing:
+			return
+		case <-t.C:
+			d.persist(false)
+		}
+	}
+}
+
+// persist writes the filter to the child. Only Close writes a clean index.
+func (d *Datastore) persist(clean bool) error {
+	d.mu.RLock()
+	buf := d.filter.marshal(clean && d.trusted)
+	d.mu.RUnlock()
+	return d.child.Put(IndexKey, buf)
+}
+
+// Persist writes the index to the child now. The written index is not
+// trusted by the next process; use Close for that.
+func (d *Datastore) Persist() error {
+	return d.persist(false)
+}
+
+// Ready reports whether the filter covers every key, i.e. whether negative
+// lookups are being answered from the filter.
+func (d *Datastore) Ready() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.trusted
+}
+
+// absent reports whether key is definitely not in the child.
+func (d *Datastore) absent(key ds.Key) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.trusted && !d.filter.mayContain(key.String())
+}
+
+func (d *Datastore) add(key ds.Key) {
+	d.mu.Lock()
+	d.filter.add(key.String())
+	if d.next != nil {
+		d.next.add(key.String())
+	}
+	d.mu.Unlock()
+}
+
+// Rebuild replaces the filter with one built from a keys-only listing of
+// the child, so keys deleted since no longer test positive. The new filter
+// is sized for twice the keys the current one is estimated to hold, or
+// ExpectedKeys if more, so a datastore grown past ExpectedKeys gets its
+// false positive rate back. The current filter answers lookups until the
+// new one is complete, and keys written meanwhile are added to both.
+func (d *Datastore) Rebuild() error {
+	d.rebuildMu.Lock()
+	defer d.rebuildMu.Unlock()
+
+	d.mu.RLock()
+	n := 2 * d.filter.estimate()
+	d.mu.RUnlock()
+	if n < d.opts.ExpectedKeys {
+		n = d.opts.ExpectedKeys
+	}
+	next := newFilter(n, d.opts.FalsePositiveRate)
+	// Writes that added their keys before next existed must reach the
+	// child before the listing starts.
+	d.writes.Lock()
+	d.mu.Lock()
+	d.next = next
+	d.mu.Unlock()
+	d.writes.Unlock()
+
+	err := d.fill(next)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.next = nil
+	if err != nil {
+		return err
+	}
+	d.filter, d.trusted = next, true
+	return nil
+}
+
+// fill adds every key in the child to f.
+func (d *Datastore) fill(f *filter) error {
+	res, err := d.child.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for {
+		select {
+		case <-d.closing:
+			return errClosed
+		case r, ok := <-res.Next():
+			if !ok {
+				return nil
+			}
+			if r.Error != nil {
+				return r.Error
+			}
+			d.mu.Lock()
+			f.add(r.Key)
+			d.mu.Unlock()
+		}
+	}
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	// Add first so there is never a window where the child has a key the
+	// filter denies.
+	d.writes.RLock()
+	defer d.writes.RUnlock()
+	d.add(key)
+	return d.child.Put(key, value)
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	if d.absent(key) {
+		return nil, ds.ErrNotFound
+	}
+	return d.child.Get(key)
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	if d.absent(key) {
+		return false, nil
+	}
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	if d.absent(key) {
+		return -1, ds.ErrNotFound
+	}
+	return d.child.GetSize(key)
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	return d.child.Delete(key)
+}
+
+// Query implements Datastore.Query
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	// The index is hidden before the offset and limit are applied, so the
+	// child must not apply them.
+	cq := q
+	cq.Limit, cq.Offset = 0, 0
+	res, err := d.child.Query(cq)
+	if err != nil {
+		return nil, err
+	}
+	res = dsq.NaiveFilter(dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next:  res.NextSync,
+		Close: res.Close,
+	}), hideIndex{})
+	if q.Offset != 0 {
+		res = dsq.NaiveOffset(res, q.Offset)
+	}
+	if q.Limit != 0 {
+		res = dsq.NaiveLimit(res, q.Limit)
+	}
+	return res, nil
+}
+
+type hideIndex struct{}
+
+func (hideIndex) Filter(e dsq.Entry) bool {
+	return e.Key != IndexKey.String()
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	if bds, ok := d.child.(ds.Batching); ok {
+		b, err := bds.Batch()
+		if err != nil {
+			return nil, err
+		}
+		return &batch{d: d, child: b}, nil
+	}
+	return ds.NewBasicBatch(d), nil
+}
+
+type batch struct {
+	d     *Datastore
+	child ds.Batch
+	keys  []ds.Key
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	b.d.add(key)
+	b.keys = append(b.keys, key)
+	return b.child.Put(key, value)
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	return b.child.Delete(key)
+}
+
+// Commit adds the batch's keys again, in case a Rebuild started since
+// they were put.
+func (b *batch) Commit() error {
+	b.d.writes.RLock()
+	defer b.d.writes.RUnlock()
+	for _, k := range b.keys {
+		b.d.add(k)
+	}
+	return b.child.Commit()
+}
+
+// DiskUsage implements the PersistentDatastore interface.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(d.child)
+}
+
+// Close persists the index and closes the child.
+func (d *Datastore) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.closing)
+		d.wg.Wait()
+		err = d.persist(true)
+		if cerr := d.child.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
@@ -0,0 +1,184 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func waitReady(t *testing.T, d *Datastore) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !d.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("filter never became ready")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSuite(t *testing.T) {
+	d, err := New(dssync.MutexWrap(ds.NewMapDatastore()), Options{ExpectedKeys: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitReady(t, d)
+	dstest.SubtestAll(t, d)
+}
+
+func TestFilter(t *testing.T) {
+	f := newFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.add(ds.RandomKey().String())
+	}
+	f.add("/present")
+	if !f.mayContain("/present") {
+		t.Fatal("false negative")
+	}
+	if n := f.estimate(); n < 900 || n > 1100 {
+		t.Fatalf("estimated %d keys in a filter of 1001", n)
+	}
+
+	g, clean, err := unmarshalFilter(f.marshal(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clean || !g.mayContain("/present") {
+		t.Fatal("filter did not round trip")
+	}
+	if _, _, err := unmarshalFilter([]byte("garbage")); err == nil {
+		t.Fatal("expected error for malformed index")
+	}
+}
+
+func TestPersistedIndex(t *testing.T) {
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+	if err := child.Put(ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(child, Options{ExpectedKeys: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitReady(t, d)
+	if err := d.Put(ds.NewKey("/b"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A clean index is trusted without warming.
+	d, err = New(child, Options{ExpectedKeys: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Ready() {
+		t.Fatal("clean index should be trusted immediately")
+	}
+	for _, k := range []string{"/a", "/b"} {
+		if has, err := d.Has(ds.NewKey(k)); err != nil || !has {
+			t.Fatalf("expected %s to be present: %v", k, err)
+		}
+	}
+
+	// Loading downgrades the stored index, so a crash now means a warm.
+	crashed, err := New(child, Options{ExpectedKeys: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed.mu.RLock()
+	trusted := crashed.trusted
+	crashed.mu.RUnlock()
+	waitReady(t, crashed)
+	if trusted {
+		t.Fatal("index left behind by an unclosed datastore should not be trusted")
+	}
+
+	res, err := d.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected index to be hidden, got %v", entries)
+	}
+
+	// The index sorts first, but must not count against a limit or offset.
+	for _, tc := range []struct {
+		limit, offset int
+		want          []string
+	}{
+		{limit: 2, want: []string{"/a", "/b"}},
+		{limit: 1, offset: 1, want: []string{"/b"}},
+	} {
+		res, err := d.Query(dsq.Query{
+			KeysOnly: true,
+			Orders:   []dsq.Order{dsq.OrderByKey{}},
+			Limit:    tc.limit,
+			Offset:   tc.offset,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("limit %d offset %d: expected %v, got %v", tc.limit, tc.offset, tc.want, got)
+		}
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+	d, err := New(child, Options{ExpectedKeys: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	waitReady(t, d)
+	for i := 0; i < 1000; i++ {
+		if err := d.Put(ds.NewKey(fmt.Sprintf("/k/%d", i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < 1000; i++ {
+		if err := d.Delete(ds.NewKey(fmt.Sprintf("/k/%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	small := d.filter.m
+	if err := d.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	if d.filter.m <= small {
+		t.Fatalf("filter of %d bits not grown from %d for its keys", d.filter.m, small)
+	}
+	if !d.filter.mayContain("/k/0") {
+		t.Fatal("remaining key missing from the rebuilt filter")
+	}
+	absent := 0
+	for i := 1; i < 1000; i++ {
+		if d.absent(ds.NewKey(fmt.Sprintf("/k/%d", i))) {
+			absent++
+		}
+	}
+	if absent < 900 {
+		t.Fatalf("only %d of 999 deleted keys answered from the rebuilt filter", absent)
+	}
+}
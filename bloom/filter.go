@@ -0,0 +1,128 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+var errBadIndex = errors.New("bloom: malformed index")
+
+const indexMagic = "dsbloom1"
+
+// filter is a plain bloom filter using double hashing over a 64 bit FNV-1a
+// hash of the key.
+type filter struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // number of hash functions
+}
+
+// newFilter sizes a filter for n entries at false positive rate p.
+func newFilter(n int, p float64) *filter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &filter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (f *filter) locations(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum & 0xffffffff, sum >> 32
+}
+
+func (f *filter) add(key string) {
+	h1, h2 := f.locations(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *filter) mayContain(key string) bool {
+	h1, h2 := f.locations(key)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// estimate returns the approximate number of distinct keys added, from the
+// fraction of bits set.
+func (f *filter) estimate() int {
+	var set uint64
+	for _, w := range f.bits {
+		set += uint64(bits.OnesCount64(w))
+	}
+	if set >= f.m {
+		// Saturated: any number of keys could be in it.
+		return int(f.m)
+	}
+	return int(math.Round(-float64(f.m) / float64(f.k) * math.Log(1-float64(set)/float64(f.m))))
+}
+
+// marshal encodes the filter together with its clean flag. A clean index was
+// written by Close and covers every key in the datastore.
+func (f *filter) marshal(clean bool) []byte {
+	buf := make([]byte, len(indexMagic)+1+16+8*len(f.bits))
+	n := copy(buf, indexMagic)
+	if clean {
+		buf[n] = 1
+	}
+	n++
+	binary.BigEndian.PutUint64(buf[n:], f.m)
+	binary.BigEndian.PutUint64(buf[n+8:], f.k)
+	n += 16
+	for _, w := range f.bits {
+		binary.BigEndian.PutUint64(buf[n:], w)
+		n += 8
+	}
+	return buf
+}
+
+func unmarshalFilter(buf []byte) (*filter, bool, error) {
+	hdr := len(indexMagic) + 1 + 16
+	if len(buf) < hdr || string(buf[:len(indexMagic)]) != indexMagic {
+		return nil, false, errBadIndex
+	}
+	n := len(indexMagic)
+	clean := buf[n] == 1
+	n++
+	f := &filter{
+		m: binary.BigEndian.Uint64(buf[n:]),
+		k: binary.BigEndian.Uint64(buf[n+8:]),
+	}
+	n += 16
+	words := (f.m + 63) / 64
+	if f.m == 0 || f.k == 0 || uint64(len(buf)-n) != words*8 {
+		return nil, false, errBadIndex
+	}
+	f.bits = make([]uint64, words)
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(buf[n:])
+		n += 8
+	}
+	return f, clean, nil
+}
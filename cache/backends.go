@@ -0,0 +1,256 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// MapCache caches every value set in a map, without bound. It suits small
+// key sets, or tests.
+type MapCache struct {
+	mu     sync.RWMutex
+	values map[ds.Key][]byte
+}
+
+var _ Cache = (*MapCache)(nil)
+
+// NewMap returns an empty MapCache.
+func NewMap() *MapCache {
+	return &MapCache{values: make(map[ds.Key][]byte)}
+}
+
+// Get implements Cache.Get
+func (c *MapCache) Get(key ds.Key) ([]byte, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	value, ok := c.values[key]
+	return value, ok
+}
+
+// Set implements Cache.Set
+func (c *MapCache) Set(key ds.Key, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+}
+
+// Remove implements Cache.Remove
+func (c *MapCache) Remove(key ds.Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+}
+
+// lru tracks the keys of a cache bounded by the total size of its values,
+// most recently used first. Its users hold their own lock.
+type lru struct {
+	maxBytes int64
+	list     *list.List // of *lruEntry
+	entries  map[ds.Key]*list.Element
+	size     int64
+}
+
+type lruEntry struct {
+	key   ds.Key
+	size  int64
+	value []byte
+}
+
+func newLRU(maxBytes int64) lru {
+	return lru{maxBytes: maxBytes, list: list.New(), entries: make(map[ds.Key]*list.Element)}
+}
+
+func (l *lru) get(key ds.Key) (*lruEntry, bool) {
+	el, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.list.MoveToFront(el)
+	return el.Value.(*lruEntry), true
+}
+
+// set records key as most recently used with a value of size, and returns
+// the entries evicted to fit it.
+func (l *lru) set(key ds.Key, size int64, value []byte) []*lruEntry {
+	if el, ok := l.entries[key]; ok {
+		e := el.Value.(*lruEntry)
+		l.size += size - e.size
+		e.size, e.value = size, value
+		l.list.MoveToFront(el)
+	} else {
+		l.entries[key] = l.list.PushFront(&lruEntry{key: key, size: size, value: value})
+		l.size += size
+	}
+	var evicted []*lruEntry
+	for l.size > l.maxBytes {
+		e := l.list.Back().Value.(*lruEntry)
+		l.remove(e.key)
+		evicted = append(evicted, e)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key ds.Key) bool {
+	el, ok := l.entries[key]
+	if !ok {
+		return false
+	}
+	l.list.Remove(el)
+	delete(l.entries, key)
+	l.size -= el.Value.(*lruEntry).size
+	return true
+}
+
+// LRUCache caches values in memory, evicting the least recently used once
+// their total size exceeds a bound.
+type LRUCache struct {
+	mu  sync.Mutex
+	lru lru
+}
+
+var _ Cache = (*LRUCache)(nil)
+
+// NewLRU returns an empty LRUCache holding up to maxBytes of values.
+// Larger values are not cached.
+func NewLRU(maxBytes int64) *LRUCache {
+	return &LRUCache{lru: newLRU(maxBytes)}
+}
+
+// Get implements Cache.Get
+func (c *LRUCache) Get(key ds.Key) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.lru.get(key)
+	if !ok {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Set implements Cache.Set
+func (c *LRUCache) Set(key ds.Key, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int64(len(value)) > c.lru.maxBytes {
+		c.lru.remove(key)
+		return
+	}
+	c.lru.set(key, int64(len(value)), value)
+}
+
+// Remove implements Cache.Remove
+func (c *LRUCache) Remove(key ds.Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.remove(key)
+}
+
+// Size returns the total size of the cached values.
+func (c *LRUCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.size
+}
+
+// DiskCache caches values as files in a directory, named by the SHA-256
+// of their keys, evicting the least recently used once their total size
+// exceeds a bound. Unlike the diskcache package, it keeps no index: what
+// it cached is forgotten, and removed, when it is opened again.
+type DiskCache struct {
+	dir string
+
+	mu  sync.Mutex
+	lru lru
+}
+
+var _ Cache = (*DiskCache)(nil)
+
+// NewDisk returns a DiskCache holding up to maxBytes of values in dir,
+// which is created if needed and emptied of the files of a previous
+// cache.
+func NewDisk(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range names {
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			return nil, err
+		}
+	}
+	return &DiskCache{dir: dir, lru: newLRU(maxBytes)}, nil
+}
+
+func (c *DiskCache) path(key ds.Key) string {
+	sum := sha256.Sum256(key.Bytes())
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// Get implements Cache.Get
+func (c *DiskCache) Get(key ds.Key) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.lru.get(key); !ok {
+		return nil, false
+	}
+	value, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		c.removeLocked(key)
+		return nil, false
+	}
+	return value, true
+}
+
+// Set implements Cache.Set. Failing to write the file leaves the key
+// uncached.
+func (c *DiskCache) Set(key ds.Key, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int64(len(value)) > c.lru.maxBytes {
+		c.removeLocked(key)
+		return
+	}
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		c.removeLocked(key)
+		return
+	}
+	_, err = tmp.Write(value)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		c.removeLocked(key)
+		return
+	}
+	for _, e := range c.lru.set(key, int64(len(value)), nil) {
+		os.Remove(c.path(e.key))
+	}
+}
+
+// Remove implements Cache.Remove
+func (c *DiskCache) Remove(key ds.Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *DiskCache) removeLocked(key ds.Key) {
+	if c.lru.remove(key) {
+		os.Remove(c.path(key))
+	}
+}
@@ -0,0 +1,241 @@
+// Package cache provides a write-through caching datastore wrapper over a
+// pluggable Cache, such as a map, a bounded LRU list in memory, or files
+// on local disk.
+//
+// Puts are written to the child and then to the cache before returning,
+// so reads through the wrapper see them at once; deletes remove the key
+// from the child and then invalidate it. A read missing the cache is read
+// from the child and cached.
+//
+// Keys changed by other writers are invalidated with Invalidate, or by
+// delivering them on Options.Feed, for example from an invalidate
+// wrapper's OnRemoteChange. Options.OnInvalidate is called with every key
+// the wrapper writes, deletes or invalidates, so caches layered elsewhere
+// can follow:
+//
+//	c := cache.New(azureDs, cache.NewLRU(64<<20), cache.Options{})
+//	d := invalidate.New(c, bus, invalidate.Options{OnRemoteChange: c.Invalidate})
+package cache
+
+import (
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Cache holds values for a datastore. Implementations must be safe for
+// concurrent use, and may drop values at any time.
+type Cache interface {
+	// Get returns the value cached for key.
+	Get(key ds.Key) ([]byte, bool)
+	// Set caches value for key.
+	Set(key ds.Key, value []byte)
+	// Remove drops the value cached for key, if any.
+	Remove(key ds.Key)
+}
+
+// Options configures the wrapper.
+type Options struct {
+	// Feed delivers keys changed outside this wrapper, to invalidate.
+	Feed <-chan ds.Key
+	// OnInvalidate is called with every key written, deleted or
+	// invalidated through the wrapper, after the cache is updated.
+	OnInvalidate func(ds.Key)
+}
+
+// Datastore caches a child datastore, writing through.
+type Datastore struct {
+	child ds.Datastore
+	cache Cache
+	opts  Options
+
+	mu  sync.Mutex
+	gen uint64 // bumped on every write and invalidation
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// New wraps child with c.
+func New(child ds.Datastore, c Cache, opts Options) *Datastore {
+	d := &Datastore{
+		child:   child,
+		cache:   c,
+		opts:    opts,
+		closing: make(chan struct{}),
+	}
+	if opts.Feed != nil {
+		d.wg.Add(1)
+		go d.follow(opts.Feed)
+	}
+	return d
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.child}
+}
+
+func (d *Datastore) follow(feed <-chan ds.Key) {
+	defer d.wg.Done()
+	for {
+		select {
+		case k, ok := <-feed:
+			if !ok {
+				return
+			}
+			d.Invalidate(k)
+		case <-d.closing:
+			return
+		}
+	}
+}
+
+// update applies a write of key to the cache: value is cached if set is
+// true, and the key dropped otherwise.
+func (d *Datastore) update(key ds.Key, value []byte, set bool) {
+	d.mu.Lock()
+	d.gen++
+	if set {
+		d.cache.Set(key, value)
+	} else {
+		d.cache.Remove(key)
+	}
+	d.mu.Unlock()
+	if d.opts.OnInvalidate != nil {
+		d.opts.OnInvalidate(key)
+	}
+}
+
+// Invalidate drops the value cached for key.
+func (d *Datastore) Invalidate(key ds.Key) {
+	d.update(key, nil, false)
+}
+
+// Put implements Datastore.Put. The value is cached once the child has
+// it; if the child fails, the key is invalidated, as the child may or may
+// not have it.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	err := d.child.Put(key, value)
+	d.update(key, value, err == nil)
+	return err
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	err := d.child.Delete(key)
+	d.Invalidate(key)
+	return err
+}
+
+// Get implements Datastore.Get. A value read from the child is cached,
+// unless a write or invalidation happened while reading it.
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	d.mu.Lock()
+	value, ok := d.cache.Get(key)
+	gen := d.gen
+	d.mu.Unlock()
+	if ok {
+		return value, nil
+	}
+
+	value, err := d.child.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	if d.gen == gen {
+		d.cache.Set(key, value)
+	}
+	d.mu.Unlock()
+	return value, nil
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	if _, ok := d.cache.Get(key); ok {
+		return true, nil
+	}
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	if value, ok := d.cache.Get(key); ok {
+		return len(value), nil
+	}
+	return d.child.GetSize(key)
+}
+
+// Query implements Datastore.Query against the child.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	return d.child.Query(q)
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Batch implements Batching.Batch. The cache is updated once the child's
+// batch is committed.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	if bds, ok := d.child.(ds.Batching); ok {
+		b, err := bds.Batch()
+		if err != nil {
+			return nil, err
+		}
+		return &batch{d: d, child: b, writes: make(map[ds.Key][]byte)}, nil
+	}
+	return ds.NewBasicBatch(d), nil
+}
+
+type batch struct {
+	d     *Datastore
+	child ds.Batch
+	// writes holds the values put, and nil for keys deleted.
+	writes map[ds.Key][]byte
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	if err := b.child.Put(key, value); err != nil {
+		return err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	b.writes[key] = value
+	return nil
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	if err := b.child.Delete(key); err != nil {
+		return err
+	}
+	b.writes[key] = nil
+	return nil
+}
+
+// Commit commits the child's batch. If it fails, every key written is
+// invalidated, as the child may hold any of the writes.
+func (b *batch) Commit() error {
+	err := b.child.Commit()
+	writes := b.writes
+	b.writes = make(map[ds.Key][]byte)
+	for k, v := range writes {
+		b.d.update(k, v, err == nil && v != nil)
+	}
+	return err
+}
+
+// Close stops following the feed and closes the child.
+func (d *Datastore) Close() error {
+	d.closeOnce.Do(func() { close(d.closing) })
+	d.wg.Wait()
+	return d.child.Close()
+}
@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk, err := NewDisk(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]Cache{
+		"map":  NewMap(),
+		"lru":  NewLRU(1 << 20),
+		"disk": disk,
+	} {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			dstest.SubtestAll(t, New(dssync.MutexWrap(ds.NewMapDatastore()), c, Options{}))
+		})
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+	c := NewMap()
+	d := New(child, c, Options{})
+	defer d.Close()
+
+	k := ds.NewKey("/a")
+	if err := d.Put(k, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := c.Get(k); !ok || string(v) != "1" {
+		t.Fatalf("expected put to be cached, got %q", v)
+	}
+	if v, err := child.Get(k); err != nil || string(v) != "1" {
+		t.Fatalf("expected put to reach the child, got %q, %v", v, err)
+	}
+
+	// A write behind the cache's back is not visible...
+	child.Put(k, []byte("2"))
+	if v, _ := d.Get(k); string(v) != "1" {
+		t.Fatalf("expected cached value, got %q", v)
+	}
+	// ...until the key is invalidated.
+	d.Invalidate(k)
+	if v, _ := d.Get(k); string(v) != "2" {
+		t.Fatalf("expected value read through, got %q", v)
+	}
+	if v, ok := c.Get(k); !ok || string(v) != "2" {
+		t.Fatalf("expected read to be cached, got %q", v)
+	}
+
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(k); ok {
+		t.Fatal("expected delete to invalidate")
+	}
+	if _, err := d.Get(k); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	c := NewMap()
+	d := New(dssync.MutexWrap(ds.NewMapDatastore()), c, Options{})
+	defer d.Close()
+
+	a, b := ds.NewKey("/a"), ds.NewKey("/b")
+	d.Put(b, []byte("b"))
+	batch, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.Put(a, []byte("a"))
+	batch.Delete(b)
+	if _, ok := c.Get(a); ok {
+		t.Fatal("expected nothing cached before commit")
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := c.Get(a); !ok || string(v) != "a" {
+		t.Fatalf("expected committed put to be cached, got %q", v)
+	}
+	if _, ok := c.Get(b); ok {
+		t.Fatal("expected committed delete to invalidate")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+	feed := make(chan ds.Key)
+	invalidated := make(chan ds.Key, 10)
+	d := New(child, NewMap(), Options{
+		Feed:         feed,
+		OnInvalidate: func(k ds.Key) { invalidated <- k },
+	})
+	defer d.Close()
+
+	k := ds.NewKey("/a")
+	d.Put(k, []byte("1"))
+	if got := <-invalidated; !got.Equal(k) {
+		t.Fatalf("expected put to call OnInvalidate with %s, got %s", k, got)
+	}
+	d.Get(k)
+
+	child.Put(k, []byte("2"))
+	feed <- k
+	select {
+	case got := <-invalidated:
+		if !got.Equal(k) {
+			t.Fatalf("expected feed to call OnInvalidate with %s, got %s", k, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("feed did not invalidate")
+	}
+	if v, _ := d.Get(k); string(v) != "2" {
+		t.Fatalf("expected value read through after feed, got %q", v)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	c := NewLRU(10)
+	for i := 0; i < 5; i++ {
+		c.Set(ds.NewKey(fmt.Sprint(i)), []byte("abc"))
+		if i == 2 {
+			// Touch 0, so 1 is the least recently used.
+			c.Get(ds.NewKey("0"))
+		}
+	}
+	if c.Size() > 10 {
+		t.Fatalf("expected at most 10 bytes cached, got %d", c.Size())
+	}
+	for i, want := range []bool{true, false, false, true, true} {
+		if _, ok := c.Get(ds.NewKey(fmt.Sprint(i))); ok != want {
+			t.Errorf("key %d: expected cached %v, got %v", i, want, ok)
+		}
+	}
+	c.Set(ds.NewKey("big"), make([]byte, 11))
+	if _, ok := c.Get(ds.NewKey("big")); ok {
+		t.Fatal("expected value larger than the cache not to be cached")
+	}
+}
+
+func TestDiskEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewDisk(dir, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, e := ds.NewKey("/a"), ds.NewKey("/b"), ds.NewKey("/c")
+	c.Set(a, []byte("aaa"))
+	c.Set(b, []byte("bbb"))
+	c.Get(a)
+	c.Set(e, []byte("ccc"))
+	if _, ok := c.Get(b); ok {
+		t.Fatal("expected least recently used value to be evicted")
+	}
+	if v, ok := c.Get(a); !ok || !bytes.Equal(v, []byte("aaa")) {
+		t.Fatalf("expected cached value, got %q", v)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+
+	// Reopening forgets, and removes, the cached values.
+	c, err = NewDisk(dir, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(a); ok {
+		t.Fatal("expected reopened cache to be empty")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected reopened cache directory to be empty, got %d files", len(files))
+	}
+}
@@ -0,0 +1,113 @@
+// Package clock abstracts the passage of time for the wrappers that
+// expire, lease or cache data, so tests and simulations can control it.
+//
+// Real is the wall clock. Mock only moves when told to, which makes TTL,
+// lease and cache expiry deterministic in tests and lets a simulation
+// replay hours of traffic in milliseconds.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel receiving the time once d has passed.
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// Real is the wall clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// OrReal returns c, or Real if c is nil, for options leaving the clock
+// unset.
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+// Mock is a clock that only moves when Advance, Set or Sleep is called.
+// It is safe for concurrent use.
+type Mock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+var _ Clock = (*Mock)(nil)
+
+// NewMock returns a mock clock reading start.
+func NewMock(start time.Time) *Mock {
+	return &Mock{now: start}
+}
+
+// Now implements Clock.Now
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// After implements Clock.After. The channel fires once the clock is moved
+// to or past now+d.
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	at := m.now.Add(d)
+	if d <= 0 {
+		ch <- m.now
+		return ch
+	}
+	m.waiters = append(m.waiters, waiter{at: at, ch: ch})
+	return ch
+}
+
+// Sleep implements Clock.Sleep by advancing the clock by d, so code that
+// sleeps runs without waiting while still seeing the time pass.
+func (m *Mock) Sleep(d time.Duration) {
+	m.Advance(d)
+}
+
+// Advance moves the clock forward by d, firing the After channels that
+// come due. A negative d moves the clock back without firing any.
+func (m *Mock) Advance(d time.Duration) {
+	m.mu.Lock()
+	t := m.now.Add(d)
+	m.mu.Unlock()
+	m.Set(t)
+}
+
+// Set moves the clock to t, firing the After channels that come due.
+func (m *Mock) Set(t time.Time) {
+	m.mu.Lock()
+	m.now = t
+	sort.Slice(m.waiters, func(i, j int) bool { return m.waiters[i].at.Before(m.waiters[j].at) })
+	n := 0
+	for _, w := range m.waiters {
+		if w.at.After(t) {
+			break
+		}
+		w.ch <- w.at
+		n++
+	}
+	m.waiters = m.waiters[n:]
+	m.mu.Unlock()
+}
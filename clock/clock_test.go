@@ -0,0 +1,42 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	m := NewMock(start)
+
+	late := m.After(2 * time.Second)
+	soon := m.After(time.Second)
+	m.Advance(1500 * time.Millisecond)
+	select {
+	case at := <-soon:
+		if !at.Equal(start.Add(time.Second)) {
+			t.Fatalf("fired at %v", at)
+		}
+	default:
+		t.Fatal("due timer did not fire")
+	}
+	select {
+	case <-late:
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	m.Sleep(time.Second)
+	if got := m.Now(); !got.Equal(start.Add(2500 * time.Millisecond)) {
+		t.Fatalf("clock reads %v", got)
+	}
+	<-late
+
+	m.Advance(-time.Hour)
+	if m.Now().After(start) {
+		t.Fatal("clock did not move back")
+	}
+	if OrReal(nil) != Real {
+		t.Fatal("nil clock not defaulted")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+const commandUsage = `commands:
+  ls [-l] [prefix]          list the keys under prefix, with -l their sizes
+  get <key>                 write the value of key to stdout
+  put [-ttl d] <key> [file] store the content of file, or stdin, at key
+  rm <key>...               delete keys
+  stat <key>                print the size, expiry and metadata of key
+  du [prefix]               total the keys and bytes under prefix
+`
+
+// usageError reports a command line that does not name a command or
+// gives it the wrong arguments.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// metadataGetter is implemented by datastores storing metadata with their
+// values, such as azure's.
+type metadataGetter interface {
+	GetMetadata(key ds.Key) (map[string]string, error)
+}
+
+// run runs the command args names against d.
+func run(d ds.Datastore, args []string, in io.Reader, out io.Writer) error {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	long := false
+	var ttl time.Duration
+	switch args[0] {
+	case "ls":
+		flags.BoolVar(&long, "l", false, "")
+	case "put":
+		flags.DurationVar(&ttl, "ttl", 0, "")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return usageError(fmt.Sprintf("%s: %v", args[0], err))
+	}
+	args = flags.Args()
+
+	switch cmd := flags.Name(); {
+	case cmd == "ls" && len(args) <= 1:
+		return ls(d, prefixArg(args), long, out)
+	case cmd == "get" && len(args) == 1:
+		return get(d, ds.NewKey(args[0]), out)
+	case cmd == "put" && (len(args) == 1 || len(args) == 2):
+		return put(d, args, ttl, in)
+	case cmd == "rm" && len(args) >= 1:
+		for _, k := range args {
+			if err := d.Delete(ds.NewKey(k)); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+		}
+		return nil
+	case cmd == "stat" && len(args) == 1:
+		return stat(d, ds.NewKey(args[0]), out)
+	case cmd == "du" && len(args) <= 1:
+		return du(d, prefixArg(args), out)
+	case cmd == "ls" || cmd == "get" || cmd == "put" || cmd == "rm" || cmd == "stat" || cmd == "du":
+		return usageError(fmt.Sprintf("%s: wrong number of arguments", cmd))
+	default:
+		return usageError(fmt.Sprintf("unknown command %q", cmd))
+	}
+}
+
+func prefixArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return ds.NewKey(args[0]).String()
+}
+
+func ls(d ds.Datastore, prefix string, long bool, out io.Writer) error {
+	res, err := d.Query(dsq.Query{Prefix: prefix, KeysOnly: true, ReturnsSizes: long, Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		if !long {
+			fmt.Fprintln(out, r.Key)
+			continue
+		}
+		size, err := entrySize(d, r.Entry)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%12d %s\n", size, r.Key)
+	}
+	return nil
+}
+
+// entrySize returns the size of a listed entry, asking for it if the
+// listing did not give it.
+func entrySize(d ds.Datastore, e dsq.Entry) (int, error) {
+	if e.Size >= 0 {
+		return e.Size, nil
+	}
+	size, err := d.GetSize(ds.RawKey(e.Key))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", e.Key, err)
+	}
+	return size, nil
+}
+
+func get(d ds.Datastore, key ds.Key, out io.Writer) error {
+	value, err := d.Get(key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	_, err = out.Write(value)
+	return err
+}
+
+func put(d ds.Datastore, args []string, ttl time.Duration, in io.Reader) error {
+	key := ds.NewKey(args[0])
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	value, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		return d.Put(key, value)
+	}
+	t, ok := d.(ds.TTLDatastore)
+	if !ok {
+		return fmt.Errorf("%s: datastore does not support TTLs", key)
+	}
+	return t.PutWithTTL(key, value, ttl)
+}
+
+func stat(d ds.Datastore, key ds.Key, out io.Writer) error {
+	size, err := d.GetSize(key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	fmt.Fprintf(out, "key:     %s\nsize:    %d\n", key, size)
+	if t, ok := d.(ds.TTLDatastore); ok {
+		exp, err := t.GetExpiration(key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if !exp.IsZero() {
+			fmt.Fprintf(out, "expires: %s\n", exp.UTC().Format(time.RFC3339))
+		}
+	}
+	if m, ok := d.(metadataGetter); ok {
+		meta, err := m.GetMetadata(key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		names := make([]string, 0, len(meta))
+		for name := range meta {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(out, "meta:    %s=%s\n", name, meta[name])
+		}
+	}
+	return nil
+}
+
+func du(d ds.Datastore, prefix string, out io.Writer) error {
+	res, err := d.Query(dsq.Query{Prefix: prefix, KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	var keys int
+	var bytes int64
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		size, err := entrySize(d, r.Entry)
+		if err != nil {
+			return err
+		}
+		keys++
+		bytes += int64(size)
+	}
+	fmt.Fprintf(out, "%d keys, %d bytes\n", keys, bytes)
+	return nil
+}
@@ -0,0 +1,60 @@
+// Command azure-ds inspects and edits the keys of a datastore, such as an
+// Azure container, from the shell.
+//
+// Usage:
+//
+//	azure-ds <datastore> <command> [args]
+//
+// The commands are:
+//
+//	ls [-l] [prefix]          list the keys under prefix, with -l their sizes
+//	get <key>                 write the value of key to stdout
+//	put [-ttl d] <key> [file] store the content of file, or stdin, at key
+//	rm <key>...               delete keys
+//	stat <key>                print the size, expiry and metadata of key
+//	du [prefix]               total the keys and bytes under prefix
+//
+// For example, with AZURE_STORAGE_KEY set:
+//
+//	azure-ds azure:myaccount/blocks ls -l /blocks
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ipfs/go-datastore/cmd/internal/dsopen"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s <datastore> <command> [args]\n\ndatastore is one of %s\n\n%s", os.Args[0], dsopen.Usage, commandUsage)
+	}
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	d, err := dsopen.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = run(d, flag.Args()[1:], os.Stdin, os.Stdout)
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	var usage usageError
+	switch {
+	case errors.As(err, &usage):
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
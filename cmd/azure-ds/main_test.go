@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/azure"
+	"github.com/ipfs/go-datastore/azure/azuretest"
+)
+
+func TestRun(t *testing.T) {
+	srv, _ := azuretest.NewServer()
+	defer srv.Close()
+	d, err := azure.NewDatastore("devstore", "data", azure.WithSharedKey("a2V5"), azure.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.PutWithMetadata(ds.NewKey("/a/meta"), []byte("m"), map[string]string{"owner": "me"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := func(in string, args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		if err := run(d, args, strings.NewReader(in), &out); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out.String()
+	}
+	cmd("value", "put", "/a/b")
+	cmd("ttl", "put", "-ttl", "1h", "/a/ttl")
+	cmd("other", "put", "/c")
+
+	if got := cmd("", "ls", "/a"); got != "/a/b\n/a/meta\n/a/ttl\n" {
+		t.Fatalf("ls:\n%s", got)
+	}
+	if got := cmd("", "ls", "-l"); !strings.Contains(got, "           5 /a/b\n") {
+		t.Fatalf("ls -l:\n%s", got)
+	}
+	if got := cmd("", "get", "/a/b"); got != "value" {
+		t.Fatalf("get %q", got)
+	}
+	if got := cmd("", "stat", "/a/meta"); !strings.Contains(got, "size:    1\n") || !strings.Contains(got, "meta:    owner=me\n") {
+		t.Fatalf("stat:\n%s", got)
+	}
+	if got := cmd("", "stat", "/a/ttl"); !strings.Contains(got, "expires: ") {
+		t.Fatalf("stat with a TTL:\n%s", got)
+	}
+	if got := cmd("", "du", "/a"); got != "3 keys, 9 bytes\n" {
+		t.Fatalf("du %q", got)
+	}
+	cmd("", "rm", "/a/b", "/c")
+	if got := cmd("", "du"); got != "2 keys, 4 bytes\n" {
+		t.Fatalf("du after rm %q", got)
+	}
+
+	var out bytes.Buffer
+	if err := run(d, []string{"get", "/a/b"}, nil, &out); !errors.Is(err, ds.ErrNotFound) {
+		t.Fatalf("get of a removed key: %v", err)
+	}
+	var usage usageError
+	for _, args := range [][]string{{"frob"}, {"get"}, {"ls", "-x"}, {"rm"}} {
+		if err := run(d, args, nil, &out); !errors.As(err, &usage) {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// PrefixStats aggregates the keys under one prefix.
+type PrefixStats struct {
+	Prefix string
+	Keys   int
+	Bytes  int64
+}
+
+// DepthStats aggregates the keys at one depth, counting a key at every
+// depth up to its own.
+type DepthStats struct {
+	Depth    int
+	Prefixes int
+	Keys     int
+	Bytes    int64
+}
+
+// Analysis is the result of scanning a datastore.
+type Analysis struct {
+	Keys  int
+	Bytes int64
+	// SmallKeys is the number of values smaller than the small-object
+	// threshold.
+	SmallKeys  int
+	SmallBytes int64
+	// Sizes counts values by power-of-two size class; Sizes[i] holds values
+	// of at most 2^i bytes.
+	Sizes  []int
+	Depths []DepthStats
+	// Largest holds the largest prefixes by bytes at each depth, deepest
+	// last.
+	Largest [][]PrefixStats
+
+	prefixes []map[string]*PrefixStats
+}
+
+// Analyze scans every key under prefix, aggregating by prefix up to
+// maxDepth segments below it.
+func Analyze(d ds.Datastore, prefix string, maxDepth, smallSize int) (*Analysis, error) {
+	res, err := d.Query(dsq.Query{Prefix: prefix, KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	base := 0
+	if pk := ds.NewKey(prefix); pk.String() != "/" {
+		base = len(pk.Namespaces())
+	}
+	a := &Analysis{prefixes: make([]map[string]*PrefixStats, maxDepth)}
+	for i := range a.prefixes {
+		a.prefixes[i] = make(map[string]*PrefixStats)
+	}
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		size := r.Size
+		if size < 0 {
+			if size, err = d.GetSize(ds.RawKey(r.Key)); err != nil {
+				if err == ds.ErrNotFound {
+					continue // deleted during the scan
+				}
+				return nil, err
+			}
+		}
+		a.add(r.Key, base, size, smallSize)
+	}
+	return a, nil
+}
+
+func (a *Analysis) add(key string, base, size, smallSize int) {
+	a.Keys++
+	a.Bytes += int64(size)
+	if size < smallSize {
+		a.SmallKeys++
+		a.SmallBytes += int64(size)
+	}
+
+	class := 0
+	for 1<<uint(class) < size {
+		class++
+	}
+	for len(a.Sizes) <= class {
+		a.Sizes = append(a.Sizes, 0)
+	}
+	a.Sizes[class]++
+
+	// The key's own last segment is not a prefix.
+	segs := ds.RawKey(key).Namespaces()
+	for depth := 1; depth <= len(a.prefixes) && base+depth < len(segs); depth++ {
+		p := "/" + strings.Join(segs[:base+depth], "/")
+		ps, ok := a.prefixes[depth-1][p]
+		if !ok {
+			ps = &PrefixStats{Prefix: p}
+			a.prefixes[depth-1][p] = ps
+		}
+		ps.Keys++
+		ps.Bytes += int64(size)
+	}
+}
+
+// Summarize fills in Depths and the top largest prefixes at each depth.
+func (a *Analysis) Summarize(top int) {
+	a.Depths = a.Depths[:0]
+	a.Largest = a.Largest[:0]
+	for i, m := range a.prefixes {
+		if len(m) == 0 {
+			break
+		}
+		st := DepthStats{Depth: i + 1, Prefixes: len(m)}
+		all := make([]PrefixStats, 0, len(m))
+		for _, ps := range m {
+			st.Keys += ps.Keys
+			st.Bytes += ps.Bytes
+			all = append(all, *ps)
+		}
+		sort.Slice(all, func(i, j int) bool {
+			if all[i].Bytes != all[j].Bytes {
+				return all[i].Bytes > all[j].Bytes
+			}
+			return all[i].Prefix < all[j].Prefix
+		})
+		if len(all) > top {
+			all = all[:top]
+		}
+		a.Depths = append(a.Depths, st)
+		a.Largest = append(a.Largest, all)
+	}
+}
+
+// Print writes a human-readable report.
+func (a *Analysis) Print(out io.Writer, smallSize int) {
+	fmt.Fprintf(out, "%d keys, %d bytes\n", a.Keys, a.Bytes)
+	if a.Keys == 0 {
+		return
+	}
+	fmt.Fprintf(out, "small objects (< %d bytes): %d keys (%.1f%%), %d bytes (%.1f%%)\n",
+		smallSize, a.SmallKeys, 100*float64(a.SmallKeys)/float64(a.Keys),
+		a.SmallBytes, percent(a.SmallBytes, a.Bytes))
+
+	fmt.Fprintln(out, "\nvalue sizes:")
+	for i, n := range a.Sizes {
+		if n > 0 {
+			fmt.Fprintf(out, "  <= %-10d %d\n", 1<<uint(i), n)
+		}
+	}
+
+	fmt.Fprintln(out, "\nby depth:")
+	fmt.Fprintf(out, "  %-6s %10s %10s %14s %12s\n", "depth", "prefixes", "keys", "bytes", "keys/prefix")
+	for _, d := range a.Depths {
+		fmt.Fprintf(out, "  %-6d %10d %10d %14d %12.1f\n",
+			d.Depth, d.Prefixes, d.Keys, d.Bytes, float64(d.Keys)/float64(d.Prefixes))
+	}
+
+	for i, largest := range a.Largest {
+		fmt.Fprintf(out, "\nlargest prefixes at depth %d:\n", i+1)
+		for _, ps := range largest {
+			fmt.Fprintf(out, "  %-40s %10d keys %14d bytes (%.1f%%)\n",
+				ps.Prefix, ps.Keys, ps.Bytes, percent(ps.Bytes, a.Bytes))
+		}
+	}
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
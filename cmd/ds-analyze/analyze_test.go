@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestAnalyze(t *testing.T) {
+	d := ds.NewMapDatastore()
+	for k, size := range map[string]int{
+		"/a/x/1": 10,
+		"/a/x/2": 10,
+		"/a/y/1": 5000,
+		"/b/1":   100,
+		"/c":     1,
+	} {
+		d.Put(ds.NewKey(k), make([]byte, size))
+	}
+
+	a, err := Analyze(d, "", 2, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Summarize(1)
+
+	if a.Keys != 5 || a.Bytes != 5121 {
+		t.Fatalf("got %d keys, %d bytes", a.Keys, a.Bytes)
+	}
+	if a.SmallKeys != 4 {
+		t.Fatalf("got %d small keys", a.SmallKeys)
+	}
+	if len(a.Depths) != 2 {
+		t.Fatalf("got %d depths", len(a.Depths))
+	}
+	if d1 := a.Depths[0]; d1.Prefixes != 2 || d1.Keys != 4 {
+		t.Fatalf("depth 1: %+v", d1)
+	}
+	if d2 := a.Depths[1]; d2.Prefixes != 2 || d2.Keys != 3 {
+		t.Fatalf("depth 2: %+v", d2)
+	}
+	if top := a.Largest[0][0]; top.Prefix != "/a" || top.Bytes != 5020 {
+		t.Fatalf("largest at depth 1: %+v", top)
+	}
+	if top := a.Largest[1][0]; top.Prefix != "/a/y" {
+		t.Fatalf("largest at depth 2: %+v", top)
+	}
+
+	a, err = Analyze(d, "/a", 1, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Summarize(10)
+	if a.Keys != 3 || len(a.Largest) != 1 || len(a.Largest[0]) != 2 || a.Largest[0][0].Prefix != "/a/y" {
+		t.Fatalf("prefixed analysis: %+v", a)
+	}
+
+	var out bytes.Buffer
+	a.Print(&out, 4096)
+	if !strings.Contains(out.String(), "largest prefixes at depth 1") {
+		t.Fatalf("unexpected report:\n%s", out.String())
+	}
+}
@@ -0,0 +1,55 @@
+// Command ds-analyze scans a datastore and reports how its keys and bytes
+// are distributed: per prefix depth, the largest prefixes, value size
+// classes and the share of small objects. The output is meant to guide
+// sharding, compaction and tiering decisions.
+//
+// Usage:
+//
+//	ds-analyze [flags] <datastore>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ipfs/go-datastore/cmd/internal/dsopen"
+)
+
+func main() {
+	var (
+		prefix    string
+		depth     int
+		top       int
+		smallSize int
+	)
+	flag.StringVar(&prefix, "prefix", "", "only analyze keys under this prefix")
+	flag.IntVar(&depth, "depth", 3, "aggregate prefixes up to this many segments deep")
+	flag.IntVar(&top, "top", 10, "list this many largest prefixes per depth")
+	flag.IntVar(&smallSize, "small", 4096, "values smaller than this many bytes count as small objects")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <datastore>\n\ndatastore is one of %s\n\n", os.Args[0], dsopen.Usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || depth < 0 || top < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	d, err := dsopen.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer d.Close()
+
+	a, err := Analyze(d, prefix, depth, smallSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	a.Summarize(top)
+	a.Print(os.Stdout, smallSize)
+}
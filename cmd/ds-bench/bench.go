@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Workload describes the load to generate.
+type Workload struct {
+	// Keys is the size of the keyspace.
+	Keys int
+	// Prefix is prepended to every generated key.
+	Prefix ds.Key
+	// ReadRatio is the fraction of operations that are Gets, in [0, 1].
+	ReadRatio float64
+	// MinValueSize and MaxValueSize bound the size of written values.
+	MinValueSize, MaxValueSize int
+	// Distribution is "uniform" or "zipf".
+	Distribution string
+	// ZipfS is the zipf skew parameter, > 1.
+	ZipfS float64
+	// Concurrency is the number of workers issuing operations.
+	Concurrency int
+	// Ops stops the run after this many operations, if positive.
+	Ops int64
+	// Duration stops the run after this long, if positive.
+	Duration time.Duration
+	// Seed seeds the workers' random sources.
+	Seed int64
+}
+
+// Validate checks the workload for usable values.
+func (w *Workload) Validate() error {
+	switch {
+	case w.Keys <= 0:
+		return fmt.Errorf("keys must be positive")
+	case w.ReadRatio < 0 || w.ReadRatio > 1:
+		return fmt.Errorf("read ratio must be within [0, 1]")
+	case w.MinValueSize < 0 || w.MaxValueSize < w.MinValueSize:
+		return fmt.Errorf("invalid value size range %d-%d", w.MinValueSize, w.MaxValueSize)
+	case w.Distribution != "uniform" && w.Distribution != "zipf":
+		return fmt.Errorf("unknown key distribution %q", w.Distribution)
+	case w.Distribution == "zipf" && w.ZipfS <= 1:
+		return fmt.Errorf("zipf skew must be greater than 1")
+	case w.Concurrency <= 0:
+		return fmt.Errorf("concurrency must be positive")
+	case w.Ops <= 0 && w.Duration <= 0:
+		return fmt.Errorf("one of ops or duration must be set")
+	}
+	return nil
+}
+
+func (w *Workload) key(i uint64) ds.Key {
+	return w.Prefix.ChildString(fmt.Sprintf("%012d", i))
+}
+
+func (w *Workload) valueSize(r *rand.Rand) int {
+	return w.MinValueSize + r.Intn(w.MaxValueSize-w.MinValueSize+1)
+}
+
+// Preload writes every key of the keyspace once, so reads hit.
+func Preload(d ds.Datastore, w *Workload) error {
+	r := rand.New(rand.NewSource(w.Seed))
+	for i := 0; i < w.Keys; i++ {
+		value := make([]byte, w.valueSize(r))
+		r.Read(value)
+		if err := d.Put(w.key(uint64(i)), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpStats collects the outcomes of one kind of operation.
+type OpStats struct {
+	Latencies []time.Duration
+	Errors    int64
+	Misses    int64
+	Bytes     int64
+}
+
+// Percentile returns the p-th percentile latency, p in [0, 100]. The
+// latencies must be sorted.
+func (s *OpStats) Percentile(p float64) time.Duration {
+	if len(s.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(s.Latencies)-1) * p / 100)
+	return s.Latencies[i]
+}
+
+func (s *OpStats) merge(o *OpStats) {
+	s.Latencies = append(s.Latencies, o.Latencies...)
+	s.Errors += o.Errors
+	s.Misses += o.Misses
+	s.Bytes += o.Bytes
+}
+
+// Report is the result of a run.
+type Report struct {
+	Elapsed time.Duration
+	Reads   OpStats
+	Writes  OpStats
+	// FirstError is the first error seen, if any.
+	FirstError error
+}
+
+// Run drives the workload against d until it is done.
+func Run(d ds.Datastore, w *Workload) *Report {
+	var (
+		issued   int64
+		deadline time.Time
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		report   Report
+	)
+	if w.Duration > 0 {
+		deadline = time.Now().Add(w.Duration)
+	}
+
+	start := time.Now()
+	for n := 0; n < w.Concurrency; n++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			var zipf *rand.Zipf
+			if w.Distribution == "zipf" {
+				zipf = rand.NewZipf(r, w.ZipfS, 1, uint64(w.Keys-1))
+			}
+			var reads, writes OpStats
+			var firstErr error
+
+			for {
+				if w.Ops > 0 && atomic.AddInt64(&issued, 1) > w.Ops {
+					break
+				}
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					break
+				}
+
+				var i uint64
+				if zipf != nil {
+					i = zipf.Uint64()
+				} else {
+					i = uint64(r.Intn(w.Keys))
+				}
+				key := w.key(i)
+
+				if r.Float64() < w.ReadRatio {
+					t := time.Now()
+					value, err := d.Get(key)
+					reads.Latencies = append(reads.Latencies, time.Since(t))
+					switch err {
+					case nil:
+						reads.Bytes += int64(len(value))
+					case ds.ErrNotFound:
+						reads.Misses++
+					default:
+						reads.Errors++
+						if firstErr == nil {
+							firstErr = err
+						}
+					}
+				} else {
+					value := make([]byte, w.valueSize(r))
+					r.Read(value)
+					t := time.Now()
+					err := d.Put(key, value)
+					writes.Latencies = append(writes.Latencies, time.Since(t))
+					if err != nil {
+						writes.Errors++
+						if firstErr == nil {
+							firstErr = err
+						}
+					} else {
+						writes.Bytes += int64(len(value))
+					}
+				}
+			}
+
+			mu.Lock()
+			report.Reads.merge(&reads)
+			report.Writes.merge(&writes)
+			if report.FirstError == nil {
+				report.FirstError = firstErr
+			}
+			mu.Unlock()
+		}(w.Seed + int64(n) + 1)
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+
+	for _, s := range []*OpStats{&report.Reads, &report.Writes} {
+		sort.Slice(s.Latencies, func(i, j int) bool { return s.Latencies[i] < s.Latencies[j] })
+	}
+	return &report
+}
+
+// Print writes a human-readable summary of the report.
+func (rep *Report) Print(out io.Writer) {
+	secs := rep.Elapsed.Seconds()
+	total := len(rep.Reads.Latencies) + len(rep.Writes.Latencies)
+	fmt.Fprintf(out, "elapsed %v, %d ops, %.1f ops/s\n", rep.Elapsed.Round(time.Millisecond), total, float64(total)/secs)
+	fmt.Fprintf(out, "%-6s %8s %10s %10s %10s %10s %10s %8s %8s\n",
+		"op", "count", "ops/s", "MB/s", "p50", "p90", "p99", "misses", "errors")
+	for _, row := range []struct {
+		name string
+		s    *OpStats
+	}{{"get", &rep.Reads}, {"put", &rep.Writes}} {
+		n := len(row.s.Latencies)
+		fmt.Fprintf(out, "%-6s %8d %10.1f %10.2f %10v %10v %10v %8d %8d\n",
+			row.name, n, float64(n)/secs, float64(row.s.Bytes)/secs/1e6,
+			row.s.Percentile(50), row.s.Percentile(90), row.s.Percentile(99),
+			row.s.Misses, row.s.Errors)
+	}
+	if rep.FirstError != nil {
+		fmt.Fprintf(out, "first error: %v\n", rep.FirstError)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+func TestRun(t *testing.T) {
+	for _, dist := range []string{"uniform", "zipf"} {
+		w := &Workload{
+			Keys:         100,
+			Prefix:       ds.NewKey("/bench"),
+			ReadRatio:    0.5,
+			MinValueSize: 10,
+			MaxValueSize: 20,
+			Distribution: dist,
+			ZipfS:        1.2,
+			Concurrency:  4,
+			Ops:          1000,
+			Seed:         1,
+		}
+		if err := w.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		d := dssync.MutexWrap(ds.NewMapDatastore())
+		if err := Preload(d, w); err != nil {
+			t.Fatal(err)
+		}
+
+		rep := Run(d, w)
+		if rep.FirstError != nil {
+			t.Fatal(rep.FirstError)
+		}
+		if n := len(rep.Reads.Latencies) + len(rep.Writes.Latencies); n != 1000 {
+			t.Fatalf("%s: ran %d ops, want 1000", dist, n)
+		}
+		if rep.Reads.Misses != 0 {
+			t.Fatalf("%s: %d misses after preload", dist, rep.Reads.Misses)
+		}
+		if rep.Reads.Percentile(50) > rep.Reads.Percentile(99) {
+			t.Fatalf("%s: percentiles out of order", dist)
+		}
+
+		var out bytes.Buffer
+		rep.Print(&out)
+		if !strings.Contains(out.String(), "p99") {
+			t.Fatalf("unexpected report:\n%s", out.String())
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	w := &Workload{Keys: 1, Distribution: "uniform", Concurrency: 1}
+	if err := w.Validate(); err == nil {
+		t.Fatal("expected an error without ops or duration")
+	}
+}
@@ -0,0 +1,75 @@
+// Command ds-bench generates load against a datastore and reports latency
+// percentiles and throughput.
+//
+// Usage:
+//
+//	ds-bench [flags] <datastore>
+//
+// For example, to run a 90% read workload with 16 workers for a minute:
+//
+//	ds-bench -preload -read-ratio 0.9 -concurrency 16 -duration 1m flatfs:/tmp/bench
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/cmd/internal/dsopen"
+)
+
+func main() {
+	w := Workload{}
+	var prefix string
+	var preload bool
+
+	flag.IntVar(&w.Keys, "keys", 10000, "size of the keyspace")
+	flag.StringVar(&prefix, "prefix", "/ds-bench", "prefix of generated keys")
+	flag.Float64Var(&w.ReadRatio, "read-ratio", 0.5, "fraction of operations that are reads")
+	flag.IntVar(&w.MinValueSize, "min-value-size", 1024, "minimum value size in bytes")
+	flag.IntVar(&w.MaxValueSize, "max-value-size", 1024, "maximum value size in bytes")
+	flag.StringVar(&w.Distribution, "dist", "uniform", "key distribution: uniform or zipf")
+	flag.Float64Var(&w.ZipfS, "zipf-s", 1.1, "zipf skew, greater than 1")
+	flag.IntVar(&w.Concurrency, "concurrency", 4, "number of concurrent workers")
+	flag.Int64Var(&w.Ops, "ops", 0, "stop after this many operations")
+	flag.DurationVar(&w.Duration, "duration", 10*time.Second, "stop after this long")
+	flag.Int64Var(&w.Seed, "seed", time.Now().UnixNano(), "random seed")
+	flag.BoolVar(&preload, "preload", false, "write every key once before the run")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <datastore>\n\ndatastore is one of %s\n\n", os.Args[0], dsopen.Usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	w.Prefix = ds.NewKey(prefix)
+	if err := w.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	d, err := dsopen.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer d.Close()
+
+	if preload {
+		if err := Preload(d, &w); err != nil {
+			fmt.Fprintln(os.Stderr, "preload:", err)
+			os.Exit(1)
+		}
+	}
+
+	report := Run(d, &w)
+	report.Print(os.Stdout)
+	if report.FirstError != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,101 @@
+// Command ds-migrate copies every key of one datastore into another, for
+// moving a datastore that is not in use onto another backend, such as from
+// flatfs into an Azure container.
+//
+// Usage:
+//
+//	ds-migrate [flags] <source> <target>
+//
+// Progress is printed to stderr as keys are copied. An interrupted
+// migration, by an error or by Ctrl-C, can be run again with -resume to
+// skip the keys already copied; run ds-verify afterwards to check the
+// result.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/cmd/internal/dsopen"
+	"github.com/ipfs/go-datastore/migrate"
+)
+
+func main() {
+	var opts migrate.Options
+	var every time.Duration
+
+	flag.StringVar(&opts.Prefix, "prefix", "", "only migrate keys under this prefix")
+	flag.IntVar(&opts.Workers, "workers", migrate.DefaultWorkers, "number of keys copied in parallel")
+	flag.BoolVar(&opts.Resume, "resume", false, "skip keys the target already has with the same size")
+	flag.DurationVar(&every, "progress", time.Second, "print progress this often (0 to disable)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <source> <target>\n\ndatastores are %s\n\n", os.Args[0], dsopen.Usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+	if every > 0 {
+		opts.Progress = progress(os.Stderr, every)
+	}
+	os.Exit(run(ctx, os.Stdout, flag.Arg(0), flag.Arg(1), opts))
+}
+
+func run(ctx context.Context, out io.Writer, source, target string, opts migrate.Options) int {
+	src, err := dsopen.Open(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer src.Close()
+	dst, err := dsopen.Open(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer dst.Close()
+
+	start := time.Now()
+	stats, err := migrate.Migrate(ctx, src, dst, opts)
+	prefix := ds.NewKey(opts.Prefix)
+	if serr := dst.Sync(prefix); err == nil {
+		err = serr
+	}
+	fmt.Fprintf(out, "copied %d keys (%d bytes), skipped %d, in %s\n",
+		stats.Copied, stats.Bytes, stats.Skipped, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "run again with -resume to carry on")
+		return 1
+	}
+	return 0
+}
+
+// progress returns a progress callback printing the totals to w at most
+// once per interval.
+func progress(w io.Writer, every time.Duration) func(migrate.Stats) {
+	var last time.Time
+	return func(s migrate.Stats) {
+		if now := time.Now(); now.Sub(last) >= every {
+			last = now
+			fmt.Fprintf(w, "copied %d keys (%d bytes), skipped %d\n", s.Copied, s.Bytes, s.Skipped)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/fs"
+	"github.com/ipfs/go-datastore/migrate"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ds-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestRun(t *testing.T) {
+	srcDir, dstDir := tempDir(t), tempDir(t)
+	src, err := fs.NewDatastore(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/a", "/b", "/c/d"} {
+		if err := src.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if code := run(context.Background(), &out, "fs:"+srcDir, "fs:"+dstDir, migrate.Options{}); code != 0 {
+		t.Fatalf("exit %d:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "copied 3 keys (8 bytes), skipped 0") {
+		t.Fatalf("unexpected summary:\n%s", out.String())
+	}
+	dst, err := fs.NewDatastore(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dst.Get(ds.NewKey("/c/d")); err != nil || string(v) != "/c/d" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	out.Reset()
+	if code := run(context.Background(), &out, "fs:"+srcDir, "fs:"+dstDir, migrate.Options{Resume: true}); code != 0 {
+		t.Fatalf("exit %d:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "copied 0 keys (0 bytes), skipped 3") {
+		t.Fatalf("unexpected summary resuming:\n%s", out.String())
+	}
+
+	if code := run(context.Background(), &out, "bogus", "mem", migrate.Options{}); code != 2 {
+		t.Fatalf("exit %d for a bad spec", code)
+	}
+}
@@ -0,0 +1,103 @@
+// Command ds-verify compares two datastores and reports keys missing from,
+// extra in, or differing in the target.
+//
+// Usage:
+//
+//	ds-verify [flags] <source> <target>
+//
+// The exit status is 0 when the datastores are consistent, 1 when
+// differences were found and 2 on usage or access errors, so it can gate a
+// migration or CI step.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-datastore/cmd/internal/dsopen"
+	"github.com/ipfs/go-datastore/verify"
+)
+
+const (
+	exitConsistent = 0
+	exitDiffers    = 1
+	exitError      = 2
+)
+
+func main() {
+	var opts verify.Options
+	var asJSON bool
+
+	flag.StringVar(&opts.Prefix, "prefix", "", "only compare keys under this prefix")
+	flag.BoolVar(&opts.SizesOnly, "sizes-only", false, "compare sizes without fetching values")
+	flag.IntVar(&opts.MaxReported, "max-report", 100, "list at most this many keys of each kind (0 for all)")
+	flag.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <source> <target>\n\ndatastores are %s\n\n", os.Args[0], dsopen.Usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(exitError)
+	}
+	os.Exit(run(os.Stdout, flag.Arg(0), flag.Arg(1), opts, asJSON))
+}
+
+func run(out io.Writer, source, target string, opts verify.Options, asJSON bool) int {
+	src, err := dsopen.Open(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	defer src.Close()
+	dst, err := dsopen.Open(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	defer dst.Close()
+
+	rep, err := verify.Compare(src, dst, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+	} else {
+		printReport(out, rep)
+	}
+	if !rep.Consistent() {
+		return exitDiffers
+	}
+	return exitConsistent
+}
+
+func printReport(out io.Writer, rep *verify.Report) {
+	fmt.Fprintf(out, "checked %d keys: %d missing, %d extra, %d mismatched\n",
+		rep.Checked, rep.MissingCount, rep.ExtraCount, rep.MismatchedCount)
+	for _, section := range []struct {
+		name  string
+		keys  []string
+		count int
+	}{
+		{"missing", rep.Missing, rep.MissingCount},
+		{"extra", rep.Extra, rep.ExtraCount},
+		{"mismatched", rep.Mismatched, rep.MismatchedCount},
+	} {
+		for _, k := range section.keys {
+			fmt.Fprintf(out, "%s\t%s\n", section.name, k)
+		}
+		if more := section.count - len(section.keys); more > 0 {
+			fmt.Fprintf(out, "%s\t... and %d more\n", section.name, more)
+		}
+	}
+}
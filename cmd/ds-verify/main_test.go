@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/fs"
+	"github.com/ipfs/go-datastore/verify"
+)
+
+func tempStore(t *testing.T, kv map[string]string) string {
+	dir, err := ioutil.TempDir("", "ds-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	d, err := fs.NewDatastore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range kv {
+		if err := d.Put(ds.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return "fs:" + dir
+}
+
+func TestRun(t *testing.T) {
+	a := tempStore(t, map[string]string{"/a": "1", "/b": "2"})
+	b := tempStore(t, map[string]string{"/a": "1", "/b": "2"})
+	c := tempStore(t, map[string]string{"/a": "1"})
+
+	var out bytes.Buffer
+	if code := run(&out, a, b, verify.Options{}, false); code != exitConsistent {
+		t.Fatalf("exit %d:\n%s", code, out.String())
+	}
+
+	out.Reset()
+	if code := run(&out, a, c, verify.Options{}, false); code != exitDiffers {
+		t.Fatalf("exit %d:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "missing\t/b") {
+		t.Fatalf("unexpected report:\n%s", out.String())
+	}
+
+	if code := run(&out, a, "bogus", verify.Options{}, false); code != exitError {
+		t.Fatalf("exit %d for a bad spec", code)
+	}
+}
@@ -0,0 +1,67 @@
+// Package dsopen opens datastores from the command-line specs shared by the
+// tools under cmd.
+//
+// A spec is a backend name, optionally followed by a colon and an argument:
+//
+//	mem                         an in-memory map datastore
+//	fs:<dir>                    the fs layout rooted at dir
+//	flatfs:<dir>                a flatfs datastore at dir
+//	azure:<account>/<container> an Azure container; the account key is
+//	                            read from AZURE_STORAGE_KEY
+//
+// Backends living in their own modules (etcd, postgres, ...) are not
+// linked into these tools.
+package dsopen
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/azure"
+	"github.com/ipfs/go-datastore/flatfs"
+	"github.com/ipfs/go-datastore/fs"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+// Usage describes the accepted specs, for flag help text.
+const Usage = "mem, fs:<dir>, flatfs:<dir> or azure:<account>/<container>"
+
+// Open opens the datastore described by spec.
+func Open(spec string) (ds.Datastore, error) {
+	kind, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "mem":
+		return dssync.MutexWrap(ds.NewMapDatastore()), nil
+	case "fs":
+		if arg == "" {
+			return nil, fmt.Errorf("%s: missing directory", spec)
+		}
+		if err := os.MkdirAll(arg, 0755); err != nil {
+			return nil, err
+		}
+		return fs.NewDatastore(arg)
+	case "flatfs":
+		if arg == "" {
+			return nil, fmt.Errorf("%s: missing directory", spec)
+		}
+		return flatfs.NewDatastore(arg, nil)
+	case "azure":
+		parts := strings.SplitN(arg, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s: expected azure:<account>/<container>", spec)
+		}
+		key := os.Getenv("AZURE_STORAGE_KEY")
+		if key == "" {
+			return nil, fmt.Errorf("%s: AZURE_STORAGE_KEY is not set", spec)
+		}
+		return azure.NewDatastore(parts[0], parts[1], azure.WithSharedKey(key))
+	default:
+		return nil, fmt.Errorf("unknown datastore %q (want %s)", spec, Usage)
+	}
+}
@@ -0,0 +1,374 @@
+// Package diskcache provides a datastore wrapper that caches a slower
+// child on local disk, so a process restarting does not have to fetch its
+// whole working set again.
+//
+// Each cached value is a content file under DIR/data named by the SHA-256
+// of its key. DIR/index records every entry's key and size, most recently
+// used first; it is rewritten on Sync and Close. When the cache is opened,
+// content files missing from the index (left by a crash) are removed and
+// index entries without a content file are dropped. The least recently
+// used entries are evicted once the cache exceeds its size bound.
+package diskcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"go.uber.org/multierr"
+)
+
+// DefaultMaxBytes bounds the cache when Options.MaxBytes is unset.
+const DefaultMaxBytes = 1 << 30
+
+const (
+	dataDir   = "data"
+	indexFile = "index"
+)
+
+// Options configures the cache.
+type Options struct {
+	// MaxBytes bounds the total size of cached values. Values larger than
+	// the bound are not cached.
+	MaxBytes int64
+}
+
+type entry struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// Datastore caches a child datastore on local disk.
+type Datastore struct {
+	child ds.Datastore
+	dir   string
+	opts  Options
+
+	mu      sync.Mutex
+	lru     *list.List // of *entry, most recently used first
+	entries map[string]*list.Element
+	size    int64
+	// gen counts writes, so a load racing a write does not cache what
+	// it read from before the write.
+	gen uint64
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// New wraps child with a cache stored under dir, loading any cache left
+// there by a previous process.
+func New(child ds.Datastore, dir string, opts Options) (*Datastore, error) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if err := os.MkdirAll(filepath.Join(dir, dataDir), 0755); err != nil {
+		return nil, err
+	}
+	d := &Datastore{
+		child:   child,
+		dir:     dir,
+		opts:    opts,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load reconciles the index with the content files on disk.
+func (d *Datastore) load() error {
+	var index []entry
+	buf, err := ioutil.ReadFile(filepath.Join(d.dir, indexFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(buf, &index); err != nil {
+			// A corrupt index only costs the cached data.
+			index = nil
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(d.dir, dataDir))
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]int64, len(files))
+	for _, fi := range files {
+		sizes[fi.Name()] = fi.Size()
+	}
+
+	for _, e := range index {
+		name := contentName(e.Key)
+		size, ok := sizes[name]
+		if !ok || size != e.Size {
+			continue
+		}
+		if _, dup := d.entries[e.Key]; dup {
+			continue
+		}
+		delete(sizes, name)
+		e := e
+		d.entries[e.Key] = d.lru.PushBack(&e)
+		d.size += e.Size
+	}
+	for name := range sizes {
+		if err := os.Remove(filepath.Join(d.dir, dataDir, name)); err != nil {
+			return err
+		}
+	}
+	return d.evict()
+}
+
+func contentName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *Datastore) contentPath(key string) string {
+	return filepath.Join(d.dir, dataDir, contentName(key))
+}
+
+// evict removes least recently used entries until the cache fits. The
+// caller holds mu, or has exclusive access.
+func (d *Datastore) evict() error {
+	var err error
+	for d.size > d.opts.MaxBytes {
+		el := d.lru.Back()
+		err = multierr.Append(err, d.removeLocked(el.Value.(*entry).Key))
+	}
+	return err
+}
+
+func (d *Datastore) removeLocked(key string) error {
+	el, ok := d.entries[key]
+	if !ok {
+		return nil
+	}
+	d.lru.Remove(el)
+	delete(d.entries, key)
+	d.size -= el.Value.(*entry).Size
+	err := os.Remove(d.contentPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// generation returns the write count, to pass to store.
+func (d *Datastore) generation() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.gen
+}
+
+// store caches value, read from the child, under key, unless a write
+// happened since gen.
+func (d *Datastore) store(gen uint64, key ds.Key, value []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if gen != d.gen {
+		return
+	}
+	d.storeLocked(key.String(), value)
+}
+
+// written updates the cache after a write of key reached the child:
+// value is cached if cache is true, and the key dropped otherwise.
+func (d *Datastore) written(key ds.Key, value []byte, cache bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	if cache {
+		d.storeLocked(key.String(), value)
+	} else {
+		d.removeLocked(key.String())
+	}
+}
+
+// storeLocked caches value under k. Failing to cache is not an error for
+// the caller, since the child holds the value.
+func (d *Datastore) storeLocked(k string, value []byte) {
+	if int64(len(value)) > d.opts.MaxBytes {
+		d.removeLocked(k)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(d.dir, dataDir), ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(value)
+	err = multierr.Append(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.contentPath(k))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		d.removeLocked(k)
+		return
+	}
+
+	if el, ok := d.entries[k]; ok {
+		e := el.Value.(*entry)
+		d.size += int64(len(value)) - e.Size
+		e.Size = int64(len(value))
+		d.lru.MoveToFront(el)
+	} else {
+		d.entries[k] = d.lru.PushFront(&entry{Key: k, Size: int64(len(value))})
+		d.size += int64(len(value))
+	}
+	d.evict()
+}
+
+// cached reads key from the cache, marking it recently used.
+func (d *Datastore) cached(key ds.Key) ([]byte, bool) {
+	k := key.String()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	el, ok := d.entries[k]
+	if !ok {
+		return nil, false
+	}
+	value, err := ioutil.ReadFile(d.contentPath(k))
+	if err != nil || int64(len(value)) != el.Value.(*entry).Size {
+		d.removeLocked(k)
+		return nil, false
+	}
+	d.lru.MoveToFront(el)
+	return value, true
+}
+
+// saveIndex writes the index atomically.
+func (d *Datastore) saveIndex() error {
+	d.mu.Lock()
+	index := make([]entry, 0, d.lru.Len())
+	for el := d.lru.Front(); el != nil; el = el.Next() {
+		index = append(index, *el.Value.(*entry))
+	}
+	d.mu.Unlock()
+
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(d.dir, ".index-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	err = multierr.Append(err, tmp.Sync())
+	err = multierr.Append(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(d.dir, indexFile))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.child}
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	if value, ok := d.cached(key); ok {
+		return value, nil
+	}
+	gen := d.generation()
+	value, err := d.child.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	d.store(gen, key, value)
+	return value, nil
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	d.mu.Lock()
+	_, ok := d.entries[key.String()]
+	d.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	d.mu.Lock()
+	el, ok := d.entries[key.String()]
+	var size int64
+	if ok {
+		size = el.Value.(*entry).Size
+	}
+	d.mu.Unlock()
+	if ok {
+		return int(size), nil
+	}
+	return d.child.GetSize(key)
+}
+
+// Put implements Datastore.Put. The child is written first so a failed
+// write never leaves the cache ahead of the backend.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	err := d.child.Put(key, value)
+	d.written(key, value, err == nil)
+	return err
+}
+
+// Delete implements Datastore.Delete. The key is invalidated once the
+// child has deleted it, so a read racing the delete cannot cache it again.
+func (d *Datastore) Delete(key ds.Key) error {
+	err := d.child.Delete(key)
+	d.written(key, nil, false)
+	return err
+}
+
+// Query implements Datastore.Query. Queries always go to the child.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	return d.child.Query(q)
+}
+
+// Sync implements Datastore.Sync, also saving the cache index.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return multierr.Append(d.child.Sync(prefix), d.saveIndex())
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// DiskUsage implements the PersistentDatastore interface by reporting the
+// child's usage.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(d.child)
+}
+
+// CacheSize returns the bytes of values currently cached.
+func (d *Datastore) CacheSize() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
+
+// Close saves the cache index and closes the child.
+func (d *Datastore) Close() error {
+	return multierr.Append(d.saveIndex(), d.child.Close())
+}
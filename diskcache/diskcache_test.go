@@ -0,0 +1,113 @@
+package diskcache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/failstore"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestSuite(t *testing.T) {
+	d, err := New(ds.NewMapDatastore(), tempDir(t), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstest.SubtestAll(t, d)
+}
+
+func TestEviction(t *testing.T) {
+	d, err := New(ds.NewMapDatastore(), tempDir(t), Options{MaxBytes: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/a", "/b", "/c"} {
+		d.Put(ds.NewKey(k), make([]byte, 100))
+	}
+	d.Get(ds.NewKey("/a")) // /b is now least recently used
+	d.Put(ds.NewKey("/d"), make([]byte, 100))
+
+	if d.CacheSize() != 300 {
+		t.Fatalf("cache holds %d bytes", d.CacheSize())
+	}
+	if _, ok := d.cached(ds.NewKey("/b")); ok {
+		t.Fatal("least recently used entry not evicted")
+	}
+	if _, ok := d.cached(ds.NewKey("/a")); !ok {
+		t.Fatal("recently used entry evicted")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir := tempDir(t)
+	d, err := New(ds.NewMapDatastore(), dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := ds.NewKey("/a")
+	if err := d.Put(k, []byte("cached")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A content file left without an index entry is discarded.
+	orphan := filepath.Join(dir, dataDir, contentName("/orphan"))
+	if err := ioutil.WriteFile(orphan, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	offline := failstore.NewFailstore(ds.NewMapDatastore(), func(string) error {
+		return errors.New("offline")
+	})
+	d, err = New(offline, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(k); err != nil || string(v) != "cached" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatal("orphaned content file kept")
+	}
+}
+
+func TestStaleLoadNotCached(t *testing.T) {
+	child := ds.NewMapDatastore()
+	d, err := New(child, tempDir(t), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := ds.NewKey("/k")
+	child.Put(k, []byte("old"))
+
+	// A load from before a Delete finishes after it.
+	gen := d.generation()
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	d.store(gen, k, []byte("old"))
+	if has, _ := d.Has(k); has {
+		t.Fatal("deleted key cached by a stale load")
+	}
+
+	gen = d.generation()
+	d.Put(k, []byte("new"))
+	d.store(gen, k, []byte("old"))
+	if v, _ := d.Get(k); string(v) != "new" {
+		t.Fatalf("load from before a put cached: %q", v)
+	}
+}
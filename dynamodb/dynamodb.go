@@ -0,0 +1,491 @@
+// Package dynamodb implements a Datastore over a DynamoDB table, for small
+// items where per-request latency matters more than bulk throughput.
+//
+// The table must have a string partition key "pk" and a string sort key
+// "sk". A ds.Key is split after its first PartitionDepth namespaces: those
+// form the partition key and the rest the sort key, so /blocks/CIQ... lands
+// in partition "/blocks" with sort key "/CIQ...". Prefix queries at or below
+// the partition depth are served by DynamoDB Query; shallower prefixes need a
+// Scan.
+//
+// Expiry is stored in the numeric "ttl" attribute; enable DynamoDB TTL on it
+// to have expired items removed server side. Expired items are hidden from
+// reads until then. Items are limited to 400KB by DynamoDB.
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	ddb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// ErrConflict is returned by conditional writes whose condition failed.
+var ErrConflict = errors.New("dynamodb: conditional check failed")
+
+const (
+	attrPK    = "pk"
+	attrSK    = "sk"
+	attrValue = "v"
+	attrSize  = "n"
+	attrTTL   = "ttl"
+)
+
+// maxBatchWrite is the BatchWriteItem request limit.
+const maxBatchWrite = 25
+
+// API is the subset of *dynamodb.Client used by the datastore.
+type API interface {
+	GetItem(ctx context.Context, in *ddb.GetItemInput, opts ...func(*ddb.Options)) (*ddb.GetItemOutput, error)
+	PutItem(ctx context.Context, in *ddb.PutItemInput, opts ...func(*ddb.Options)) (*ddb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, in *ddb.DeleteItemInput, opts ...func(*ddb.Options)) (*ddb.DeleteItemOutput, error)
+	UpdateItem(ctx context.Context, in *ddb.UpdateItemInput, opts ...func(*ddb.Options)) (*ddb.UpdateItemOutput, error)
+	Query(ctx context.Context, in *ddb.QueryInput, opts ...func(*ddb.Options)) (*ddb.QueryOutput, error)
+	Scan(ctx context.Context, in *ddb.ScanInput, opts ...func(*ddb.Options)) (*ddb.ScanOutput, error)
+	BatchWriteItem(ctx context.Context, in *ddb.BatchWriteItemInput, opts ...func(*ddb.Options)) (*ddb.BatchWriteItemOutput, error)
+}
+
+// Options configures the datastore.
+type Options struct {
+	// PartitionDepth is the number of leading key namespaces that form the
+	// partition key. Defaults to 1.
+	PartitionDepth int
+	// ConsistentRead requests strongly consistent reads.
+	ConsistentRead bool
+	// Clock sets TTL expirations and hides expired items DynamoDB has not
+	// deleted yet. Defaults to the wall clock.
+	Clock clock.Clock
+}
+
+// Datastore stores keys as items of a DynamoDB table.
+type Datastore struct {
+	api   API
+	table string
+	opts  Options
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.TTLDatastore = (*Datastore)(nil)
+
+// NewDatastore returns a datastore over table.
+func NewDatastore(api API, table string, opts Options) *Datastore {
+	if opts.PartitionDepth <= 0 {
+		opts.PartitionDepth = 1
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+	return &Datastore{api: api, table: table, opts: opts}
+}
+
+// splitKey derives the partition and sort keys for key.
+func (d *Datastore) splitKey(key ds.Key) (string, string) {
+	ns := key.Namespaces()
+	if len(ns) <= d.opts.PartitionDepth {
+		// Sort keys can't be empty; "/" can't collide with a real
+		// remainder, which always has a name after the slash.
+		return key.String(), "/"
+	}
+	return "/" + strings.Join(ns[:d.opts.PartitionDepth], "/"),
+		"/" + strings.Join(ns[d.opts.PartitionDepth:], "/")
+}
+
+func joinKey(pk, sk string) string {
+	if sk == "/" {
+		return pk
+	}
+	return pk + sk
+}
+
+func (d *Datastore) itemKey(key ds.Key) map[string]types.AttributeValue {
+	pk, sk := d.splitKey(key)
+	return map[string]types.AttributeValue{
+		attrPK: &types.AttributeValueMemberS{Value: pk},
+		attrSK: &types.AttributeValueMemberS{Value: sk},
+	}
+}
+
+func (d *Datastore) item(key ds.Key, value []byte, expiry time.Time) map[string]types.AttributeValue {
+	item := d.itemKey(key)
+	item[attrValue] = &types.AttributeValueMemberB{Value: value}
+	item[attrSize] = &types.AttributeValueMemberN{Value: strconv.Itoa(len(value))}
+	if !expiry.IsZero() {
+		item[attrTTL] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expiry.Unix(), 10)}
+	}
+	return item
+}
+
+// expiration returns the item's expiry, or the zero time.
+func expiration(item map[string]types.AttributeValue) time.Time {
+	n, ok := item[attrTTL].(*types.AttributeValueMemberN)
+	if !ok {
+		return time.Time{}
+	}
+	secs, err := strconv.ParseInt(n.Value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+func (d *Datastore) expired(item map[string]types.AttributeValue) bool {
+	exp := expiration(item)
+	return !exp.IsZero() && !exp.After(d.opts.Clock.Now())
+}
+
+func isConditionFailed(err error) bool {
+	var cfe *types.ConditionalCheckFailedException
+	return errors.As(err, &cfe)
+}
+
+func (d *Datastore) get(key ds.Key) (map[string]types.AttributeValue, error) {
+	out, err := d.api.GetItem(context.TODO(), &ddb.GetItemInput{
+		TableName:      &d.table,
+		Key:            d.itemKey(key),
+		ConsistentRead: &d.opts.ConsistentRead,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil || d.expired(out.Item) {
+		return nil, ds.ErrNotFound
+	}
+	return out.Item, nil
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	_, err := d.api.PutItem(context.TODO(), &ddb.PutItemInput{
+		TableName: &d.table,
+		Item:      d.item(key, value, time.Time{}),
+	})
+	return err
+}
+
+// PutIfAbsent writes value only if key does not exist, returning
+// ErrConflict otherwise.
+func (d *Datastore) PutIfAbsent(key ds.Key, value []byte) error {
+	cond := "attribute_not_exists(" + attrPK + ")"
+	_, err := d.api.PutItem(context.TODO(), &ddb.PutItemInput{
+		TableName:           &d.table,
+		Item:                d.item(key, value, time.Time{}),
+		ConditionExpression: &cond,
+	})
+	if isConditionFailed(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// CompareAndSwap replaces the value of key with new only if it currently
+// holds old, returning ErrConflict otherwise.
+func (d *Datastore) CompareAndSwap(key ds.Key, old, new []byte) error {
+	cond := attrValue + " = :old"
+	_, err := d.api.PutItem(context.TODO(), &ddb.PutItemInput{
+		TableName:           &d.table,
+		Item:                d.item(key, new, time.Time{}),
+		ConditionExpression: &cond,
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":old": &types.AttributeValueMemberB{Value: old},
+		},
+	})
+	if isConditionFailed(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// Sync implements Datastore.Sync. Writes are durable once acknowledged.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return nil
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	item, err := d.get(key)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := item[attrValue].(*types.AttributeValueMemberB)
+	if v == nil || v.Value == nil {
+		return []byte{}, nil
+	}
+	return v.Value, nil
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	return ds.GetBackedHas(d, key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	item, err := d.get(key)
+	if err != nil {
+		return -1, err
+	}
+	if n, ok := item[attrSize].(*types.AttributeValueMemberN); ok {
+		return strconv.Atoi(n.Value)
+	}
+	return -1, nil
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	_, err := d.api.DeleteItem(context.TODO(), &ddb.DeleteItemInput{
+		TableName: &d.table,
+		Key:       d.itemKey(key),
+	})
+	return err
+}
+
+// PutWithTTL implements TTL.PutWithTTL
+func (d *Datastore) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
+	_, err := d.api.PutItem(context.TODO(), &ddb.PutItemInput{
+		TableName: &d.table,
+		Item:      d.item(key, value, d.opts.Clock.Now().Add(ttl)),
+	})
+	return err
+}
+
+// SetTTL implements TTL.SetTTL
+func (d *Datastore) SetTTL(key ds.Key, ttl time.Duration) error {
+	update := "SET #ttl = :ttl"
+	cond := "attribute_exists(" + attrPK + ")"
+	_, err := d.api.UpdateItem(context.TODO(), &ddb.UpdateItemInput{
+		TableName:                &d.table,
+		Key:                      d.itemKey(key),
+		UpdateExpression:         &update,
+		ConditionExpression:      &cond,
+		ExpressionAttributeNames: map[string]string{"#ttl": attrTTL},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":ttl": &types.AttributeValueMemberN{Value: strconv.FormatInt(d.opts.Clock.Now().Add(ttl).Unix(), 10)},
+		},
+	})
+	if isConditionFailed(err) {
+		return ds.ErrNotFound
+	}
+	return err
+}
+
+// GetExpiration implements TTL.GetExpiration. Keys without a TTL return the
+// zero time.
+func (d *Datastore) GetExpiration(key ds.Key) (time.Time, error) {
+	item, err := d.get(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expiration(item), nil
+}
+
+// page fetches one page of items under prefix, returning the key to resume
+// from, or nil when done.
+type pager func(ctx context.Context, start map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error)
+
+// pagerFor returns a pager listing the children of a query prefix.
+func (d *Datastore) pagerFor(prefix string, keysOnly bool) pager {
+	var projection *string
+	names := map[string]string{"#pk": attrPK, "#sk": attrSK}
+	if keysOnly {
+		p := "#pk, #sk, #n, #ttl"
+		projection = &p
+		names["#n"] = attrSize
+		names["#ttl"] = attrTTL
+	}
+
+	p := path.Clean("/" + prefix)
+	depth := 0
+	if p != "/" {
+		depth = len(ds.NewKey(p).Namespaces())
+	}
+
+	if depth >= d.opts.PartitionDepth {
+		pk, sk := d.splitKey(ds.NewKey(p))
+		cond := "#pk = :pk"
+		values := map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: pk},
+		}
+		if sk == "/" {
+			// Everything in the partition except the item for pk itself.
+			cond += " AND #sk > :root"
+			values[":root"] = &types.AttributeValueMemberS{Value: "/"}
+		} else {
+			cond += " AND begins_with(#sk, :sk)"
+			values[":sk"] = &types.AttributeValueMemberS{Value: sk + "/"}
+		}
+		return func(ctx context.Context, start map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+			out, err := d.api.Query(ctx, &ddb.QueryInput{
+				TableName:                 &d.table,
+				KeyConditionExpression:    &cond,
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+				ProjectionExpression:      projection,
+				ExclusiveStartKey:         start,
+				ConsistentRead:            &d.opts.ConsistentRead,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			return out.Items, out.LastEvaluatedKey, nil
+		}
+	}
+
+	in := &ddb.ScanInput{
+		TableName:            &d.table,
+		ProjectionExpression: projection,
+		ConsistentRead:       &d.opts.ConsistentRead,
+	}
+	if p != "/" {
+		cond := "begins_with(#pk, :prefix)"
+		in.FilterExpression = &cond
+		in.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: p + "/"},
+		}
+		names = map[string]string{"#pk": attrPK}
+		if keysOnly {
+			names["#sk"] = attrSK
+			names["#n"] = attrSize
+			names["#ttl"] = attrTTL
+		}
+	} else if !keysOnly {
+		names = nil
+	}
+	in.ExpressionAttributeNames = names
+	return func(ctx context.Context, start map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		in.ExclusiveStartKey = start
+		out, err := d.api.Scan(ctx, in)
+		if err != nil {
+			return nil, nil, err
+		}
+		return out.Items, out.LastEvaluatedKey, nil
+	}
+}
+
+// Query implements Datastore.Query. The prefix is pushed down; everything
+// else is applied naively.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	next := d.pagerFor(q.Prefix, q.KeysOnly)
+
+	var (
+		page  []map[string]types.AttributeValue
+		start map[string]types.AttributeValue
+		done  bool
+	)
+	it := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for {
+				for len(page) > 0 {
+					item := page[0]
+					page = page[1:]
+					if d.expired(item) {
+						continue
+					}
+					pk, _ := item[attrPK].(*types.AttributeValueMemberS)
+					sk, _ := item[attrSK].(*types.AttributeValueMemberS)
+					if pk == nil || sk == nil {
+						continue
+					}
+					e := dsq.Entry{Key: joinKey(pk.Value, sk.Value), Size: -1}
+					if n, ok := item[attrSize].(*types.AttributeValueMemberN); ok {
+						e.Size, _ = strconv.Atoi(n.Value)
+					}
+					if !q.KeysOnly {
+						e.Value = []byte{}
+						if v, ok := item[attrValue].(*types.AttributeValueMemberB); ok && v.Value != nil {
+							e.Value = v.Value
+						}
+					}
+					if q.ReturnExpirations {
+						e.Expiration = expiration(item)
+					}
+					return dsq.Result{Entry: e}, true
+				}
+				if done {
+					return dsq.Result{}, false
+				}
+				items, last, err := next(ctx, start)
+				if err != nil {
+					done = true
+					return dsq.Result{Error: err}, true
+				}
+				page, start = items, last
+				done = len(last) == 0
+			}
+		},
+		Close: func() error {
+			cancel()
+			return nil
+		},
+	}
+	return dsq.NaiveQueryApply(q, dsq.ResultsFromIterator(q, it)), nil
+}
+
+// Batch implements Batching.Batch. Batches are committed with
+// BatchWriteItem, 25 items per request.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return &batch{d: d, ops: make(map[ds.Key][]byte), deletes: make(map[ds.Key]struct{})}, nil
+}
+
+type batch struct {
+	d       *Datastore
+	ops     map[ds.Key][]byte
+	deletes map[ds.Key]struct{}
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	delete(b.deletes, key)
+	b.ops[key] = value
+	return nil
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	delete(b.ops, key)
+	b.deletes[key] = struct{}{}
+	return nil
+}
+
+func (b *batch) Commit() error {
+	var reqs []types.WriteRequest
+	for k, v := range b.ops {
+		reqs = append(reqs, types.WriteRequest{PutRequest: &types.PutRequest{Item: b.d.item(k, v, time.Time{})}})
+	}
+	for k := range b.deletes {
+		reqs = append(reqs, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: b.d.itemKey(k)}})
+	}
+	backoff := 50 * time.Millisecond
+	for len(reqs) > 0 {
+		n := len(reqs)
+		if n > maxBatchWrite {
+			n = maxBatchWrite
+		}
+		out, err := b.d.api.BatchWriteItem(context.TODO(), &ddb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{b.d.table: reqs[:n]},
+		})
+		if err != nil {
+			return err
+		}
+		// Throttled items come back unprocessed; requeue them.
+		unprocessed := out.UnprocessedItems[b.d.table]
+		reqs = append(reqs[n:], unprocessed...)
+		if len(unprocessed) > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	b.ops = make(map[ds.Key][]byte)
+	b.deletes = make(map[ds.Key]struct{})
+	return nil
+}
+
+// Close implements Datastore.Close
+func (d *Datastore) Close() error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	ddb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSplitKey(t *testing.T) {
+	d := NewDatastore(nil, "t", Options{PartitionDepth: 1})
+	for _, tc := range []struct{ key, pk, sk string }{
+		{"/blocks/abc", "/blocks", "/abc"},
+		{"/blocks/a/b", "/blocks", "/a/b"},
+		{"/blocks", "/blocks", "/"},
+	} {
+		pk, sk := d.splitKey(ds.NewKey(tc.key))
+		if pk != tc.pk || sk != tc.sk {
+			t.Errorf("splitKey(%s) = (%s, %s), want (%s, %s)", tc.key, pk, sk, tc.pk, tc.sk)
+		}
+		if k := joinKey(pk, sk); k != tc.key {
+			t.Errorf("joinKey(%s, %s) = %s, want %s", pk, sk, k, tc.key)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	c := clock.NewMock(time.Unix(1000, 0))
+	d := NewDatastore(nil, "t", Options{Clock: c})
+	item := d.item(ds.NewKey("/k"), nil, c.Now().Add(time.Minute))
+	if d.expired(item) {
+		t.Fatal("expired early")
+	}
+	c.Advance(time.Minute)
+	if !d.expired(item) {
+		t.Fatal("not expired after its TTL")
+	}
+	if d.expired(d.item(ds.NewKey("/k"), nil, time.Time{})) {
+		t.Fatal("item without a TTL expired")
+	}
+}
+
+// TestSuite runs against the table named by DYNAMODB_TABLE using the
+// default AWS credential chain. The table is cleared by the suite.
+func TestSuite(t *testing.T) {
+	table := os.Getenv("DYNAMODB_TABLE")
+	if table == "" {
+		t.Skip("DYNAMODB_TABLE not set")
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDatastore(ddb.NewFromConfig(cfg), table, Options{ConsistentRead: true})
+	dstest.SubtestAll(t, d)
+
+	k := ds.NewKey("/cas/key")
+	if err := d.PutIfAbsent(k, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutIfAbsent(k, []byte("b")); err != ErrConflict {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if err := d.CompareAndSwap(k, []byte("x"), []byte("b")); err != ErrConflict {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if err := d.CompareAndSwap(k, []byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	d.Delete(k)
+}
@@ -0,0 +1,321 @@
+// Package encrypted provides a datastore wrapper that encrypts values
+// before they reach the child datastore, so a backend such as Azure Blob
+// Storage only ever holds ciphertext. Keys are not encrypted: listings,
+// prefixes and key orders work as before.
+//
+// Values are sealed with envelope encryption. Each value is encrypted with
+// AES-256-GCM under a data key, and stored with that data key wrapped by a
+// key-encryption key (KEK) the wrapper never stores: a local key (see
+// NewKEK) or one held in Azure Key Vault (see KeyVault). The ciphertext is
+// bound to its key, so a stored value copied or moved to another key does
+// not decrypt.
+//
+// A data key is used for Options.ValuesPerDataKey values before a new one
+// is generated, and unwrapped data keys are cached, so the KEK is not
+// called for every read and write.
+package encrypted
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+var (
+	// ErrNotEncrypted is returned when reading a value stored without
+	// encryption, unless Options.AllowPlaintext is set.
+	ErrNotEncrypted = errors.New("encrypted: value is not encrypted")
+	// ErrDecrypt is returned when a value fails to decrypt: it was
+	// tampered with, moved from another key, or sealed under another KEK.
+	ErrDecrypt = errors.New("encrypted: value failed to decrypt")
+)
+
+// magic starts every encrypted value.
+var magic = []byte{0x00, 'd', 's', 'e'}
+
+// formatVersion is the version of the envelope layout after magic: the
+// wrapped data key, length-prefixed, then the GCM nonce and ciphertext.
+const formatVersion = 1
+
+const (
+	// dataKeySize is the size of the AES-256 data keys.
+	dataKeySize = 32
+	// DefaultValuesPerDataKey is how many values are encrypted under one
+	// data key. Random GCM nonces stay safe for far more.
+	DefaultValuesPerDataKey = 1 << 20
+	// DefaultCacheSize is how many unwrapped data keys are cached.
+	DefaultCacheSize = 1024
+)
+
+// KeyWrapper encrypts data keys under a key-encryption key. The wrapped
+// form is stored with every value; UnwrapKey must be able to find the KEK
+// it was wrapped with, so values stay readable after the KEK rotates.
+type KeyWrapper interface {
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// Options configures the wrapper.
+type Options struct {
+	// KEK wraps the data keys. Required.
+	KEK KeyWrapper
+	// ValuesPerDataKey is how many values are encrypted under a data key
+	// before a new one is generated. Defaults to DefaultValuesPerDataKey;
+	// 1 gives every value its own.
+	ValuesPerDataKey int
+	// CacheSize is how many unwrapped data keys reads keep. Defaults to
+	// DefaultCacheSize.
+	CacheSize int
+	// AllowPlaintext has reads return values stored without encryption
+	// as they are, for adopting the wrapper over existing data. Such
+	// values are encrypted when next written.
+	AllowPlaintext bool
+}
+
+// Datastore encrypts the values of a child datastore.
+type Datastore struct {
+	child ds.Datastore
+	opts  Options
+
+	mu      sync.Mutex
+	current *dataKey // the data key new values are sealed under
+	uses    int      // values sealed under current
+	cache   map[string]cipher.AEAD
+}
+
+// dataKey is a data key ready for sealing, with its wrapped form.
+type dataKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// New wraps child, encrypting values with data keys wrapped by opts.KEK.
+func New(child ds.Datastore, opts Options) (*Datastore, error) {
+	if opts.KEK == nil {
+		return nil, errors.New("encrypted: no KEK")
+	}
+	if opts.ValuesPerDataKey <= 0 {
+		opts.ValuesPerDataKey = DefaultValuesPerDataKey
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = DefaultCacheSize
+	}
+	return &Datastore{child: child, opts: opts, cache: make(map[string]cipher.AEAD)}, nil
+}
+
+// newGCM returns AES-GCM under key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealingKey returns the data key to seal the next value under, making a
+// new one when the current one has sealed its share.
+func (d *Datastore) sealingKey() (*dataKey, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.current == nil || d.uses >= d.opts.ValuesPerDataKey {
+		key := make([]byte, dataKeySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		wrapped, err := d.opts.KEK.WrapKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("encrypted: wrapping data key: %w", err)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		d.current, d.uses = &dataKey{aead: aead, wrapped: wrapped}, 0
+	}
+	d.uses++
+	return d.current, nil
+}
+
+// openingKey returns the data key wrapped as wrapped, unwrapping it unless
+// it is cached.
+func (d *Datastore) openingKey(wrapped []byte) (cipher.AEAD, error) {
+	d.mu.Lock()
+	aead, ok := d.cache[string(wrapped)]
+	d.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	key, err := d.opts.KEK.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted: unwrapping data key: %w", err)
+	}
+	if aead, err = newGCM(key); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.cache) >= d.opts.CacheSize {
+		for k := range d.cache {
+			delete(d.cache, k)
+			break
+		}
+	}
+	d.cache[string(wrapped)] = aead
+	return aead, nil
+}
+
+// seal encrypts the value of key.
+func (d *Datastore) seal(key ds.Key, value []byte) ([]byte, error) {
+	dk, err := d.sealingKey()
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := dk.aead.NonceSize()
+	buf := make([]byte, 0, len(magic)+1+binary.MaxVarintLen64+len(dk.wrapped)+nonceSize+len(value)+dk.aead.Overhead())
+	buf = append(buf, magic...)
+	buf = append(buf, formatVersion)
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(dk.wrapped)))]...)
+	buf = append(buf, dk.wrapped...)
+	nonce := buf[len(buf) : len(buf)+nonceSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	buf = buf[:len(buf)+nonceSize]
+	return dk.aead.Seal(buf, nonce, value, key.Bytes()), nil
+}
+
+// open decrypts the stored value of key.
+func (d *Datastore) open(key ds.Key, stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, magic) {
+		if d.opts.AllowPlaintext {
+			return stored, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotEncrypted, key)
+	}
+	rest := stored[len(magic):]
+	if len(rest) == 0 || rest[0] != formatVersion {
+		return nil, fmt.Errorf("%w: %s has an unknown format", ErrDecrypt, key)
+	}
+	rest = rest[1:]
+	n, m := binary.Uvarint(rest)
+	if m <= 0 || n > uint64(len(rest)-m) {
+		return nil, fmt.Errorf("%w: %s has a corrupt header", ErrDecrypt, key)
+	}
+	wrapped, rest := rest[m:m+int(n)], rest[m+int(n):]
+	aead, err := d.openingKey(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: %s is truncated", ErrDecrypt, key)
+	}
+	value, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], key.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecrypt, key)
+	}
+	return value, nil
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.child}
+}
+
+// Put implements Datastore.Put, encrypting value.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	sealed, err := d.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return d.child.Put(key, sealed)
+}
+
+// Get implements Datastore.Get, decrypting the value.
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	stored, err := d.child.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return d.open(key, stored)
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize. The size of the plaintext depends
+// on the envelope it is stored in, so the value is read and decrypted to
+// measure it.
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	value, err := d.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	return d.child.Delete(key)
+}
+
+// Query implements Datastore.Query. Returned values are decrypted and
+// their sizes are those of the plaintext; keys-only queries report stored
+// sizes. Filters and orders on values are applied to the plaintext.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	if q.KeysOnly && len(q.Filters) == 0 && len(q.Orders) == 0 {
+		return d.child.Query(q)
+	}
+
+	// Value filters and orders must see plaintext, and offsets and limits
+	// apply after them, so only the prefix is pushed down.
+	res, err := d.child.Query(dsq.Query{Prefix: q.Prefix, ReturnExpirations: q.ReturnExpirations})
+	if err != nil {
+		return nil, err
+	}
+	decrypted := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil {
+				return r, ok
+			}
+			value, err := d.open(ds.RawKey(r.Key), r.Value)
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			r.Value, r.Size = value, len(value)
+			return r, true
+		},
+		Close: res.Close,
+	})
+	return dsq.NaiveQueryApply(q, decrypted), nil
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// Close closes the child.
+func (d *Datastore) Close() error {
+	return d.child.Close()
+}
@@ -0,0 +1,157 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func newKEK(t *testing.T, fill byte, old ...[]byte) KeyWrapper {
+	t.Helper()
+	kek, err := NewKEK(bytes.Repeat([]byte{fill}, 32), old...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kek
+}
+
+func TestSuite(t *testing.T) {
+	d, err := New(ds.NewMapDatastore(), Options{KEK: newKEK(t, 1), ValuesPerDataKey: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstest.SubtestAll(t, d)
+}
+
+func TestEncrypted(t *testing.T) {
+	child := ds.NewMapDatastore()
+	d, err := New(child, Options{KEK: newKEK(t, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := ds.NewKey("/a"), ds.NewKey("/b")
+	if err := d.Put(a, []byte("secret value")); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := child.Get(a)
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Fatal("value stored in plaintext")
+	}
+	if v, err := d.Get(a); err != nil || string(v) != "secret value" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	// A value moved to another key does not decrypt.
+	child.Put(b, stored)
+	if _, err := d.Get(b); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("moved value: %v", err)
+	}
+	tampered := append([]byte(nil), stored...)
+	tampered[len(tampered)-1] ^= 1
+	child.Put(a, tampered)
+	if _, err := d.Get(a); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("tampered value: %v", err)
+	}
+
+	child.Put(a, []byte("legacy"))
+	if _, err := d.Get(a); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("plaintext value: %v", err)
+	}
+	lenient, _ := New(child, Options{KEK: newKEK(t, 1), AllowPlaintext: true})
+	if v, err := lenient.Get(a); err != nil || string(v) != "legacy" {
+		t.Fatalf("plaintext value allowed: %q, %v", v, err)
+	}
+}
+
+func TestRotateKEK(t *testing.T) {
+	child := ds.NewMapDatastore()
+	old, _ := New(child, Options{KEK: newKEK(t, 1)})
+	k := ds.NewKey("/k")
+	if err := old.Put(k, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, _ := New(child, Options{KEK: newKEK(t, 2, bytes.Repeat([]byte{1}, 32))})
+	if v, err := rotated.Get(k); err != nil || string(v) != "v" {
+		t.Fatalf("value under the old KEK: %q, %v", v, err)
+	}
+	if err := rotated.Put(k, []byte("w")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Get(k); err == nil {
+		t.Fatal("value under the new KEK read with the old one")
+	}
+}
+
+// fakeVault serves wrapkey and unwrapkey with a local KEK per key version.
+func fakeVault(t *testing.T, version *string) *httptest.Server {
+	keks := map[string]KeyWrapper{"v1": newKEK(t, 1), "v2": newKEK(t, 2)}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		var op keyOperation
+		json.NewDecoder(r.Body).Decode(&op)
+		in, _ := base64.RawURLEncoding.DecodeString(op.Value)
+		var ver string
+		var out []byte
+		var err error
+		switch {
+		case len(parts) == 3 && parts[2] == "wrapkey":
+			ver = *version
+			out, err = keks[ver].WrapKey(in)
+		case len(parts) == 4 && parts[3] == "unwrapkey":
+			ver = parts[2]
+			out, err = keks[ver].UnwrapKey(in)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": "BadParameter", "message": err.Error()}})
+			return
+		}
+		json.NewEncoder(w).Encode(keyOperation{Kid: srv.URL + "/keys/kek/" + ver, Value: base64.RawURLEncoding.EncodeToString(out)})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestKeyVault(t *testing.T) {
+	version := "v1"
+	srv := fakeVault(t, &version)
+	vault := NewKeyVault(srv.URL+"/keys/kek", func(context.Context) (string, error) { return "token", nil })
+
+	d, _ := New(ds.NewMapDatastore(), Options{KEK: vault, ValuesPerDataKey: 1, CacheSize: 1})
+	k1, k2 := ds.NewKey("/1"), ds.NewKey("/2")
+	if err := d.Put(k1, []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	version = "v2"
+	if err := d.Put(k2, []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[ds.Key]string{k1: "one", k2: "two"} {
+		if v, err := d.Get(k); err != nil || string(v) != want {
+			t.Fatalf("%s: got %q, %v", k, v, err)
+		}
+	}
+
+	denied := NewKeyVault(srv.URL+"/keys/kek", func(context.Context) (string, error) { return "expired", nil })
+	if _, err := denied.WrapKey([]byte("key")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("unauthorized wrap: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package encrypted
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// localKEK wraps data keys with AES-GCM under keys held in memory.
+type localKEK struct {
+	keys []cipher.AEAD
+}
+
+// NewKEK returns a KeyWrapper wrapping data keys with AES-GCM under kek,
+// an AES key of 16, 24 or 32 bytes. Data keys wrapped under the previous
+// KEKs in old are still unwrapped, so a KEK can be rotated by passing the
+// new one with the old ones until every value has been rewritten.
+func NewKEK(kek []byte, old ...[]byte) (KeyWrapper, error) {
+	k := &localKEK{}
+	for _, key := range append([][]byte{kek}, old...) {
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, aead)
+	}
+	return k, nil
+}
+
+func (k *localKEK) WrapKey(dataKey []byte) ([]byte, error) {
+	aead := k.keys[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (k *localKEK) UnwrapKey(wrapped []byte) ([]byte, error) {
+	for _, aead := range k.keys {
+		if len(wrapped) < aead.NonceSize() {
+			break
+		}
+		n := aead.NonceSize()
+		if key, err := aead.Open(nil, wrapped[:n], wrapped[n:], nil); err == nil {
+			return key, nil
+		}
+	}
+	return nil, errors.New("encrypted: data key not wrapped by a known KEK")
+}
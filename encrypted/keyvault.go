@@ -0,0 +1,144 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// keyVaultAPIVersion is the Key Vault REST API version requests are made
+// with.
+const keyVaultAPIVersion = "7.4"
+
+// KeyVault is a KeyWrapper whose KEK is a key in Azure Key Vault, used
+// through the REST API's wrapkey and unwrapkey operations, so the KEK never
+// leaves the vault. Wrapped data keys record the key version used; after
+// the key is rotated, new data keys are wrapped with the current version
+// and old ones still unwrap with theirs.
+type KeyVault struct {
+	// KeyURL identifies the key, e.g.
+	// https://myvault.vault.azure.net/keys/mykey, optionally followed by
+	// a version to pin.
+	KeyURL string
+	// Token returns an OAuth access token for https://vault.azure.net,
+	// for example from a managed identity, with wrap and unwrap
+	// permissions on the key.
+	Token func(ctx context.Context) (string, error)
+	// Algorithm is the wrapping algorithm. Defaults to RSA-OAEP-256.
+	Algorithm string
+
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Timeout bounds each request. Defaults to 30s.
+	Timeout time.Duration
+}
+
+var _ KeyWrapper = (*KeyVault)(nil)
+
+// NewKeyVault returns a KeyWrapper for the given Key Vault key, authorized
+// by tokens from token.
+func NewKeyVault(keyURL string, token func(ctx context.Context) (string, error)) *KeyVault {
+	return &KeyVault{KeyURL: keyURL, Token: token}
+}
+
+func (v *KeyVault) client() *http.Client {
+	if v.Client != nil {
+		return v.Client
+	}
+	return http.DefaultClient
+}
+
+func (v *KeyVault) algorithm() string {
+	if v.Algorithm != "" {
+		return v.Algorithm
+	}
+	return "RSA-OAEP-256"
+}
+
+type keyOperation struct {
+	Alg   string `json:"alg,omitempty"`
+	Kid   string `json:"kid,omitempty"`
+	Value string `json:"value"`
+}
+
+// do runs a key operation on the key kid, returning the result's key ID
+// and value.
+func (v *KeyVault) do(kid, op string, value []byte) (string, []byte, error) {
+	timeout := v.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	token, err := v.Token(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	body, err := json.Marshal(keyOperation{Alg: v.algorithm(), Value: base64.RawURLEncoding.EncodeToString(value)})
+	if err != nil {
+		return "", nil, err
+	}
+	u := strings.TrimSuffix(kid, "/") + "/" + op + "?api-version=" + keyVaultAPIVersion
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := v.client().Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return "", nil, fmt.Errorf("encrypted: key vault %s: %s %s %s", op, resp.Status, e.Error.Code, e.Error.Message)
+	}
+	var result keyOperation
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", nil, fmt.Errorf("encrypted: key vault %s: %w", op, err)
+	}
+	out, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(result.Value, "="))
+	if err != nil {
+		return "", nil, fmt.Errorf("encrypted: key vault %s: %w", op, err)
+	}
+	return result.Kid, out, nil
+}
+
+// WrapKey implements KeyWrapper. The wrapped form is the versioned key ID,
+// a newline, then the wrapped key.
+func (v *KeyVault) WrapKey(dataKey []byte) ([]byte, error) {
+	kid, wrapped, err := v.do(v.KeyURL, "wrapkey", dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if kid == "" || strings.Contains(kid, "\n") {
+		return nil, fmt.Errorf("encrypted: key vault wrapkey: bad key ID %q", kid)
+	}
+	return append([]byte(kid+"\n"), wrapped...), nil
+}
+
+// UnwrapKey implements KeyWrapper, with the key version that wrapped the
+// data key.
+func (v *KeyVault) UnwrapKey(wrapped []byte) ([]byte, error) {
+	i := bytes.IndexByte(wrapped, '\n')
+	if i <= 0 {
+		return nil, errors.New("encrypted: wrapped data key has no key ID")
+	}
+	_, key, err := v.do(string(wrapped[:i]), "unwrapkey", wrapped[i+1:])
+	return key, err
+}
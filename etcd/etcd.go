@@ -0,0 +1,436 @@
+// Package etcd implements a Datastore over an etcd v3 cluster, for small,
+// hot metadata that should live next to existing coordination state.
+//
+// TTLs are implemented with etcd leases, and transactions are mapped onto
+// etcd transactions guarded by the mod revisions of the keys they read.
+// etcd limits request and value sizes (1.5MiB by default), so this is not a
+// place for bulk data.
+package etcd
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// ErrConflict is returned by Txn.Commit when a key read by the transaction
+// was modified before it committed.
+var ErrConflict = errors.New("etcd: transaction conflict")
+
+// pageSize is the number of keys fetched per range request in Query.
+const pageSize = 1000
+
+// maxTxnOps is etcd's default --max-txn-ops.
+const maxTxnOps = 128
+
+// Datastore stores keys under a prefix in etcd.
+type Datastore struct {
+	cli    *clientv3.Client
+	prefix string
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.TTLDatastore = (*Datastore)(nil)
+var _ ds.TxnDatastore = (*Datastore)(nil)
+
+// NewDatastore returns a datastore storing keys under prefix. The client is
+// owned by the caller and is not closed by Close.
+func NewDatastore(cli *clientv3.Client, prefix string) *Datastore {
+	return &Datastore{cli: cli, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+func (d *Datastore) etcdKey(key ds.Key) string {
+	return d.prefix + key.String()
+}
+
+func (d *Datastore) dsKey(k []byte) string {
+	return strings.TrimPrefix(string(k), d.prefix)
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	_, err := d.cli.Put(context.TODO(), d.etcdKey(key), string(value))
+	return err
+}
+
+// Sync implements Datastore.Sync. Writes are durable once acknowledged.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return nil
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	resp, err := d.cli.Get(context.TODO(), d.etcdKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ds.ErrNotFound
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	resp, err := d.cli.Get(context.TODO(), d.etcdKey(key), clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return resp.Count > 0, nil
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	return ds.GetBackedSize(d, key)
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	_, err := d.cli.Delete(context.TODO(), d.etcdKey(key))
+	return err
+}
+
+// Query implements Datastore.Query. The prefix is pushed down to a range
+// request; everything else is applied naively.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	prefix := d.prefix + "/"
+	if q.Prefix != "" {
+		p := path.Clean("/" + q.Prefix)
+		if p != "/" {
+			prefix = d.prefix + p + "/"
+		}
+	}
+	// Sizes can only be had by fetching values.
+	keysOnly := q.KeysOnly && !q.ReturnsSizes
+	end := clientv3.GetPrefixRangeEnd(prefix)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	from := prefix
+	var page []dsq.Entry
+	iter := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for len(page) == 0 {
+				if from == "" {
+					return dsq.Result{}, false
+				}
+				opts := []clientv3.OpOption{
+					clientv3.WithRange(end),
+					clientv3.WithLimit(pageSize),
+					clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+				}
+				if keysOnly {
+					opts = append(opts, clientv3.WithKeysOnly())
+				}
+				resp, err := d.cli.Get(ctx, from, opts...)
+				if err != nil {
+					from = ""
+					return dsq.Result{Error: err}, true
+				}
+				for _, kv := range resp.Kvs {
+					e := dsq.Entry{Key: d.dsKey(kv.Key), Size: -1}
+					if !keysOnly {
+						e.Size = len(kv.Value)
+						if !q.KeysOnly {
+							e.Value = kv.Value
+						}
+					}
+					page = append(page, e)
+				}
+				if resp.More && len(resp.Kvs) > 0 {
+					from = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+				} else {
+					from = ""
+				}
+			}
+			e := page[0]
+			page = page[1:]
+			return dsq.Result{Entry: e}, true
+		},
+		Close: func() error {
+			cancel()
+			return nil
+		},
+	}
+
+	// The prefix is already applied by the range request.
+	naive := q
+	naive.Prefix = ""
+	return dsq.NaiveQueryApply(naive, dsq.ResultsFromIterator(q, iter)), nil
+}
+
+// PutWithTTL implements TTL.PutWithTTL
+func (d *Datastore) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
+	ctx := context.TODO()
+	lease, err := d.grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	_, err = d.cli.Put(ctx, d.etcdKey(key), string(value), clientv3.WithLease(lease))
+	return err
+}
+
+// SetTTL implements TTL.SetTTL. The value is rewritten under a new lease,
+// guarded against concurrent modification.
+func (d *Datastore) SetTTL(key ds.Key, ttl time.Duration) error {
+	ctx := context.TODO()
+	k := d.etcdKey(key)
+	resp, err := d.cli.Get(ctx, k)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return ds.ErrNotFound
+	}
+	kv := resp.Kvs[0]
+	lease, err := d.grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	txn, err := d.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(k), "=", kv.ModRevision)).
+		Then(clientv3.OpPut(k, string(kv.Value), clientv3.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return ErrConflict
+	}
+	return nil
+}
+
+// GetExpiration implements TTL.GetExpiration. Keys without a TTL return the
+// zero time.
+func (d *Datastore) GetExpiration(key ds.Key) (time.Time, error) {
+	ctx := context.TODO()
+	resp, err := d.cli.Get(ctx, d.etcdKey(key))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return time.Time{}, ds.ErrNotFound
+	}
+	lease := clientv3.LeaseID(resp.Kvs[0].Lease)
+	if lease == clientv3.NoLease {
+		return time.Time{}, nil
+	}
+	ttl, err := d.cli.TimeToLive(ctx, lease)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ttl.TTL < 0 {
+		return time.Time{}, ds.ErrNotFound
+	}
+	return time.Now().Add(time.Duration(ttl.TTL) * time.Second), nil
+}
+
+// grant creates a lease, rounding ttl up to whole seconds.
+func (d *Datastore) grant(ctx context.Context, ttl time.Duration) (clientv3.LeaseID, error) {
+	secs := int64((ttl + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	resp, err := d.cli.Grant(ctx, secs)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	return resp.ID, nil
+}
+
+// Batch implements Batching.Batch. Batches are committed as etcd
+// transactions of up to 128 operations each.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return &batch{d: d, ops: make(map[ds.Key]op)}, nil
+}
+
+type op struct {
+	delete bool
+	value  []byte
+}
+
+type batch struct {
+	d   *Datastore
+	ops map[ds.Key]op
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	b.ops[key] = op{value: value}
+	return nil
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	b.ops[key] = op{delete: true}
+	return nil
+}
+
+func (b *batch) Commit() error {
+	var ops []clientv3.Op
+	for k, o := range b.ops {
+		if o.delete {
+			ops = append(ops, clientv3.OpDelete(b.d.etcdKey(k)))
+		} else {
+			ops = append(ops, clientv3.OpPut(b.d.etcdKey(k), string(o.value)))
+		}
+	}
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		if _, err := b.d.cli.Txn(context.TODO()).Then(ops[:n]...).Commit(); err != nil {
+			return err
+		}
+		ops = ops[n:]
+	}
+	b.ops = make(map[ds.Key]op)
+	return nil
+}
+
+// NewTransaction implements TxnDatastore.NewTransaction
+func (d *Datastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	return &txn{
+		d:        d,
+		readOnly: readOnly,
+		reads:    make(map[string]int64),
+		ops:      make(map[ds.Key]op),
+	}, nil
+}
+
+// txn records the mod revision of every key it reads (0 for absent keys)
+// and commits only if none of them changed.
+type txn struct {
+	d        *Datastore
+	readOnly bool
+	reads    map[string]int64
+	ops      map[ds.Key]op
+}
+
+var errReadOnly = errors.New("etcd: cannot write in a read-only transaction")
+
+func (t *txn) read(key ds.Key) ([]byte, bool, error) {
+	if o, ok := t.ops[key]; ok {
+		return o.value, !o.delete, nil
+	}
+	k := t.d.etcdKey(key)
+	resp, err := t.d.cli.Get(context.TODO(), k)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		if _, seen := t.reads[k]; !seen {
+			t.reads[k] = 0
+		}
+		return nil, false, nil
+	}
+	if _, seen := t.reads[k]; !seen {
+		t.reads[k] = resp.Kvs[0].ModRevision
+	}
+	return resp.Kvs[0].Value, true, nil
+}
+
+func (t *txn) Get(key ds.Key) ([]byte, error) {
+	v, ok, err := t.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ds.ErrNotFound
+	}
+	return v, nil
+}
+
+func (t *txn) Has(key ds.Key) (bool, error) {
+	_, ok, err := t.read(key)
+	return ok, err
+}
+
+func (t *txn) GetSize(key ds.Key) (int, error) {
+	v, ok, err := t.read(key)
+	if err != nil {
+		return -1, err
+	}
+	if !ok {
+		return -1, ds.ErrNotFound
+	}
+	return len(v), nil
+}
+
+// Query runs against the committed state; it does not observe the
+// transaction's own writes and does not participate in conflict checks.
+func (t *txn) Query(q dsq.Query) (dsq.Results, error) {
+	return t.d.Query(q)
+}
+
+func (t *txn) Put(key ds.Key, value []byte) error {
+	if t.readOnly {
+		return errReadOnly
+	}
+	t.ops[key] = op{value: value}
+	return nil
+}
+
+func (t *txn) Delete(key ds.Key) error {
+	if t.readOnly {
+		return errReadOnly
+	}
+	t.ops[key] = op{delete: true}
+	return nil
+}
+
+func (t *txn) Commit() error {
+	if len(t.ops) == 0 {
+		return nil
+	}
+	var cmps []clientv3.Cmp
+	for k, rev := range t.reads {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(k), "=", rev))
+	}
+	var ops []clientv3.Op
+	for k, o := range t.ops {
+		if o.delete {
+			ops = append(ops, clientv3.OpDelete(t.d.etcdKey(k)))
+		} else {
+			ops = append(ops, clientv3.OpPut(t.d.etcdKey(k), string(o.value)))
+		}
+	}
+	resp, err := t.d.cli.Txn(context.TODO()).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrConflict
+	}
+	t.ops = make(map[ds.Key]op)
+	return nil
+}
+
+func (t *txn) Discard() {
+	t.ops = make(map[ds.Key]op)
+	t.reads = make(map[string]int64)
+}
+
+// DiskUsage implements the PersistentDatastore interface by asking the first
+// endpoint for its database size.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	eps := d.cli.Endpoints()
+	if len(eps) == 0 {
+		return 0, nil
+	}
+	status, err := d.cli.Status(context.TODO(), eps[0])
+	if err != nil {
+		return 0, err
+	}
+	return uint64(status.DbSize), nil
+}
+
+// Close implements Datastore.Close. The client is left open.
+func (d *Datastore) Close() error {
+	return nil
+}
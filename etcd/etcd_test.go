@@ -0,0 +1,74 @@
+package etcd
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dstest "github.com/ipfs/go-datastore/test"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// newTestDatastore connects to the cluster in ETCD_ENDPOINTS, skipping the
+// test when it is unset.
+func newTestDatastore(t *testing.T) *Datastore {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCD_ENDPOINTS not set")
+	}
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "/dstest/" + ds.RandomKey().String()
+	t.Cleanup(func() {
+		cli.Delete(context.Background(), prefix, clientv3.WithPrefix())
+		cli.Close()
+	})
+	return NewDatastore(cli, prefix)
+}
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, newTestDatastore(t))
+}
+
+func TestTxnConflict(t *testing.T) {
+	d := newTestDatastore(t)
+	k := ds.NewKey("/counter")
+	if err := d.Put(k, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ := d.NewTransaction(false)
+	if _, err := txn.Get(k); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(k, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Put(k, []byte("3"))
+	if err := txn.Commit(); err != ErrConflict {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	d := newTestDatastore(t)
+	k := ds.NewKey("/ephemeral")
+	if err := d.PutWithTTL(k, []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	exp, err := d.GetExpiration(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(exp) <= 0 || time.Until(exp) > time.Minute+time.Second {
+		t.Fatalf("unexpected expiration %v", exp)
+	}
+}
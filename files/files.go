@@ -0,0 +1,344 @@
+// Package files implements a Datastore over an Azure Files share, so the
+// data can at the same time be mounted over SMB and looked through by
+// hand.
+//
+// Keys are stored as the fs package stores them: as directories mirroring
+// the key, with the value of "/foo/bar" in the file "foo/bar/.dsobject".
+// A mounted share can be opened with fs.NewDatastore, and keys put through
+// it read back here. Bytes file names cannot hold (control characters and
+// '"', '*', ':', '<', '>', '?', '\', '|'), '%' itself, and a '.' or ' '
+// ending a segment are escaped as %XX, as is the leading dot of a segment
+// starting with ".dsobject"; keys without them look the same on the share.
+//
+// Azure Files has neither recursive listings nor TTLs: queries walk the
+// directories under their prefix, a listing per directory, and TTLs are
+// not supported.
+package files
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azfile/directory"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azfile/file"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azfile/fileerror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azfile/share"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// ObjectKeySuffix is the name of the file holding a key's value inside the
+// key's directory, the same as the fs package's.
+const ObjectKeySuffix = ".dsobject"
+
+// tmpPrefix starts the names of the files values are written to before
+// being renamed into place, next to the key's value file.
+const tmpPrefix = ObjectKeySuffix + ".tmp"
+
+// Datastore stores keys as directories of a share.
+type Datastore struct {
+	share *share.Client
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// NewDatastore returns a datastore over s, which must exist.
+func NewDatastore(s *share.Client) *Datastore {
+	return &Datastore{share: s}
+}
+
+// segments returns the escaped path segments of key's directory.
+func segments(key ds.Key) []string {
+	ns := key.Namespaces()
+	for i, n := range ns {
+		ns[i] = escape(n)
+	}
+	return ns
+}
+
+// escape returns the path segment of the key namespace s.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c < 0x20, c == 0x7f, strings.IndexByte(`"*:<>?\|%`, c) >= 0:
+		case (c == '.' || c == ' ') && i == len(s)-1:
+		case c == '.' && i == 0 && strings.HasPrefix(s, ObjectKeySuffix):
+		default:
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&0xf])
+	}
+	return b.String()
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+// unescape reverses escape.
+func unescape(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// dir returns the client of the directory at the path segs.
+func (d *Datastore) dir(segs []string) *directory.Client {
+	dir := d.share.NewRootDirectoryClient()
+	for _, s := range segs {
+		dir = dir.NewSubdirectoryClient(s)
+	}
+	return dir
+}
+
+func (d *Datastore) file(key ds.Key) *file.Client {
+	return d.dir(segments(key)).NewFileClient(ObjectKeySuffix)
+}
+
+func isNotFound(err error) bool {
+	var rerr *azcore.ResponseError
+	return errors.As(err, &rerr) && rerr.StatusCode == http.StatusNotFound
+}
+
+// mkdirAll creates the directory at the path segs and its parents, like
+// os.MkdirAll.
+func (d *Datastore) mkdirAll(ctx context.Context, segs []string) error {
+	for i := 1; i <= len(segs); i++ {
+		_, err := d.dir(segs[:i]).Create(ctx, nil)
+		if err != nil && !fileerror.HasCode(err, fileerror.ResourceAlreadyExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put implements Datastore.Put. As with fs, the value is written to a
+// temporary file and renamed into place, so readers never observe a
+// partially written value.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	ctx := context.TODO()
+	segs := segments(key)
+	var name [8]byte
+	if _, err := rand.Read(name[:]); err != nil {
+		return err
+	}
+	tmpName := tmpPrefix + hex.EncodeToString(name[:])
+	tmp := d.dir(segs).NewFileClient(tmpName)
+	_, err := tmp.Create(ctx, int64(len(value)), nil)
+	if fileerror.HasCode(err, fileerror.ParentNotFound) {
+		if err := d.mkdirAll(ctx, segs); err != nil {
+			return err
+		}
+		_, err = tmp.Create(ctx, int64(len(value)), nil)
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.write(ctx, tmp, segs, value); err != nil {
+		tmp.Delete(ctx, nil)
+		return err
+	}
+	return nil
+}
+
+func (d *Datastore) write(ctx context.Context, tmp *file.Client, segs []string, value []byte) error {
+	if len(value) > 0 {
+		if err := tmp.UploadBuffer(ctx, value, nil); err != nil {
+			return err
+		}
+	}
+	dest := strings.Join(append(segs, ObjectKeySuffix), "/")
+	_, err := tmp.Rename(ctx, dest, &file.RenameOptions{ReplaceIfExists: to.Ptr(true)})
+	return err
+}
+
+// Sync implements Datastore.Sync. Writes are durable once they return.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return nil
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	return d.read(context.TODO(), key)
+}
+
+func (d *Datastore) read(ctx context.Context, key ds.Key) ([]byte, error) {
+	resp, err := d.file(key).DownloadStream(ctx, nil)
+	if isNotFound(err) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	_, err := d.GetSize(key)
+	if err == ds.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	props, err := d.file(key).GetProperties(context.TODO(), nil)
+	if isNotFound(err) {
+		return -1, ds.ErrNotFound
+	}
+	if err != nil {
+		return -1, err
+	}
+	if props.ContentLength == nil {
+		return 0, nil
+	}
+	return int(*props.ContentLength), nil
+}
+
+// Delete implements Datastore.Delete. Deleting a missing key is not an
+// error. As with fs, directories left empty are removed too.
+func (d *Datastore) Delete(key ds.Key) error {
+	ctx := context.TODO()
+	_, err := d.file(key).Delete(ctx, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Deleting a directory that is not empty fails, which ends the walk.
+	for segs := segments(key); len(segs) > 0; segs = segs[:len(segs)-1] {
+		if _, err := d.dir(segs).Delete(ctx, nil); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Query implements Datastore.Query. Only the directories under the query
+// prefix are walked, depth first; values are read one at a time as the
+// results are consumed. Everything else is applied naively.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	prefix := ds.NewKey(q.Prefix)
+
+	// pending holds the directories left to list, as their keys.
+	pending := []ds.Key{prefix}
+	var entries []dsq.Entry
+	it := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for {
+				for len(entries) > 0 {
+					e := entries[0]
+					entries = entries[1:]
+					if !q.KeysOnly {
+						var err error
+						e.Value, err = d.read(ctx, ds.RawKey(e.Key))
+						if err == ds.ErrNotFound {
+							continue
+						}
+						if err != nil {
+							return dsq.Result{Error: err}, true
+						}
+					}
+					return dsq.Result{Entry: e}, true
+				}
+				if len(pending) == 0 {
+					return dsq.Result{}, false
+				}
+				key := pending[len(pending)-1]
+				pending = pending[:len(pending)-1]
+				subdirs, value, err := d.list(ctx, key)
+				if err != nil {
+					return dsq.Result{Error: err}, true
+				}
+				if value != nil && !key.Equal(prefix) {
+					entries = append(entries, *value)
+				}
+				// Reversed, so the stack pops them in listing order.
+				for i := len(subdirs) - 1; i >= 0; i-- {
+					pending = append(pending, subdirs[i])
+				}
+			}
+		},
+		Close: func() error {
+			cancel()
+			return nil
+		},
+	}
+	return dsq.NaiveQueryApply(q, dsq.ResultsFromIterator(q, it)), nil
+}
+
+// list lists the directory of key, returning the keys of its
+// subdirectories and, if key has a value, its entry without the value.
+// A missing directory lists empty.
+func (d *Datastore) list(ctx context.Context, key ds.Key) ([]ds.Key, *dsq.Entry, error) {
+	var subdirs []ds.Key
+	var value *dsq.Entry
+	pager := d.dir(segments(key)).NewListFilesAndDirectoriesPager(nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if isNotFound(err) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if page.Segment == nil {
+			continue
+		}
+		for _, dir := range page.Segment.Directories {
+			if dir.Name != nil {
+				subdirs = append(subdirs, key.ChildString(unescape(*dir.Name)))
+			}
+		}
+		for _, f := range page.Segment.Files {
+			if f.Name == nil || *f.Name != ObjectKeySuffix {
+				continue
+			}
+			value = &dsq.Entry{Key: key.String(), Size: -1}
+			if f.Properties != nil && f.Properties.ContentLength != nil {
+				value.Size = int(*f.Properties.ContentLength)
+			}
+		}
+	}
+	return subdirs, value, nil
+}
+
+// Batch implements Batching.Batch. Keys are written one request or more
+// each.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// Close implements Datastore.Close
+func (d *Datastore) Close() error {
+	return nil
+}
@@ -0,0 +1,48 @@
+package files
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azfile/share"
+	ds "github.com/ipfs/go-datastore"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSegments(t *testing.T) {
+	for _, tc := range []struct{ key, path string }{
+		{"/blocks/CIQABC", "blocks/CIQABC"},
+		{"/a b/c.d", "a b/c.d"},
+		{"/a:b/50%", "a%3Ab/50%25"},
+		{"/dot./space ", "dot%2E/space%20"},
+		{"/.dsobject/.dsobject.tmp1", "%2Edsobject/%2Edsobject.tmp1"},
+		{"/.hidden", ".hidden"},
+	} {
+		segs := segments(ds.NewKey(tc.key))
+		if p := strings.Join(segs, "/"); p != tc.path {
+			t.Errorf("segments(%s) = %s, want %s", tc.key, p, tc.path)
+		}
+		for i, s := range segs {
+			segs[i] = unescape(s)
+		}
+		if k := ds.KeyWithNamespaces(segs); k.String() != tc.key {
+			t.Errorf("unescaped %s, want %s", k, tc.key)
+		}
+	}
+}
+
+// TestSuite runs against the share named by AZURE_FILES_SHARE in the
+// account of AZURE_FILES_CONNECTION_STRING. The share is cleared by the
+// suite.
+func TestSuite(t *testing.T) {
+	conn, name := os.Getenv("AZURE_FILES_CONNECTION_STRING"), os.Getenv("AZURE_FILES_SHARE")
+	if conn == "" || name == "" {
+		t.Skip("AZURE_FILES_CONNECTION_STRING or AZURE_FILES_SHARE not set")
+	}
+	s, err := share.NewClientFromConnectionString(conn, name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstest.SubtestAll(t, NewDatastore(s))
+}
@@ -0,0 +1,19 @@
+module github.com/ipfs/go-datastore/files
+
+go 1.21
+
+replace github.com/ipfs/go-datastore => ../
+
+require (
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.9.2
+	github.com/Azure/azure-sdk-for-go/sdk/storage/azfile v1.2.0
+	github.com/ipfs/go-datastore v0.4.4
+)
+
+require (
+	github.com/Azure/azure-sdk-for-go/sdk/internal v1.5.2 // indirect
+	github.com/google/uuid v1.3.1 // indirect
+	github.com/jbenet/goprocess v0.1.4 // indirect
+	golang.org/x/net v0.20.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
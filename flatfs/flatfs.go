@@ -0,0 +1,286 @@
+// Package flatfs is a local Datastore that stores each key as a file in one
+// of a fixed set of shard directories, so that no directory grows to hold
+// millions of entries. That is, the key "/foo/bar" is stored as
+// "PATH/<shard>/foo%2Fbar.data", where <shard> is chosen by a ShardFunc.
+//
+// The shard function is recorded in PATH/SHARDING when the datastore is
+// created and must match on every later open. Keys are escaped into file
+// names, so keys longer than the file system's name limit cannot be stored.
+//
+// Datastores using the plain directory-per-key layout of the fs package can
+// be moved over with ImportFS.
+package flatfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/fs"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jbenet/goprocess"
+)
+
+const (
+	extension    = ".data"
+	shardingFile = "SHARDING"
+)
+
+// ErrShardingMismatch is returned when opening a datastore with a shard
+// function other than the one it was created with.
+var ErrShardingMismatch = errors.New("flatfs: shard function does not match the existing datastore")
+
+// Datastore stores one file per key in sharded directories.
+type Datastore struct {
+	path  string
+	shard *ShardFunc
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// NewDatastore opens the flatfs datastore at path, creating the directory if
+// needed. A nil shard uses the function recorded in the datastore, or
+// HashPrefix(2) for a new one.
+func NewDatastore(path string, shard *ShardFunc) (*Datastore, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	sfn := filepath.Join(path, shardingFile)
+	b, err := ioutil.ReadFile(sfn)
+	switch {
+	case err == nil:
+		existing, err := ParseShardFunc(string(b))
+		if err != nil {
+			return nil, err
+		}
+		if shard != nil && shard.String() != existing.String() {
+			return nil, ErrShardingMismatch
+		}
+		shard = existing
+	case os.IsNotExist(err):
+		if shard == nil {
+			shard, _ = HashPrefix(2)
+		}
+		if err := ioutil.WriteFile(sfn, []byte(shard.String()+"\n"), 0644); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	return &Datastore{path: path, shard: shard}, nil
+}
+
+// Shard returns the datastore's shard function.
+func (d *Datastore) Shard() *ShardFunc {
+	return d.shard
+}
+
+func encode(key ds.Key) string {
+	return url.PathEscape(strings.TrimPrefix(key.String(), "/"))
+}
+
+func decode(name string) (ds.Key, bool) {
+	if !strings.HasSuffix(name, extension) {
+		return ds.Key{}, false
+	}
+	s, err := url.PathUnescape(strings.TrimSuffix(name, extension))
+	if err != nil {
+		return ds.Key{}, false
+	}
+	return ds.NewKey(s), true
+}
+
+// KeyFilename returns the filename associated with key.
+func (d *Datastore) KeyFilename(key ds.Key) string {
+	name := encode(key)
+	return filepath.Join(d.path, d.shard.Dir(name), name+extension)
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	fn := d.KeyFilename(key)
+	dir := filepath.Dir(fn)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename so readers never observe a
+	// partially written value. The temporary name lacks the extension, so
+	// queries skip it.
+	tmp, err := ioutil.TempFile(dir, "put-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fn)
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	value, err := ioutil.ReadFile(d.KeyFilename(key))
+	if os.IsNotExist(err) {
+		return nil, ds.ErrNotFound
+	}
+	return value, err
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	_, err := os.Stat(d.KeyFilename(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	fi, err := os.Stat(d.KeyFilename(key))
+	if os.IsNotExist(err) {
+		return -1, ds.ErrNotFound
+	}
+	if err != nil {
+		return -1, err
+	}
+	return int(fi.Size()), nil
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	err := os.Remove(d.KeyFilename(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Query implements Datastore.Query. Keys are spread over the shards without
+// regard to prefix, so every shard directory is listed.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	return dsq.NaiveQueryApply(q, dsq.ResultsWithProcess(q, func(p goprocess.Process, out chan<- dsq.Result) {
+		send := func(r dsq.Result) bool {
+			select {
+			case out <- r:
+				return true
+			case <-p.Closing():
+				return false
+			}
+		}
+
+		shards, err := ioutil.ReadDir(d.path)
+		if err != nil {
+			send(dsq.Result{Error: err})
+			return
+		}
+		for _, shard := range shards {
+			if !shard.IsDir() {
+				continue
+			}
+			dir := filepath.Join(d.path, shard.Name())
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				if !send(dsq.Result{Error: err}) {
+					return
+				}
+				continue
+			}
+			for _, fi := range files {
+				key, ok := decode(fi.Name())
+				if !ok || fi.IsDir() {
+					continue
+				}
+				e := dsq.Entry{Key: key.String(), Size: int(fi.Size())}
+				if !q.KeysOnly {
+					e.Value, err = ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+					if os.IsNotExist(err) {
+						continue // deleted since the listing
+					}
+					if err != nil {
+						if !send(dsq.Result{Error: err}) {
+							return
+						}
+						continue
+					}
+				}
+				if !send(dsq.Result{Entry: e}) {
+					return
+				}
+			}
+		}
+	})), nil
+}
+
+// Sync implements Datastore.Sync. Writes go straight to the file system.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return nil
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// DiskUsage implements the PersistentDatastore interface.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	var du uint64
+	err := filepath.Walk(d.path, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.Mode().IsRegular() {
+			du += uint64(f.Size())
+		}
+		return nil
+	})
+	return du, err
+}
+
+// Close implements Datastore.Close
+func (d *Datastore) Close() error {
+	return nil
+}
+
+// ImportFS copies every key of the plain fs datastore at dir into d and
+// returns the number of keys copied. The source is left untouched, so an
+// interrupted import can simply be run again; remove the old tree once the
+// import has been verified.
+func (d *Datastore) ImportFS(dir string) (int, error) {
+	src, err := fs.NewDatastore(dir)
+	if err != nil {
+		return 0, err
+	}
+	res, err := src.Query(dsq.Query{})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	n := 0
+	for r := range res.Next() {
+		if r.Error != nil {
+			return n, fmt.Errorf("flatfs: listing %s: %w", dir, r.Error)
+		}
+		if err := d.Put(ds.RawKey(r.Key), r.Value); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,207 @@
+package flatfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/fs"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ds-flatfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func mustShard(t *testing.T) func(*ShardFunc, error) *ShardFunc {
+	return func(s *ShardFunc, err error) *ShardFunc {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+}
+
+func TestSuite(t *testing.T) {
+	d, err := NewDatastore(tempDir(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstest.SubtestAll(t, d)
+}
+
+func TestShardFuncs(t *testing.T) {
+	must := mustShard(t)
+	for _, tc := range []struct {
+		shard *ShardFunc
+		name  string
+		dir   string
+	}{
+		{must(Prefix(2)), "abcd", "ab"},
+		{must(Prefix(3)), "a", "a__"},
+		{must(Suffix(2)), "abcd", "cd"},
+		{must(NextToLast(2)), "abcd", "bc"},
+		{must(NextToLast(2)), "a", "__"},
+	} {
+		if got := tc.shard.Dir(tc.name); got != tc.dir {
+			t.Errorf("%s(%q) = %q, want %q", tc.shard, tc.name, got, tc.dir)
+		}
+		parsed, err := ParseShardFunc(tc.shard.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.String() != tc.shard.String() {
+			t.Errorf("parsed %s as %s", tc.shard, parsed)
+		}
+	}
+	if d := must(HashPrefix(3)).Dir("foo"); len(d) != 3 {
+		t.Errorf("hash prefix dir %q", d)
+	}
+	if _, err := ParseShardFunc("/repo/flatfs/shard/v1/bogus/2"); err == nil {
+		t.Error("expected an error for an unknown shard function")
+	}
+	for _, n := range []int{0, -1} {
+		if _, err := Prefix(n); err == nil {
+			t.Errorf("expected an error for Prefix(%d)", n)
+		}
+		if _, err := ParseShardFunc(fmt.Sprintf("/repo/flatfs/shard/v1/suffix/%d", n)); err == nil {
+			t.Errorf("expected an error for a shard parameter of %d", n)
+		}
+	}
+	if _, err := HashPrefix(65); err == nil {
+		t.Error("expected an error for a hash prefix longer than the hash")
+	}
+}
+
+func TestDotShards(t *testing.T) {
+	must := mustShard(t)
+	for _, shard := range []*ShardFunc{must(Prefix(2)), must(Prefix(1)), must(Suffix(2)), must(NextToLast(2))} {
+		root := filepath.Join(tempDir(t), "root")
+		d, err := NewDatastore(root, shard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"/..evil", "/.", "/a..", "/a...", "/..."} {
+			key := ds.NewKey(k)
+			rel, err := filepath.Rel(root, d.KeyFilename(key))
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) ||
+				filepath.Dir(rel) == "." {
+				t.Fatalf("%s: %s stored as %s, outside a shard of the root", shard, key, rel)
+			}
+			if err := d.Put(key, []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := d.Get(key); err != nil || string(v) != k {
+				t.Fatalf("%s: %s read back as %q, %v", shard, key, v, err)
+			}
+		}
+		res, err := d.Query(dsq.Query{KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 5 {
+			t.Fatalf("%s: listed %d keys, want 5", shard, len(entries))
+		}
+		// Nothing was written beside the root.
+		if names, _ := ioutil.ReadDir(filepath.Dir(root)); len(names) != 1 {
+			t.Fatalf("%s: %d entries beside the root", shard, len(names))
+		}
+	}
+}
+
+func TestShardingMismatch(t *testing.T) {
+	dir := tempDir(t)
+	if _, err := NewDatastore(dir, mustShard(t)(Prefix(2))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDatastore(dir, mustShard(t)(Suffix(2))); err != ErrShardingMismatch {
+		t.Fatalf("expected ErrShardingMismatch, got %v", err)
+	}
+	d, err := NewDatastore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Shard().String() != mustShard(t)(Prefix(2)).String() {
+		t.Fatalf("reopened with %s", d.Shard())
+	}
+}
+
+func TestLayout(t *testing.T) {
+	dir := tempDir(t)
+	d, err := NewDatastore(dir, mustShard(t)(Prefix(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ds.NewKey("/foo/bar"), []byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "fo", "foo%2Fbar.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "baz" {
+		t.Fatalf("got %q", b)
+	}
+}
+
+func TestImportFS(t *testing.T) {
+	srcDir := tempDir(t)
+	src, err := fs.NewDatastore(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"/a", "/a/b", "/c/d/e"}
+	for _, k := range keys {
+		if err := src.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := NewDatastore(tempDir(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := d.ImportFS(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(keys) {
+		t.Fatalf("imported %d keys, want %d", n, len(keys))
+	}
+	for _, k := range keys {
+		v, err := d.Get(ds.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != k {
+			t.Fatalf("%s = %q", k, v)
+		}
+	}
+
+	res, err := d.Query(dsq.Query{Prefix: "/a", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "/a/b" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
@@ -0,0 +1,125 @@
+package flatfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const shardIDPrefix = "/repo/flatfs/shard/v1/"
+
+// ShardFunc maps a key's encoded file name to the name of the directory it
+// is stored in.
+type ShardFunc struct {
+	name  string
+	param int
+	fn    func(name string) string
+}
+
+// String returns the shard function's identifier, as stored in the
+// SHARDING file.
+func (s *ShardFunc) String() string {
+	return shardIDPrefix + s.name + "/" + strconv.Itoa(s.param)
+}
+
+// Dir returns the shard directory for an encoded file name. Keys made of
+// dots where the shard is taken from would name the directory "." or "..",
+// outside of the shards, so those dots are replaced by the padding '_'.
+func (s *ShardFunc) Dir(name string) string {
+	dir := s.fn(name)
+	if dir == "." || dir == ".." {
+		return strings.Repeat("_", len(dir))
+	}
+	return dir
+}
+
+func checkParam(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("flatfs: shard parameter %d is not positive", n)
+	}
+	return nil
+}
+
+// HashPrefix shards by the first n hex digits of the SHA-256 of the key, so
+// keys spread evenly over 16^n directories regardless of their naming. n
+// must be from 1 to 64.
+func HashPrefix(n int) (*ShardFunc, error) {
+	if err := checkParam(n); err != nil {
+		return nil, err
+	}
+	if n > sha256.Size*2 {
+		return nil, fmt.Errorf("flatfs: hash prefix of %d digits is longer than the hash", n)
+	}
+	return &ShardFunc{name: "hash-prefix", param: n, fn: func(name string) string {
+		sum := sha256.Sum256([]byte(name))
+		return hex.EncodeToString(sum[:])[:n]
+	}}, nil
+}
+
+// Prefix shards by the first n characters of the key. n must be positive.
+func Prefix(n int) (*ShardFunc, error) {
+	if err := checkParam(n); err != nil {
+		return nil, err
+	}
+	padding := strings.Repeat("_", n)
+	return &ShardFunc{name: "prefix", param: n, fn: func(name string) string {
+		return (name + padding)[:n]
+	}}, nil
+}
+
+// Suffix shards by the last n characters of the key. n must be positive.
+func Suffix(n int) (*ShardFunc, error) {
+	if err := checkParam(n); err != nil {
+		return nil, err
+	}
+	padding := strings.Repeat("_", n)
+	return &ShardFunc{name: "suffix", param: n, fn: func(name string) string {
+		s := padding + name
+		return s[len(s)-n:]
+	}}, nil
+}
+
+// NextToLast shards by the n characters before the last one of the key. n
+// must be positive.
+func NextToLast(n int) (*ShardFunc, error) {
+	if err := checkParam(n); err != nil {
+		return nil, err
+	}
+	padding := strings.Repeat("_", n+1)
+	return &ShardFunc{name: "next-to-last", param: n, fn: func(name string) string {
+		s := padding + name
+		offset := len(s) - n - 1
+		return s[offset : offset+n]
+	}}, nil
+}
+
+// ParseShardFunc parses a shard function identifier as returned by
+// ShardFunc.String.
+func ParseShardFunc(id string) (*ShardFunc, error) {
+	id = strings.TrimSpace(id)
+	if !strings.HasPrefix(id, shardIDPrefix) {
+		return nil, fmt.Errorf("flatfs: invalid shard identifier %q", id)
+	}
+	parts := strings.Split(strings.TrimPrefix(id, shardIDPrefix), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("flatfs: invalid shard identifier %q", id)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("flatfs: invalid shard parameter in %q", id)
+	}
+	switch parts[0] {
+	case "hash-prefix":
+		return HashPrefix(n)
+	case "prefix":
+		return Prefix(n)
+	case "suffix":
+		return Suffix(n)
+	case "next-to-last":
+		return NextToLast(n)
+	default:
+		return nil, fmt.Errorf("flatfs: unknown shard function %q", parts[0])
+	}
+}
@@ -0,0 +1,268 @@
+// Package fs is a simple Datastore implementation that stores keys
+// as directories and files, mirroring the key. That is, the key
+// "/foo/bar" is stored as file "PATH/foo/bar/.dsobject".
+//
+// This means key some segments will not work. For example, the
+// following keys will result in unwanted behavior:
+//
+//   - "/foo/./bar"
+//   - "/foo/../bar"
+//   - "/foo\x00bar"
+//
+// Keys that only differ in case may be confused with each other on
+// case insensitive file systems, for example in OS X.
+//
+// This package is intended for exploratory use, where the user would
+// examine the file system manually, and should only be used with
+// human-friendly, trusted keys. You have been warned.
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+)
+
+// ObjectKeySuffix is the name of the file holding a key's value inside the
+// key's directory.
+var ObjectKeySuffix = ".dsobject"
+
+// Datastore uses a file per key to store values.
+type Datastore struct {
+	path string
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// NewDatastore returns a new fs Datastore at given `path`
+func NewDatastore(path string) (*Datastore, error) {
+	if !isDir(path) {
+		return nil, fmt.Errorf("failed to find directory at: %v (file? perms?)", path)
+	}
+
+	return &Datastore{path: path}, nil
+}
+
+// KeyFilename returns the filename associated with `key`
+func (d *Datastore) KeyFilename(key ds.Key) string {
+	return filepath.Join(d.path, filepath.FromSlash(key.String()), ObjectKeySuffix)
+}
+
+// Put stores the given value.
+func (d *Datastore) Put(key ds.Key, value []byte) (err error) {
+	fn := d.KeyFilename(key)
+
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename so readers never observe a
+	// partially written value.
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), ObjectKeySuffix+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fn)
+}
+
+// Sync would ensure that any previous Puts under the prefix are written to disk.
+// However, they already are.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return nil
+}
+
+// Get returns the value for given key
+func (d *Datastore) Get(key ds.Key) (value []byte, err error) {
+	value, err = ioutil.ReadFile(d.KeyFilename(key))
+	if os.IsNotExist(err) {
+		return nil, ds.ErrNotFound
+	}
+	return value, err
+}
+
+// Has returns whether the datastore has a value for a given key
+func (d *Datastore) Has(key ds.Key) (exists bool, err error) {
+	return isFile(d.KeyFilename(key)), nil
+}
+
+// GetSize returns the size of the value for given key
+func (d *Datastore) GetSize(key ds.Key) (size int, err error) {
+	fi, err := os.Stat(d.KeyFilename(key))
+	if os.IsNotExist(err) {
+		return -1, ds.ErrNotFound
+	}
+	if err != nil {
+		return -1, err
+	}
+	if fi.IsDir() {
+		return -1, ds.ErrNotFound
+	}
+	return int(fi.Size()), nil
+}
+
+// Delete removes the value for given key, and any directories left empty
+// by its removal.
+func (d *Datastore) Delete(key ds.Key) (err error) {
+	fn := d.KeyFilename(key)
+	err = os.Remove(fn)
+	if os.IsNotExist(err) {
+		return nil // idempotent
+	}
+	if err != nil {
+		return err
+	}
+
+	// Prune now-empty directories up to the root. Remove fails on
+	// non-empty directories, which ends the walk.
+	for dir := filepath.Dir(fn); dir != d.path && strings.HasPrefix(dir, d.path); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Query implements Datastore.Query. Only the directory subtree under the
+// query prefix is walked.
+func (d *Datastore) Query(q query.Query) (query.Results, error) {
+	root := d.path
+	prefix := path.Clean("/" + q.Prefix)
+	if prefix != "/" {
+		root = filepath.Join(d.path, filepath.FromSlash(prefix))
+	}
+
+	results := make(chan query.Result)
+	done := make(chan struct{})
+
+	walkFn := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			select {
+			case results <- query.Result{Error: err}:
+			case <-done:
+			}
+			return filepath.SkipDir
+		}
+		if info.IsDir() || info.Name() != ObjectKeySuffix {
+			return nil
+		}
+		rel, err := filepath.Rel(d.path, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		key := ds.NewKey(filepath.ToSlash(rel))
+		// The prefix itself is not one of its children.
+		if prefix != "/" && key.String() == prefix {
+			return nil
+		}
+
+		var result query.Result
+		result.Key = key.String()
+		result.Size = int(info.Size())
+		if !q.KeysOnly {
+			result.Value, result.Error = ioutil.ReadFile(p)
+			if result.Error != nil {
+				result.Entry = query.Entry{}
+			}
+		}
+		select {
+		case results <- result:
+			return nil
+		case <-done:
+			return errStop
+		}
+	}
+
+	go func() {
+		defer close(results)
+		filepath.Walk(root, walkFn)
+	}()
+
+	r := query.ResultsWithChan(q, results)
+	r = &closeNotify{Results: r, done: done}
+	naive := q
+	naive.Prefix = ""
+	return query.NaiveQueryApply(naive, r), nil
+}
+
+var errStop = fmt.Errorf("query closed")
+
+// closeNotify stops the directory walk when the results are closed.
+type closeNotify struct {
+	query.Results
+	done   chan struct{}
+	closed bool
+}
+
+func (c *closeNotify) Close() error {
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return c.Results.Close()
+}
+
+// isDir returns whether given path is a directory
+func isDir(path string) bool {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	return finfo.IsDir()
+}
+
+// isFile returns whether given path is a file
+func isFile(path string) bool {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	return !finfo.IsDir()
+}
+
+// Close implements Datastore.Close
+func (d *Datastore) Close() error {
+	return nil
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// DiskUsage returns the disk size used by the datastore in bytes.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	var du uint64
+	err := filepath.Walk(d.path, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f != nil && f.Mode().IsRegular() {
+			du += uint64(f.Size())
+		}
+		return nil
+	})
+	return du, err
+}
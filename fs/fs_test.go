@@ -0,0 +1,97 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func newDS(t *testing.T) (*Datastore, string) {
+	dir, err := ioutil.TempDir("", "ds-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	d, err := NewDatastore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, dir
+}
+
+func TestSuite(t *testing.T) {
+	d, _ := newDS(t)
+	dstest.SubtestAll(t, d)
+}
+
+func TestNotADirectory(t *testing.T) {
+	_, dir := newDS(t)
+	fn := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(fn, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDatastore(fn); err == nil {
+		t.Fatal("expected an error opening a file")
+	}
+}
+
+func TestLayout(t *testing.T) {
+	d, dir := newDS(t)
+	if err := d.Put(ds.NewKey("/foo/bar"), []byte("baz")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "foo", "bar", ObjectKeySuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "baz" {
+		t.Fatalf("got %q", b)
+	}
+
+	if err := d.Delete(ds.NewKey("/foo/bar")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo")); !os.IsNotExist(err) {
+		t.Fatalf("expected empty directories to be removed, got %v", err)
+	}
+}
+
+func TestQueryPrefixSubtree(t *testing.T) {
+	d, _ := newDS(t)
+	for _, k := range []string{"/a", "/a/b", "/a/b/c", "/ab", "/z"} {
+		if err := d.Put(ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := d.Query(dsq.Query{Prefix: "/a", Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "/a/b" || entries[1].Key != "/a/b/c" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	for _, e := range entries {
+		if e.Size != len(e.Key) {
+			t.Fatalf("size %d for %s", e.Size, e.Key)
+		}
+	}
+
+	res, err = d.Query(dsq.Query{Prefix: "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = res.Rest()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected no entries, got %v, %v", entries, err)
+	}
+}
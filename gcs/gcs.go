@@ -0,0 +1,300 @@
+// Package gcs implements a Datastore over a Google Cloud Storage bucket.
+//
+// Each key is stored as an object named by the key, escaped and listed as
+// the azure package does with its blobs, so a bucket and a container
+// holding the same keys hold the same names and can be copied between with
+// the providers' own tools. Queries list the bucket by name prefix.
+//
+// Expiry is stored in the object's "dsexpires" metadata, in Unix
+// nanoseconds. Expired objects are hidden from reads but stay in the
+// bucket until overwritten or deleted, for example by an Object Lifecycle
+// Management rule.
+package gcs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	"github.com/ipfs/go-datastore/internal/blobkey"
+	dsq "github.com/ipfs/go-datastore/query"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// metaExpires is the object metadata entry holding a key's expiry, in
+// Unix nanoseconds.
+const metaExpires = "dsexpires"
+
+// Options configures the datastore.
+type Options struct {
+	// Clock sets TTL expirations and hides expired objects. Defaults to
+	// the wall clock.
+	Clock clock.Clock
+}
+
+// Datastore stores keys as objects of a bucket.
+type Datastore struct {
+	bucket *storage.BucketHandle
+	opts   Options
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.TTLDatastore = (*Datastore)(nil)
+
+// NewDatastore returns a datastore over bucket, which must exist. The
+// client stays the caller's to close.
+func NewDatastore(client *storage.Client, bucket string, opts Options) *Datastore {
+	opts.Clock = clock.OrReal(opts.Clock)
+	return &Datastore{bucket: client.Bucket(bucket), opts: opts}
+}
+
+func (d *Datastore) object(key ds.Key) *storage.ObjectHandle {
+	return d.bucket.Object(blobkey.Escape(key.String()))
+}
+
+// expiration returns the expiry recorded in meta, or the zero time.
+func expiration(meta map[string]string) time.Time {
+	n, err := strconv.ParseInt(meta[metaExpires], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func (d *Datastore) expired(meta map[string]string) bool {
+	exp := expiration(meta)
+	return !exp.IsZero() && !exp.After(d.opts.Clock.Now())
+}
+
+// attrs returns the attributes of key's object, or ds.ErrNotFound if it
+// has none or it has expired.
+func (d *Datastore) attrs(ctx context.Context, key ds.Key) (*storage.ObjectAttrs, error) {
+	attrs, err := d.object(key).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.expired(attrs.Metadata) {
+		return nil, ds.ErrNotFound
+	}
+	return attrs, nil
+}
+
+// isPreconditionFailed reports whether err is a write failing its
+// condition.
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+func (d *Datastore) put(ctx context.Context, key ds.Key, value []byte, meta map[string]string) error {
+	w := d.object(key).NewWriter(ctx)
+	w.Metadata = meta
+	if _, err := w.Write(value); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.put(context.TODO(), key, value, nil)
+}
+
+// Sync implements Datastore.Sync. Writes are durable once they return.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return nil
+}
+
+// Get implements Datastore.Get. Reading the object's metadata, to check
+// its expiry, takes a request of its own; the value is then read from the
+// same generation of the object.
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	ctx := context.TODO()
+	attrs, err := d.attrs(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return d.read(ctx, key, attrs.Generation)
+}
+
+// read reads the value of a generation of key's object.
+func (d *Datastore) read(ctx context.Context, key ds.Key, generation int64) ([]byte, error) {
+	r, err := d.object(key).Generation(generation).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		// Replaced or deleted since its metadata was read.
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	_, err := d.attrs(context.TODO(), key)
+	if err == ds.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	attrs, err := d.attrs(context.TODO(), key)
+	if err != nil {
+		return -1, err
+	}
+	return int(attrs.Size), nil
+}
+
+// Delete implements Datastore.Delete. Deleting a missing key is not an
+// error.
+func (d *Datastore) Delete(key ds.Key) error {
+	err := d.object(key).Delete(context.TODO())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+// PutWithTTL implements TTL.PutWithTTL
+func (d *Datastore) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
+	return d.put(context.TODO(), key, value, d.expiresIn(ttl))
+}
+
+// SetTTL implements TTL.SetTTL. Expired keys are not found.
+func (d *Datastore) SetTTL(key ds.Key, ttl time.Duration) error {
+	ctx := context.TODO()
+	for {
+		attrs, err := d.attrs(ctx, key)
+		if err != nil {
+			return err
+		}
+		// The metageneration condition keeps a concurrent Put's metadata
+		// from being replaced by this TTL.
+		_, err = d.object(key).If(storage.Conditions{MetagenerationMatch: attrs.Metageneration}).
+			Update(ctx, storage.ObjectAttrsToUpdate{Metadata: d.expiresIn(ttl)})
+		if !isPreconditionFailed(err) {
+			return err
+		}
+	}
+}
+
+// GetExpiration implements TTL.GetExpiration. Keys without a TTL return the
+// zero time.
+func (d *Datastore) GetExpiration(key ds.Key) (time.Time, error) {
+	attrs, err := d.attrs(context.TODO(), key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expiration(attrs.Metadata), nil
+}
+
+func (d *Datastore) expiresIn(ttl time.Duration) map[string]string {
+	return map[string]string{metaExpires: strconv.FormatInt(d.opts.Clock.Now().Add(ttl).UnixNano(), 10)}
+}
+
+// Query implements Datastore.Query. The prefix is pushed down, and unless
+// the query has filters or orders, so are the offset and limit;
+// everything else is applied naively. Values are read one at a
+// time as the results are consumed.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	within := blobkey.PrefixFilter(q.Prefix)
+	listPrefix := within
+	if listPrefix == "" {
+		listPrefix = "/"
+	}
+	sq := &storage.Query{Prefix: blobkey.Escape(listPrefix)}
+	if err := sq.SetAttrSelection([]string{"Name", "Size", "Metadata", "Generation"}); err != nil {
+		cancel()
+		return nil, err
+	}
+	objects := d.bucket.Objects(ctx, sq)
+
+	// Without filters or orders, the listing can apply the offset and
+	// limit itself.
+	pushdown := blobkey.PushDown(q)
+	skip, remaining := q.Offset, q.Limit
+	done := false
+
+	it := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for !done {
+				attrs, err := objects.Next()
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					done = true
+					return dsq.Result{Error: err}, true
+				}
+				if d.expired(attrs.Metadata) {
+					continue
+				}
+				key := ds.NewKey(blobkey.Unescape(attrs.Name))
+				e := dsq.Entry{Key: key.String(), Size: int(attrs.Size)}
+				if !strings.HasPrefix(e.Key, within) {
+					continue
+				}
+				if pushdown && skip > 0 {
+					skip--
+					continue
+				}
+				if q.ReturnExpirations {
+					e.Expiration = expiration(attrs.Metadata)
+				}
+				if !q.KeysOnly {
+					e.Value, err = d.read(ctx, key, attrs.Generation)
+					if err == ds.ErrNotFound {
+						continue
+					}
+					if err != nil {
+						return dsq.Result{Error: err}, true
+					}
+				}
+				if pushdown && remaining > 0 {
+					if remaining--; remaining == 0 {
+						done = true
+					}
+				}
+				return dsq.Result{Entry: e}, true
+			}
+			return dsq.Result{}, false
+		},
+		Close: func() error {
+			cancel()
+			return nil
+		},
+	}
+	naive := q
+	if pushdown {
+		naive.Offset, naive.Limit = 0, 0
+	}
+	return dsq.NaiveQueryApply(naive, dsq.ResultsFromIterator(q, it)), nil
+}
+
+// Batch implements Batching.Batch. Objects are written one request each.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// Close implements Datastore.Close. The client is left open.
+func (d *Datastore) Close() error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package gcs
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestExpired(t *testing.T) {
+	c := clock.NewMock(time.Unix(1000, 0))
+	d := &Datastore{opts: Options{Clock: c}}
+	meta := d.expiresIn(time.Minute)
+	if d.expired(meta) {
+		t.Fatal("expired early")
+	}
+	c.Advance(time.Minute)
+	if !d.expired(meta) {
+		t.Fatal("not expired after its TTL")
+	}
+	if d.expired(nil) {
+		t.Fatal("object without a TTL expired")
+	}
+}
+
+// TestSuite runs against the bucket named by GCS_BUCKET using application
+// default credentials, or the emulator at STORAGE_EMULATOR_HOST. The
+// bucket is cleared by the suite.
+func TestSuite(t *testing.T) {
+	bucket := os.Getenv("GCS_BUCKET")
+	if bucket == "" {
+		t.Skip("GCS_BUCKET not set")
+	}
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	d := NewDatastore(client, bucket, Options{})
+	dstest.SubtestAll(t, d)
+
+	k := ds.NewKey("/ttl/key")
+	if err := d.PutWithTTL(k, []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTTL(k, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(k); has {
+		t.Fatal("expired key reported present")
+	}
+	d.Delete(k)
+
+	// "/a." escapes to "/a%2E", which is listed before "/a-", so the
+	// listing cannot apply the offset and limit of an ordered query.
+	for _, k := range []string{"/a-", "/a.", "/b"} {
+		if err := d.Put(ds.NewKey(k), nil); err != nil {
+			t.Fatal(err)
+		}
+		defer d.Delete(ds.NewKey(k))
+	}
+	res, err := d.Query(dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := res.Rest(); err != nil || len(entries) != 1 || entries[0].Key != "/a-" {
+		t.Fatalf("ordered query got %v, %v", entries, err)
+	}
+}
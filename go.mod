@@ -1,10 +1,12 @@
 module github.com/ipfs/go-datastore
 
 require (
+	github.com/Azure/azure-pipeline-go v0.2.3
 	github.com/Azure/azure-storage-blob-go v0.13.0
 	github.com/google/uuid v1.1.1
 	github.com/ipfs/go-ipfs-delay v0.0.0-20181109222059-70721b86a9a8
 	github.com/jbenet/goprocess v0.1.4
+	github.com/klauspost/compress v1.15.15
 	github.com/kr/pretty v0.2.0 // indirect
 	go.uber.org/multierr v1.5.0
 	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7
@@ -0,0 +1,268 @@
+// Package hybrid composes a local datastore with a durable remote one.
+// Writes go through to both, reads are served locally when possible, and
+// local misses are backfilled from the remote on read. Warm preloads a
+// prefix ahead of traffic, and Prefetch copies individual keys in the
+// background. NewFSAzure builds the common pairing of a local
+// fs datastore in front of an Azure container.
+package hybrid
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/azure"
+	"github.com/ipfs/go-datastore/fs"
+	dsq "github.com/ipfs/go-datastore/query"
+	"go.uber.org/multierr"
+)
+
+// Datastore writes through to a remote datastore and caches on a local one.
+// The remote is authoritative: queries are answered by it, and a key is
+// only reported missing once the remote has been checked.
+type Datastore struct {
+	local  ds.Datastore
+	remote ds.Datastore
+
+	// mu guards gen and writing, and is held while copying a value from
+	// the remote to local, so a copy racing a write does not keep what it
+	// read from before the write.
+	mu      sync.Mutex
+	gen     uint64 // bumped as each write finishes
+	writing int    // writes in flight
+
+	prefetchOnce sync.Once
+	prefetchMu   sync.RWMutex
+	prefetchCh   chan ds.Key
+	prefetchStop chan struct{}
+	prefetchWG   sync.WaitGroup
+	closed       bool
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// New returns a datastore serving reads from local and writing through to
+// remote.
+func New(local, remote ds.Datastore) *Datastore {
+	return &Datastore{local: local, remote: remote}
+}
+
+// NewFSAzure returns a datastore keeping a local copy under dir of the
+// given Azure container.
+func NewFSAzure(dir, accountName, accountKey, container string) (*Datastore, error) {
+	local, err := fs.NewDatastore(dir)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := azure.NewDatastore(accountName, container, azure.WithSharedKey(accountKey))
+	if err != nil {
+		return nil, err
+	}
+	return New(local, remote), nil
+}
+
+// beginWrite records a write in flight, until endWrite.
+func (d *Datastore) beginWrite() {
+	d.mu.Lock()
+	d.writing++
+	d.mu.Unlock()
+}
+
+func (d *Datastore) endWrite() {
+	d.mu.Lock()
+	d.writing--
+	d.gen++
+	d.mu.Unlock()
+}
+
+// generation returns the write count, to pass to backfill.
+func (d *Datastore) generation() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.gen
+}
+
+// backfill copies value, read from the remote, to local, unless a write
+// finished since gen or is in flight.
+func (d *Datastore) backfill(gen uint64, key ds.Key, value []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if gen != d.gen || d.writing > 0 {
+		return nil
+	}
+	return d.local.Put(key, value)
+}
+
+// Put implements Datastore.Put. The value is written to the remote first,
+// so a write is only acknowledged once it is durable. If the local write
+// then fails, the stale local copy is dropped so reads fall back to the
+// remote.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	d.beginWrite()
+	defer d.endWrite()
+	if err := d.remote.Put(key, value); err != nil {
+		return err
+	}
+	if err := d.local.Put(key, value); err != nil {
+		return multierr.Append(err, d.local.Delete(key))
+	}
+	return nil
+}
+
+// Delete implements Datastore.Delete. The local copy is deleted first, so
+// a failure never leaves it serving a key the remote no longer holds.
+func (d *Datastore) Delete(key ds.Key) error {
+	d.beginWrite()
+	defer d.endWrite()
+	if err := d.local.Delete(key); err != nil {
+		return err
+	}
+	return d.remote.Delete(key)
+}
+
+// Get implements Datastore.Get. A local miss is read from the remote and
+// copied to local disk; failing to copy does not fail the read.
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	value, err := d.local.Get(key)
+	if err != ds.ErrNotFound {
+		return value, err
+	}
+	gen := d.generation()
+	value, err = d.remote.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	_ = d.backfill(gen, key, value)
+	return value, nil
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	exists, err := d.local.Has(key)
+	if err != nil || exists {
+		return exists, err
+	}
+	return d.remote.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	size, err := d.local.GetSize(key)
+	if err != ds.ErrNotFound {
+		return size, err
+	}
+	return d.remote.GetSize(key)
+}
+
+// Query implements Datastore.Query against the remote, which holds every
+// key; the local datastore only holds those written or read through it.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	return d.remote.Query(q)
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return multierr.Append(d.remote.Sync(prefix), d.local.Sync(prefix))
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// DiskUsage implements the PersistentDatastore interface by reporting the
+// local datastore's usage.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(d.local)
+}
+
+// Close stops prefetching, dropping queued hints and waiting for fetches in
+// flight, then closes both datastores.
+func (d *Datastore) Close() error {
+	d.stopPrefetch()
+	return multierr.Append(d.local.Close(), d.remote.Close())
+}
+
+// WarmOptions configures Warm.
+type WarmOptions struct {
+	// BytesPerSecond caps the rate values are copied at. Zero is
+	// unlimited.
+	BytesPerSecond int64
+	// Overwrite refreshes keys already held locally instead of skipping
+	// them.
+	Overwrite bool
+}
+
+// WarmStats reports what Warm did.
+type WarmStats struct {
+	Keys  int
+	Bytes int64
+	// Skipped counts keys already held locally.
+	Skipped int
+}
+
+// Warm copies the remote keys under prefix to the local datastore, so a
+// service can load its hot data before taking traffic. It stops early with
+// ctx's error when ctx is done.
+func (d *Datastore) Warm(ctx context.Context, prefix ds.Key, opts WarmOptions) (WarmStats, error) {
+	var stats WarmStats
+	res, err := d.remote.Query(dsq.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return stats, err
+	}
+	defer res.Close()
+
+	start := time.Now()
+	for r := range res.Next() {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if r.Error != nil {
+			return stats, r.Error
+		}
+		key := ds.RawKey(r.Key)
+		if !opts.Overwrite {
+			has, err := d.local.Has(key)
+			if err != nil {
+				return stats, err
+			}
+			if has {
+				stats.Skipped++
+				continue
+			}
+		}
+
+		gen := d.generation()
+		value, err := d.remote.Get(key)
+		if err == ds.ErrNotFound {
+			continue // deleted since the listing
+		}
+		if err != nil {
+			return stats, err
+		}
+		if err := d.backfill(gen, key, value); err != nil {
+			return stats, err
+		}
+		stats.Keys++
+		stats.Bytes += int64(len(value))
+
+		// Sleep until the average rate since the start is back under the
+		// cap.
+		if opts.BytesPerSecond > 0 {
+			due := time.Duration(float64(stats.Bytes) / float64(opts.BytesPerSecond) * float64(time.Second))
+			if wait := due - time.Since(start); wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return stats, ctx.Err()
+				case <-t.C:
+				}
+			}
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,160 @@
+package hybrid
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/failstore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, New(ds.NewMapDatastore(), ds.NewMapDatastore()))
+}
+
+func TestWriteThrough(t *testing.T) {
+	local, remote := ds.NewMapDatastore(), ds.NewMapDatastore()
+	d := New(local, remote)
+	k := ds.NewKey("/a")
+
+	if err := d.Put(k, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []ds.Datastore{local, remote} {
+		if v, err := s.Get(k); err != nil || string(v) != "1" {
+			t.Fatalf("got %q, %v", v, err)
+		}
+	}
+
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []ds.Datastore{local, remote} {
+		if has, _ := s.Has(k); has {
+			t.Fatal("key not deleted")
+		}
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	local, remote := ds.NewMapDatastore(), ds.NewMapDatastore()
+	d := New(local, remote)
+	k := ds.NewKey("/a")
+	remote.Put(k, []byte("1"))
+
+	if v, err := d.Get(k); err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if v, err := local.Get(k); err != nil || string(v) != "1" {
+		t.Fatalf("local not backfilled: %q, %v", v, err)
+	}
+}
+
+func TestStaleBackfill(t *testing.T) {
+	local, remote := ds.NewMapDatastore(), ds.NewMapDatastore()
+	d := New(local, remote)
+	k := ds.NewKey("/a")
+	remote.Put(k, []byte("1"))
+
+	// A remote read from before a Delete finishes after it...
+	gen := d.generation()
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	d.backfill(gen, k, []byte("1"))
+	if has, _ := local.Has(k); has {
+		t.Fatal("deleted key backfilled by a stale read")
+	}
+	if _, err := d.Get(k); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// ...or while a write is in flight.
+	d.beginWrite()
+	d.backfill(d.generation(), k, []byte("1"))
+	d.endWrite()
+	if has, _ := local.Has(k); has {
+		t.Fatal("key backfilled during a write")
+	}
+}
+
+func TestRemoteFailure(t *testing.T) {
+	local := ds.NewMapDatastore()
+	remote := failstore.NewFailstore(ds.NewMapDatastore(), func(op string) error {
+		if op == "put" {
+			return errors.New("remote down")
+		}
+		return nil
+	})
+	d := New(local, remote)
+	k := ds.NewKey("/a")
+
+	if err := d.Put(k, []byte("1")); err == nil {
+		t.Fatal("expected the remote failure")
+	}
+	if has, _ := local.Has(k); has {
+		t.Fatal("unacknowledged write reached local disk")
+	}
+}
+
+func TestWarm(t *testing.T) {
+	local, remote := ds.NewMapDatastore(), ds.NewMapDatastore()
+	d := New(local, remote)
+	for _, k := range []string{"/hot/a", "/hot/b", "/hot/c", "/cold/x"} {
+		remote.Put(ds.NewKey(k), make([]byte, 100))
+	}
+	local.Put(ds.NewKey("/hot/a"), make([]byte, 100))
+
+	start := time.Now()
+	stats, err := d.Warm(context.Background(), ds.NewKey("/hot"), WarmOptions{BytesPerSecond: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 2 || stats.Skipped != 1 || stats.Bytes != 200 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("200 bytes at 2000 B/s took %v", elapsed)
+	}
+	if has, _ := local.Has(ds.NewKey("/cold/x")); has {
+		t.Fatal("warmed a key outside the prefix")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.Warm(ctx, ds.NewKey("/cold"), WarmOptions{}); err != context.Canceled {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	local, remote := dssync.MutexWrap(ds.NewMapDatastore()), dssync.MutexWrap(ds.NewMapDatastore())
+	d := New(local, remote)
+	keys := []ds.Key{ds.NewKey("/a"), ds.NewKey("/b"), ds.NewKey("/c")}
+	for _, k := range keys {
+		remote.Put(k, []byte(k.String()))
+	}
+
+	d.Prefetch(append(keys, ds.NewKey("/missing"))...)
+	deadline := time.Now().Add(5 * time.Second)
+	for _, k := range keys {
+		for {
+			if has, _ := local.Has(k); has {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not prefetched", k)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d.Prefetch(keys...) // dropped after Close
+}
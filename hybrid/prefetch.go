@@ -0,0 +1,88 @@
+package hybrid
+
+import (
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// PrefetchWorkers is the number of keys fetched concurrently.
+	PrefetchWorkers = 8
+	// PrefetchQueue is the number of hints held before further ones are
+	// dropped.
+	PrefetchQueue = 1024
+)
+
+// Prefetch hints that keys will be read soon. Keys missing locally are
+// copied from the remote in the background, so a caller that knows its
+// access pattern, such as a DAG traversal, can overlap remote latency with
+// its own work. Prefetch never blocks: hints arriving while the queue is
+// full, or after Close, are dropped, and fetch errors are ignored since
+// the later read will retry them.
+func (d *Datastore) Prefetch(keys ...ds.Key) {
+	d.prefetchOnce.Do(d.startPrefetch)
+
+	d.prefetchMu.RLock()
+	defer d.prefetchMu.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, k := range keys {
+		select {
+		case d.prefetchCh <- k:
+		default:
+			return
+		}
+	}
+}
+
+func (d *Datastore) startPrefetch() {
+	d.prefetchCh = make(chan ds.Key, PrefetchQueue)
+	d.prefetchStop = make(chan struct{})
+	d.prefetchWG.Add(PrefetchWorkers)
+	for i := 0; i < PrefetchWorkers; i++ {
+		go d.prefetchWorker()
+	}
+}
+
+func (d *Datastore) prefetchWorker() {
+	defer d.prefetchWG.Done()
+	for {
+		select {
+		case <-d.prefetchStop:
+			return
+		case k := <-d.prefetchCh:
+			d.prefetch(k)
+		}
+	}
+}
+
+func (d *Datastore) prefetch(key ds.Key) {
+	if has, err := d.local.Has(key); err != nil || has {
+		return
+	}
+	gen := d.generation()
+	value, err := d.remote.Get(key)
+	if err != nil {
+		return
+	}
+	_ = d.backfill(gen, key, value)
+}
+
+// stopPrefetch stops the workers, if they were started, and waits for them.
+func (d *Datastore) stopPrefetch() {
+	d.prefetchMu.Lock()
+	wasClosed := d.closed
+	d.closed = true
+	d.prefetchMu.Unlock()
+	if wasClosed {
+		return
+	}
+
+	// Make sure a later Prefetch does not start workers.
+	started := true
+	d.prefetchOnce.Do(func() { started = false })
+	if started {
+		close(d.prefetchStop)
+		d.prefetchWG.Wait()
+	}
+}
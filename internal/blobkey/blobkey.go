@@ -0,0 +1,138 @@
+// Package blobkey maps datastore keys to the names of objects in flat
+// object stores, such as Azure Blob Storage and Google Cloud Storage, and
+// helps their datastores push queries down to prefix listings.
+//
+// Names are escaped for the stricter of the services, Azure, so a
+// container and a bucket holding the same keys hold the same names.
+package blobkey
+
+import (
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// MaxSegments is the number of path segments an Azure blob name may have.
+const MaxSegments = 254
+
+// Escape returns the object name of the key string s. Most keys are
+// stored under their own string; bytes object names cannot hold are
+// escaped as %XX:
+//
+//   - '%' itself, so names decode unambiguously,
+//   - '\', which Azure turns into '/',
+//   - control characters and invalid UTF-8, which cannot be listed,
+//   - a '.' ending a path segment, which Azure drops,
+//   - every '/' past Azure's segment limit, so deep keys stay one blob.
+//
+// Escaping works byte by byte from the start of s, so a key prefix ending
+// in '/' escapes to a prefix of the names of the keys under it, and can be
+// listed by.
+func Escape(s string) string {
+	var b strings.Builder
+	slashes := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		c := s[i]
+		escape := false
+		switch {
+		case r == utf8.RuneError && size == 1, c < 0x20, c == 0x7f, c == '%', c == '\\':
+			escape = true
+		case c == '/':
+			slashes++
+			escape = slashes >= MaxSegments
+		case c == '.':
+			escape = i+1 == len(s) || s[i+1] == '/'
+		}
+		if escape {
+			if b.Len() == 0 {
+				b.Grow(len(s) + 8)
+				b.WriteString(s[:i])
+			}
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+		} else if b.Len() > 0 {
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	if b.Len() == 0 {
+		return s
+	}
+	return b.String()
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+// Unescape reverses Escape. Names Escape does not produce, such as those
+// of objects written before keys were escaped, are legacy names and kept
+// as is, so "/50%off" or "/a%41" is listed under the key it was written
+// with. A legacy name that reads as escaped, such as "/a%25", cannot be
+// told apart and decodes to another key, "/a%".
+func Unescape(name string) string {
+	if !strings.Contains(name, "%") {
+		return name
+	}
+	if s := decode(name); Escape(s) == name {
+		return s
+	}
+	return name
+}
+
+// decode replaces each %XX in name with the byte it escapes.
+func decode(name string) string {
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+2 < len(name) {
+			hi, ok1 := unhex(name[i+1])
+			lo, ok2 := unhex(name[i+2])
+			if ok1 && ok2 {
+				b = append(b, hi<<4|lo)
+				i += 2
+				continue
+			}
+		}
+		b = append(b, name[i])
+	}
+	return string(b)
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// PushDown reports whether the offset and limit of q can be applied to a
+// listing of object names. Objects are listed in name order, which is not
+// key order once names are escaped: "/a." escapes to "/a%2E", listed
+// before "/a-". So only queries without filters or orders, whose results
+// may come in any order, can.
+func PushDown(q dsq.Query) bool {
+	return len(q.Filters) == 0 && len(q.Orders) == 0
+}
+
+// PrefixFilter returns the prefix a key must have to be under the query
+// prefix p, as NaiveQueryApply applies it, or "" for every key.
+func PrefixFilter(p string) string {
+	if p == "" {
+		return ""
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	p = path.Clean(p)
+	if p == "/" {
+		return ""
+	}
+	return p + "/"
+}
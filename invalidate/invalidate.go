@@ -0,0 +1,288 @@
+// Package invalidate provides a datastore wrapper that broadcasts the keys
+// it writes on a Bus, and reports keys written by other instances, so that
+// per-process caches in front of a shared datastore can invalidate each
+// other promptly.
+//
+// A typical composition puts the wrapper outside a cache and hands the
+// cache's invalidation method to OnRemoteChange:
+//
+//   lc := listcache.New(azureDs, listcache.Options{})
+//   d := invalidate.New(lc, bus, invalidate.Options{OnRemoteChange: lc.Invalidate})
+package invalidate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Notification announces that a key was written or deleted.
+type Notification struct {
+	Key    string `json:"key"`
+	Origin string `json:"origin"`
+}
+
+// Bus carries notifications between instances. Every instance must receive
+// every notification, so with a topic-based broker each instance needs its
+// own subscription.
+type Bus interface {
+	Publish(ctx context.Context, n Notification) error
+	// Receive blocks until a notification arrives or ctx is done.
+	Receive(ctx context.Context) (Notification, error)
+}
+
+// Options configures the wrapper.
+type Options struct {
+	// OnRemoteChange is called with every key written by another instance.
+	OnRemoteChange func(ds.Key)
+	// RetryDelay is how long to wait after a failed Receive. Defaults to
+	// one second.
+	RetryDelay time.Duration
+}
+
+// Datastore publishes its writes and listens for writes made elsewhere.
+type Datastore struct {
+	child  ds.Datastore
+	bus    Bus
+	origin string
+	opts   Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+
+// New wraps child and starts listening on bus.
+func New(child ds.Datastore, bus Bus, opts Options) *Datastore {
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Datastore{
+		child:  child,
+		bus:    bus,
+		origin: uuid.New().String(),
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	d.wg.Add(1)
+	go d.listen()
+	return d
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.child}
+}
+
+func (d *Datastore) listen() {
+	defer d.wg.Done()
+	for {
+		n, err := d.bus.Receive(d.ctx)
+		if d.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(d.opts.RetryDelay):
+			}
+			continue
+		}
+		if n.Origin == d.origin || d.opts.OnRemoteChange == nil {
+			continue
+		}
+		d.opts.OnRemoteChange(ds.RawKey(n.Key))
+	}
+}
+
+func (d *Datastore) publish(key ds.Key) error {
+	err := d.bus.Publish(d.ctx, Notification{Key: key.String(), Origin: d.origin})
+	if err != nil {
+		return fmt.Errorf("write to %s succeeded but invalidation was not published: %w", key, err)
+	}
+	return nil
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	if err := d.child.Put(key, value); err != nil {
+		return err
+	}
+	return d.publish(key)
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	if err := d.child.Delete(key); err != nil {
+		return err
+	}
+	return d.publish(key)
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	return d.child.Get(key)
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	return d.child.GetSize(key)
+}
+
+// Query implements Datastore.Query
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	return d.child.Query(q)
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	if bds, ok := d.child.(ds.Batching); ok {
+		b, err := bds.Batch()
+		if err != nil {
+			return nil, err
+		}
+		return &batch{d: d, child: b}, nil
+	}
+	return ds.NewBasicBatch(d), nil
+}
+
+type batch struct {
+	d     *Datastore
+	child ds.Batch
+	keys  []ds.Key
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	b.keys = append(b.keys, key)
+	return b.child.Put(key, value)
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	b.keys = append(b.keys, key)
+	return b.child.Delete(key)
+}
+
+func (b *batch) Commit() error {
+	if err := b.child.Commit(); err != nil {
+		return err
+	}
+	keys := b.keys
+	b.keys = nil
+	for _, k := range keys {
+		if err := b.d.publish(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiskUsage implements the PersistentDatastore interface.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(d.child)
+}
+
+// Close stops listening, closes the bus if it is an io.Closer, and closes
+// the child.
+func (d *Datastore) Close() error {
+	d.cancel()
+	d.wg.Wait()
+	if c, ok := d.bus.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			d.child.Close()
+			return err
+		}
+	}
+	return d.child.Close()
+}
+
+// LocalHub is an in-process Bus broker, useful for tests and for several
+// datastores sharing a child within one process.
+type LocalHub struct {
+	mu   sync.Mutex
+	subs []*localBus
+}
+
+// NewLocalHub creates an empty hub.
+func NewLocalHub() *LocalHub {
+	return &LocalHub{}
+}
+
+// Join returns a Bus that receives every notification published on the hub
+// until it is closed. Closing the Datastore using it closes it.
+func (h *LocalHub) Join() Bus {
+	b := &localBus{hub: h, ch: make(chan Notification, 1024), closed: make(chan struct{})}
+	h.mu.Lock()
+	h.subs = append(h.subs, b)
+	h.mu.Unlock()
+	return b
+}
+
+type localBus struct {
+	hub       *LocalHub
+	ch        chan Notification
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Publish blocks while a subscriber's buffer is full, but not on the hub,
+// so that subscribers can still leave meanwhile.
+func (b *localBus) Publish(ctx context.Context, n Notification) error {
+	b.hub.mu.Lock()
+	subs := append([]*localBus(nil), b.hub.subs...)
+	b.hub.mu.Unlock()
+	for _, sub := range subs {
+		select {
+		case sub.ch <- n:
+		case <-sub.closed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *localBus) Receive(ctx context.Context) (Notification, error) {
+	select {
+	case n := <-b.ch:
+		return n, nil
+	case <-ctx.Done():
+		return Notification{}, ctx.Err()
+	}
+}
+
+// Close leaves the hub.
+func (b *localBus) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		b.hub.mu.Lock()
+		defer b.hub.mu.Unlock()
+		for i, sub := range b.hub.subs {
+			if sub == b {
+				b.hub.subs = append(b.hub.subs[:i], b.hub.subs[i+1:]...)
+				break
+			}
+		}
+	})
+	return nil
+}
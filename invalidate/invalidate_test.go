@@ -0,0 +1,124 @@
+package invalidate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	d := New(dssync.MutexWrap(ds.NewMapDatastore()), NewLocalHub().Join(), Options{})
+	defer d.Close()
+	dstest.SubtestAll(t, d)
+}
+
+func TestRemoteChanges(t *testing.T) {
+	shared := dssync.MutexWrap(ds.NewMapDatastore())
+	hub := NewLocalHub()
+
+	local := make(chan ds.Key, 10)
+	remote := make(chan ds.Key, 10)
+	a := New(shared, hub.Join(), Options{OnRemoteChange: func(k ds.Key) { local <- k }})
+	defer a.Close()
+	b := New(shared, hub.Join(), Options{OnRemoteChange: func(k ds.Key) { remote <- k }})
+	defer b.Close()
+
+	if err := a.Put(ds.NewKey("/foo"), []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case k := <-remote:
+		if k != ds.NewKey("/foo") {
+			t.Fatalf("unexpected key %s", k)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote instance was not notified")
+	}
+	select {
+	case k := <-local:
+		t.Fatalf("instance notified of its own write to %s", k)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestClosedSubscriber(t *testing.T) {
+	shared := dssync.MutexWrap(ds.NewMapDatastore())
+	hub := NewLocalHub()
+	a := New(shared, hub.Join(), Options{})
+	defer a.Close()
+	b := New(shared, hub.Join(), Options{})
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// b no longer reads its channel, so it would fill after its buffer.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 2048; i++ {
+			if err := a.Put(ds.NewKey(fmt.Sprint("/", i)), nil); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a closed instance")
+	}
+}
+
+func TestServiceBus(t *testing.T) {
+	var queued [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedAccessSignature sr=") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/topic/messages":
+			body, _ := ioutil.ReadAll(r.Body)
+			queued = append(queued, body)
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodDelete && r.URL.Path == "/topic/subscriptions/sub/messages/head":
+			if len(queued) == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Write(queued[0])
+			queued = queued[1:]
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	bus := &ServiceBus{Endpoint: srv.URL, Topic: "topic", Subscription: "sub", KeyName: "k", Key: "secret"}
+	ctx := context.Background()
+	want := Notification{Key: "/foo", Origin: "me"}
+	if err := bus.Publish(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bus.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		a, _ := json.Marshal(got)
+		t.Fatalf("unexpected notification %s", a)
+	}
+}
@@ -0,0 +1,134 @@
+package invalidate
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ServiceBus is a Bus backed by an Azure Service Bus topic, using the REST
+// API directly. Each instance should use its own subscription on the topic.
+type ServiceBus struct {
+	// Endpoint is the namespace URL, e.g.
+	// https://mynamespace.servicebus.windows.net.
+	Endpoint     string
+	Topic        string
+	Subscription string
+	// KeyName and Key are a shared access policy with Send and Listen
+	// rights on the topic.
+	KeyName string
+	Key     string
+
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// PollTimeout is the server-side long poll duration. Defaults to 60s.
+	PollTimeout time.Duration
+}
+
+var _ Bus = (*ServiceBus)(nil)
+
+// NewServiceBus returns a Bus for the given namespace, topic and
+// subscription.
+func NewServiceBus(namespace, topic, subscription, keyName, key string) *ServiceBus {
+	return &ServiceBus{
+		Endpoint:     fmt.Sprintf("https://%s.servicebus.windows.net", namespace),
+		Topic:        topic,
+		Subscription: subscription,
+		KeyName:      keyName,
+		Key:          key,
+	}
+}
+
+func (b *ServiceBus) client() *http.Client {
+	if b.Client != nil {
+		return b.Client
+	}
+	return http.DefaultClient
+}
+
+// token builds a shared access signature for resource.
+func (b *ServiceBus) token(resource string) string {
+	expiry := time.Now().Add(time.Hour).Unix()
+	sr := url.QueryEscape(strings.ToLower(resource))
+	mac := hmac.New(sha256.New, []byte(b.Key))
+	fmt.Fprintf(mac, "%s\n%d", sr, expiry)
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%d&skn=%s",
+		sr, url.QueryEscape(sig), expiry, b.KeyName)
+}
+
+func (b *ServiceBus) do(req *http.Request, resource string) (*http.Response, error) {
+	req.Header.Set("Authorization", b.token(resource))
+	return b.client().Do(req)
+}
+
+// Publish sends n to the topic.
+func (b *ServiceBus) Publish(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resource := b.Endpoint + "/" + b.Topic
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, resource+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.do(req, resource)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("service bus send: %s", resp.Status)
+	}
+	return nil
+}
+
+// Receive long-polls the subscription, removing the message it returns.
+func (b *ServiceBus) Receive(ctx context.Context) (Notification, error) {
+	timeout := b.PollTimeout
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	resource := b.Endpoint + "/" + b.Topic
+	for {
+		u := fmt.Sprintf("%s/subscriptions/%s/messages/head?timeout=%d",
+			resource, b.Subscription, int(timeout/time.Second))
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u, nil)
+		if err != nil {
+			return Notification{}, err
+		}
+		resp, err := b.do(req, resource)
+		if err != nil {
+			return Notification{}, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return Notification{}, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			var n Notification
+			err := json.Unmarshal(body, &n)
+			return n, err
+		case http.StatusNoContent:
+			// Poll timed out with nothing to deliver.
+			if err := ctx.Err(); err != nil {
+				return Notification{}, err
+			}
+		default:
+			return Notification{}, fmt.Errorf("service bus receive: %s", resp.Status)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// Package listcache provides a datastore wrapper that caches keys-only
+// listings by prefix, so repeated prefix scans over mostly static data are
+// served from memory.
+//
+// Cached listings are invalidated by writes made through the wrapper and by
+// keys delivered on Options.Feed, which should carry every key changed by
+// other writers (for example, keys read from the storage account's change
+// feed). Without a feed, the wrapper is only coherent when it is the sole
+// writer, or within Options.MaxAge.
+package listcache
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Options configures the cache.
+type Options struct {
+	// MaxAge bounds how long a listing is served from the cache. Zero means
+	// listings live until invalidated.
+	MaxAge time.Duration
+	// MaxPrefixes bounds the number of cached listings. Defaults to 64.
+	MaxPrefixes int
+	// Feed delivers keys changed outside this wrapper.
+	Feed <-chan ds.Key
+	// Clock ages listings against MaxAge. Defaults to the wall clock.
+	Clock clock.Clock
+}
+
+type listing struct {
+	entries []dsq.Entry
+	sizes   map[string]int
+	fetched time.Time
+}
+
+// Datastore caches listings of a child datastore.
+type Datastore struct {
+	child ds.Datastore
+	opts  Options
+
+	mu       sync.Mutex
+	listings map[string]*listing
+	gen      uint64 // bumped on every invalidation
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+
+// New wraps child with a listing cache.
+func New(child ds.Datastore, opts Options) *Datastore {
+	if opts.MaxPrefixes <= 0 {
+		opts.MaxPrefixes = 64
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+	d := &Datastore{
+		child:    child,
+		opts:     opts,
+		listings: make(map[string]*listing),
+		closing:  make(chan struct{}),
+	}
+	if opts.Feed != nil {
+		d.wg.Add(1)
+		go d.follow(opts.Feed)
+	}
+	return d
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.child}
+}
+
+func (d *Datastore) follow(feed <-chan ds.Key) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.closing:
+			return
+		case k, ok := <-feed:
+			if !ok {
+				return
+			}
+			d.Invalidate(k)
+		}
+	}
+}
+
+// cleanPrefix normalizes a query prefix the same way NaiveQueryApply does.
+func cleanPrefix(prefix string) string {
+	if prefix == "" {
+		return "/"
+	}
+	if prefix[0] != '/' {
+		prefix = "/" + prefix
+	}
+	return path.Clean(prefix)
+}
+
+// covers reports whether a listing of prefix would contain key.
+func covers(prefix, key string) bool {
+	return prefix == "/" || strings.HasPrefix(key, prefix+"/")
+}
+
+// Invalidate drops every cached listing that could contain key.
+func (d *Datastore) Invalidate(key ds.Key) {
+	k := key.String()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	for p := range d.listings {
+		if covers(p, k) {
+			delete(d.listings, p)
+		}
+	}
+}
+
+// InvalidateAll drops every cached listing.
+func (d *Datastore) InvalidateAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	d.listings = make(map[string]*listing)
+}
+
+func (d *Datastore) fresh(l *listing) bool {
+	return d.opts.MaxAge == 0 || d.opts.Clock.Now().Sub(l.fetched) < d.opts.MaxAge
+}
+
+// cached returns the cached listing for prefix, if any.
+func (d *Datastore) cached(prefix string) *listing {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	l, ok := d.listings[prefix]
+	if !ok {
+		return nil
+	}
+	if !d.fresh(l) {
+		delete(d.listings, prefix)
+		return nil
+	}
+	return l
+}
+
+// lookup finds a cached listing of an ancestor of key.
+func (d *Datastore) lookup(key ds.Key) *listing {
+	k := key.String()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for p, l := range d.listings {
+		if covers(p, k) && d.fresh(l) {
+			return l
+		}
+	}
+	return nil
+}
+
+// list returns the listing for prefix, fetching and caching it on a miss.
+func (d *Datastore) list(prefix string) ([]dsq.Entry, error) {
+	if l := d.cached(prefix); l != nil {
+		return l.entries, nil
+	}
+
+	d.mu.Lock()
+	gen := d.gen
+	d.mu.Unlock()
+
+	res, err := d.child.Query(dsq.Query{Prefix: prefix, KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listing{
+		entries: entries,
+		sizes:   make(map[string]int, len(entries)),
+		fetched: d.opts.Clock.Now(),
+	}
+	for _, e := range entries {
+		l.sizes[e.Key] = e.Size
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Something changed while listing; the result may already be stale.
+	if d.gen != gen {
+		return entries, nil
+	}
+	if len(d.listings) >= d.opts.MaxPrefixes {
+		for p := range d.listings {
+			delete(d.listings, p)
+			break
+		}
+	}
+	d.listings[prefix] = l
+	return entries, nil
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	err := d.child.Put(key, value)
+	d.Invalidate(key)
+	return err
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	err := d.child.Delete(key)
+	d.Invalidate(key)
+	return err
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	return d.child.Get(key)
+}
+
+// Has implements Datastore.Has. It is answered from a cached listing of an
+// ancestor prefix when there is one.
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	if l := d.lookup(key); l != nil {
+		_, ok := l.sizes[key.String()]
+		return ok, nil
+	}
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	if l := d.lookup(key); l != nil {
+		size, ok := l.sizes[key.String()]
+		if !ok {
+			return -1, ds.ErrNotFound
+		}
+		if size >= 0 {
+			return size, nil
+		}
+	}
+	return d.child.GetSize(key)
+}
+
+// Query implements Datastore.Query. Keys-only queries are served from the
+// listing cache; queries for values go to the child.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	if !q.KeysOnly || q.ReturnExpirations {
+		return d.child.Query(q)
+	}
+	entries, err := d.list(cleanPrefix(q.Prefix))
+	if err != nil {
+		return nil, err
+	}
+	// Copy so orders can't reorder the cached slice.
+	re := make([]dsq.Entry, len(entries))
+	copy(re, entries)
+
+	// The listing is already scoped to the prefix.
+	qNoPrefix := q
+	qNoPrefix.Prefix = ""
+	r := dsq.ResultsWithEntries(q, re)
+	return dsq.NaiveQueryApply(qNoPrefix, r), nil
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	if bds, ok := d.child.(ds.Batching); ok {
+		b, err := bds.Batch()
+		if err != nil {
+			return nil, err
+		}
+		return &batch{d: d, child: b}, nil
+	}
+	return ds.NewBasicBatch(d), nil
+}
+
+type batch struct {
+	d     *Datastore
+	child ds.Batch
+	keys  []ds.Key
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	b.keys = append(b.keys, key)
+	return b.child.Put(key, value)
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	b.keys = append(b.keys, key)
+	return b.child.Delete(key)
+}
+
+func (b *batch) Commit() error {
+	err := b.child.Commit()
+	for _, k := range b.keys {
+		b.d.Invalidate(k)
+	}
+	b.keys = nil
+	return err
+}
+
+// DiskUsage implements the PersistentDatastore interface.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(d.child)
+}
+
+// Close stops following the feed and closes the child.
+func (d *Datastore) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closing)
+	})
+	d.wg.Wait()
+	return d.child.Close()
+}
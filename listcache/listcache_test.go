@@ -0,0 +1,102 @@
+package listcache
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, New(dssync.MutexWrap(ds.NewMapDatastore()), Options{}))
+}
+
+func count(t *testing.T, d ds.Datastore, prefix string) int {
+	t.Helper()
+	res, err := d.Query(dsq.Query{Prefix: prefix, KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestFeedInvalidates(t *testing.T) {
+	child := dssync.MutexWrap(ds.NewMapDatastore())
+	feed := make(chan ds.Key)
+	d := New(child, Options{Feed: feed})
+	defer d.Close()
+
+	child.Put(ds.NewKey("/foo/a"), []byte("a"))
+	if n := count(t, d, "/foo"); n != 1 {
+		t.Fatalf("expected 1 entry, got %d", n)
+	}
+
+	// A write behind the cache's back is not visible...
+	child.Put(ds.NewKey("/foo/b"), []byte("b"))
+	if n := count(t, d, "/foo"); n != 1 {
+		t.Fatalf("expected cached listing, got %d entries", n)
+	}
+	if has, _ := d.Has(ds.NewKey("/foo/b")); has {
+		t.Fatal("expected Has to be answered from the cached listing")
+	}
+
+	// ...until the feed reports it.
+	feed <- ds.NewKey("/foo/b")
+	deadline := time.Now().Add(5 * time.Second)
+	for count(t, d, "/foo") != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("feed did not invalidate listing")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWritesInvalidate(t *testing.T) {
+	d := New(dssync.MutexWrap(ds.NewMapDatastore()), Options{})
+	d.Put(ds.NewKey("/foo/a"), []byte("a"))
+	d.Put(ds.NewKey("/bar/a"), []byte("a"))
+	if n := count(t, d, "/foo"); n != 1 {
+		t.Fatalf("expected 1 entry, got %d", n)
+	}
+	count(t, d, "/bar")
+
+	d.Put(ds.NewKey("/foo/b"), []byte("b"))
+	if _, ok := d.listings["/bar"]; !ok {
+		t.Fatal("unrelated listing should stay cached")
+	}
+	if n := count(t, d, "/foo"); n != 2 {
+		t.Fatalf("expected 2 entries, got %d", n)
+	}
+	size, err := d.GetSize(ds.NewKey("/foo/b"))
+	if err != nil || size != 1 {
+		t.Fatalf("expected size 1, got %d: %v", size, err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	child := ds.NewMapDatastore()
+	c := clock.NewMock(time.Unix(1000, 0))
+	d := New(child, Options{MaxAge: time.Minute, Clock: c})
+	defer d.Close()
+
+	child.Put(ds.NewKey("/foo/a"), []byte("a"))
+	count(t, d, "/foo")
+	child.Put(ds.NewKey("/foo/b"), []byte("b"))
+
+	c.Advance(59 * time.Second)
+	if n := count(t, d, "/foo"); n != 1 {
+		t.Fatalf("expected cached listing, got %d entries", n)
+	}
+	c.Advance(time.Second)
+	if n := count(t, d, "/foo"); n != 2 {
+		t.Fatalf("expected expired listing to be refetched, got %d entries", n)
+	}
+}
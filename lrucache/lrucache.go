@@ -0,0 +1,376 @@
+// Package lrucache provides a datastore wrapper caching a slower child's
+// values in memory, so repeated reads of the same keys, such as a
+// gateway serving popular blocks from blob storage, skip the round trip.
+//
+// Values are kept in a least recently used list bounded by their total
+// size. Keys known to exist, from Has, GetSize or a value too large to
+// cache, are kept in the same list without their values, bounded by a
+// count, so repeated Has calls are answered too. With a NegativeTTL,
+// keys found missing are cached for that long as well, so lookups of
+// missing blocks do not keep reaching the child. Concurrent misses for the
+// same key are collapsed into a single load from the child.
+//
+// The cache only sees writes made through it: values changed in the
+// child by others are served stale until evicted. It suits immutable,
+// content-addressed values best.
+package lrucache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// DefaultMaxBytes bounds the cached values when Options.MaxBytes is
+	// unset.
+	DefaultMaxBytes = 64 << 20
+	// DefaultMaxEntries bounds the cached keys when Options.MaxEntries is
+	// unset.
+	DefaultMaxEntries = 1 << 16
+)
+
+// Options configures the cache.
+type Options struct {
+	// MaxBytes bounds the total size of cached values. Larger values
+	// are not cached, though their presence is.
+	MaxBytes int64
+	// MaxEntries bounds the number of keys cached, with or without
+	// their values, including missing ones.
+	MaxEntries int
+	// NegativeTTL caches keys found missing for this long. A write of
+	// the key through the cache ends it early. Zero disables negative
+	// caching.
+	NegativeTTL time.Duration
+	// Clock expires missing keys. Defaults to the wall clock.
+	Clock clock.Clock
+}
+
+type entry struct {
+	key   string
+	value []byte // nil if only the key's presence is cached
+	size  int    // -1 if unknown
+
+	// missing is set for keys found missing, until expires.
+	missing bool
+	expires time.Time
+}
+
+// Datastore caches a child datastore in memory.
+type Datastore struct {
+	child ds.Datastore
+	opts  Options
+
+	mu      sync.Mutex
+	lru     *list.List // of *entry, most recently used first
+	entries map[string]*list.Element
+	bytes   int64
+	// gen counts writes, so a load racing a write does not cache what
+	// it read from before the write.
+	gen uint64
+
+	loads group
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// New wraps child with an in-memory cache.
+func New(child ds.Datastore, opts Options) *Datastore {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+	return &Datastore{
+		child:   child,
+		opts:    opts,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.child}
+}
+
+// generation returns the write count, to pass to store.
+func (d *Datastore) generation() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.gen
+}
+
+// store caches what a read found of key, unless key was written since
+// gen. A nil value caches only the key's presence, and a negative size
+// leaves the size unknown.
+func (d *Datastore) store(gen uint64, key ds.Key, value []byte, size int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if gen != d.gen {
+		return
+	}
+	d.storeLocked(key.String(), value, size)
+}
+
+func (d *Datastore) storeLocked(k string, value []byte, size int) {
+	if int64(len(value)) > d.opts.MaxBytes {
+		value = nil
+	}
+	if el, ok := d.entries[k]; ok {
+		e := el.Value.(*entry)
+		if e.missing {
+			d.removeLocked(k)
+			d.storeLocked(k, value, size)
+			return
+		}
+		if value == nil && e.value != nil {
+			// A presence check does not drop a cached value.
+			d.lru.MoveToFront(el)
+			return
+		}
+		if size < 0 && value == nil {
+			size = e.size
+		}
+		d.bytes += int64(len(value)) - int64(len(e.value))
+		e.value, e.size = value, size
+		d.lru.MoveToFront(el)
+	} else {
+		d.entries[k] = d.lru.PushFront(&entry{key: k, value: value, size: size})
+		d.bytes += int64(len(value))
+	}
+	d.evictLocked()
+}
+
+func (d *Datastore) evictLocked() {
+	for d.bytes > d.opts.MaxBytes || d.lru.Len() > d.opts.MaxEntries {
+		d.removeLocked(d.lru.Back().Value.(*entry).key)
+	}
+}
+
+// storeMissing caches that key was found missing, unless key was written
+// since gen or negative caching is off.
+func (d *Datastore) storeMissing(gen uint64, key ds.Key) {
+	if d.opts.NegativeTTL <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if gen != d.gen {
+		return
+	}
+	d.storeMissingLocked(key.String())
+}
+
+func (d *Datastore) storeMissingLocked(k string) {
+	d.removeLocked(k)
+	d.entries[k] = d.lru.PushFront(&entry{
+		key:     k,
+		size:    -1,
+		missing: true,
+		expires: d.opts.Clock.Now().Add(d.opts.NegativeTTL),
+	})
+	d.evictLocked()
+}
+
+func (d *Datastore) removeLocked(k string) {
+	el, ok := d.entries[k]
+	if !ok {
+		return
+	}
+	d.lru.Remove(el)
+	delete(d.entries, k)
+	d.bytes -= int64(len(el.Value.(*entry).value))
+}
+
+// written records a write of key. A successful Put caches a copy of
+// value, as the caller may reuse it, and a successful Delete caches the
+// key as missing. A failed write may or may not have reached the child,
+// so it only invalidates.
+func (d *Datastore) written(key ds.Key, value []byte, put, ok bool) {
+	if put && ok {
+		value = append([]byte{}, value...)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	d.removeLocked(key.String())
+	switch {
+	case !ok:
+	case put:
+		d.storeLocked(key.String(), value, len(value))
+	case d.opts.NegativeTTL > 0:
+		d.storeMissingLocked(key.String())
+	}
+}
+
+// cached returns the cache entry of key, marking it recently used. An
+// expired missing entry is dropped.
+func (d *Datastore) cached(key ds.Key) (entry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	el, ok := d.entries[key.String()]
+	if !ok {
+		return entry{}, false
+	}
+	e := el.Value.(*entry)
+	if e.missing && !d.opts.Clock.Now().Before(e.expires) {
+		d.removeLocked(e.key)
+		return entry{}, false
+	}
+	d.lru.MoveToFront(el)
+	return *e, true
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	if e, ok := d.cached(key); ok {
+		if e.missing {
+			return nil, ds.ErrNotFound
+		}
+		if e.value != nil {
+			return e.value, nil
+		}
+	}
+	return d.loads.do(key.String(), func() ([]byte, error) {
+		gen := d.generation()
+		value, err := d.child.Get(key)
+		switch err {
+		case nil:
+			d.store(gen, key, value, len(value))
+		case ds.ErrNotFound:
+			d.storeMissing(gen, key)
+		}
+		return value, err
+	})
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	if e, ok := d.cached(key); ok {
+		return !e.missing, nil
+	}
+	gen := d.generation()
+	exists, err := d.child.Has(key)
+	switch {
+	case err != nil:
+	case exists:
+		d.store(gen, key, nil, -1)
+	default:
+		d.storeMissing(gen, key)
+	}
+	return exists, err
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	if e, ok := d.cached(key); ok {
+		if e.missing {
+			return -1, ds.ErrNotFound
+		}
+		if e.size >= 0 {
+			return e.size, nil
+		}
+	}
+	gen := d.generation()
+	size, err := d.child.GetSize(key)
+	switch err {
+	case nil:
+		d.store(gen, key, nil, size)
+	case ds.ErrNotFound:
+		d.storeMissing(gen, key)
+	}
+	return size, err
+}
+
+// Put implements Datastore.Put. The child is written first so a failed
+// write never leaves the cache ahead of the backend.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	err := d.child.Put(key, value)
+	d.written(key, value, true, err == nil)
+	return err
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	err := d.child.Delete(key)
+	d.written(key, nil, false, err == nil)
+	return err
+}
+
+// Query implements Datastore.Query. Queries always go to the child.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	return d.child.Query(q)
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// DiskUsage implements the PersistentDatastore interface by reporting the
+// child's usage.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(d.child)
+}
+
+// CacheSize returns the bytes of values currently cached.
+func (d *Datastore) CacheSize() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.bytes
+}
+
+// Close closes the child.
+func (d *Datastore) Close() error {
+	return d.child.Close()
+}
+
+// group collapses concurrent loads of the same key.
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+func (g *group) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.val, c.err
+}
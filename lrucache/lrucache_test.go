@@ -0,0 +1,185 @@
+package lrucache
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	"github.com/ipfs/go-datastore/failstore"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, New(ds.NewMapDatastore(), Options{}))
+}
+
+func TestSuiteNegative(t *testing.T) {
+	dstest.SubtestAll(t, New(ds.NewMapDatastore(), Options{NegativeTTL: time.Minute}))
+}
+
+func TestEviction(t *testing.T) {
+	d := New(ds.NewMapDatastore(), Options{MaxBytes: 300})
+	for _, k := range []string{"/a", "/b", "/c"} {
+		d.Put(ds.NewKey(k), make([]byte, 100))
+	}
+	d.Get(ds.NewKey("/a")) // /b is now least recently used
+	d.Put(ds.NewKey("/d"), make([]byte, 100))
+
+	if d.CacheSize() != 300 {
+		t.Fatalf("cache holds %d bytes", d.CacheSize())
+	}
+	if _, ok := d.cached(ds.NewKey("/b")); ok {
+		t.Fatal("least recently used entry not evicted")
+	}
+	if _, ok := d.cached(ds.NewKey("/a")); !ok {
+		t.Fatal("recently used entry evicted")
+	}
+
+	// A value over the bound is not cached, but its presence is.
+	big := ds.NewKey("/big")
+	d.Put(big, make([]byte, 301))
+	if e, ok := d.cached(big); !ok || e.value != nil || e.size != 301 {
+		t.Fatalf("oversized value cached as %v, %v", e.value != nil, ok)
+	}
+
+	d = New(ds.NewMapDatastore(), Options{MaxEntries: 2})
+	for _, k := range []string{"/a", "/b", "/c"} {
+		d.Put(ds.NewKey(k), []byte("v"))
+	}
+	if _, ok := d.cached(ds.NewKey("/a")); ok {
+		t.Fatal("entry over the count bound not evicted")
+	}
+}
+
+func TestReadsServedFromCache(t *testing.T) {
+	var reads int32
+	offline := int32(0)
+	child := failstore.NewFailstore(ds.NewMapDatastore(), func(op string) error {
+		if atomic.LoadInt32(&offline) == 1 {
+			return errors.New("offline")
+		}
+		if op != "put" && op != "delete" {
+			atomic.AddInt32(&reads, 1)
+		}
+		return nil
+	})
+	child.Put(ds.NewKey("/present"), []byte("value"))
+	d := New(child, Options{})
+
+	k := ds.NewKey("/present")
+	if ok, err := d.Has(k); err != nil || !ok {
+		t.Fatalf("has: %v, %v", ok, err)
+	}
+	if n, err := d.GetSize(k); err != nil || n != 5 {
+		t.Fatalf("size: %d, %v", n, err)
+	}
+	if v, err := d.Get(k); err != nil || string(v) != "value" {
+		t.Fatalf("get: %q, %v", v, err)
+	}
+	if reads != 3 {
+		t.Fatalf("%d reads of the child", reads)
+	}
+
+	atomic.StoreInt32(&offline, 1)
+	if ok, err := d.Has(k); err != nil || !ok {
+		t.Fatalf("cached has: %v, %v", ok, err)
+	}
+	if v, err := d.Get(k); err != nil || string(v) != "value" {
+		t.Fatalf("cached get: %q, %v", v, err)
+	}
+	// Misses are not cached.
+	if _, err := d.Has(ds.NewKey("/missing")); err == nil {
+		t.Fatal("miss answered from the cache")
+	}
+	// A failed write invalidates.
+	if err := d.Put(k, []byte("new")); err == nil {
+		t.Fatal("put succeeded offline")
+	}
+	if _, err := d.Get(k); err == nil {
+		t.Fatal("value of a failed put's key still cached")
+	}
+}
+
+func TestPutCopiesValue(t *testing.T) {
+	d := New(ds.NewMapDatastore(), Options{})
+	k := ds.NewKey("/k")
+	buf := []byte("value")
+	d.Put(k, buf)
+	buf[0] = 'X'
+	if e, _ := d.cached(k); string(e.value) != "value" {
+		t.Fatalf("cached value changed to %q with the caller's buffer", e.value)
+	}
+}
+
+func TestStaleLoadNotCached(t *testing.T) {
+	d := New(ds.NewMapDatastore(), Options{})
+	k := ds.NewKey("/k")
+	gen := d.generation()
+	d.Put(k, []byte("new"))
+	d.store(gen, k, []byte("old"), 3)
+	if v, _ := d.Get(k); string(v) != "new" {
+		t.Fatalf("load from before a put cached: %q", v)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	var reads int32
+	child := ds.NewMapDatastore()
+	counted := failstore.NewFailstore(child, func(op string) error {
+		if op == "get" || op == "has" || op == "getsize" {
+			atomic.AddInt32(&reads, 1)
+		}
+		return nil
+	})
+	clk := clock.NewMock(time.Unix(0, 0))
+	d := New(counted, Options{NegativeTTL: time.Minute, Clock: clk})
+
+	k := ds.NewKey("/missing")
+	for i := 0; i < 3; i++ {
+		if _, err := d.Get(k); err != ds.ErrNotFound {
+			t.Fatalf("get: %v", err)
+		}
+		if ok, err := d.Has(k); err != nil || ok {
+			t.Fatalf("has: %v, %v", ok, err)
+		}
+		if _, err := d.GetSize(k); err != ds.ErrNotFound {
+			t.Fatalf("size: %v", err)
+		}
+	}
+	if reads != 1 {
+		t.Fatalf("%d reads of the child for a missing key", reads)
+	}
+
+	// The miss expires.
+	clk.Advance(time.Minute)
+	d.Has(k)
+	if reads != 2 {
+		t.Fatalf("expired miss not reread: %d reads", reads)
+	}
+
+	// A put through the cache ends it at once.
+	if err := d.Put(k, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(k); err != nil || string(v) != "v" {
+		t.Fatalf("get after put: %q, %v", v, err)
+	}
+
+	// A delete caches the key as missing.
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Has(k); err != nil || ok || reads != 2 {
+		t.Fatalf("has after delete: %v, %v, %d reads", ok, err, reads)
+	}
+
+	// Misses written by others are seen once the TTL is up.
+	child.Put(k, []byte("w"))
+	clk.Advance(time.Minute)
+	if v, err := d.Get(k); err != nil || string(v) != "w" {
+		t.Fatalf("get after expiry: %q, %v", v, err)
+	}
+}
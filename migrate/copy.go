@@ -0,0 +1,166 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// DefaultWorkers is the number of keys Migrate copies at once by default.
+const DefaultWorkers = 16
+
+// Options configures an offline migration.
+type Options struct {
+	// Prefix restricts the migration to keys under it.
+	Prefix string
+	// Workers is the number of keys copied in parallel. Zero means
+	// DefaultWorkers.
+	Workers int
+	// Resume skips keys the target already holds with the source's size,
+	// so an interrupted migration can be run again without copying
+	// everything again. Values are not compared; run verify.Compare
+	// afterwards to be sure.
+	Resume bool
+	// Progress, if set, is called after each key with the totals so far.
+	// Calls are made one at a time.
+	Progress func(Stats)
+}
+
+// Stats counts the keys a migration has gone through.
+type Stats struct {
+	// Copied keys were written to the target, and Bytes is the size of
+	// their values.
+	Copied int
+	Bytes  int64
+	// Skipped keys were already in the target, with Resume, or were
+	// deleted from the source while it was being listed.
+	Skipped int
+}
+
+// Migrate copies every key of source to target, for moving a datastore
+// that is not in use onto another backend; a datastore still being written
+// is migrated with a Live one instead. Keys are listed from the source
+// and copied by parallel workers. The first failure cancels the rest and
+// is returned, with the totals of the keys done by then.
+func Migrate(ctx context.Context, source, target ds.Datastore, opts Options) (Stats, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	res, err := source.Query(dsq.Query{Prefix: opts.Prefix, KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		return Stats{}, fmt.Errorf("migrate: listing source: %w", err)
+	}
+	defer res.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		stats   Stats
+		failure error
+	)
+	// finish records the outcome of a key, cancelling the migration on
+	// its first failure.
+	finish := func(copied bool, size int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err != nil:
+			if failure == nil {
+				failure = err
+				cancel()
+			}
+			return
+		case copied:
+			stats.Copied++
+			stats.Bytes += int64(size)
+		default:
+			stats.Skipped++
+		}
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+	}
+
+	entries := make(chan dsq.Entry)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				copied, size, err := copyEntry(source, target, e, opts.Resume)
+				finish(copied, size, err)
+			}
+		}()
+	}
+
+	var listErr error
+list:
+	for {
+		r, ok := res.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			listErr = fmt.Errorf("migrate: listing source: %w", r.Error)
+			break
+		}
+		select {
+		case entries <- r.Entry:
+		case <-ctx.Done():
+			break list
+		}
+	}
+	close(entries)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case failure != nil:
+		return stats, failure
+	case listErr != nil:
+		return stats, listErr
+	}
+	return stats, ctx.Err()
+}
+
+// copyEntry copies the key of a listed entry unless resuming and the
+// target has it already, and reports whether it did and the value's size.
+func copyEntry(source, target ds.Datastore, e dsq.Entry, resume bool) (bool, int, error) {
+	key := ds.RawKey(e.Key)
+	if resume {
+		size := e.Size
+		if size < 0 {
+			var err error
+			if size, err = source.GetSize(key); err == ds.ErrNotFound {
+				return false, 0, nil
+			} else if err != nil {
+				return false, 0, fmt.Errorf("migrate: sizing %s: %w", key, err)
+			}
+		}
+		switch have, err := target.GetSize(key); {
+		case err == nil && have == size:
+			return false, 0, nil
+		case err != nil && err != ds.ErrNotFound:
+			return false, 0, fmt.Errorf("migrate: checking %s: %w", key, err)
+		}
+	}
+	value, err := source.Get(key)
+	switch {
+	case err == ds.ErrNotFound:
+		return false, 0, nil
+	case err != nil:
+		return false, 0, fmt.Errorf("migrate: reading %s: %w", key, err)
+	}
+	if err := target.Put(key, value); err != nil {
+		return false, 0, fmt.Errorf("migrate: writing %s: %w", key, err)
+	}
+	return true, len(value), nil
+}
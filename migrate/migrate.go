@@ -0,0 +1,310 @@
+// Package migrate moves a live datastore onto another backend without
+// downtime.
+//
+// A migration wraps the source and target in a Live datastore and goes
+// through three phases:
+//
+//  1. Dual-write. Reads are served by the source; every write goes to the
+//     source and then the target. Copy runs the bulk copy of existing keys
+//     meanwhile.
+//  2. Switched. Switch atomically moves reads to the target. Writes still go
+//     to both, target first, so Rollback can return to the source.
+//  3. Finished. Finish stops writing to the source, closing the rollback
+//     window.
+//
+// A write that fails on the secondary datastore after succeeding on the
+// primary is not reported to the caller; the key is remembered and copied
+// again before the next Switch, Rollback or Finish.
+//
+// A datastore that is not in use needs none of this: Migrate copies it
+// over in one pass.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-datastore/verify"
+	"go.uber.org/multierr"
+)
+
+// Phase is the stage a migration is in.
+type Phase int
+
+const (
+	// DualWrite serves reads from the source and writes to both.
+	DualWrite Phase = iota
+	// Switched serves reads from the target and writes to both.
+	Switched
+	// Finished serves reads and writes from the target only.
+	Finished
+)
+
+func (p Phase) String() string {
+	switch p {
+	case DualWrite:
+		return "dual-write"
+	case Switched:
+		return "switched"
+	case Finished:
+		return "finished"
+	default:
+		return fmt.Sprintf("Phase(%d)", int(p))
+	}
+}
+
+// ErrPhase is returned when an operation is not allowed in the current
+// phase.
+var ErrPhase = errors.New("migrate: operation not allowed in this phase")
+
+const stripes = 256
+
+// Live is a datastore being migrated from a source to a target.
+type Live struct {
+	source ds.Datastore
+	target ds.Datastore
+
+	// mu guards phase. Writes hold it for reading so that a phase change
+	// waits for in-flight writes.
+	mu    sync.RWMutex
+	phase Phase
+
+	// keyLocks serialize writes to a key with the bulk copy of that key,
+	// so the copy never overwrites a newer value in the target.
+	keyLocks [stripes]sync.Mutex
+
+	pendingMu sync.Mutex
+	pending   map[ds.Key]struct{}
+}
+
+var _ ds.Datastore = (*Live)(nil)
+var _ ds.Batching = (*Live)(nil)
+
+// New starts a migration from source to target in the DualWrite phase.
+func New(source, target ds.Datastore) *Live {
+	return &Live{source: source, target: target, pending: make(map[ds.Key]struct{})}
+}
+
+// Phase returns the current phase.
+func (l *Live) Phase() Phase {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.phase
+}
+
+// stores returns the datastore serving reads, and the one receiving
+// secondary writes, which is nil once finished. Callers hold mu.
+func (l *Live) stores() (primary, secondary ds.Datastore) {
+	switch l.phase {
+	case DualWrite:
+		return l.source, l.target
+	case Switched:
+		return l.target, l.source
+	default:
+		return l.target, nil
+	}
+}
+
+func (l *Live) keyLock(key ds.Key) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(key.Bytes())
+	return &l.keyLocks[h.Sum32()%stripes]
+}
+
+func (l *Live) write(key ds.Key, op func(ds.Datastore) error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	primary, secondary := l.stores()
+
+	lk := l.keyLock(key)
+	lk.Lock()
+	defer lk.Unlock()
+
+	if err := op(primary); err != nil {
+		return err
+	}
+	if secondary != nil {
+		if err := op(secondary); err != nil {
+			l.pendingMu.Lock()
+			l.pending[key] = struct{}{}
+			l.pendingMu.Unlock()
+		}
+	}
+	return nil
+}
+
+// Put implements Datastore.Put
+func (l *Live) Put(key ds.Key, value []byte) error {
+	return l.write(key, func(d ds.Datastore) error { return d.Put(key, value) })
+}
+
+// Delete implements Datastore.Delete
+func (l *Live) Delete(key ds.Key) error {
+	return l.write(key, func(d ds.Datastore) error { return d.Delete(key) })
+}
+
+func (l *Live) reader() ds.Datastore {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	primary, _ := l.stores()
+	return primary
+}
+
+// Get implements Datastore.Get
+func (l *Live) Get(key ds.Key) ([]byte, error) {
+	return l.reader().Get(key)
+}
+
+// Has implements Datastore.Has
+func (l *Live) Has(key ds.Key) (bool, error) {
+	return l.reader().Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (l *Live) GetSize(key ds.Key) (int, error) {
+	return l.reader().GetSize(key)
+}
+
+// Query implements Datastore.Query
+func (l *Live) Query(q dsq.Query) (dsq.Results, error) {
+	return l.reader().Query(q)
+}
+
+// Sync implements Datastore.Sync
+func (l *Live) Sync(prefix ds.Key) error {
+	return multierr.Append(l.source.Sync(prefix), l.target.Sync(prefix))
+}
+
+// Batch implements Batching.Batch
+func (l *Live) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(l), nil
+}
+
+// Close closes both datastores.
+func (l *Live) Close() error {
+	return multierr.Append(l.source.Close(), l.target.Close())
+}
+
+// copyKey copies one key from src to dst under the key's lock, deleting it
+// from dst if src no longer has it.
+func (l *Live) copyKey(src, dst ds.Datastore, key ds.Key) error {
+	lk := l.keyLock(key)
+	lk.Lock()
+	defer lk.Unlock()
+
+	value, err := src.Get(key)
+	switch err {
+	case nil:
+		return dst.Put(key, value)
+	case ds.ErrNotFound:
+		return dst.Delete(key)
+	default:
+		return err
+	}
+}
+
+// Copy copies every key of the source to the target and returns how many
+// were copied. It may only run in the DualWrite phase, and may be run
+// again after an interruption.
+func (l *Live) Copy(ctx context.Context) (int, error) {
+	if l.Phase() != DualWrite {
+		return 0, ErrPhase
+	}
+	res, err := l.source.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	n := 0
+	for r := range res.Next() {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if r.Error != nil {
+			return n, r.Error
+		}
+		if err := l.copyLive(ds.RawKey(r.Key)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// copyLive copies a key from the source while still in the DualWrite
+// phase.
+func (l *Live) copyLive(key ds.Key) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.phase != DualWrite {
+		return ErrPhase
+	}
+	if err := l.copyKey(l.source, l.target, key); err != nil {
+		return fmt.Errorf("migrate: copying %s: %w", key, err)
+	}
+	return nil
+}
+
+// repair re-copies keys whose secondary write failed. Callers hold mu for
+// writing.
+func (l *Live) repair() error {
+	primary, secondary := l.stores()
+	l.pendingMu.Lock()
+	defer l.pendingMu.Unlock()
+	for key := range l.pending {
+		if err := l.copyKey(primary, secondary, key); err != nil {
+			return fmt.Errorf("migrate: repairing %s: %w", key, err)
+		}
+		delete(l.pending, key)
+	}
+	return nil
+}
+
+// Pending returns the number of keys whose secondary write failed and
+// that are yet to be repaired.
+func (l *Live) Pending() int {
+	l.pendingMu.Lock()
+	defer l.pendingMu.Unlock()
+	return len(l.pending)
+}
+
+// Verify compares the target against the source.
+func (l *Live) Verify(opts verify.Options) (*verify.Report, error) {
+	return verify.Compare(l.source, l.target, opts)
+}
+
+func (l *Live) transition(from, to Phase) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.phase != from {
+		return ErrPhase
+	}
+	if err := l.repair(); err != nil {
+		return err
+	}
+	l.phase = to
+	return nil
+}
+
+// Switch moves reads to the target. Writes keep going to the source until
+// Finish, so the switch can be rolled back.
+func (l *Live) Switch() error {
+	return l.transition(DualWrite, Switched)
+}
+
+// Rollback moves reads back to the source after a Switch.
+func (l *Live) Rollback() error {
+	return l.transition(Switched, DualWrite)
+}
+
+// Finish stops writing to the source. The migration can no longer be
+// rolled back.
+func (l *Live) Finish() error {
+	return l.transition(Switched, Finished)
+}
@@ -0,0 +1,198 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/failstore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+	"github.com/ipfs/go-datastore/verify"
+)
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, New(ds.NewMapDatastore(), ds.NewMapDatastore()))
+}
+
+func TestMigration(t *testing.T) {
+	source := dssync.MutexWrap(ds.NewMapDatastore())
+	target := dssync.MutexWrap(ds.NewMapDatastore())
+	for i := 0; i < 100; i++ {
+		source.Put(ds.NewKey(string(rune('a'+i%26))).ChildString(string(rune('0'+i/26))), []byte{byte(i)})
+	}
+
+	l := New(source, target)
+
+	// Keep writing while the bulk copy runs.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			k := ds.NewKey("/live").ChildString(string(rune('a' + i%10)))
+			if i%3 == 0 {
+				l.Delete(k)
+			} else {
+				l.Put(k, []byte{byte(i)})
+			}
+		}
+	}()
+	if _, err := l.Copy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	rep, err := l.Verify(verify.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Consistent() {
+		t.Fatalf("inconsistent after copy: %+v", rep)
+	}
+
+	if err := l.Switch(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Copy(context.Background()); err != ErrPhase {
+		t.Fatalf("expected ErrPhase copying after the switch, got %v", err)
+	}
+
+	k := ds.NewKey("/after-switch")
+	if err := l.Put(k, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := source.Has(k); !has {
+		t.Fatal("writes must reach the source until finished")
+	}
+
+	if err := l.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if l.Phase() != DualWrite {
+		t.Fatalf("phase %s after rollback", l.Phase())
+	}
+	if err := l.Switch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Rollback(); err != ErrPhase {
+		t.Fatalf("expected ErrPhase rolling back a finished migration, got %v", err)
+	}
+
+	k = ds.NewKey("/after-finish")
+	if err := l.Put(k, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := source.Has(k); has {
+		t.Fatal("finished migration wrote to the source")
+	}
+	if v, err := l.Get(k); err != nil || string(v) != "v" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+}
+
+func TestRepairFailedSecondaryWrites(t *testing.T) {
+	source := ds.NewMapDatastore()
+	failing := true
+	target := failstore.NewFailstore(ds.NewMapDatastore(), func(op string) error {
+		if failing && op == "put" {
+			return errors.New("target unavailable")
+		}
+		return nil
+	})
+	l := New(source, target)
+
+	k := ds.NewKey("/a")
+	if err := l.Put(k, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if l.Pending() != 1 {
+		t.Fatalf("%d pending keys", l.Pending())
+	}
+	if err := l.Switch(); err == nil {
+		t.Fatal("switch must fail while the target cannot be repaired")
+	}
+
+	failing = false
+	if err := l.Switch(); err != nil {
+		t.Fatal(err)
+	}
+	if l.Pending() != 0 {
+		t.Fatalf("%d pending keys after repair", l.Pending())
+	}
+	if v, err := l.Get(k); err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	source := dssync.MutexWrap(ds.NewMapDatastore())
+	for i := 0; i < 100; i++ {
+		source.Put(ds.NewKey("/k").ChildString(string(rune('a'+i%26))+string(rune('a'+i/26))), []byte{byte(i), byte(i)})
+	}
+	source.Put(ds.NewKey("/other"), []byte("x"))
+
+	// The target fails after 40 puts, as an interrupted migration would.
+	var mu sync.Mutex
+	puts := 0
+	target := failstore.NewFailstore(dssync.MutexWrap(ds.NewMapDatastore()), func(op string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if op != "put" {
+			return nil
+		}
+		if puts++; puts > 40 {
+			return errors.New("target unavailable")
+		}
+		return nil
+	})
+	opts := Options{Prefix: "/k", Workers: 4, Resume: true}
+	stats, err := Migrate(context.Background(), source, target, opts)
+	if err == nil {
+		t.Fatal("expected the failing target's error")
+	}
+	if stats.Copied > 40 {
+		t.Fatalf("copied %d keys with 40 puts", stats.Copied)
+	}
+
+	mu.Lock()
+	puts = -1000
+	mu.Unlock()
+	var last Stats
+	opts.Progress = func(s Stats) { last = s }
+	stats, err = Migrate(context.Background(), source, target, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied+stats.Skipped != 100 || stats.Skipped < 40 || stats.Bytes != int64(2*stats.Copied) {
+		t.Fatalf("resumed with %+v", stats)
+	}
+	if last != stats {
+		t.Fatalf("last progress %+v, stats %+v", last, stats)
+	}
+	rep, err := verify.Compare(source, target, verify.Options{Prefix: "/k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Consistent() {
+		t.Fatalf("inconsistent after migrating: %+v", rep)
+	}
+	if has, _ := target.Has(ds.NewKey("/other")); has {
+		t.Fatal("migrated a key outside the prefix")
+	}
+}
+
+func TestMigrateCancel(t *testing.T) {
+	source := ds.NewMapDatastore()
+	source.Put(ds.NewKey("/a"), []byte("1"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Migrate(ctx, source, ds.NewMapDatastore(), Options{}); err != context.Canceled {
+		t.Fatalf("got %v", err)
+	}
+}
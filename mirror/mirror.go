@@ -0,0 +1,281 @@
+// Package mirror provides a datastore wrapper that replays a sample of
+// reads against a candidate backend, such as a new account, SDK or codec,
+// and compares what it returns with the primary, so the candidate can be
+// validated on production traffic before a cutover.
+//
+// The primary serves every operation. Sampled reads are replayed on the
+// candidate in the background, after the primary has answered, so the
+// candidate never adds latency or errors to the caller. Writes only reach
+// the primary: keeping the candidate populated is left to the caller, for
+// example with the migrate package's dual writes.
+package mirror
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Options configures the mirror.
+type Options struct {
+	// SampleRate is the fraction of reads replayed, between 0 and 1.
+	SampleRate float64
+	// Queue bounds the reads waiting to be replayed; reads sampled while
+	// it is full are counted as dropped. Defaults to 1024.
+	Queue int
+	// Workers is the number of replays run at once. Defaults to 4.
+	Workers int
+	// OnDivergence, if set, is called from a replay worker with each
+	// divergence found.
+	OnDivergence func(Divergence)
+}
+
+// Divergence describes a read the candidate answered differently.
+type Divergence struct {
+	Op  string
+	Key ds.Key
+	// Primary and Candidate describe each side's result.
+	Primary   string
+	Candidate string
+}
+
+// Metrics counts the mirror's work so far.
+type Metrics struct {
+	Sampled  int64
+	Dropped  int64
+	Matched  int64
+	Diverged int64
+	// CandidateErrors counts replays the candidate failed outright, other
+	// than by reporting a key missing.
+	CandidateErrors int64
+	// PrimaryLatency and CandidateLatency total the time each side spent
+	// on the replayed reads.
+	PrimaryLatency   time.Duration
+	CandidateLatency time.Duration
+}
+
+// outcome is one side's answer to a read.
+type outcome struct {
+	value   []byte
+	exists  bool
+	size    int
+	err     error
+	latency time.Duration
+}
+
+type replay struct {
+	op      string
+	key     ds.Key
+	primary outcome
+}
+
+// Datastore serves reads from a primary and replays a sample on a
+// candidate.
+type Datastore struct {
+	primary   ds.Datastore
+	candidate ds.Datastore
+	opts      Options
+
+	queue chan replay
+	stop  chan struct{}
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	metrics Metrics
+	rand    *rand.Rand
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// New wraps primary, replaying sampled reads on candidate.
+func New(primary, candidate ds.Datastore, opts Options) *Datastore {
+	if opts.Queue <= 0 {
+		opts.Queue = 1024
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	d := &Datastore{
+		primary:   primary,
+		candidate: candidate,
+		opts:      opts,
+		queue:     make(chan replay, opts.Queue),
+		stop:      make(chan struct{}),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	d.wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+// Metrics returns a snapshot of the counters.
+func (d *Datastore) Metrics() Metrics {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.metrics
+}
+
+func (d *Datastore) sample(op string, key ds.Key, primary outcome) {
+	d.mu.Lock()
+	sampled := d.rand.Float64() < d.opts.SampleRate
+	if sampled {
+		d.metrics.Sampled++
+	}
+	d.mu.Unlock()
+	if !sampled {
+		return
+	}
+
+	select {
+	case d.queue <- replay{op: op, key: key, primary: primary}:
+	default:
+		d.mu.Lock()
+		d.metrics.Dropped++
+		d.mu.Unlock()
+	}
+}
+
+func (d *Datastore) worker() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case r := <-d.queue:
+			d.replay(r)
+		}
+	}
+}
+
+func (d *Datastore) replay(r replay) {
+	var got outcome
+	start := time.Now()
+	switch r.op {
+	case "get":
+		got.value, got.err = d.candidate.Get(r.key)
+	case "has":
+		got.exists, got.err = d.candidate.Has(r.key)
+	case "getsize":
+		got.size, got.err = d.candidate.GetSize(r.key)
+	}
+	got.latency = time.Since(start)
+
+	want, have := describe(r.op, r.primary), describe(r.op, got)
+	same := want == have
+	if same && r.op == "get" && r.primary.err == nil {
+		same = bytes.Equal(got.value, r.primary.value)
+	}
+
+	d.mu.Lock()
+	d.metrics.PrimaryLatency += r.primary.latency
+	d.metrics.CandidateLatency += got.latency
+	if got.err != nil && got.err != ds.ErrNotFound {
+		d.metrics.CandidateErrors++
+	}
+	if same {
+		d.metrics.Matched++
+	} else {
+		d.metrics.Diverged++
+	}
+	d.mu.Unlock()
+
+	if !same && d.opts.OnDivergence != nil {
+		d.opts.OnDivergence(Divergence{
+			Op:        r.op,
+			Key:       r.key,
+			Primary:   want,
+			Candidate: have,
+		})
+	}
+}
+
+// describe summarizes an outcome for comparison and reporting. Values are
+// compared separately so they are not copied into reports.
+func describe(op string, o outcome) string {
+	if o.err == ds.ErrNotFound {
+		return "not found"
+	}
+	if o.err != nil {
+		return "error: " + o.err.Error()
+	}
+	switch op {
+	case "has":
+		if o.exists {
+			return "exists"
+		}
+		return "missing"
+	case "getsize":
+		return "size " + strconv.Itoa(o.size)
+	}
+	return "value of " + strconv.Itoa(len(o.value)) + " bytes"
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	start := time.Now()
+	value, err := d.primary.Get(key)
+	d.sample("get", key, outcome{value: value, err: err, latency: time.Since(start)})
+	return value, err
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	start := time.Now()
+	exists, err := d.primary.Has(key)
+	d.sample("has", key, outcome{exists: exists, err: err, latency: time.Since(start)})
+	return exists, err
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	start := time.Now()
+	size, err := d.primary.GetSize(key)
+	d.sample("getsize", key, outcome{size: size, err: err, latency: time.Since(start)})
+	return size, err
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.primary.Put(key, value)
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	return d.primary.Delete(key)
+}
+
+// Query implements Datastore.Query. Queries are not mirrored.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	return d.primary.Query(q)
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.primary.Sync(prefix)
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.primary}
+}
+
+// Close stops the replay workers, dropping queued replays, and closes the
+// primary. The candidate is owned by the caller.
+func (d *Datastore) Close() error {
+	close(d.stop)
+	d.wg.Wait()
+	return d.primary.Close()
+}
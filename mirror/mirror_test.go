@@ -0,0 +1,82 @@
+package mirror
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	d := New(ds.NewMapDatastore(), dssync.MutexWrap(ds.NewMapDatastore()), Options{SampleRate: 1})
+	defer d.Close()
+	dstest.SubtestAll(t, d)
+}
+
+func TestDivergence(t *testing.T) {
+	primary := ds.NewMapDatastore()
+	candidate := dssync.MutexWrap(ds.NewMapDatastore())
+	for _, k := range []string{"/same", "/changed"} {
+		primary.Put(ds.NewKey(k), []byte("v1"))
+		candidate.Put(ds.NewKey(k), []byte("v1"))
+	}
+	candidate.Put(ds.NewKey("/changed"), []byte("v2"))
+	primary.Put(ds.NewKey("/unmigrated"), []byte("v1"))
+
+	found := make(chan Divergence, 10)
+	d := New(primary, candidate, Options{
+		SampleRate:   1,
+		OnDivergence: func(div Divergence) { found <- div },
+	})
+	defer d.Close()
+
+	for _, k := range []string{"/same", "/changed", "/unmigrated", "/absent"} {
+		if _, err := d.Get(ds.NewKey(k)); err != nil && err != ds.ErrNotFound {
+			t.Fatal(err)
+		}
+	}
+	d.Has(ds.NewKey("/unmigrated"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m := d.Metrics()
+		if m.Matched+m.Diverged == 5 {
+			if m.Matched != 2 || m.Diverged != 3 || m.Sampled != 5 {
+				t.Fatalf("unexpected metrics %+v", m)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replays did not finish: %+v", d.Metrics())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	div := map[string]Divergence{}
+	for i := 0; i < 3; i++ {
+		v := <-found
+		div[v.Op+v.Key.String()] = v
+	}
+	if v := div["get/unmigrated"]; v.Candidate != "not found" {
+		t.Fatalf("unexpected divergence %+v", v)
+	}
+	if v := div["has/unmigrated"]; v.Primary != "exists" || v.Candidate != "missing" {
+		t.Fatalf("unexpected divergence %+v", v)
+	}
+	if _, ok := div["get/changed"]; !ok {
+		t.Fatal("changed value not reported")
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	d := New(ds.NewMapDatastore(), ds.NewMapDatastore(), Options{SampleRate: 0})
+	defer d.Close()
+	for i := 0; i < 100; i++ {
+		d.Has(ds.NewKey("/a"))
+	}
+	if m := d.Metrics(); m.Sampled != 0 {
+		t.Fatalf("sampled %d reads at rate 0", m.Sampled)
+	}
+}
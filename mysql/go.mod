@@ -0,0 +1,15 @@
+module github.com/ipfs/go-datastore/mysql
+
+go 1.21
+
+replace github.com/ipfs/go-datastore => ../
+
+require (
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/ipfs/go-datastore v0.4.4
+)
+
+require (
+	github.com/google/uuid v1.1.1 // indirect
+	github.com/jbenet/goprocess v0.1.4 // indirect
+)
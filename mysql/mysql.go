@@ -0,0 +1,386 @@
+// Package mysql implements a Datastore over a MySQL (InnoDB) table. It
+// mirrors the postgres package for shops standardized on MySQL.
+//
+// Each key is a row:
+//
+//   `key`   VARBINARY(n) PRIMARY KEY
+//   `value` LONGBLOB NOT NULL
+//   size    INT NOT NULL
+//   expiry  BIGINT NULL -- unix milliseconds
+//
+// Prefix queries use LIKE 'prefix/%', which InnoDB serves as a range scan
+// over the primary key. The package uses database/sql and does not import a
+// driver; callers open the *sql.DB with the driver of their choice.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Schema parameterizes the table layout.
+type Schema struct {
+	// Table is the table name.
+	Table string
+	// MaxKeyLength is the key column width in bytes. Defaults to 1024;
+	// InnoDB allows at most 3072.
+	MaxKeyLength int
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Datastore stores keys as rows of a table.
+type Datastore struct {
+	db    *sql.DB
+	table string
+	ops
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.TTLDatastore = (*Datastore)(nil)
+var _ ds.TxnDatastore = (*Datastore)(nil)
+var _ ds.GCDatastore = (*Datastore)(nil)
+
+// NewDatastore returns a datastore backed by the table described by schema,
+// creating it if needed. The database handle is owned by the caller and is
+// not closed by Close.
+func NewDatastore(db *sql.DB, schema Schema) (*Datastore, error) {
+	if !validTable.MatchString(schema.Table) {
+		return nil, fmt.Errorf("mysql: invalid table name %q", schema.Table)
+	}
+	if schema.MaxKeyLength <= 0 {
+		schema.MaxKeyLength = 1024
+	}
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` ("+
+		"`key` VARBINARY(%d) NOT NULL PRIMARY KEY, "+
+		"`value` LONGBLOB NOT NULL, "+
+		"size INT NOT NULL, "+
+		"expiry BIGINT NULL"+
+		") ENGINE=InnoDB", schema.Table, schema.MaxKeyLength))
+	if err != nil {
+		return nil, err
+	}
+	return &Datastore{db: db, table: schema.Table, ops: ops{q: db, table: schema.Table}}, nil
+}
+
+// ops implements the read and write operations against either the database
+// or a transaction.
+type ops struct {
+	q     querier
+	table string
+}
+
+const live = "(expiry IS NULL OR expiry > ?)"
+
+func now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Put implements Datastore.Put
+func (o ops) Put(key ds.Key, value []byte) error {
+	return o.put(key, value, nil)
+}
+
+func (o ops) put(key ds.Key, value []byte, expiry *int64) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := o.q.ExecContext(context.TODO(), fmt.Sprintf("INSERT INTO `%s` (`key`, `value`, size, expiry) "+
+		"VALUES (?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE `value` = VALUES(`value`), size = VALUES(size), expiry = VALUES(expiry)",
+		o.table), key.Bytes(), value, len(value), expiry)
+	return err
+}
+
+// Get implements Datastore.Get
+func (o ops) Get(key ds.Key) ([]byte, error) {
+	var value []byte
+	err := o.q.QueryRowContext(context.TODO(),
+		fmt.Sprintf("SELECT `value` FROM `%s` WHERE `key` = ? AND %s", o.table, live),
+		key.Bytes(), now()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// Has implements Datastore.Has
+func (o ops) Has(key ds.Key) (bool, error) {
+	var exists bool
+	err := o.q.QueryRowContext(context.TODO(),
+		fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM `%s` WHERE `key` = ? AND %s)", o.table, live),
+		key.Bytes(), now()).Scan(&exists)
+	return exists, err
+}
+
+// GetSize implements Datastore.GetSize
+func (o ops) GetSize(key ds.Key) (int, error) {
+	var size int
+	err := o.q.QueryRowContext(context.TODO(),
+		fmt.Sprintf("SELECT size FROM `%s` WHERE `key` = ? AND %s", o.table, live),
+		key.Bytes(), now()).Scan(&size)
+	if err == sql.ErrNoRows {
+		return -1, ds.ErrNotFound
+	}
+	if err != nil {
+		return -1, err
+	}
+	return size, nil
+}
+
+// Delete implements Datastore.Delete
+func (o ops) Delete(key ds.Key) error {
+	_, err := o.q.ExecContext(context.TODO(),
+		fmt.Sprintf("DELETE FROM `%s` WHERE `key` = ?", o.table), key.Bytes())
+	return err
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// prefixPattern returns the LIKE pattern matching the children of a query
+// prefix, or "" for the root.
+func prefixPattern(prefix string) string {
+	p := path.Clean("/" + prefix)
+	if p == "/" {
+		return ""
+	}
+	return likeEscaper.Replace(p+"/") + "%"
+}
+
+// Query implements Datastore.Query. The prefix, and limit and offset when
+// no filters or custom orders are present, are pushed down to SQL.
+func (o ops) Query(q dsq.Query) (dsq.Results, error) {
+	cols := "`key`, size, expiry"
+	if !q.KeysOnly {
+		cols += ", `value`"
+	}
+	stmt := fmt.Sprintf("SELECT %s FROM `%s` WHERE %s", cols, o.table, live)
+	args := []interface{}{now()}
+	if pattern := prefixPattern(q.Prefix); pattern != "" {
+		stmt += " AND `key` LIKE ?"
+		args = append(args, pattern)
+	}
+
+	naive := q
+	naive.Prefix = ""
+	pushdown := len(q.Filters) == 0 && (len(q.Orders) == 0 || isKeyOrder(q.Orders))
+	if pushdown {
+		stmt += " ORDER BY `key`"
+		if q.Limit > 0 || q.Offset > 0 {
+			// MySQL has no OFFSET without LIMIT.
+			limit := "18446744073709551615"
+			if q.Limit > 0 {
+				limit = fmt.Sprint(q.Limit)
+			}
+			stmt += fmt.Sprintf(" LIMIT %s OFFSET %d", limit, q.Offset)
+		}
+		naive.Orders = nil
+		naive.Limit = 0
+		naive.Offset = 0
+	}
+
+	rows, err := o.q.QueryContext(context.TODO(), stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	it := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			if !rows.Next() {
+				if err := rows.Err(); err != nil {
+					return dsq.Result{Error: err}, true
+				}
+				return dsq.Result{}, false
+			}
+			var (
+				key    []byte
+				e      dsq.Entry
+				expiry sql.NullInt64
+				err    error
+			)
+			if q.KeysOnly {
+				err = rows.Scan(&key, &e.Size, &expiry)
+			} else {
+				err = rows.Scan(&key, &e.Size, &expiry, &e.Value)
+			}
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			e.Key = string(key)
+			if q.ReturnExpirations && expiry.Valid {
+				e.Expiration = time.Unix(0, expiry.Int64*int64(time.Millisecond))
+			}
+			return dsq.Result{Entry: e}, true
+		},
+		Close: func() error {
+			return rows.Close()
+		},
+	}
+	return dsq.NaiveQueryApply(naive, dsq.ResultsFromIterator(q, it)), nil
+}
+
+func isKeyOrder(orders []dsq.Order) bool {
+	if len(orders) != 1 {
+		return false
+	}
+	_, ok := orders[0].(dsq.OrderByKey)
+	return ok
+}
+
+// PutWithTTL implements TTL.PutWithTTL
+func (o ops) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
+	expiry := now() + int64(ttl/time.Millisecond)
+	return o.put(key, value, &expiry)
+}
+
+// SetTTL implements TTL.SetTTL
+func (o ops) SetTTL(key ds.Key, ttl time.Duration) error {
+	n := now()
+	res, err := o.q.ExecContext(context.TODO(),
+		fmt.Sprintf("UPDATE `%s` SET expiry = ? WHERE `key` = ? AND %s", o.table, live),
+		n+int64(ttl/time.Millisecond), key.Bytes(), n)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ds.ErrNotFound
+	}
+	return nil
+}
+
+// GetExpiration implements TTL.GetExpiration. Keys without a TTL return the
+// zero time.
+func (o ops) GetExpiration(key ds.Key) (time.Time, error) {
+	var expiry sql.NullInt64
+	err := o.q.QueryRowContext(context.TODO(),
+		fmt.Sprintf("SELECT expiry FROM `%s` WHERE `key` = ? AND %s", o.table, live),
+		key.Bytes(), now()).Scan(&expiry)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ds.ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !expiry.Valid {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, expiry.Int64*int64(time.Millisecond)), nil
+}
+
+// Sync implements Datastore.Sync. Writes are durable once committed.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return nil
+}
+
+// Batch implements Batching.Batch. A batch is a database transaction
+// opened on the first write.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return &batch{d: d}, nil
+}
+
+type batch struct {
+	d  *Datastore
+	tx *sql.Tx
+}
+
+func (b *batch) begin() error {
+	if b.tx != nil {
+		return nil
+	}
+	tx, err := b.d.db.Begin()
+	if err != nil {
+		return err
+	}
+	b.tx = tx
+	return nil
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	if err := b.begin(); err != nil {
+		return err
+	}
+	return ops{q: b.tx, table: b.d.table}.Put(key, value)
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	if err := b.begin(); err != nil {
+		return err
+	}
+	return ops{q: b.tx, table: b.d.table}.Delete(key)
+}
+
+func (b *batch) Commit() error {
+	if b.tx == nil {
+		return nil
+	}
+	tx := b.tx
+	b.tx = nil
+	return tx.Commit()
+}
+
+// NewTransaction implements TxnDatastore.NewTransaction. Transactions run
+// at the serializable isolation level.
+func (d *Datastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	tx, err := d.db.BeginTx(context.TODO(), &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  readOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &txn{ops: ops{q: tx, table: d.table}, tx: tx}, nil
+}
+
+type txn struct {
+	ops
+	tx *sql.Tx
+}
+
+func (t *txn) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *txn) Discard() {
+	t.tx.Rollback()
+}
+
+// CollectGarbage implements GCDatastore by deleting expired rows.
+func (d *Datastore) CollectGarbage() error {
+	_, err := d.db.Exec(fmt.Sprintf("DELETE FROM `%s` WHERE expiry <= ?", d.table), now())
+	return err
+}
+
+// DiskUsage implements the PersistentDatastore interface.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	var size sql.NullInt64
+	err := d.db.QueryRow(`SELECT data_length + index_length FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name = ?`, d.table).Scan(&size)
+	return uint64(size.Int64), err
+}
+
+// Close implements Datastore.Close. The database handle is left open.
+func (d *Datastore) Close() error {
+	return nil
+}
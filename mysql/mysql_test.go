@@ -0,0 +1,68 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	ds "github.com/ipfs/go-datastore"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+// newTestDatastore connects to the database in MYSQL_DSN, skipping the test
+// when it is unset. Each test gets its own table.
+func newTestDatastore(t *testing.T) *Datastore {
+	dsn := os.Getenv("MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("MYSQL_DSN not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := fmt.Sprintf("dstest_%d", time.Now().UnixNano())
+	d, err := NewDatastore(db, Schema{Table: table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP TABLE " + table)
+		db.Close()
+	})
+	return d
+}
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, newTestDatastore(t))
+}
+
+func TestPrefixPattern(t *testing.T) {
+	for in, want := range map[string]string{
+		"":         "",
+		"/":        "",
+		"/foo":     "/foo/%",
+		"/a_b%c/":  `/a\_b\%c/%`,
+		`/back\sl`: `/back\\sl/%`,
+	} {
+		if got := prefixPattern(in); got != want {
+			t.Errorf("prefixPattern(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	d := newTestDatastore(t)
+	k := ds.NewKey("/ephemeral")
+	if err := d.PutWithTTL(k, []byte("v"), -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(k); err != ds.ErrNotFound {
+		t.Fatalf("expected expired key to be missing, got %v", err)
+	}
+	if err := d.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,303 @@
+// Package pebble implements an embedded Datastore on CockroachDB's Pebble
+// LSM engine.
+//
+// Queries iterate a consistent snapshot, bounded to the prefix's key range.
+// Batches are committed atomically. Read-only transactions read from a
+// snapshot; read-write transactions buffer writes in an indexed batch, read
+// their own writes, and commit atomically, but Pebble does no conflict
+// detection, so they are not isolated from concurrent writers.
+package pebble
+
+import (
+	"errors"
+	"path"
+
+	"github.com/cockroachdb/pebble"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+var errReadOnly = errors.New("pebble: cannot write in a read-only transaction")
+
+// Datastore is a Pebble-backed datastore.
+type Datastore struct {
+	db        *pebble.DB
+	writeOpts *pebble.WriteOptions
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.TxnDatastore = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// Options configures the datastore.
+type Options struct {
+	// Pebble options. Nil uses Pebble's defaults.
+	Pebble *pebble.Options
+	// SyncWrites fsyncs the WAL on every write. Otherwise Sync must be
+	// called for durability.
+	SyncWrites bool
+}
+
+// NewDatastore opens (creating if needed) a Pebble database at dir.
+func NewDatastore(dir string, opts Options) (*Datastore, error) {
+	db, err := pebble.Open(dir, opts.Pebble)
+	if err != nil {
+		return nil, err
+	}
+	wo := pebble.NoSync
+	if opts.SyncWrites {
+		wo = pebble.Sync
+	}
+	return &Datastore{db: db, writeOpts: wo}, nil
+}
+
+func get(r pebble.Reader, key ds.Key) ([]byte, error) {
+	v, closer, err := r.Get(key.Bytes())
+	if err == pebble.ErrNotFound {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	out := make([]byte, len(v))
+	copy(out, v)
+	return out, nil
+}
+
+func has(r pebble.Reader, key ds.Key) (bool, error) {
+	_, closer, err := r.Get(key.Bytes())
+	if err == pebble.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	closer.Close()
+	return true, nil
+}
+
+func getSize(r pebble.Reader, key ds.Key) (int, error) {
+	v, closer, err := r.Get(key.Bytes())
+	if err == pebble.ErrNotFound {
+		return -1, ds.ErrNotFound
+	}
+	if err != nil {
+		return -1, err
+	}
+	defer closer.Close()
+	return len(v), nil
+}
+
+// prefixBounds returns the iterator bounds covering the children of a query
+// prefix.
+func prefixBounds(prefix string) *pebble.IterOptions {
+	p := path.Clean("/" + prefix)
+	if p == "/" {
+		return &pebble.IterOptions{LowerBound: []byte("/"), UpperBound: []byte("0")}
+	}
+	lower := []byte(p + "/")
+	upper := []byte(p + "0") // '/' + 1
+	return &pebble.IterOptions{LowerBound: lower, UpperBound: upper}
+}
+
+// query iterates r, calling release when the results are closed.
+func query(r pebble.Reader, q dsq.Query, release func() error) (dsq.Results, error) {
+	iter, err := r.NewIter(prefixBounds(q.Prefix))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	first, closed := true, false
+	it := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			var ok bool
+			if first {
+				ok = iter.First()
+				first = false
+			} else {
+				ok = iter.Next()
+			}
+			if !ok {
+				if err := iter.Error(); err != nil {
+					return dsq.Result{Error: err}, true
+				}
+				return dsq.Result{}, false
+			}
+			e := dsq.Entry{Key: string(iter.Key())}
+			v := iter.Value()
+			e.Size = len(v)
+			if !q.KeysOnly {
+				e.Value = make([]byte, len(v))
+				copy(e.Value, v)
+			}
+			return dsq.Result{Entry: e}, true
+		},
+		Close: func() error {
+			if closed {
+				return nil
+			}
+			closed = true
+			err := iter.Close()
+			if rerr := release(); err == nil {
+				err = rerr
+			}
+			return err
+		},
+	}
+	// The prefix is already applied by the iterator bounds, and results
+	// come out in key order.
+	naive := q
+	naive.Prefix = ""
+	if isKeyOrder(q.Orders) {
+		naive.Orders = nil
+	}
+	return dsq.NaiveQueryApply(naive, dsq.ResultsFromIterator(q, it)), nil
+}
+
+func isKeyOrder(orders []dsq.Order) bool {
+	if len(orders) != 1 {
+		return false
+	}
+	_, ok := orders[0].(dsq.OrderByKey)
+	return ok
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.db.Set(key.Bytes(), value, d.writeOpts)
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	return d.db.Delete(key.Bytes(), d.writeOpts)
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	return get(d.db, key)
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	return has(d.db, key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	return getSize(d.db, key)
+}
+
+// Query implements Datastore.Query. Each query reads from its own snapshot.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	snap := d.db.NewSnapshot()
+	return query(snap, q, snap.Close)
+}
+
+// Sync implements Datastore.Sync by syncing the WAL.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.db.LogData(nil, pebble.Sync)
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return &batch{d: d, b: d.db.NewBatch()}, nil
+}
+
+type batch struct {
+	d *Datastore
+	b *pebble.Batch
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	return b.b.Set(key.Bytes(), value, nil)
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	return b.b.Delete(key.Bytes(), nil)
+}
+
+func (b *batch) Commit() error {
+	err := b.b.Commit(b.d.writeOpts)
+	b.b.Close()
+	b.b = b.d.db.NewBatch()
+	return err
+}
+
+// NewTransaction implements TxnDatastore.NewTransaction
+func (d *Datastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	if readOnly {
+		return &snapshotTxn{snap: d.db.NewSnapshot()}, nil
+	}
+	return &txn{d: d, b: d.db.NewIndexedBatch()}, nil
+}
+
+// snapshotTxn is a read-only transaction over a snapshot.
+type snapshotTxn struct {
+	snap *pebble.Snapshot
+}
+
+func (t *snapshotTxn) Get(key ds.Key) ([]byte, error)     { return get(t.snap, key) }
+func (t *snapshotTxn) Has(key ds.Key) (bool, error)       { return has(t.snap, key) }
+func (t *snapshotTxn) GetSize(key ds.Key) (int, error)    { return getSize(t.snap, key) }
+func (t *snapshotTxn) Put(key ds.Key, value []byte) error { return errReadOnly }
+func (t *snapshotTxn) Delete(key ds.Key) error            { return errReadOnly }
+
+func (t *snapshotTxn) Query(q dsq.Query) (dsq.Results, error) {
+	return query(t.snap, q, func() error { return nil })
+}
+
+func (t *snapshotTxn) Commit() error {
+	return nil
+}
+
+func (t *snapshotTxn) Discard() {
+	if t.snap != nil {
+		t.snap.Close()
+		t.snap = nil
+	}
+}
+
+// txn buffers writes in an indexed batch.
+type txn struct {
+	d *Datastore
+	b *pebble.Batch
+}
+
+func (t *txn) Get(key ds.Key) ([]byte, error)     { return get(t.b, key) }
+func (t *txn) Has(key ds.Key) (bool, error)       { return has(t.b, key) }
+func (t *txn) GetSize(key ds.Key) (int, error)    { return getSize(t.b, key) }
+func (t *txn) Put(key ds.Key, value []byte) error { return t.b.Set(key.Bytes(), value, nil) }
+func (t *txn) Delete(key ds.Key) error            { return t.b.Delete(key.Bytes(), nil) }
+
+func (t *txn) Query(q dsq.Query) (dsq.Results, error) {
+	return query(t.b, q, func() error { return nil })
+}
+
+func (t *txn) Commit() error {
+	if t.b == nil {
+		return nil
+	}
+	err := t.b.Commit(t.d.writeOpts)
+	t.b.Close()
+	t.b = nil
+	return err
+}
+
+func (t *txn) Discard() {
+	if t.b != nil {
+		t.b.Close()
+		t.b = nil
+	}
+}
+
+// DiskUsage implements the PersistentDatastore interface.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return d.db.Metrics().DiskSpaceUsage(), nil
+}
+
+// Close closes the database.
+func (d *Datastore) Close() error {
+	return d.db.Close()
+}
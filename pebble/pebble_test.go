@@ -0,0 +1,80 @@
+package pebble
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func newDS(t *testing.T) *Datastore {
+	dir, err := ioutil.TempDir("", "ds-pebble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDatastore(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+		os.RemoveAll(dir)
+	})
+	return d
+}
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, newDS(t))
+}
+
+func TestSnapshotQuery(t *testing.T) {
+	d := newDS(t)
+	d.Put(ds.NewKey("/a/1"), []byte("1"))
+
+	res, err := d.Query(dsq.Query{Prefix: "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written after the query started, so not visible to it.
+	d.Put(ds.NewKey("/a/2"), []byte("2"))
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the query to see its snapshot, got %d entries", len(entries))
+	}
+}
+
+func TestTxn(t *testing.T) {
+	d := newDS(t)
+	k := ds.NewKey("/k")
+	d.Put(k, []byte("old"))
+
+	ro, _ := d.NewTransaction(true)
+	defer ro.Discard()
+	if err := ro.Put(k, []byte("x")); err == nil {
+		t.Fatal("expected read-only transaction to reject writes")
+	}
+
+	rw, _ := d.NewTransaction(false)
+	rw.Put(k, []byte("new"))
+	if v, _ := rw.Get(k); string(v) != "new" {
+		t.Fatalf("transaction should read its own writes, got %q", v)
+	}
+	if v, _ := d.Get(k); string(v) != "old" {
+		t.Fatalf("uncommitted write leaked: %q", v)
+	}
+	if err := rw.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := d.Get(k); string(v) != "new" {
+		t.Fatalf("committed write missing: %q", v)
+	}
+	if v, _ := ro.Get(k); string(v) != "old" {
+		t.Fatalf("snapshot should not see later writes: %q", v)
+	}
+}
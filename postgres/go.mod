@@ -0,0 +1,15 @@
+module github.com/ipfs/go-datastore/postgres
+
+go 1.21
+
+replace github.com/ipfs/go-datastore => ../
+
+require (
+	github.com/ipfs/go-datastore v0.4.4
+	github.com/lib/pq v1.10.9
+)
+
+require (
+	github.com/google/uuid v1.1.1 // indirect
+	github.com/jbenet/goprocess v0.1.4 // indirect
+)
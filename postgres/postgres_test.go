@@ -0,0 +1,88 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dstest "github.com/ipfs/go-datastore/test"
+	_ "github.com/lib/pq"
+)
+
+// newTestDatastore connects to the database in POSTGRES_URL, skipping the
+// test when it is unset. Each test gets its own table.
+func newTestDatastore(t *testing.T) *Datastore {
+	url := os.Getenv("POSTGRES_URL")
+	if url == "" {
+		t.Skip("POSTGRES_URL not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := fmt.Sprintf("dstest_%d", time.Now().UnixNano())
+	d, err := NewDatastore(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP TABLE " + table)
+		db.Close()
+	})
+	return d
+}
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, newTestDatastore(t))
+}
+
+func TestPrefixRange(t *testing.T) {
+	start, end := prefixRange("/foo/")
+	if string(start) != "/foo/" || string(end) != "/foo0" {
+		t.Fatalf("unexpected range [%s, %s)", start, end)
+	}
+	start, end = prefixRange("")
+	if string(start) != "/" || end != nil {
+		t.Fatalf("unexpected range [%s, %s)", start, end)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	d := newTestDatastore(t)
+	k := ds.NewKey("/ephemeral")
+	if err := d.PutWithTTL(k, []byte("v"), -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(k); err != ds.ErrNotFound {
+		t.Fatalf("expected expired key to be missing, got %v", err)
+	}
+	if err := d.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	d := newTestDatastore(t)
+	k := ds.NewKey("/k")
+	txn, err := d.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Put(k, []byte("v"))
+	txn.Discard()
+	if has, _ := d.Has(k); has {
+		t.Fatal("discarded write should not be visible")
+	}
+
+	txn, _ = d.NewTransaction(false)
+	txn.Put(k, []byte("v"))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := d.Has(k); !has {
+		t.Fatal("committed write should be visible")
+	}
+}
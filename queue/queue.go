@@ -0,0 +1,263 @@
+// Package queue layers a simple work queue on a datastore.
+//
+// Each message is a key under the queue's prefix holding the body and its
+// delivery state. Claim leases the oldest visible message for the
+// visibility timeout; the consumer acknowledges it with Ack once done. If
+// the lease expires first, the message becomes visible again and is
+// redelivered. Messages that exceed MaxAttempts deliveries are moved to a
+// dead-letter prefix.
+//
+// Claims read and then rewrite a message, so consumers in different
+// processes must share a Locker that excludes each other; the default only
+// covers the current process.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+var (
+	// ErrEmpty is returned by Claim when no message is visible.
+	ErrEmpty = errors.New("queue: no visible message")
+	// ErrLeaseLost is returned when acknowledging or extending a message
+	// whose lease expired and was claimed again, or that was already
+	// acknowledged.
+	ErrLeaseLost = errors.New("queue: message lease lost")
+)
+
+// Locker serializes claims and acknowledgements across consumers.
+type Locker interface {
+	Lock() error
+	Unlock() error
+}
+
+type mutexLocker struct{ mu sync.Mutex }
+
+func (l *mutexLocker) Lock() error   { l.mu.Lock(); return nil }
+func (l *mutexLocker) Unlock() error { l.mu.Unlock(); return nil }
+
+// Options configures a Queue.
+type Options struct {
+	// VisibilityTimeout is how long a claimed message stays hidden from
+	// other consumers. Defaults to 30 seconds.
+	VisibilityTimeout time.Duration
+	// MaxAttempts moves a message to the dead-letter prefix instead of
+	// delivering it again once it has been claimed this many times. Zero
+	// redelivers forever.
+	MaxAttempts int
+	// Locker excludes concurrent claims. Defaults to an in-process mutex.
+	Locker Locker
+	// Clock times message visibility. Defaults to the wall clock.
+	Clock clock.Clock
+}
+
+// Queue is a work queue stored under a datastore prefix.
+type Queue struct {
+	d      ds.Datastore
+	msgs   ds.Key
+	dead   ds.Key
+	opts   Options
+	locker Locker
+	clock  clock.Clock
+}
+
+// Message is a claimed message.
+type Message struct {
+	ID       string
+	Body     []byte
+	Attempts int
+
+	lease string
+}
+
+// envelope is the stored form of a message.
+type envelope struct {
+	Body      []byte `json:"body"`
+	Attempts  int    `json:"attempts"`
+	VisibleAt int64  `json:"visibleAt"`
+	Lease     string `json:"lease,omitempty"`
+}
+
+// New returns the queue stored under prefix in d.
+func New(d ds.Datastore, prefix ds.Key, opts Options) *Queue {
+	if opts.VisibilityTimeout <= 0 {
+		opts.VisibilityTimeout = 30 * time.Second
+	}
+	locker := opts.Locker
+	if locker == nil {
+		locker = &mutexLocker{}
+	}
+	return &Queue{
+		d:      d,
+		msgs:   prefix.ChildString("msgs"),
+		dead:   prefix.ChildString("dead"),
+		opts:   opts,
+		locker: locker,
+		clock:  clock.OrReal(opts.Clock),
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (q *Queue) load(key ds.Key) (*envelope, error) {
+	b, err := q.d.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var e envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("queue: decoding %s: %w", key, err)
+	}
+	return &e, nil
+}
+
+func (q *Queue) store(key ds.Key, e *envelope) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return q.d.Put(key, b)
+}
+
+// Enqueue adds a message and returns its ID. IDs sort in enqueue order, so
+// messages are claimed roughly first in, first out.
+func (q *Queue) Enqueue(body []byte) (string, error) {
+	id := fmt.Sprintf("%020d-%s", q.clock.Now().UnixNano(), randomHex(4))
+	return id, q.store(q.msgs.ChildString(id), &envelope{Body: body})
+}
+
+// Claim leases the oldest visible message, returning ErrEmpty if there is
+// none.
+func (q *Queue) Claim() (*Message, error) {
+	if err := q.locker.Lock(); err != nil {
+		return nil, err
+	}
+	defer q.locker.Unlock()
+
+	res, err := q.d.Query(dsq.Query{
+		Prefix: q.msgs.String(),
+		Orders: []dsq.Order{dsq.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	now := q.clock.Now()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var e envelope
+		if err := json.Unmarshal(r.Value, &e); err != nil {
+			return nil, fmt.Errorf("queue: decoding %s: %w", r.Key, err)
+		}
+		if e.VisibleAt > now.UnixNano() {
+			continue
+		}
+		key := ds.RawKey(r.Key)
+		if q.opts.MaxAttempts > 0 && e.Attempts >= q.opts.MaxAttempts {
+			if err := q.deadLetter(key, &e); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		e.Attempts++
+		e.VisibleAt = now.Add(q.opts.VisibilityTimeout).UnixNano()
+		e.Lease = randomHex(8)
+		if err := q.store(key, &e); err != nil {
+			return nil, err
+		}
+		return &Message{ID: key.BaseNamespace(), Body: e.Body, Attempts: e.Attempts, lease: e.Lease}, nil
+	}
+	return nil, ErrEmpty
+}
+
+func (q *Queue) deadLetter(key ds.Key, e *envelope) error {
+	e.Lease = ""
+	if err := q.store(q.dead.ChildString(key.BaseNamespace()), e); err != nil {
+		return err
+	}
+	return q.d.Delete(key)
+}
+
+// update applies fn to a message still leased by m.
+func (q *Queue) update(m *Message, fn func(key ds.Key, e *envelope) error) error {
+	if err := q.locker.Lock(); err != nil {
+		return err
+	}
+	defer q.locker.Unlock()
+
+	key := q.msgs.ChildString(m.ID)
+	e, err := q.load(key)
+	if err == ds.ErrNotFound {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+	if e.Lease != m.lease {
+		return ErrLeaseLost
+	}
+	return fn(key, e)
+}
+
+// Ack deletes a processed message.
+func (q *Queue) Ack(m *Message) error {
+	return q.update(m, func(key ds.Key, e *envelope) error {
+		return q.d.Delete(key)
+	})
+}
+
+// Nack gives up a message's lease, making it visible again immediately.
+func (q *Queue) Nack(m *Message) error {
+	return q.update(m, func(key ds.Key, e *envelope) error {
+		e.VisibleAt = 0
+		e.Lease = ""
+		return q.store(key, e)
+	})
+}
+
+// Extend keeps a message hidden for d from now, for consumers that need
+// longer than the visibility timeout.
+func (q *Queue) Extend(m *Message, d time.Duration) error {
+	return q.update(m, func(key ds.Key, e *envelope) error {
+		e.VisibleAt = q.clock.Now().Add(d).UnixNano()
+		return q.store(key, e)
+	})
+}
+
+// Len returns the number of messages in the queue, claimed or not,
+// excluding dead letters.
+func (q *Queue) Len() (int, error) {
+	return count(q.d, q.msgs)
+}
+
+// DeadLetters returns the number of dead-lettered messages.
+func (q *Queue) DeadLetters() (int, error) {
+	return count(q.d, q.dead)
+}
+
+func count(d ds.Datastore, prefix ds.Key) (int, error) {
+	res, err := d.Query(dsq.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := res.Rest()
+	return len(entries), err
+}
@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+)
+
+func newQueue(opts Options) (*Queue, *clock.Mock) {
+	c := clock.NewMock(time.Unix(1000, 0))
+	opts.Clock = c
+	return New(ds.NewMapDatastore(), ds.NewKey("/jobs"), opts), c
+}
+
+func TestClaimAck(t *testing.T) {
+	q, c := newQueue(Options{})
+	for _, body := range []string{"a", "b"} {
+		if _, err := q.Enqueue([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		c.Advance(time.Millisecond)
+	}
+
+	m, err := q.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Body) != "a" || m.Attempts != 1 {
+		t.Fatalf("claimed %q, attempt %d", m.Body, m.Attempts)
+	}
+	m2, err := q.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m2.Body) != "b" {
+		t.Fatalf("claimed %q second", m2.Body)
+	}
+	if _, err := q.Claim(); err != ErrEmpty {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+
+	if err := q.Ack(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(m); err != ErrLeaseLost {
+		t.Fatalf("double ack: %v", err)
+	}
+	if n, _ := q.Len(); n != 1 {
+		t.Fatalf("%d messages left", n)
+	}
+}
+
+func TestRedelivery(t *testing.T) {
+	q, c := newQueue(Options{VisibilityTimeout: time.Minute})
+	q.Enqueue([]byte("a"))
+
+	m, err := q.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(30 * time.Second)
+	if _, err := q.Claim(); err != ErrEmpty {
+		t.Fatalf("claimed a hidden message: %v", err)
+	}
+	if err := q.Extend(m, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(45 * time.Second)
+	if _, err := q.Claim(); err != ErrEmpty {
+		t.Fatalf("claimed an extended message: %v", err)
+	}
+
+	c.Advance(time.Minute)
+	again, err := q.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != m.ID || again.Attempts != 2 {
+		t.Fatalf("redelivered %s attempt %d", again.ID, again.Attempts)
+	}
+	if err := q.Ack(m); err != ErrLeaseLost {
+		t.Fatalf("stale ack: %v", err)
+	}
+	if err := q.Nack(again); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Claim(); err != nil {
+		t.Fatalf("nacked message not visible: %v", err)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	q, c := newQueue(Options{VisibilityTimeout: time.Second, MaxAttempts: 2})
+	q.Enqueue([]byte("poison"))
+
+	for i := 0; i < 2; i++ {
+		if _, err := q.Claim(); err != nil {
+			t.Fatal(err)
+		}
+		c.Advance(2 * time.Second)
+	}
+	if _, err := q.Claim(); err != ErrEmpty {
+		t.Fatalf("expected ErrEmpty after max attempts, got %v", err)
+	}
+	if n, _ := q.DeadLetters(); n != 1 {
+		t.Fatalf("%d dead letters", n)
+	}
+	if n, _ := q.Len(); n != 0 {
+		t.Fatalf("%d messages left", n)
+	}
+}
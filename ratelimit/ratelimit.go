@@ -0,0 +1,183 @@
+// Package ratelimit provides a datastore wrapper capping the rate of
+// operations, with separate budgets for reads and writes, so one consumer
+// cannot push a shared backend into throttling.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Options configures the limits. A zero rate leaves that kind of operation
+// unlimited.
+type Options struct {
+	// ReadsPerSecond limits Get, Has, GetSize and Query calls.
+	ReadsPerSecond float64
+	// ReadBurst is how many reads may run back to back after an idle
+	// period. Defaults to 1.
+	ReadBurst int
+	// WritesPerSecond limits Put and Delete calls, including those in
+	// batches.
+	WritesPerSecond float64
+	// WriteBurst is how many writes may run back to back after an idle
+	// period. Defaults to 1.
+	WriteBurst int
+	// Clock refills the buckets and waits for tokens. Defaults to the
+	// wall clock.
+	Clock clock.Clock
+}
+
+// Datastore limits the operation rate on a child datastore. Operations
+// over the limit block until allowed.
+type Datastore struct {
+	child  ds.Datastore
+	reads  *bucket
+	writes *bucket
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// New wraps child with the given limits.
+func New(child ds.Datastore, opts Options) *Datastore {
+	return &Datastore{
+		child:  child,
+		reads:  newBucket(opts.ReadsPerSecond, opts.ReadBurst, clock.OrReal(opts.Clock)),
+		writes: newBucket(opts.WritesPerSecond, opts.WriteBurst, clock.OrReal(opts.Clock)),
+	}
+}
+
+// bucket is a token bucket. A nil bucket never waits.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	clock  clock.Clock
+}
+
+func newBucket(rate float64, burst int, c clock.Clock) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   c.Now(),
+		clock:  c,
+	}
+}
+
+// wait takes a token, sleeping until one is available. Waiters reserve
+// tokens in arrival order by letting the balance go negative.
+func (b *bucket) wait() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay > 0 {
+		b.clock.Sleep(delay)
+	}
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	d.writes.wait()
+	return d.child.Put(key, value)
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	d.writes.wait()
+	return d.child.Delete(key)
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	d.reads.wait()
+	return d.child.Get(key)
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	d.reads.wait()
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	d.reads.wait()
+	return d.child.GetSize(key)
+}
+
+// Query implements Datastore.Query. A query counts as one read however
+// many results it returns.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	d.reads.wait()
+	return d.child.Query(q)
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Batch implements Batching.Batch. Each buffered Put or Delete takes a
+// write token when added, so a batch cannot bypass the write limit.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	bds, ok := d.child.(ds.Batching)
+	if !ok {
+		return ds.NewBasicBatch(d), nil
+	}
+	b, err := bds.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &batch{b: b, writes: d.writes}, nil
+}
+
+type batch struct {
+	b      ds.Batch
+	writes *bucket
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	b.writes.wait()
+	return b.b.Put(key, value)
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	b.writes.wait()
+	return b.b.Delete(key)
+}
+
+func (b *batch) Commit() error {
+	return b.b.Commit()
+}
+
+// Close implements Datastore.Close
+func (d *Datastore) Close() error {
+	return d.child.Close()
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, New(ds.NewMapDatastore(), Options{}))
+}
+
+func TestBucket(t *testing.T) {
+	// The mock clock lets the bucket sleep without waiting.
+	c := clock.NewMock(time.Unix(0, 0))
+	b := newBucket(10, 5, c)
+	start := c.Now()
+
+	for i := 0; i < 5; i++ {
+		b.wait()
+	}
+	if slept := c.Now().Sub(start); slept != 0 {
+		t.Fatalf("burst slept %v", slept)
+	}
+	for i := 0; i < 10; i++ {
+		b.wait()
+	}
+	if slept := c.Now().Sub(start); slept < 990*time.Millisecond || slept > 1010*time.Millisecond {
+		t.Fatalf("10 ops over the burst at 10/s slept %v, want ~1s", slept)
+	}
+
+	c.Advance(time.Hour)
+	before := c.Now()
+	for i := 0; i < 5; i++ {
+		b.wait()
+	}
+	if !c.Now().Equal(before) {
+		t.Fatal("burst not refilled after idling")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	if newBucket(0, 10, clock.Real) != nil {
+		t.Fatal("zero rate should not limit")
+	}
+	var b *bucket
+	b.wait()
+}
+
+func TestWriteLimit(t *testing.T) {
+	d := New(ds.NewMapDatastore(), Options{WritesPerSecond: 100})
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		d.Put(ds.NewKey("/k"), nil)
+	}
+	// Reads are not limited.
+	for i := 0; i < 1000; i++ {
+		d.Get(ds.NewKey("/k"))
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("11 writes at 100/s took %v", elapsed)
+	}
+}
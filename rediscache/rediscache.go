@@ -0,0 +1,272 @@
+// Package rediscache provides a datastore wrapper that uses Redis as a shared
+// read-through, write-through cache in front of a slower datastore, for
+// fleets where per-process caches are not enough.
+//
+// Values are cached with a jittered TTL. Concurrent misses for the same key
+// within a process are collapsed into a single load from the child, so a
+// popular key expiring does not stampede the backend. Redis failures are not
+// fatal: reads fall back to the child and writes still reach it.
+package rediscache
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Client is the subset of a Redis client the cache needs. RESPClient
+// implements it; adapting go-redis or redigo takes a few lines.
+type Client interface {
+	// Get returns the value and whether the key was present.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value, expiring after ttl if ttl is positive.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Del(ctx context.Context, key string) error
+}
+
+// Options configures the cache.
+type Options struct {
+	// Prefix namespaces cache entries in Redis. Defaults to "ds:".
+	Prefix string
+	// TTL is how long values stay cached. Defaults to ten minutes.
+	TTL time.Duration
+	// NegativeTTL caches misses for this long. Zero disables negative
+	// caching.
+	NegativeTTL time.Duration
+	// Jitter randomizes TTLs by up to this fraction so entries written
+	// together don't expire together. Defaults to 0.1.
+	Jitter float64
+	// MaxValueSize skips caching larger values. Zero means no limit.
+	MaxValueSize int
+}
+
+// Cached values carry a one byte tag so misses can be cached too.
+const (
+	tagValue   = 'v'
+	tagMissing = 'n'
+)
+
+// Datastore caches a child datastore in Redis.
+type Datastore struct {
+	child  ds.Datastore
+	client Client
+	opts   Options
+
+	loads group
+
+	mu sync.Mutex
+	// gen counts writes through this instance, so a load racing one does
+	// not cache what it read from before the write.
+	gen uint64
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+
+// New wraps child with a Redis cache.
+func New(child ds.Datastore, client Client, opts Options) *Datastore {
+	if opts.Prefix == "" {
+		opts.Prefix = "ds:"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 10 * time.Minute
+	}
+	if opts.Jitter <= 0 {
+		opts.Jitter = 0.1
+	}
+	return &Datastore{child: child, client: client, opts: opts}
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.child}
+}
+
+func (d *Datastore) cacheKey(key ds.Key) string {
+	return d.opts.Prefix + key.String()
+}
+
+func (d *Datastore) ttl(base time.Duration) time.Duration {
+	return base + time.Duration(rand.Float64()*d.opts.Jitter*float64(base))
+}
+
+func (d *Datastore) store(key ds.Key, value []byte, found bool) {
+	ctx := context.Background()
+	if !found {
+		if d.opts.NegativeTTL > 0 {
+			d.client.Set(ctx, d.cacheKey(key), []byte{tagMissing}, d.ttl(d.opts.NegativeTTL))
+		}
+		return
+	}
+	if d.opts.MaxValueSize > 0 && len(value) > d.opts.MaxValueSize {
+		return
+	}
+	buf := make([]byte, len(value)+1)
+	buf[0] = tagValue
+	copy(buf[1:], value)
+	d.client.Set(ctx, d.cacheKey(key), buf, d.ttl(d.opts.TTL))
+}
+
+func (d *Datastore) invalidate(key ds.Key) {
+	d.client.Del(context.Background(), d.cacheKey(key))
+}
+
+// generation returns the write count, to pass to storeLoaded.
+func (d *Datastore) generation() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.gen
+}
+
+// written records a write of the child, before the cache is updated.
+func (d *Datastore) written() {
+	d.mu.Lock()
+	d.gen++
+	d.mu.Unlock()
+}
+
+// storeLoaded caches what a load from the child found of key, unless a
+// write happened since gen. A write landing while the entry is stored may
+// be overwritten by it, so the entry is dropped again if one did.
+func (d *Datastore) storeLoaded(gen uint64, key ds.Key, value []byte, found bool) {
+	if d.generation() != gen {
+		return
+	}
+	d.store(key, value, found)
+	if d.generation() != gen {
+		d.invalidate(key)
+	}
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	buf, ok, err := d.client.Get(context.Background(), d.cacheKey(key))
+	if err == nil && ok && len(buf) > 0 {
+		switch buf[0] {
+		case tagValue:
+			return buf[1:], nil
+		case tagMissing:
+			return nil, ds.ErrNotFound
+		}
+	}
+
+	v, err := d.loads.do(key.String(), func() ([]byte, error) {
+		gen := d.generation()
+		v, err := d.child.Get(key)
+		switch err {
+		case nil:
+			d.storeLoaded(gen, key, v, true)
+		case ds.ErrNotFound:
+			d.storeLoaded(gen, key, nil, false)
+		}
+		return v, err
+	})
+	return v, err
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	buf, ok, err := d.client.Get(context.Background(), d.cacheKey(key))
+	if err == nil && ok && len(buf) > 0 {
+		return buf[0] == tagValue, nil
+	}
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	buf, ok, err := d.client.Get(context.Background(), d.cacheKey(key))
+	if err == nil && ok && len(buf) > 0 {
+		if buf[0] == tagMissing {
+			return -1, ds.ErrNotFound
+		}
+		return len(buf) - 1, nil
+	}
+	return d.child.GetSize(key)
+}
+
+// Put implements Datastore.Put. The child is written first so a failed
+// write never leaves the cache ahead of the backend.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	err := d.child.Put(key, value)
+	d.written()
+	if err != nil {
+		d.invalidate(key)
+		return err
+	}
+	d.store(key, value, true)
+	return nil
+}
+
+// Delete implements Datastore.Delete. The key is invalidated once the
+// child has deleted it, so a load racing the delete cannot cache it again.
+func (d *Datastore) Delete(key ds.Key) error {
+	err := d.child.Delete(key)
+	d.written()
+	d.invalidate(key)
+	return err
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Query implements Datastore.Query. Queries always go to the child.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	return d.child.Query(q)
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// DiskUsage implements the PersistentDatastore interface.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(d.child)
+}
+
+// Close closes the child. The Redis client is owned by the caller.
+func (d *Datastore) Close() error {
+	return d.child.Close()
+}
+
+// group collapses concurrent loads of the same key.
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+func (g *group) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.val, c.err
+}
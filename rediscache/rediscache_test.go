@@ -0,0 +1,189 @@
+package rediscache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+// fakeRedis serves GET, SET and DEL from a map, counting the connections
+// it accepts in conns.
+func fakeRedis(t *testing.T) (addr string, conns *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	data := make(map[string][]byte)
+	conns = new(int32)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					reply, err := readReply(r)
+					if err != nil {
+						return
+					}
+					args := reply.([]interface{})
+					cmd := string(args[0].([]byte))
+					key := string(args[1].([]byte))
+					mu.Lock()
+					switch cmd {
+					case "GET":
+						if v, ok := data[key]; ok {
+							fmt.Fprintf(c, "$%d\r\n%s\r\n", len(v), v)
+						} else {
+							fmt.Fprint(c, "$-1\r\n")
+						}
+					case "SET":
+						data[key] = args[2].([]byte)
+						fmt.Fprint(c, "+OK\r\n")
+					case "DEL":
+						delete(data, key)
+						fmt.Fprint(c, ":1\r\n")
+					default:
+						fmt.Fprint(c, "-ERR unknown command\r\n")
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), conns
+}
+
+func TestSuite(t *testing.T) {
+	addr, _ := fakeRedis(t)
+	client := NewRESPClient(addr, "", 0, 4)
+	defer client.Close()
+	dstest.SubtestAll(t, New(dssync.MutexWrap(ds.NewMapDatastore()), client, Options{NegativeTTL: time.Minute}))
+}
+
+type slowCounting struct {
+	ds.Datastore
+	gets int32
+}
+
+func (s *slowCounting) Get(key ds.Key) ([]byte, error) {
+	atomic.AddInt32(&s.gets, 1)
+	time.Sleep(50 * time.Millisecond)
+	return s.Datastore.Get(key)
+}
+
+func TestStampede(t *testing.T) {
+	child := &slowCounting{Datastore: dssync.MutexWrap(ds.NewMapDatastore())}
+	k := ds.NewKey("/hot")
+	child.Datastore.Put(k, []byte("value"))
+
+	addr, _ := fakeRedis(t)
+	client := NewRESPClient(addr, "", 0, 16)
+	defer client.Close()
+	d := New(child, client, Options{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := d.Get(k); err != nil || string(v) != "value" {
+				t.Errorf("unexpected get result %q: %v", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&child.gets); n != 1 {
+		t.Fatalf("expected a single load from the child, got %d", n)
+	}
+
+	// Now served from redis.
+	if _, err := d.Get(k); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&child.gets); n != 1 {
+		t.Fatalf("expected cached read, got %d loads", n)
+	}
+}
+
+// pausedGet reads the value of a key, then waits for release to return
+// it, as a slow read from before a write would.
+type pausedGet struct {
+	ds.Datastore
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (p *pausedGet) Get(key ds.Key) ([]byte, error) {
+	v, err := p.Datastore.Get(key)
+	close(p.read)
+	<-p.release
+	return v, err
+}
+
+func TestStaleLoadNotCached(t *testing.T) {
+	child := &pausedGet{
+		Datastore: dssync.MutexWrap(ds.NewMapDatastore()),
+		read:      make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	k := ds.NewKey("/k")
+	child.Datastore.Put(k, []byte("v1"))
+	addr, _ := fakeRedis(t)
+	client := NewRESPClient(addr, "", 0, 4)
+	defer client.Close()
+	d := New(child, client, Options{})
+
+	loaded := make(chan struct{})
+	go func() {
+		defer close(loaded)
+		d.Get(k)
+	}()
+	<-child.read
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	close(child.release)
+	<-loaded
+
+	if has, err := d.Has(k); err != nil || has {
+		t.Fatalf("deleted key cached by a load racing the delete: %v, %v", has, err)
+	}
+}
+
+func TestPoolBound(t *testing.T) {
+	addr, conns := fakeRedis(t)
+	client := NewRESPClient(addr, "", 0, 2)
+	defer client.Close()
+	d := New(dssync.MutexWrap(ds.NewMapDatastore()), client, Options{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := d.Put(ds.NewKey(fmt.Sprint(i)), []byte("v")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(conns); n > 2 {
+		t.Fatalf("dialed %d connections with a pool of 2", n)
+	}
+}
@@ -0,0 +1,240 @@
+package rediscache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// errNil is returned by a command that replied with a nil bulk string.
+var errNil = errors.New("redis: nil")
+
+// RESPClient is a minimal Redis client speaking RESP over a small pool of
+// connections. It supports exactly the commands the cache uses.
+type RESPClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	pool     chan *conn
+	// slots holds a token for each connection open, idle or in use.
+	slots chan struct{}
+}
+
+var _ Client = (*RESPClient)(nil)
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// NewRESPClient returns a client for the Redis server at addr. Connections
+// are dialed lazily, up to poolSize of them; commands wait for a free one
+// once that many are in use.
+func NewRESPClient(addr, password string, db, poolSize int) *RESPClient {
+	if poolSize <= 0 {
+		poolSize = 8
+	}
+	return &RESPClient{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  5 * time.Second,
+		pool:     make(chan *conn, poolSize),
+		slots:    make(chan struct{}, poolSize),
+	}
+}
+
+func (c *RESPClient) dial(ctx context.Context) (*conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if c.password != "" {
+		if _, err := cn.do(c.timeout, "AUTH", []byte(c.password)); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do(c.timeout, "SELECT", []byte(strconv.Itoa(c.db))); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// get returns an idle connection, or dials one if fewer than poolSize are
+// open, waiting for one to be returned otherwise.
+func (c *RESPClient) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	case c.slots <- struct{}{}:
+		cn, err := c.dial(ctx)
+		if err != nil {
+			<-c.slots
+		}
+		return cn, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put returns cn to the pool.
+func (c *RESPClient) put(cn *conn) {
+	c.pool <- cn
+}
+
+// discard closes cn, freeing its slot.
+func (c *RESPClient) discard(cn *conn) {
+	cn.Close()
+	<-c.slots
+}
+
+func (c *RESPClient) do(ctx context.Context, cmd string, args ...[]byte) (interface{}, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.do(c.timeout, cmd, args...)
+	var rerr redisError
+	if err != nil && err != errNil && !errors.As(err, &rerr) {
+		// The connection is in an unknown state.
+		c.discard(cn)
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+func (cn *conn) do(timeout time.Duration, cmd string, args ...[]byte) (interface{}, error) {
+	cn.SetDeadline(time.Now().Add(timeout))
+	fmt.Fprintf(cn.w, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)
+	for _, a := range args {
+		fmt.Fprintf(cn.w, "$%d\r\n", len(a))
+		cn.w.Write(a)
+		cn.w.WriteString("\r\n")
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(cn.r)
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = readReply(r); err != nil && err != errNil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line)
+}
+
+// Get implements Client.Get
+func (c *RESPClient) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := c.do(ctx, "GET", []byte(key))
+	if err == errNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected GET reply %v", reply)
+	}
+	return b, true, nil
+}
+
+// Set implements Client.Set
+func (c *RESPClient) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := [][]byte{[]byte(key), value}
+	if ttl > 0 {
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(int64(ttl/time.Millisecond), 10)))
+	}
+	_, err := c.do(ctx, "SET", args...)
+	return err
+}
+
+// Del implements Client.Del
+func (c *RESPClient) Del(ctx context.Context, key string) error {
+	_, err := c.do(ctx, "DEL", []byte(key))
+	return err
+}
+
+// Close closes pooled connections.
+func (c *RESPClient) Close() error {
+	for {
+		select {
+		case cn := <-c.pool:
+			c.discard(cn)
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package replicate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// recordMagic starts every stored record. Values stored before the
+// wrapper was introduced lack it and read as records with no timestamp or
+// origin, so any replicated write supersedes them.
+var recordMagic = []byte{0x00, 'd', 's', 'r'}
+
+var errCorrupt = errors.New("replicate: corrupt record")
+
+// Record is a key's value with the version information used to resolve
+// conflicts. Deletes are kept as records with Deleted set, so they can win
+// over concurrent writes.
+type Record struct {
+	Value     []byte
+	Deleted   bool
+	Timestamp time.Time
+	// Origin is the region that wrote the record.
+	Origin string
+}
+
+func (r Record) sameContent(o Record) bool {
+	return r.Deleted == o.Deleted && bytes.Equal(r.Value, o.Value)
+}
+
+func encodeRecord(r Record) []byte {
+	buf := make([]byte, 0, len(recordMagic)+2*binary.MaxVarintLen64+len(r.Origin)+1+len(r.Value))
+	buf = append(buf, recordMagic...)
+	var n [binary.MaxVarintLen64]byte
+	var nanos int64
+	if !r.Timestamp.IsZero() {
+		nanos = r.Timestamp.UnixNano()
+	}
+	buf = append(buf, n[:binary.PutVarint(n[:], nanos)]...)
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(r.Origin)))]...)
+	buf = append(buf, r.Origin...)
+	if r.Deleted {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	return append(buf, r.Value...)
+}
+
+func decodeRecord(b []byte) (Record, error) {
+	if !bytes.HasPrefix(b, recordMagic) {
+		return Record{Value: b}, nil
+	}
+	b = b[len(recordMagic):]
+	nanos, n := binary.Varint(b)
+	if n <= 0 {
+		return Record{}, errCorrupt
+	}
+	b = b[n:]
+	olen, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < olen+1 {
+		return Record{}, errCorrupt
+	}
+	b = b[n:]
+	r := Record{Origin: string(b[:olen]), Deleted: b[olen] == 1, Value: b[olen+1:]}
+	if nanos != 0 {
+		r.Timestamp = time.Unix(0, nanos)
+	}
+	return r, nil
+}
@@ -0,0 +1,362 @@
+// Package replicate keeps datastores in two regions in sync while both
+// accept writes.
+//
+// Each region wraps its datastore with New. Writes are stored as records
+// stamped with a timestamp and the writing region, deletes leave
+// tombstone records, and every change is appended to the region's change
+// feed, a topic stored alongside the data. A region follows its peer's
+// feed with Follow: for each changed key it reads the peer's record and
+// resolves it against its own with the configured Policy, storing the
+// winner. Both regions resolve every conflict the same way, so they
+// converge once each has applied the other's feed.
+//
+// Changes applied from a peer are not forwarded, so replication is between
+// two regions. Tombstones are kept so that late-arriving writes lose to
+// the deletes that followed them.
+package replicate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-datastore/topic"
+)
+
+// ErrReserved is returned for writes to a region's change feed.
+var ErrReserved = errors.New("replicate: key is reserved for the change feed")
+
+// Policy resolves a key changed in two regions.
+type Policy interface {
+	// Resolve returns the record to keep. Returning one of its arguments
+	// keeps that version; any other record is stored as a new version
+	// and replicated back to the peer. Resolve must give the same answer
+	// whichever region calls it, with the arguments swapped.
+	Resolve(key ds.Key, local, remote Record) (Record, error)
+}
+
+// PolicyFunc adapts a function to a Policy.
+type PolicyFunc func(key ds.Key, local, remote Record) (Record, error)
+
+// Resolve implements Policy.
+func (f PolicyFunc) Resolve(key ds.Key, local, remote Record) (Record, error) {
+	return f(key, local, remote)
+}
+
+// LastWriterWins keeps the record with the later timestamp. Ties are
+// broken by origin region name so both regions pick the same record.
+var LastWriterWins Policy = PolicyFunc(func(_ ds.Key, local, remote Record) (Record, error) {
+	switch {
+	case remote.Timestamp.After(local.Timestamp):
+		return remote, nil
+	case local.Timestamp.After(remote.Timestamp):
+		return local, nil
+	case remote.Origin > local.Origin:
+		return remote, nil
+	}
+	return local, nil
+})
+
+// Options configures a region.
+type Options struct {
+	// Region names this region. It must be unique among the replicas and
+	// may not contain "/".
+	Region string
+	// Policy resolves conflicts. Defaults to LastWriterWins.
+	Policy Policy
+	// Clock stamps writes. Defaults to the wall clock.
+	Clock clock.Clock
+}
+
+const stripes = 256
+
+// Datastore is one region's replica.
+type Datastore struct {
+	child ds.Datastore
+	opts  Options
+	feed  *topic.Topic
+	// reserved is the prefix holding the change feed.
+	reserved ds.Key
+
+	keyLocks [stripes]sync.Mutex
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+func feedName(region string) string {
+	return "replication-" + region
+}
+
+// New wraps child as the replica of the named region.
+func New(child ds.Datastore, opts Options) (*Datastore, error) {
+	if opts.Region == "" || strings.Contains(opts.Region, "/") {
+		return nil, fmt.Errorf("replicate: invalid region name %q", opts.Region)
+	}
+	if opts.Policy == nil {
+		opts.Policy = LastWriterWins
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+	feed := topic.New(child, feedName(opts.Region))
+	feed.Clock = opts.Clock
+	return &Datastore{
+		child:    child,
+		opts:     opts,
+		feed:     feed,
+		reserved: topic.Root.ChildString(feedName(opts.Region)),
+	}, nil
+}
+
+func (d *Datastore) isReserved(key ds.Key) bool {
+	return d.reserved.Equal(key) || d.reserved.IsAncestorOf(key)
+}
+
+func (d *Datastore) keyLock(key ds.Key) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(key.Bytes())
+	return &d.keyLocks[h.Sum32()%stripes]
+}
+
+// load returns the stored record for key.
+func load(d ds.Datastore, key ds.Key) (Record, error) {
+	b, err := d.Get(key)
+	if err != nil {
+		return Record{}, err
+	}
+	return decodeRecord(b)
+}
+
+// write stores a local change and appends it to the change feed.
+func (d *Datastore) write(key ds.Key, value []byte, deleted bool) error {
+	if d.isReserved(key) {
+		return ErrReserved
+	}
+	l := d.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	r := Record{Value: value, Deleted: deleted, Timestamp: d.opts.Clock.Now(), Origin: d.opts.Region}
+	// A write must supersede the record it replaces, even if that record
+	// came from a peer whose clock runs ahead.
+	prev, err := load(d.child, key)
+	switch {
+	case err == ds.ErrNotFound:
+		if deleted {
+			return nil
+		}
+	case err != nil:
+		return err
+	case !r.Timestamp.After(prev.Timestamp):
+		r.Timestamp = prev.Timestamp.Add(time.Nanosecond)
+	}
+	return d.store(key, r)
+}
+
+// store writes a record and announces it on the change feed. The feed is
+// written second so a peer reading a change always finds the record.
+func (d *Datastore) store(key ds.Key, r Record) error {
+	if err := d.child.Put(key, encodeRecord(r)); err != nil {
+		return err
+	}
+	_, err := d.feed.Publish(key.Bytes())
+	return err
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.write(key, value, false)
+}
+
+// Delete implements Datastore.Delete, leaving a tombstone.
+func (d *Datastore) Delete(key ds.Key) error {
+	return d.write(key, nil, true)
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	r, err := load(d.child, key)
+	if err != nil {
+		return nil, err
+	}
+	if r.Deleted {
+		return nil, ds.ErrNotFound
+	}
+	return r.Value, nil
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	_, err := d.Get(key)
+	switch err {
+	case nil:
+		return true, nil
+	case ds.ErrNotFound:
+		return false, nil
+	}
+	return false, err
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	value, err := d.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+// Query implements Datastore.Query. Tombstones and the change feed are
+// not listed. Records are read whole even for keys-only queries, to tell
+// tombstones apart.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	res, err := d.child.Query(dsq.Query{Prefix: q.Prefix})
+	if err != nil {
+		return nil, err
+	}
+	records := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for {
+				r, ok := res.NextSync()
+				if !ok || r.Error != nil {
+					return r, ok
+				}
+				key := ds.RawKey(r.Key)
+				if d.isReserved(key) {
+					continue
+				}
+				rec, err := decodeRecord(r.Value)
+				if err != nil {
+					return dsq.Result{Error: fmt.Errorf("%w: %s", err, key)}, true
+				}
+				if rec.Deleted {
+					continue
+				}
+				r.Value, r.Size = rec.Value, len(rec.Value)
+				return r, true
+			}
+		},
+		Close: res.Close,
+	})
+	return dsq.NaiveQueryApply(q, records), nil
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// Close closes the child.
+func (d *Datastore) Close() error {
+	return d.child.Close()
+}
+
+// TrimFeed drops change feed entries older than age. Peers that have not
+// read them by then must be resynchronized.
+func (d *Datastore) TrimFeed(age time.Duration) error {
+	return d.feed.Trim(age)
+}
+
+// Follower applies a peer region's changes to a local replica.
+type Follower struct {
+	d    *Datastore
+	peer ds.Datastore
+	sub  *topic.Subscriber
+}
+
+// Follow subscribes to the change feed of the named peer region, stored in
+// peer, the peer's underlying datastore. The subscription cursor is kept
+// in the peer's feed, so a restarted follower resumes where it stopped; a
+// new follower starts with changes made from now on.
+func (d *Datastore) Follow(peer ds.Datastore, peerRegion string, opts topic.Options) (*Follower, error) {
+	if peerRegion == d.opts.Region {
+		return nil, fmt.Errorf("replicate: region %s cannot follow itself", peerRegion)
+	}
+	feed := topic.New(peer, feedName(peerRegion))
+	feed.Clock = d.opts.Clock
+	sub, err := feed.Subscribe(d.opts.Region, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Follower{d: d, peer: peer, sub: sub}, nil
+}
+
+// Poll applies the changes published since the last poll, returning how
+// many were read.
+func (f *Follower) Poll() (int, error) {
+	msgs, err := f.sub.Poll()
+	if err != nil {
+		return 0, err
+	}
+	for i, m := range msgs {
+		if err := f.apply(m); err != nil {
+			return i, err
+		}
+		if err := f.sub.Commit(m); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// Run applies changes as they are published until ctx is done.
+func (f *Follower) Run(ctx context.Context) error {
+	return f.sub.Run(ctx, f.apply)
+}
+
+func (f *Follower) apply(m topic.Message) error {
+	key := ds.RawKey(string(m.Data))
+	d := f.d
+	l := d.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	remote, err := load(f.peer, key)
+	if err == ds.ErrNotFound {
+		return nil // trimmed by the peer since
+	}
+	if err != nil {
+		return err
+	}
+	local, err := load(d.child, key)
+	if err == ds.ErrNotFound {
+		return d.child.Put(key, encodeRecord(remote))
+	}
+	if err != nil {
+		return err
+	}
+
+	winner, err := d.opts.Policy.Resolve(key, local, remote)
+	if err != nil {
+		return fmt.Errorf("replicate: resolving %s: %w", key, err)
+	}
+	// Records are compared by content, so a region receiving a merge it
+	// would have made itself takes it instead of merging again.
+	switch {
+	case winner.sameContent(local):
+		return nil
+	case winner.sameContent(remote):
+		// Taken from the peer as is, without announcing it back.
+		return d.child.Put(key, encodeRecord(remote))
+	}
+
+	// A merged record is a new version, which the peer must pick up too.
+	winner.Origin = d.opts.Region
+	winner.Timestamp = local.Timestamp
+	if remote.Timestamp.After(winner.Timestamp) {
+		winner.Timestamp = remote.Timestamp
+	}
+	winner.Timestamp = winner.Timestamp.Add(time.Nanosecond)
+	return d.store(key, winner)
+}
@@ -0,0 +1,152 @@
+package replicate
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+	"github.com/ipfs/go-datastore/topic"
+)
+
+func TestSuite(t *testing.T) {
+	d, err := New(ds.NewMapDatastore(), Options{Region: "east"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstest.SubtestAll(t, d)
+}
+
+type region struct {
+	raw ds.Datastore
+	d   *Datastore
+	f   *Follower
+}
+
+// newPair returns two regions following each other, sharing a mock clock.
+func newPair(t *testing.T, policy Policy) (*region, *region, *clock.Mock) {
+	c := clock.NewMock(time.Unix(1000, 0))
+	east := &region{raw: ds.NewMapDatastore()}
+	west := &region{raw: ds.NewMapDatastore()}
+	var err error
+	if east.d, err = New(east.raw, Options{Region: "east", Policy: policy, Clock: c}); err != nil {
+		t.Fatal(err)
+	}
+	if west.d, err = New(west.raw, Options{Region: "west", Policy: policy, Clock: c}); err != nil {
+		t.Fatal(err)
+	}
+	if east.f, err = east.d.Follow(west.raw, "west", topic.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if west.f, err = west.d.Follow(east.raw, "east", topic.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(time.Millisecond)
+	return east, west, c
+}
+
+// settle polls both followers until neither has anything to apply.
+func settle(t *testing.T, regions ...*region) {
+	t.Helper()
+	for round := 0; round < 10; round++ {
+		total := 0
+		for _, r := range regions {
+			n, err := r.f.Poll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += n
+		}
+		if total == 0 {
+			return
+		}
+	}
+	t.Fatal("regions did not settle")
+}
+
+func get(t *testing.T, d ds.Datastore, key string) string {
+	t.Helper()
+	v, err := d.Get(ds.NewKey(key))
+	if err == ds.ErrNotFound {
+		return "<missing>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(v)
+}
+
+func TestLastWriterWins(t *testing.T) {
+	east, west, c := newPair(t, nil)
+
+	east.d.Put(ds.NewKey("/a"), []byte("east"))
+	c.Advance(time.Millisecond)
+	west.d.Put(ds.NewKey("/a"), []byte("west"))
+	west.d.Put(ds.NewKey("/b"), []byte("only west"))
+	c.Advance(time.Millisecond)
+	settle(t, east, west)
+
+	for _, r := range []*region{east, west} {
+		if v := get(t, r.d, "/a"); v != "west" {
+			t.Fatalf("%s has /a = %s", r.d.opts.Region, v)
+		}
+		if v := get(t, r.d, "/b"); v != "only west" {
+			t.Fatalf("%s has /b = %s", r.d.opts.Region, v)
+		}
+	}
+
+	// A delete after the write wins, and is not listed.
+	c.Advance(time.Millisecond)
+	east.d.Delete(ds.NewKey("/b"))
+	c.Advance(time.Millisecond)
+	settle(t, east, west)
+	if v := get(t, west.d, "/b"); v != "<missing>" {
+		t.Fatalf("delete not replicated: %s", v)
+	}
+	res, _ := west.d.Query(dsq.Query{KeysOnly: true})
+	entries, _ := res.Rest()
+	if len(entries) != 1 || entries[0].Key != "/a" {
+		t.Fatalf("unexpected listing %v", entries)
+	}
+
+	if err := east.d.Put(east.d.reserved.ChildString("x"), nil); err != ErrReserved {
+		t.Fatalf("write to the change feed: %v", err)
+	}
+}
+
+// union merges comma separated sets.
+var union = PolicyFunc(func(_ ds.Key, local, remote Record) (Record, error) {
+	set := map[string]bool{}
+	for _, r := range []Record{local, remote} {
+		for _, s := range strings.Split(string(r.Value), ",") {
+			if s != "" {
+				set[s] = true
+			}
+		}
+	}
+	var items []string
+	for s := range set {
+		items = append(items, s)
+	}
+	sort.Strings(items)
+	return Record{Value: []byte(strings.Join(items, ","))}, nil
+})
+
+func TestMerge(t *testing.T) {
+	east, west, c := newPair(t, union)
+
+	east.d.Put(ds.NewKey("/set"), []byte("a,b"))
+	west.d.Put(ds.NewKey("/set"), []byte("c"))
+	c.Advance(time.Millisecond)
+	settle(t, east, west)
+
+	for _, r := range []*region{east, west} {
+		if v := get(t, r.d, "/set"); v != "a,b,c" {
+			t.Fatalf("%s has %s", r.d.opts.Region, v)
+		}
+	}
+}
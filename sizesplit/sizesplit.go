@@ -0,0 +1,245 @@
+// Package sizesplit provides a datastore that keeps small values in one
+// datastore and large values in another, by the size of each value put,
+// and reads and queries them as one.
+//
+// It is meant for a cheap, low latency store of small records in front of
+// an object store, such as an Azure Table (the table module) beside an
+// Azure Blob container, where a request per value costs more than a
+// pin or a DHT record is worth:
+//
+//	small := table.NewDatastore(tableClient, table.Options{})
+//	large, err := azure.NewDatastore(account, container, azure.WithSharedKey(key))
+//	...
+//	d := sizesplit.New(small, large, sizesplit.Options{})
+//
+// Reads try the small datastore first, then the large one. A put removes
+// any value the key had on the other side afterwards, so a crash between
+// the two can leave a previous small value shadowing a new large one, or
+// a key listed twice by queries, until the key is put or deleted again.
+package sizesplit
+
+import (
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"go.uber.org/multierr"
+)
+
+// DefaultThreshold is the default size from which values go to the large
+// datastore, the most an Azure Table entity's binary property holds.
+const DefaultThreshold = 64 << 10
+
+// Options configures the datastore.
+type Options struct {
+	// Threshold is the size in bytes from which values are put in the
+	// large datastore; smaller ones are put in the small one. Defaults to
+	// DefaultThreshold.
+	Threshold int
+	// Immutable declares that a key is never put again with a value on
+	// the other side of the threshold, as with content-addressed blocks,
+	// and skips removing previous values from the other datastore on each
+	// put, which halves the requests a put costs.
+	Immutable bool
+}
+
+// Datastore routes values between a small and a large datastore by size.
+type Datastore struct {
+	small ds.Datastore
+	large ds.Datastore
+	opts  Options
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// New returns a datastore putting values under opts.Threshold in small and
+// the rest in large.
+func New(small, large ds.Datastore, opts Options) *Datastore {
+	if opts.Threshold <= 0 {
+		opts.Threshold = DefaultThreshold
+	}
+	return &Datastore{small: small, large: large, opts: opts}
+}
+
+// route returns the datastore a value of size n goes to, and the other.
+func (d *Datastore) route(n int) (to, other ds.Datastore) {
+	if n < d.opts.Threshold {
+		return d.small, d.large
+	}
+	return d.large, d.small
+}
+
+// Put implements Datastore.Put
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	to, other := d.route(len(value))
+	if err := to.Put(key, value); err != nil {
+		return err
+	}
+	if d.opts.Immutable {
+		return nil
+	}
+	return other.Delete(key)
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return multierr.Combine(d.small.Sync(prefix), d.large.Sync(prefix))
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	value, err := d.small.Get(key)
+	if err == ds.ErrNotFound {
+		return d.large.Get(key)
+	}
+	return value, err
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	has, err := d.small.Has(key)
+	if err != nil || has {
+		return has, err
+	}
+	return d.large.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	size, err := d.small.GetSize(key)
+	if err == ds.ErrNotFound {
+		return d.large.GetSize(key)
+	}
+	return size, err
+}
+
+// Delete implements Datastore.Delete. The key is deleted from both
+// datastores.
+func (d *Datastore) Delete(key ds.Key) error {
+	return multierr.Combine(d.small.Delete(key), d.large.Delete(key))
+}
+
+// Query implements Datastore.Query. Both datastores are queried with the
+// prefix, filters and orders, and their results merged in order; the
+// offset and limit are applied to the merged results.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	child := q
+	child.Offset, child.Limit = 0, 0
+	small, err := d.small.Query(child)
+	if err != nil {
+		return nil, err
+	}
+	large, err := d.large.Query(child)
+	if err != nil {
+		small.Close()
+		return nil, err
+	}
+
+	m := &merge{orders: q.Orders, sources: [2]dsq.Results{small, large}}
+	naive := dsq.Query{Offset: q.Offset, Limit: q.Limit}
+	return dsq.NaiveQueryApply(naive, dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next:  m.next,
+		Close: m.close,
+	})), nil
+}
+
+// merge merges the ordered results of two queries. Without orders, the
+// first results are exhausted before the second.
+type merge struct {
+	orders  []dsq.Order
+	sources [2]dsq.Results
+	heads   [2]*dsq.Result
+	done    [2]bool
+}
+
+func (m *merge) next() (dsq.Result, bool) {
+	for i, src := range m.sources {
+		if m.heads[i] != nil || m.done[i] {
+			continue
+		}
+		r, ok := src.NextSync()
+		if !ok {
+			m.done[i] = true
+			continue
+		}
+		if r.Error != nil {
+			return r, true
+		}
+		m.heads[i] = &r
+	}
+	i := 0
+	switch {
+	case m.heads[0] == nil && m.heads[1] == nil:
+		return dsq.Result{}, false
+	case m.heads[0] == nil:
+		i = 1
+	case m.heads[1] != nil && len(m.orders) > 0 && dsq.Less(m.orders, m.heads[1].Entry, m.heads[0].Entry):
+		i = 1
+	}
+	r := *m.heads[i]
+	m.heads[i] = nil
+	return r, true
+}
+
+func (m *merge) close() error {
+	return multierr.Combine(m.sources[0].Close(), m.sources[1].Close())
+}
+
+// Batch implements Batching.Batch. Writes are batched on each datastore
+// that supports batching.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	small, err := batchOf(d.small)
+	if err != nil {
+		return nil, err
+	}
+	large, err := batchOf(d.large)
+	if err != nil {
+		return nil, err
+	}
+	return &batch{d: d, small: small, large: large}, nil
+}
+
+func batchOf(d ds.Datastore) (ds.Batch, error) {
+	if b, ok := d.(ds.Batching); ok {
+		return b.Batch()
+	}
+	return ds.NewBasicBatch(d), nil
+}
+
+type batch struct {
+	d     *Datastore
+	small ds.Batch
+	large ds.Batch
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	to, other := b.large, b.small
+	if len(value) < b.d.opts.Threshold {
+		to, other = b.small, b.large
+	}
+	if err := to.Put(key, value); err != nil {
+		return err
+	}
+	if b.d.opts.Immutable {
+		return nil
+	}
+	return other.Delete(key)
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	return multierr.Combine(b.small.Delete(key), b.large.Delete(key))
+}
+
+// Commit commits the large datastore's writes, then the small one's. The
+// two are not committed atomically: if the second commit fails, keys
+// whose values moved to the small datastore may be left in neither.
+func (b *batch) Commit() error {
+	if err := b.large.Commit(); err != nil {
+		return err
+	}
+	return b.small.Commit()
+}
+
+// Close implements Datastore.Close, closing both datastores.
+func (d *Datastore) Close() error {
+	return multierr.Combine(d.small.Close(), d.large.Close())
+}
@@ -0,0 +1,81 @@
+package sizesplit
+
+import (
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, New(ds.NewMapDatastore(), ds.NewMapDatastore(), Options{Threshold: 100}))
+}
+
+func TestRouting(t *testing.T) {
+	small, large := ds.NewMapDatastore(), ds.NewMapDatastore()
+	d := New(small, large, Options{Threshold: 4})
+	k := ds.NewKey("/a")
+
+	if err := d.Put(k, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := small.Has(k); !has {
+		t.Fatal("small value not in the small datastore")
+	}
+	if err := d.Put(k, []byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := small.Has(k); has {
+		t.Fatal("previous small value not removed")
+	}
+	if v, err := d.Get(k); err != nil || string(v) != "abcd" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if err := d.Put(k, []byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := large.Has(k); has {
+		t.Fatal("previous large value not removed")
+	}
+
+	b, err := d.Batch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Put(k, []byte("abcdef"))
+	b.Put(ds.NewKey("/b"), []byte("b"))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := small.Has(k); has {
+		t.Fatal("batch left the previous small value")
+	}
+	if size, err := d.GetSize(k); err != nil || size != 6 {
+		t.Fatalf("got size %d, %v", size, err)
+	}
+}
+
+func TestMergedQuery(t *testing.T) {
+	d := New(ds.NewMapDatastore(), ds.NewMapDatastore(), Options{Threshold: 2})
+	for _, k := range []string{"/a", "/bb", "/c", "/dd", "/e"} {
+		if err := d.Put(ds.NewKey(k), []byte(k[1:])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := d.Query(dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}, Offset: 1, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	if len(keys) != 3 || keys[0] != "/bb" || keys[1] != "/c" || keys[2] != "/dd" {
+		t.Fatalf("got keys %v", keys)
+	}
+}
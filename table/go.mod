@@ -0,0 +1,19 @@
+module github.com/ipfs/go-datastore/table
+
+go 1.21
+
+replace github.com/ipfs/go-datastore => ../
+
+require (
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.10.0
+	github.com/Azure/azure-sdk-for-go/sdk/data/aztables v1.2.0
+	github.com/ipfs/go-datastore v0.4.4
+)
+
+require (
+	github.com/Azure/azure-sdk-for-go/sdk/internal v1.5.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/jbenet/goprocess v0.1.4 // indirect
+	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
@@ -0,0 +1,475 @@
+// Package table implements a Datastore over an Azure Table, for small
+// values such as DHT provider records and pins, where a request to Blob
+// Storage per value costs more than the value is worth.
+//
+// A ds.Key is split after its first PartitionDepth namespaces: those form
+// the entity's PartitionKey and the rest its RowKey, so /blocks/CIQ...
+// lands in partition "/blocks" with row "/CIQ...". Both are escaped, as
+// table keys cannot hold '/' and a few other characters. Prefix queries at
+// or below the partition depth are served within a partition; shallower
+// prefixes scan a range of partitions.
+//
+// Values are stored in a binary property, limited to 64KiB by the service.
+// Expiry is stored in the "expires" property, in Unix nanoseconds; expired
+// entities are hidden from reads but stay in the table until overwritten or
+// deleted.
+package table
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// MaxValueSize is the largest value an entity can hold.
+const MaxValueSize = 64 << 10
+
+// ErrValueTooLarge is returned by writes of values over MaxValueSize.
+var ErrValueTooLarge = fmt.Errorf("table: value larger than %d bytes", MaxValueSize)
+
+const (
+	propValue   = "v"
+	propSize    = "n"
+	propExpires = "expires"
+)
+
+// maxTransaction is the number of operations an entity group transaction
+// may hold.
+const maxTransaction = 100
+
+// API is the subset of *aztables.Client used by the datastore.
+type API interface {
+	GetEntity(ctx context.Context, partitionKey, rowKey string, options *aztables.GetEntityOptions) (aztables.GetEntityResponse, error)
+	UpsertEntity(ctx context.Context, entity []byte, options *aztables.UpsertEntityOptions) (aztables.UpsertEntityResponse, error)
+	UpdateEntity(ctx context.Context, entity []byte, options *aztables.UpdateEntityOptions) (aztables.UpdateEntityResponse, error)
+	DeleteEntity(ctx context.Context, partitionKey, rowKey string, options *aztables.DeleteEntityOptions) (aztables.DeleteEntityResponse, error)
+	NewListEntitiesPager(options *aztables.ListEntitiesOptions) *runtime.Pager[aztables.ListEntitiesResponse]
+	SubmitTransaction(ctx context.Context, actions []aztables.TransactionAction, options *aztables.SubmitTransactionOptions) (aztables.TransactionResponse, error)
+}
+
+// Options configures the datastore.
+type Options struct {
+	// PartitionDepth is the number of leading key namespaces that form the
+	// partition key. Defaults to 1.
+	PartitionDepth int
+	// Clock sets TTL expirations and hides expired entities. Defaults to
+	// the wall clock.
+	Clock clock.Clock
+}
+
+// Datastore stores keys as entities of an Azure Table.
+type Datastore struct {
+	api  API
+	opts Options
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.TTLDatastore = (*Datastore)(nil)
+
+// NewDatastore returns a datastore over the table of api, which must
+// exist.
+func NewDatastore(api API, opts Options) *Datastore {
+	if opts.PartitionDepth <= 0 {
+		opts.PartitionDepth = 1
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+	return &Datastore{api: api, opts: opts}
+}
+
+// splitKey derives the partition and row keys for key, unescaped.
+func (d *Datastore) splitKey(key ds.Key) (string, string) {
+	ns := key.Namespaces()
+	if len(ns) <= d.opts.PartitionDepth {
+		// "/" can't collide with a real remainder, which always has a name
+		// after the slash.
+		return key.String(), "/"
+	}
+	return "/" + strings.Join(ns[:d.opts.PartitionDepth], "/"),
+		"/" + strings.Join(ns[d.opts.PartitionDepth:], "/")
+}
+
+func joinKey(pk, rk string) string {
+	if rk == "/" {
+		return pk
+	}
+	return pk + rk
+}
+
+// entityKeys returns the escaped partition and row keys of key.
+func (d *Datastore) entityKeys(key ds.Key) (string, string) {
+	pk, rk := d.splitKey(key)
+	return escape(pk), escape(rk)
+}
+
+// escape returns s with the bytes table keys cannot hold escaped as %XX:
+// '%' itself, '/', '\', '#', '?', the quote the client library mangles,
+// and everything outside printable ASCII. Escaping works byte by byte, so
+// a prefix escapes to a prefix.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c < 0x20 || c > 0x7e, c == '%', c == '/', c == '\\', c == '#', c == '?', c == '\'':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescape reverses escape.
+func unescape(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// entity is the form entities are read in.
+type entity struct {
+	key     string
+	value   []byte
+	size    int
+	expires time.Time
+}
+
+func (d *Datastore) marshal(key ds.Key, value []byte, expires time.Time) ([]byte, error) {
+	if len(value) > MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+	pk, rk := d.entityKeys(key)
+	e := aztables.EDMEntity{
+		Entity: aztables.Entity{PartitionKey: pk, RowKey: rk},
+		Properties: map[string]any{
+			propValue: aztables.EDMBinary(value),
+			propSize:  int32(len(value)),
+		},
+	}
+	if !expires.IsZero() {
+		e.Properties[propExpires] = aztables.EDMInt64(expires.UnixNano())
+	}
+	return json.Marshal(e)
+}
+
+func unmarshal(b []byte) (entity, error) {
+	var e aztables.EDMEntity
+	if err := json.Unmarshal(b, &e); err != nil {
+		return entity{}, err
+	}
+	out := entity{key: joinKey(unescape(e.PartitionKey), unescape(e.RowKey)), size: -1}
+	if v, ok := e.Properties[propValue].(aztables.EDMBinary); ok {
+		out.value = []byte(v)
+	}
+	if n, ok := e.Properties[propSize].(int32); ok {
+		out.size = int(n)
+	}
+	if n, ok := e.Properties[propExpires].(aztables.EDMInt64); ok {
+		out.expires = time.Unix(0, int64(n))
+	}
+	return out, nil
+}
+
+func (d *Datastore) expired(e entity) bool {
+	return !e.expires.IsZero() && !e.expires.After(d.opts.Clock.Now())
+}
+
+func isNotFound(err error) bool {
+	var rerr *azcore.ResponseError
+	return errors.As(err, &rerr) && rerr.StatusCode == http.StatusNotFound
+}
+
+func isPreconditionFailed(err error) bool {
+	var rerr *azcore.ResponseError
+	return errors.As(err, &rerr) && rerr.StatusCode == http.StatusPreconditionFailed
+}
+
+func (d *Datastore) get(key ds.Key) (entity, azcore.ETag, error) {
+	pk, rk := d.entityKeys(key)
+	resp, err := d.api.GetEntity(context.TODO(), pk, rk, nil)
+	if isNotFound(err) {
+		return entity{}, "", ds.ErrNotFound
+	}
+	if err != nil {
+		return entity{}, "", err
+	}
+	e, err := unmarshal(resp.Value)
+	if err != nil {
+		return entity{}, "", err
+	}
+	if d.expired(e) {
+		return entity{}, "", ds.ErrNotFound
+	}
+	return e, resp.ETag, nil
+}
+
+func (d *Datastore) put(key ds.Key, value []byte, expires time.Time) error {
+	b, err := d.marshal(key, value, expires)
+	if err != nil {
+		return err
+	}
+	_, err = d.api.UpsertEntity(context.TODO(), b, &aztables.UpsertEntityOptions{UpdateMode: aztables.UpdateModeReplace})
+	return err
+}
+
+// Put implements Datastore.Put. Values over MaxValueSize fail with
+// ErrValueTooLarge.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.put(key, value, time.Time{})
+}
+
+// Sync implements Datastore.Sync. Writes are durable once acknowledged.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return nil
+}
+
+// Get implements Datastore.Get
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	e, _, err := d.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if e.value == nil {
+		return []byte{}, nil
+	}
+	return e.value, nil
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	return ds.GetBackedHas(d, key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	e, _, err := d.get(key)
+	if err != nil {
+		return -1, err
+	}
+	return len(e.value), nil
+}
+
+// Delete implements Datastore.Delete. Deleting a missing key is not an
+// error.
+func (d *Datastore) Delete(key ds.Key) error {
+	pk, rk := d.entityKeys(key)
+	_, err := d.api.DeleteEntity(context.TODO(), pk, rk, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// PutWithTTL implements TTL.PutWithTTL
+func (d *Datastore) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
+	return d.put(key, value, d.opts.Clock.Now().Add(ttl))
+}
+
+// SetTTL implements TTL.SetTTL. Expired keys are not found.
+func (d *Datastore) SetTTL(key ds.Key, ttl time.Duration) error {
+	for {
+		_, etag, err := d.get(key)
+		if err != nil {
+			return err
+		}
+		pk, rk := d.entityKeys(key)
+		b, err := json.Marshal(aztables.EDMEntity{
+			Entity:     aztables.Entity{PartitionKey: pk, RowKey: rk},
+			Properties: map[string]any{propExpires: aztables.EDMInt64(d.opts.Clock.Now().Add(ttl).UnixNano())},
+		})
+		if err != nil {
+			return err
+		}
+		// The ETag condition keeps the TTL from being merged into a value
+		// written since.
+		_, err = d.api.UpdateEntity(context.TODO(), b, &aztables.UpdateEntityOptions{IfMatch: &etag, UpdateMode: aztables.UpdateModeMerge})
+		if !isPreconditionFailed(err) {
+			return err
+		}
+	}
+}
+
+// GetExpiration implements TTL.GetExpiration. Keys without a TTL return the
+// zero time.
+func (d *Datastore) GetExpiration(key ds.Key) (time.Time, error) {
+	e, _, err := d.get(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return e.expires, nil
+}
+
+// filterFor returns the OData filter selecting the entities under a query
+// prefix, or nil for all of them.
+func (d *Datastore) filterFor(prefix string) *string {
+	p := path.Clean("/" + prefix)
+	if p == "/" {
+		return nil
+	}
+	var filter string
+	if key := ds.NewKey(p); len(key.Namespaces()) >= d.opts.PartitionDepth {
+		pk, rk := d.splitKey(key)
+		if rk == "/" {
+			// Everything in the partition but the entity of pk itself.
+			filter = fmt.Sprintf("PartitionKey eq '%s' and RowKey gt '%s'", escape(pk), escape(rk))
+		} else {
+			lo := escape(rk + "/")
+			filter = fmt.Sprintf("PartitionKey eq '%s' and RowKey ge '%s' and RowKey lt '%s'", escape(pk), lo, successor(lo))
+		}
+	} else {
+		lo := escape(p + "/")
+		filter = fmt.Sprintf("PartitionKey ge '%s' and PartitionKey lt '%s'", lo, successor(lo))
+	}
+	return &filter
+}
+
+// successor returns the least string greater than every string starting
+// with s. Escaped keys hold printable ASCII only and s ends in the hex
+// digit of an escaped slash, so incrementing its last byte is enough.
+func successor(s string) string {
+	return s[:len(s)-1] + string(s[len(s)-1]+1)
+}
+
+// Query implements Datastore.Query. The prefix is pushed down; everything
+// else is applied naively.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := &aztables.ListEntitiesOptions{Filter: d.filterFor(q.Prefix)}
+	if q.KeysOnly {
+		sel := "PartitionKey,RowKey," + propSize + "," + propExpires
+		opts.Select = &sel
+	}
+	pager := d.api.NewListEntitiesPager(opts)
+
+	var page [][]byte
+	it := dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			for {
+				for len(page) > 0 {
+					e, err := unmarshal(page[0])
+					page = page[1:]
+					if err != nil {
+						return dsq.Result{Error: err}, true
+					}
+					if d.expired(e) {
+						continue
+					}
+					r := dsq.Entry{Key: e.key, Size: e.size}
+					if !q.KeysOnly {
+						r.Value = e.value
+						if r.Value == nil {
+							r.Value = []byte{}
+						}
+					}
+					if q.ReturnExpirations {
+						r.Expiration = e.expires
+					}
+					return dsq.Result{Entry: r}, true
+				}
+				if !pager.More() {
+					return dsq.Result{}, false
+				}
+				resp, err := pager.NextPage(ctx)
+				if err != nil {
+					return dsq.Result{Error: err}, true
+				}
+				page = resp.Entities
+			}
+		},
+		Close: func() error {
+			cancel()
+			return nil
+		},
+	}
+	return dsq.NaiveQueryApply(q, dsq.ResultsFromIterator(q, it)), nil
+}
+
+// Batch implements Batching.Batch. Puts are committed as entity group
+// transactions, one per partition and 100 puts; deletes are sent one by
+// one, as a transaction fails whole on a missing entity.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return &batch{d: d, puts: make(map[ds.Key][]byte), deletes: make(map[ds.Key]struct{})}, nil
+}
+
+type batch struct {
+	d       *Datastore
+	puts    map[ds.Key][]byte
+	deletes map[ds.Key]struct{}
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	if len(value) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+	delete(b.deletes, key)
+	b.puts[key] = value
+	return nil
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	delete(b.puts, key)
+	b.deletes[key] = struct{}{}
+	return nil
+}
+
+func (b *batch) Commit() error {
+	partitions := make(map[string][]aztables.TransactionAction)
+	for k, v := range b.puts {
+		e, err := b.d.marshal(k, v, time.Time{})
+		if err != nil {
+			return err
+		}
+		pk, _ := b.d.entityKeys(k)
+		partitions[pk] = append(partitions[pk], aztables.TransactionAction{ActionType: aztables.TransactionTypeInsertReplace, Entity: e})
+	}
+	for _, actions := range partitions {
+		for len(actions) > 0 {
+			n := len(actions)
+			if n > maxTransaction {
+				n = maxTransaction
+			}
+			if _, err := b.d.api.SubmitTransaction(context.TODO(), actions[:n], nil); err != nil {
+				return err
+			}
+			actions = actions[n:]
+		}
+	}
+	for k := range b.deletes {
+		if err := b.d.Delete(k); err != nil {
+			return err
+		}
+	}
+	b.puts = make(map[ds.Key][]byte)
+	b.deletes = make(map[ds.Key]struct{})
+	return nil
+}
+
+// Close implements Datastore.Close
+func (d *Datastore) Close() error {
+	return nil
+}
@@ -0,0 +1,108 @@
+package table
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSplitKey(t *testing.T) {
+	d := NewDatastore(nil, Options{})
+	for _, tc := range []struct{ key, pk, rk string }{
+		{"/blocks/abc", "/blocks", "/abc"},
+		{"/blocks/a/b", "/blocks", "/a/b"},
+		{"/blocks", "/blocks", "/"},
+	} {
+		pk, rk := d.splitKey(ds.NewKey(tc.key))
+		if pk != tc.pk || rk != tc.rk {
+			t.Errorf("splitKey(%s) = (%s, %s), want (%s, %s)", tc.key, pk, rk, tc.pk, tc.rk)
+		}
+		if k := joinKey(pk, rk); k != tc.key {
+			t.Errorf("joinKey(%s, %s) = %s, want %s", pk, rk, k, tc.key)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for _, tc := range []struct{ in, out string }{
+		{"/a", "%2Fa"},
+		{"/50%", "%2F50%25"},
+		{"/it's", "%2Fit%27s"},
+		{"/a?b#c\\d", "%2Fa%3Fb%23c%5Cd"},
+		{"/\x00\xff", "%2F%00%FF"},
+	} {
+		if got := escape(tc.in); got != tc.out {
+			t.Errorf("escape(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+		if got := unescape(tc.out); got != tc.in {
+			t.Errorf("unescape(%q) = %q, want %q", tc.out, got, tc.in)
+		}
+	}
+}
+
+func TestFilterFor(t *testing.T) {
+	d := NewDatastore(nil, Options{})
+	for _, tc := range []struct{ prefix, filter string }{
+		{"", ""},
+		{"/", ""},
+		{"/blocks", "PartitionKey eq '%2Fblocks' and RowKey gt '%2F'"},
+		{"/blocks/a", "PartitionKey eq '%2Fblocks' and RowKey ge '%2Fa%2F' and RowKey lt '%2Fa%2G'"},
+	} {
+		got := ""
+		if f := d.filterFor(tc.prefix); f != nil {
+			got = *f
+		}
+		if got != tc.filter {
+			t.Errorf("filterFor(%q) = %q, want %q", tc.prefix, got, tc.filter)
+		}
+	}
+	d = NewDatastore(nil, Options{PartitionDepth: 2})
+	if f := d.filterFor("/a"); f == nil || *f != "PartitionKey ge '%2Fa%2F' and PartitionKey lt '%2Fa%2G'" {
+		t.Errorf("unexpected partition range %v", f)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	c := clock.NewMock(time.Unix(1000, 0))
+	d := NewDatastore(nil, Options{Clock: c})
+	b, err := d.marshal(ds.NewKey("/blocks/it's"), []byte("value"), c.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.key != "/blocks/it's" || string(e.value) != "value" || e.size != 5 {
+		t.Fatalf("unexpected entity %+v", e)
+	}
+	if d.expired(e) {
+		t.Fatal("expired early")
+	}
+	c.Advance(time.Minute)
+	if !d.expired(e) {
+		t.Fatal("not expired after its TTL")
+	}
+	if _, err := d.marshal(ds.NewKey("/k"), make([]byte, MaxValueSize+1), time.Time{}); err != ErrValueTooLarge {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+}
+
+// TestSuite runs against the table named by AZURE_TABLE in the account of
+// AZURE_TABLES_CONNECTION_STRING. The table is cleared by the suite.
+func TestSuite(t *testing.T) {
+	conn, name := os.Getenv("AZURE_TABLES_CONNECTION_STRING"), os.Getenv("AZURE_TABLE")
+	if conn == "" || name == "" {
+		t.Skip("AZURE_TABLES_CONNECTION_STRING or AZURE_TABLE not set")
+	}
+	svc, err := aztables.NewServiceClientFromConnectionString(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstest.SubtestAll(t, NewDatastore(svc.NewClient(name), Options{}))
+}
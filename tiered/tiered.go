@@ -0,0 +1,467 @@
+// Package tiered provides a two-tier datastore: a small, fast hot tier,
+// in memory or on local disk, in front of a large, slow cold tier such as
+// an Azure container, so a gateway serves its hot blocks at the hot
+// tier's speed.
+//
+// Reads are served by the hot tier, and misses read through to the cold
+// tier and are kept hot. Writes are written back: a put is acknowledged
+// once it is in the hot tier and copied to the cold tier in the
+// background, every FlushInterval, or on Sync. The hot tier is bounded by
+// the total size of its values, evicting the least recently used ones;
+// an evicted value not flushed yet is flushed first, by the put or read
+// making room for another.
+//
+// Unflushed keys are recorded in the hot tier itself, so with a
+// persistent hot tier, values written but not yet flushed when the
+// process stopped are flushed after New opens it again. The hot tier is
+// the tiered datastore's own: its keys are namespaced, and it must not be
+// written by others.
+//
+// Deletes are not written back: they reach both tiers before returning,
+// so a deleted key cannot be read back from the cold tier. Queries flush
+// the keys under their prefix and are then answered by the cold tier.
+package tiered
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"go.uber.org/multierr"
+)
+
+const (
+	// DefaultMaxBytes bounds the hot tier when Options.MaxBytes is unset.
+	DefaultMaxBytes = 256 << 20
+	// DefaultFlushInterval is the flush interval when
+	// Options.FlushInterval is unset.
+	DefaultFlushInterval = time.Second
+)
+
+// The hot tier holds values under valuePrefix and marks unflushed keys
+// under dirtyPrefix.
+var (
+	valuePrefix = ds.NewKey("/v")
+	dirtyPrefix = ds.NewKey("/d")
+)
+
+// lockStripes is the number of locks serializing the writes of keys.
+const lockStripes = 256
+
+// Options configures the datastore.
+type Options struct {
+	// MaxBytes bounds the total size of the values in the hot tier.
+	// Values read from the cold tier that are larger are not kept hot.
+	MaxBytes int64
+	// FlushInterval is how often unflushed values are copied to the cold
+	// tier.
+	FlushInterval time.Duration
+	// Clock times the flushes. Defaults to the wall clock.
+	Clock clock.Clock
+}
+
+type entry struct {
+	key   ds.Key
+	size  int64
+	dirty bool
+}
+
+// Datastore serves a cold datastore from a hot one, writing back.
+type Datastore struct {
+	hot  ds.Datastore
+	cold ds.Datastore
+	opts Options
+
+	// locks serialize the hot tier writes and flushes of each key. They
+	// are taken before mu.
+	locks [lockStripes]sync.Mutex
+
+	mu      sync.Mutex
+	lru     *list.List // of *entry, most recently used first
+	entries map[ds.Key]*list.Element
+	size    int64
+	// gen counts writes, so a read of the cold tier racing a write does
+	// not keep hot what it read from before the write.
+	gen uint64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// New returns a datastore serving cold from hot, which it takes over. The
+// values hot already holds are indexed, and those left unflushed by a
+// previous process are flushed with the next flush.
+func New(hot, cold ds.Datastore, opts Options) (*Datastore, error) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+	d := &Datastore{
+		hot:     hot,
+		cold:    cold,
+		opts:    opts,
+		lru:     list.New(),
+		entries: make(map[ds.Key]*list.Element),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	if err := d.makeRoom(); err != nil {
+		return nil, err
+	}
+	go d.flusher()
+	return d, nil
+}
+
+// NewMemory returns a datastore serving cold from a hot tier in memory.
+func NewMemory(cold ds.Datastore, opts Options) *Datastore {
+	// Loading an empty map datastore cannot fail.
+	d, _ := New(dssync.MutexWrap(ds.NewMapDatastore()), cold, opts)
+	return d
+}
+
+// load indexes the values in the hot tier and the marks of those
+// unflushed.
+func (d *Datastore) load() error {
+	dirty := make(map[ds.Key]bool)
+	err := scan(d.hot, dirtyPrefix, func(key ds.Key, _ int) {
+		dirty[key] = true
+	})
+	if err != nil {
+		return err
+	}
+	err = scan(d.hot, valuePrefix, func(key ds.Key, size int) {
+		d.entries[key] = d.lru.PushBack(&entry{key: key, size: int64(size), dirty: dirty[key]})
+		d.size += int64(size)
+		delete(dirty, key)
+	})
+	if err != nil {
+		return err
+	}
+	// Marks without a value were left by a crash before the value was
+	// written.
+	for key := range dirty {
+		if err := d.hot.Delete(dirtyPrefix.Child(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn with the keys under prefix in hot, without the prefix,
+// and the sizes of their values.
+func scan(hot ds.Datastore, prefix ds.Key, fn func(ds.Key, int)) error {
+	res, err := hot.Query(dsq.Query{Prefix: prefix.String(), KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		fn(ds.NewKey(r.Key[len(prefix.String()):]), r.Size)
+	}
+	return nil
+}
+
+func (d *Datastore) lock(key ds.Key) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key.String()))
+	return &d.locks[h.Sum32()%lockStripes]
+}
+
+// touchLocked records key as held hot with a value of size, most
+// recently used, and returns its entry.
+func (d *Datastore) touchLocked(key ds.Key, size int64) *entry {
+	if el, ok := d.entries[key]; ok {
+		e := el.Value.(*entry)
+		d.size += size - e.size
+		e.size = size
+		d.lru.MoveToFront(el)
+		return e
+	}
+	e := &entry{key: key, size: size}
+	d.entries[key] = d.lru.PushFront(e)
+	d.size += size
+	return e
+}
+
+func (d *Datastore) removeLocked(key ds.Key) {
+	if el, ok := d.entries[key]; ok {
+		d.size -= el.Value.(*entry).size
+		d.lru.Remove(el)
+		delete(d.entries, key)
+	}
+}
+
+// Put implements Datastore.Put. The value is written to the hot tier and
+// marked for the next flush.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	l := d.lock(key)
+	l.Lock()
+	// The mark goes first, so a crash never leaves a value that is not
+	// known to be unflushed.
+	err := d.hot.Put(dirtyPrefix.Child(key), nil)
+	if err == nil {
+		err = d.hot.Put(valuePrefix.Child(key), value)
+	}
+	d.mu.Lock()
+	d.gen++
+	if err == nil {
+		d.touchLocked(key, int64(len(value))).dirty = true
+	}
+	d.mu.Unlock()
+	l.Unlock()
+	if err != nil {
+		return err
+	}
+	return d.makeRoom()
+}
+
+// makeRoom evicts the least recently used values from the hot tier until
+// it fits its bound, flushing them first if they have not been.
+func (d *Datastore) makeRoom() error {
+	for {
+		d.mu.Lock()
+		if d.size <= d.opts.MaxBytes || d.lru.Len() == 0 {
+			d.mu.Unlock()
+			return nil
+		}
+		key := d.lru.Back().Value.(*entry).key
+		d.mu.Unlock()
+
+		if err := d.evict(key); err != nil {
+			return err
+		}
+	}
+}
+
+// evict flushes key if needed and drops its value from the hot tier.
+func (d *Datastore) evict(key ds.Key) error {
+	l := d.lock(key)
+	l.Lock()
+	defer l.Unlock()
+	if err := d.flushLocked(key); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	_, ok := d.entries[key]
+	d.removeLocked(key)
+	d.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return d.hot.Delete(valuePrefix.Child(key))
+}
+
+// flushLocked copies key's value to the cold tier if it is marked
+// unflushed. The key's lock is held.
+func (d *Datastore) flushLocked(key ds.Key) error {
+	d.mu.Lock()
+	el, ok := d.entries[key]
+	dirty := ok && el.Value.(*entry).dirty
+	d.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	value, err := d.hot.Get(valuePrefix.Child(key))
+	if err == ds.ErrNotFound {
+		// Lost from the hot tier; there is nothing left to flush.
+		d.mu.Lock()
+		d.removeLocked(key)
+		d.mu.Unlock()
+		return d.hot.Delete(dirtyPrefix.Child(key))
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.cold.Put(key, value); err != nil {
+		return err
+	}
+	if err := d.hot.Delete(dirtyPrefix.Child(key)); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if el, ok := d.entries[key]; ok {
+		el.Value.(*entry).dirty = false
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// flush copies the unflushed values under prefix to the cold tier.
+func (d *Datastore) flush(prefix ds.Key) error {
+	d.mu.Lock()
+	var keys []ds.Key
+	for key, el := range d.entries {
+		if el.Value.(*entry).dirty && (prefix.Equal(key) || prefix.IsAncestorOf(key)) {
+			keys = append(keys, key)
+		}
+	}
+	d.mu.Unlock()
+
+	var err error
+	for _, key := range keys {
+		l := d.lock(key)
+		l.Lock()
+		err = multierr.Append(err, d.flushLocked(key))
+		l.Unlock()
+	}
+	return err
+}
+
+func (d *Datastore) flusher() {
+	defer close(d.done)
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-d.opts.Clock.After(d.opts.FlushInterval):
+		}
+		// Values that fail to flush stay marked, and are tried again by
+		// the next flush; Sync reports the failures.
+		d.flush(ds.NewKey("/"))
+	}
+}
+
+// Get implements Datastore.Get. A value missing from the hot tier is read
+// from the cold tier and kept hot.
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	d.mu.Lock()
+	el, ok := d.entries[key]
+	if ok {
+		d.lru.MoveToFront(el)
+	}
+	gen := d.gen
+	d.mu.Unlock()
+	if ok {
+		value, err := d.hot.Get(valuePrefix.Child(key))
+		if err != ds.ErrNotFound {
+			return value, err
+		}
+	}
+
+	value, err := d.cold.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(value)) <= d.opts.MaxBytes {
+		d.fill(gen, key, value)
+	}
+	return value, nil
+}
+
+// fill keeps a value read from the cold tier hot, unless a key was
+// written since gen or key is held hot. Failing to does not fail the
+// read.
+func (d *Datastore) fill(gen uint64, key ds.Key, value []byte) {
+	l := d.lock(key)
+	l.Lock()
+	d.mu.Lock()
+	_, held := d.entries[key]
+	stale := held || gen != d.gen
+	d.mu.Unlock()
+	if stale || d.hot.Put(valuePrefix.Child(key), value) != nil {
+		l.Unlock()
+		return
+	}
+	d.mu.Lock()
+	d.touchLocked(key, int64(len(value)))
+	d.mu.Unlock()
+	l.Unlock()
+	d.makeRoom()
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	d.mu.Lock()
+	_, ok := d.entries[key]
+	d.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return d.cold.Has(key)
+}
+
+// GetSize implements Datastore.GetSize
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	d.mu.Lock()
+	el, ok := d.entries[key]
+	d.mu.Unlock()
+	if ok {
+		return int(el.Value.(*entry).size), nil
+	}
+	return d.cold.GetSize(key)
+}
+
+// Delete implements Datastore.Delete. The key is deleted from both tiers
+// before returning.
+func (d *Datastore) Delete(key ds.Key) error {
+	l := d.lock(key)
+	l.Lock()
+	defer l.Unlock()
+	d.mu.Lock()
+	d.gen++
+	d.mu.Unlock()
+	if err := d.cold.Delete(key); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.removeLocked(key)
+	d.mu.Unlock()
+	return multierr.Append(
+		d.hot.Delete(valuePrefix.Child(key)),
+		d.hot.Delete(dirtyPrefix.Child(key)),
+	)
+}
+
+// Query implements Datastore.Query. The unflushed values under the prefix
+// are flushed, and the query answered by the cold tier.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	if err := d.flush(ds.NewKey(q.Prefix)); err != nil {
+		return nil, err
+	}
+	return d.cold.Query(q)
+}
+
+// Sync implements Datastore.Sync. The unflushed values under prefix are
+// flushed to the cold tier, which is synced.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	if err := d.flush(prefix); err != nil {
+		return err
+	}
+	return d.cold.Sync(prefix)
+}
+
+// Batch implements Batching.Batch. Puts are written back like single
+// ones.
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// Close flushes every unflushed value and closes both tiers. Later calls
+// return nil.
+func (d *Datastore) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		<-d.done
+		err = multierr.Combine(d.flush(ds.NewKey("/")), d.hot.Close(), d.cold.Close())
+	})
+	return err
+}
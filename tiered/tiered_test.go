@@ -0,0 +1,134 @@
+package tiered
+
+import (
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, NewMemory(dssync.MutexWrap(ds.NewMapDatastore()), Options{MaxBytes: 1 << 10}))
+}
+
+// newTest returns a datastore whose background flushes never run, as its
+// clock does not advance.
+func newTest(t *testing.T, hot, cold ds.Datastore, maxBytes int64) *Datastore {
+	d, err := New(hot, cold, Options{MaxBytes: maxBytes, Clock: clock.NewMock(time.Unix(0, 0))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestWriteBack(t *testing.T) {
+	cold := dssync.MutexWrap(ds.NewMapDatastore())
+	d := newTest(t, dssync.MutexWrap(ds.NewMapDatastore()), cold, 1<<10)
+	k := ds.NewKey("/a")
+
+	if err := d.Put(k, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := cold.Has(k); has {
+		t.Fatal("put reached the cold tier before a flush")
+	}
+	if v, err := d.Get(k); err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if err := d.Sync(ds.NewKey("/")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cold.Get(k); err != nil || string(v) != "1" {
+		t.Fatalf("cold tier has %q, %v after sync", v, err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	hot, cold := dssync.MutexWrap(ds.NewMapDatastore()), dssync.MutexWrap(ds.NewMapDatastore())
+	d := newTest(t, hot, cold, 4)
+	for _, k := range []string{"/a", "/b", "/c"} {
+		if err := d.Put(ds.NewKey(k), []byte("xx")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The oldest value was flushed to make room, then evicted.
+	if has, _ := hot.Has(valuePrefix.Child(ds.NewKey("/a"))); has {
+		t.Fatal("least recently used value not evicted")
+	}
+	if has, _ := cold.Has(ds.NewKey("/a")); !has {
+		t.Fatal("evicted value not flushed first")
+	}
+	if has, _ := cold.Has(ds.NewKey("/c")); has {
+		t.Fatal("newest value flushed early")
+	}
+
+	// Reading it back keeps it hot again, evicting the next oldest.
+	if v, err := d.Get(ds.NewKey("/a")); err != nil || string(v) != "xx" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if has, _ := hot.Has(valuePrefix.Child(ds.NewKey("/a"))); !has {
+		t.Fatal("value read from the cold tier not kept hot")
+	}
+	if has, _ := hot.Has(valuePrefix.Child(ds.NewKey("/b"))); has {
+		t.Fatal("next least recently used value not evicted")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	hot, cold := dssync.MutexWrap(ds.NewMapDatastore()), dssync.MutexWrap(ds.NewMapDatastore())
+	d := newTest(t, hot, cold, 1<<10)
+	if err := d.Put(ds.NewKey("/a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// A crash before a mark's value was written.
+	hot.Put(dirtyPrefix.Child(ds.NewKey("/lost")), nil)
+
+	d = newTest(t, hot, cold, 1<<10)
+	if size, err := d.GetSize(ds.NewKey("/a")); err != nil || size != 1 {
+		t.Fatalf("got size %d, %v", size, err)
+	}
+	if err := d.Sync(ds.NewKey("/")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cold.Get(ds.NewKey("/a")); err != nil || string(v) != "1" {
+		t.Fatalf("unflushed value not recovered: %q, %v", v, err)
+	}
+	if has, _ := hot.Has(dirtyPrefix.Child(ds.NewKey("/lost"))); has {
+		t.Fatal("mark without a value kept")
+	}
+}
+
+func TestStaleFillNotKept(t *testing.T) {
+	cold := dssync.MutexWrap(ds.NewMapDatastore())
+	d := newTest(t, dssync.MutexWrap(ds.NewMapDatastore()), cold, 1<<10)
+	k := ds.NewKey("/a")
+	cold.Put(k, []byte("v1"))
+
+	// A cold read from before a Delete finishes after it.
+	d.mu.Lock()
+	gen := d.gen
+	d.mu.Unlock()
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	d.fill(gen, k, []byte("v1"))
+	if has, _ := d.Has(k); has {
+		t.Fatal("deleted key kept hot by a stale read")
+	}
+	if _, err := d.Get(k); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	d := newTest(t, dssync.MutexWrap(ds.NewMapDatastore()), dssync.MutexWrap(ds.NewMapDatastore()), 1<<10)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+}
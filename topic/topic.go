@@ -0,0 +1,235 @@
+// Package topic emulates low-rate publish/subscribe on a datastore.
+//
+// Publishers append messages under /topics/<name>/msgs/<seq>, where seq
+// orders messages by publish time. Subscribers poll for keys after their
+// cursor, which is stored under /topics/<name>/cursors/<subscriber> so a
+// restarted subscriber resumes where it left off.
+//
+// Publishers on different machines may have skewed clocks, and a slow
+// write may land after a later one, so each poll also rescans a lookback
+// window behind the cursor and skips messages already delivered. Delivery
+// is at least once: a message handled but not yet committed when a
+// subscriber stops is delivered again.
+package topic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Root is the prefix all topics are stored under.
+var Root = ds.NewKey("/topics")
+
+// Message is a published message.
+type Message struct {
+	// Seq orders messages within the topic.
+	Seq  string
+	Data []byte
+}
+
+// Topic is a named topic in a datastore.
+type Topic struct {
+	d       ds.Datastore
+	msgs    ds.Key
+	cursors ds.Key
+
+	// Clock stamps published messages and paces Run. Defaults to the
+	// wall clock.
+	Clock clock.Clock
+}
+
+// New returns the topic of the given name.
+func New(d ds.Datastore, name string) *Topic {
+	base := Root.ChildString(name)
+	return &Topic{
+		d:       d,
+		msgs:    base.ChildString("msgs"),
+		cursors: base.ChildString("cursors"),
+		Clock:   clock.Real,
+	}
+}
+
+func seqAt(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+// Publish appends a message and returns its sequence.
+func (t *Topic) Publish(data []byte) (string, error) {
+	b := make([]byte, 4)
+	rand.Read(b)
+	seq := seqAt(t.Clock.Now()) + "-" + hex.EncodeToString(b)
+	return seq, t.d.Put(t.msgs.ChildString(seq), data)
+}
+
+// Trim deletes messages published more than age ago.
+func (t *Topic) Trim(age time.Duration) error {
+	res, err := t.d.Query(dsq.Query{
+		Prefix:   t.msgs.String(),
+		KeysOnly: true,
+		Filters: []dsq.Filter{dsq.FilterKeyCompare{
+			Op:  dsq.LessThan,
+			Key: t.msgs.ChildString(seqAt(t.Clock.Now().Add(-age))).String(),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := t.d.Delete(ds.RawKey(e.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Options configures a Subscriber.
+type Options struct {
+	// Lookback is how far behind the cursor each poll rescans for late
+	// messages. Defaults to 5 seconds.
+	Lookback time.Duration
+	// PollInterval is the delay between polls in Run when nothing is new.
+	// Defaults to one second.
+	PollInterval time.Duration
+}
+
+// Subscriber tails a topic from a stored cursor.
+type Subscriber struct {
+	t      *Topic
+	cursor ds.Key
+	opts   Options
+
+	// last is the newest delivered sequence, and seen the sequences
+	// delivered within the lookback window behind it.
+	last string
+	seen map[string]struct{}
+}
+
+// Subscribe returns the named subscriber of the topic, loading its stored
+// cursor. A new subscriber starts with messages published from now on.
+func (t *Topic) Subscribe(name string, opts Options) (*Subscriber, error) {
+	if opts.Lookback <= 0 {
+		opts.Lookback = 5 * time.Second
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	s := &Subscriber{
+		t:      t,
+		cursor: t.cursors.ChildString(name),
+		opts:   opts,
+		seen:   make(map[string]struct{}),
+	}
+	b, err := t.d.Get(s.cursor)
+	switch err {
+	case nil:
+		s.last = string(b)
+	case ds.ErrNotFound:
+		s.last = seqAt(t.Clock.Now())
+		if err := t.d.Put(s.cursor, []byte(s.last)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return s, nil
+}
+
+// windowStart returns the oldest sequence rescanned by a poll.
+func (s *Subscriber) windowStart() string {
+	var nanos int64
+	fmt.Sscanf(s.last, "%d", &nanos)
+	return seqAt(time.Unix(0, nanos).Add(-s.opts.Lookback))
+}
+
+// Poll returns the messages not yet delivered, oldest first. They count as
+// delivered once passed to Commit.
+func (s *Subscriber) Poll() ([]Message, error) {
+	start := s.windowStart()
+	res, err := s.t.d.Query(dsq.Query{
+		Prefix: s.t.msgs.String(),
+		Filters: []dsq.Filter{dsq.FilterKeyCompare{
+			Op:  dsq.GreaterThanOrEqual,
+			Key: s.t.msgs.ChildString(start).String(),
+		}},
+		Orders: []dsq.Order{dsq.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []Message
+	for _, e := range entries {
+		seq := ds.RawKey(e.Key).BaseNamespace()
+		if _, ok := s.seen[seq]; ok {
+			continue
+		}
+		// Messages behind the cursor that were not seen in this process
+		// were delivered before a restart.
+		if seq <= s.last && len(s.seen) == 0 {
+			continue
+		}
+		msgs = append(msgs, Message{Seq: seq, Data: e.Value})
+	}
+	return msgs, nil
+}
+
+// Commit records m as delivered and advances the stored cursor.
+func (s *Subscriber) Commit(m Message) error {
+	s.seen[m.Seq] = struct{}{}
+	if m.Seq > s.last {
+		s.last = m.Seq
+		if err := s.t.d.Put(s.cursor, []byte(s.last)); err != nil {
+			return err
+		}
+	}
+	start := s.windowStart()
+	for seq := range s.seen {
+		if seq < start {
+			delete(s.seen, seq)
+		}
+	}
+	return nil
+}
+
+// Run polls the topic until ctx is done, passing each message to handle
+// and committing it if handle succeeds. It returns the first error from
+// polling, handling or committing.
+func (s *Subscriber) Run(ctx context.Context, handle func(Message) error) error {
+	for {
+		msgs, err := s.Poll()
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := handle(m); err != nil {
+				return err
+			}
+			if err := s.Commit(m); err != nil {
+				return err
+			}
+		}
+		if len(msgs) > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.t.Clock.After(s.opts.PollInterval):
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package topic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/clock"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+func newTopic(d ds.Datastore) (*Topic, *clock.Mock) {
+	c := clock.NewMock(time.Unix(1000, 0))
+	t := New(d, "events")
+	t.Clock = c
+	return t, c
+}
+
+func bodies(msgs []Message) []string {
+	var out []string
+	for _, m := range msgs {
+		out = append(out, string(m.Data))
+	}
+	return out
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	d := ds.NewMapDatastore()
+	top, c := newTopic(d)
+
+	c.Advance(time.Second)
+	top.Publish([]byte("before"))
+	c.Advance(time.Millisecond)
+
+	sub, err := top.Subscribe("worker", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(time.Second)
+	top.Publish([]byte("a"))
+	c.Advance(time.Second)
+	top.Publish([]byte("b"))
+
+	msgs, err := sub.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(msgs); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("polled %v", got)
+	}
+	sub.Commit(msgs[0])
+
+	// A restarted subscriber resumes after its committed cursor.
+	sub2, err := top.Subscribe("worker", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err = sub2.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(msgs); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("resumed with %v", got)
+	}
+}
+
+func TestLateMessage(t *testing.T) {
+	top, c := newTopic(ds.NewMapDatastore())
+	sub, err := top.Subscribe("worker", Options{Lookback: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Advance(5 * time.Second)
+	top.Publish([]byte("on time"))
+	msgs, _ := sub.Poll()
+	for _, m := range msgs {
+		sub.Commit(m)
+	}
+
+	// A publisher with a slow clock writes behind the cursor.
+	c.Advance(-2 * time.Second)
+	top.Publish([]byte("late"))
+
+	msgs, err = sub.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(msgs); len(got) != 1 || got[0] != "late" {
+		t.Fatalf("polled %v", got)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	d := ds.NewMapDatastore()
+	top, c := newTopic(d)
+	top.Publish([]byte("old"))
+	c.Advance(time.Hour)
+	top.Publish([]byte("new"))
+
+	if err := top.Trim(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := top.Subscribe("s", Options{})
+	sub.last = "0"
+	msgs, _ := sub.Poll()
+	if got := bodies(msgs); len(got) != 1 || got[0] != "new" {
+		t.Fatalf("after trim %v", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	top := New(dssync.MutexWrap(ds.NewMapDatastore()), "events")
+	sub, err := top.Subscribe("worker", Options{PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	top.Publish([]byte("x"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got := make(chan string, 1)
+	go sub.Run(ctx, func(m Message) error {
+		got <- string(m.Data)
+		cancel()
+		return nil
+	})
+	select {
+	case v := <-got:
+		if v != "x" {
+			t.Fatalf("got %q", v)
+		}
+	case <-ctx.Done():
+		t.Fatal("message not delivered")
+	}
+}
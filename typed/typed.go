@@ -0,0 +1,122 @@
+// Package typed stores Go values in a datastore through a Codec, so callers
+// do not marshal and unmarshal around every datastore call.
+//
+//	s := typed.New(d, typed.JSON)
+//	err := s.Put(ds.NewKey("/users/42"), &user)
+//	err = s.Get(ds.NewKey("/users/42"), &user)
+//
+// JSON and Gob codecs are provided; other encodings such as CBOR or
+// protobuf plug in by implementing Codec.
+package typed
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Codec converts values to and from their stored bytes.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+var (
+	// JSON encodes values with encoding/json.
+	JSON Codec = jsonCodec{}
+	// Gob encodes values with encoding/gob. Each value is encoded as a
+	// self-contained stream, including its type description.
+	Gob Codec = gobCodec{}
+)
+
+// Get reads key from d and decodes it into v, which must be a pointer.
+func Get(d ds.Read, c Codec, key ds.Key, v interface{}) error {
+	data, err := d.Get(key)
+	if err != nil {
+		return err
+	}
+	if err := c.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("decoding %s: %w", key, err)
+	}
+	return nil
+}
+
+// Put encodes v and writes it to d under key.
+func Put(d ds.Write, c Codec, key ds.Key, v interface{}) error {
+	data, err := c.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", key, err)
+	}
+	return d.Put(key, data)
+}
+
+// Store binds a datastore to a codec. Methods other than Get and Put are
+// the datastore's own; use the Datastore field for raw Get and Put.
+type Store struct {
+	ds.Datastore
+	Codec Codec
+}
+
+// New returns a Store encoding values in d with c.
+func New(d ds.Datastore, c Codec) *Store {
+	return &Store{Datastore: d, Codec: c}
+}
+
+// Get decodes the value of key into v, which must be a pointer.
+func (s *Store) Get(key ds.Key, v interface{}) error {
+	return Get(s.Datastore, s.Codec, key, v)
+}
+
+// Put encodes v and stores it under key.
+func (s *Store) Put(key ds.Key, v interface{}) error {
+	return Put(s.Datastore, s.Codec, key, v)
+}
+
+// Each decodes every value matching q, calling fn with the key and the
+// decoded value. newValue returns a fresh pointer to decode each value
+// into. Iteration stops at the first error, from the query, decoding or fn.
+func (s *Store) Each(q dsq.Query, newValue func() interface{}, fn func(key ds.Key, v interface{}) error) error {
+	q.KeysOnly = false
+	res, err := s.Datastore.Query(q)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		v := newValue()
+		if err := s.Codec.Unmarshal(r.Value, v); err != nil {
+			return fmt.Errorf("decoding %s: %w", r.Key, err)
+		}
+		if err := fn(ds.RawKey(r.Key), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
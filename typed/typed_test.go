@@ -0,0 +1,72 @@
+package typed
+
+import (
+	"reflect"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+type user struct {
+	Name  string
+	Email string
+	Tags  []string
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, c := range map[string]Codec{"json": JSON, "gob": Gob} {
+		s := New(ds.NewMapDatastore(), c)
+		in := user{Name: "ada", Email: "ada@example.com", Tags: []string{"admin"}}
+		k := ds.NewKey("/users/1")
+
+		if err := s.Put(k, &in); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var out user
+		if err := s.Get(k, &out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("%s: got %+v, want %+v", name, out, in)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	d := ds.NewMapDatastore()
+	var u user
+	if err := Get(d, JSON, ds.NewKey("/missing"), &u); err != ds.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	d.Put(ds.NewKey("/bad"), []byte("{"))
+	if err := Get(d, JSON, ds.NewKey("/bad"), &u); err == nil {
+		t.Fatal("expected a decoding error")
+	}
+
+	if err := Put(d, JSON, ds.NewKey("/chan"), make(chan int)); err == nil {
+		t.Fatal("expected an encoding error")
+	}
+}
+
+func TestEach(t *testing.T) {
+	s := New(ds.NewMapDatastore(), JSON)
+	s.Put(ds.NewKey("/users/1"), user{Name: "a"})
+	s.Put(ds.NewKey("/users/2"), user{Name: "b"})
+	s.Put(ds.NewKey("/other"), user{Name: "c"})
+
+	names := map[string]string{}
+	err := s.Each(dsq.Query{Prefix: "/users"}, func() interface{} { return new(user) },
+		func(key ds.Key, v interface{}) error {
+			names[key.String()] = v.(*user).Name
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/users/1": "a", "/users/2": "b"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %v", names)
+	}
+}
@@ -0,0 +1,161 @@
+// Package verify checks two datastores for consistency, for example after a
+// copy or during a migration between backends.
+//
+// Both datastores are listed in key order and merged, so every key is
+// visited once. Keys present on both sides are compared by size and, unless
+// disabled, by value.
+package verify
+
+import (
+	"bytes"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Options configures a comparison.
+type Options struct {
+	// Prefix restricts the comparison to keys under it.
+	Prefix string
+	// SizesOnly compares sizes without fetching values.
+	SizesOnly bool
+	// MaxReported caps how many keys of each kind are recorded in the
+	// report; counts are always exact. Zero records every key.
+	MaxReported int
+}
+
+// Report lists the differences found. Missing keys are in the source but
+// not the target, extra keys are in the target but not the source.
+type Report struct {
+	Checked    int
+	Missing    []string
+	Extra      []string
+	Mismatched []string
+
+	MissingCount    int
+	ExtraCount      int
+	MismatchedCount int
+}
+
+// Consistent reports whether no differences were found.
+func (r *Report) Consistent() bool {
+	return r.MissingCount == 0 && r.ExtraCount == 0 && r.MismatchedCount == 0
+}
+
+func (r *Report) record(list *[]string, count *int, key string, max int) {
+	*count++
+	if max == 0 || len(*list) < max {
+		*list = append(*list, key)
+	}
+}
+
+// cursor walks a key-ordered query.
+type cursor struct {
+	res  dsq.Results
+	cur  dsq.Entry
+	done bool
+}
+
+func newCursor(d ds.Datastore, prefix string) (*cursor, error) {
+	res, err := d.Query(dsq.Query{
+		Prefix:       prefix,
+		KeysOnly:     true,
+		ReturnsSizes: true,
+		Orders:       []dsq.Order{dsq.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := &cursor{res: res}
+	return c, c.next()
+}
+
+func (c *cursor) next() error {
+	r, ok := c.res.NextSync()
+	if !ok {
+		c.done = true
+		return nil
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+	c.cur = r.Entry
+	return nil
+}
+
+// Compare checks target against source.
+func Compare(source, target ds.Datastore, opts Options) (*Report, error) {
+	src, err := newCursor(source, opts.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing source: %w", err)
+	}
+	defer src.res.Close()
+	dst, err := newCursor(target, opts.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing target: %w", err)
+	}
+	defer dst.res.Close()
+
+	rep := &Report{}
+	for !src.done || !dst.done {
+		switch {
+		case dst.done || (!src.done && src.cur.Key < dst.cur.Key):
+			rep.Checked++
+			rep.record(&rep.Missing, &rep.MissingCount, src.cur.Key, opts.MaxReported)
+			err = src.next()
+		case src.done || dst.cur.Key < src.cur.Key:
+			rep.Checked++
+			rep.record(&rep.Extra, &rep.ExtraCount, dst.cur.Key, opts.MaxReported)
+			err = dst.next()
+		default:
+			rep.Checked++
+			same, cerr := sameEntry(source, target, src.cur, dst.cur, opts.SizesOnly)
+			if cerr != nil {
+				return nil, cerr
+			}
+			if !same {
+				rep.record(&rep.Mismatched, &rep.MismatchedCount, src.cur.Key, opts.MaxReported)
+			}
+			if err = src.next(); err == nil {
+				err = dst.next()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rep, nil
+}
+
+func sameEntry(source, target ds.Datastore, a, b dsq.Entry, sizesOnly bool) (bool, error) {
+	key := ds.RawKey(a.Key)
+	sa, sb := a.Size, b.Size
+	var err error
+	if sa < 0 {
+		if sa, err = source.GetSize(key); err != nil {
+			return false, fmt.Errorf("source %s: %w", key, err)
+		}
+	}
+	if sb < 0 {
+		if sb, err = target.GetSize(key); err != nil {
+			return false, fmt.Errorf("target %s: %w", key, err)
+		}
+	}
+	if sa != sb {
+		return false, nil
+	}
+	if sizesOnly {
+		return true, nil
+	}
+
+	va, err := source.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("source %s: %w", key, err)
+	}
+	vb, err := target.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("target %s: %w", key, err)
+	}
+	return bytes.Equal(va, vb), nil
+}
@@ -0,0 +1,69 @@
+package verify
+
+import (
+	"reflect"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+func fill(d ds.Datastore, kv map[string]string) {
+	for k, v := range kv {
+		d.Put(ds.NewKey(k), []byte(v))
+	}
+}
+
+func TestCompare(t *testing.T) {
+	src, dst := ds.NewMapDatastore(), ds.NewMapDatastore()
+	fill(src, map[string]string{"/a": "1", "/b": "2", "/c": "3", "/d": "4", "/x/y": "5"})
+	fill(dst, map[string]string{"/a": "1", "/c": "x", "/d": "44", "/e": "5", "/x/y": "5"})
+
+	rep, err := Compare(src, dst, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Consistent() {
+		t.Fatal("expected differences")
+	}
+	if rep.Checked != 6 {
+		t.Errorf("checked %d keys, want 6", rep.Checked)
+	}
+	if !reflect.DeepEqual(rep.Missing, []string{"/b"}) {
+		t.Errorf("missing %v", rep.Missing)
+	}
+	if !reflect.DeepEqual(rep.Extra, []string{"/e"}) {
+		t.Errorf("extra %v", rep.Extra)
+	}
+	if !reflect.DeepEqual(rep.Mismatched, []string{"/c", "/d"}) {
+		t.Errorf("mismatched %v", rep.Mismatched)
+	}
+
+	rep, err = Compare(src, dst, Options{SizesOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rep.Mismatched, []string{"/d"}) {
+		t.Errorf("sizes only: mismatched %v", rep.Mismatched)
+	}
+
+	rep, err = Compare(src, dst, Options{Prefix: "/x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Consistent() || rep.Checked != 1 {
+		t.Errorf("prefix: %+v", rep)
+	}
+}
+
+func TestMaxReported(t *testing.T) {
+	src, dst := ds.NewMapDatastore(), ds.NewMapDatastore()
+	fill(src, map[string]string{"/a": "", "/b": "", "/c": ""})
+
+	rep, err := Compare(src, dst, Options{MaxReported: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.MissingCount != 3 || len(rep.Missing) != 2 {
+		t.Fatalf("got %d reported of %d missing", len(rep.Missing), rep.MissingCount)
+	}
+}
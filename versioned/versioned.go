@@ -0,0 +1,205 @@
+// Package versioned provides a datastore wrapper that records a format
+// version with every value and upgrades old values as they are read, so
+// an application can change its value format without rewriting every key
+// at once.
+//
+// Each stored value is prefixed with a small header holding its version.
+// Reads apply the registered migrations one version at a time until the
+// value reaches Options.Current, and may write the upgraded value back.
+// Values written before the wrapper was introduced have no header and are
+// read as Options.Unversioned.
+package versioned
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+var (
+	// ErrNoMigration is returned when a value's version has no migration
+	// registered to the next one.
+	ErrNoMigration = errors.New("versioned: no migration registered")
+	// ErrFutureVersion is returned for values written with a version newer
+	// than Options.Current, typically by a newer release.
+	ErrFutureVersion = errors.New("versioned: value is newer than the current version")
+)
+
+// magic starts every versioned value. A value written without the wrapper
+// that happens to start with it is misread, so the bytes are chosen to be
+// unlikely at the start of real data.
+var magic = []byte{0x00, 'd', 's', 'v'}
+
+// Migration upgrades a value by one version.
+type Migration func(key ds.Key, value []byte) ([]byte, error)
+
+// Options configures the wrapper.
+type Options struct {
+	// Current is the version values are written at.
+	Current uint64
+	// Unversioned is the version assumed for values without a header.
+	Unversioned uint64
+	// Migrations maps each version to the migration upgrading values from
+	// it to the next version.
+	Migrations map[uint64]Migration
+	// Rewrite writes values upgraded on read back to the child, so each
+	// value is migrated once. Rewriting failures do not fail the read.
+	Rewrite bool
+}
+
+// Datastore versions the values of a child datastore.
+type Datastore struct {
+	child ds.Datastore
+	opts  Options
+}
+
+var _ ds.Datastore = (*Datastore)(nil)
+var _ ds.Batching = (*Datastore)(nil)
+
+// New wraps child, writing values at opts.Current.
+func New(child ds.Datastore, opts Options) *Datastore {
+	return &Datastore{child: child, opts: opts}
+}
+
+// Encode prefixes value with the header for version.
+func Encode(version uint64, value []byte) []byte {
+	buf := make([]byte, len(magic)+binary.MaxVarintLen64+len(value))
+	n := copy(buf, magic)
+	n += binary.PutUvarint(buf[n:], version)
+	n += copy(buf[n:], value)
+	return buf[:n]
+}
+
+// Decode splits a stored value into its version and payload. Values
+// without a header are returned whole with version unversioned.
+func Decode(stored []byte, unversioned uint64) (uint64, []byte, error) {
+	if !bytes.HasPrefix(stored, magic) {
+		return unversioned, stored, nil
+	}
+	version, n := binary.Uvarint(stored[len(magic):])
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("versioned: corrupt version header")
+	}
+	return version, stored[len(magic)+n:], nil
+}
+
+// upgrade decodes a stored value and migrates it to the current version,
+// reporting whether any migration ran.
+func (d *Datastore) upgrade(key ds.Key, stored []byte) ([]byte, bool, error) {
+	version, value, err := Decode(stored, d.opts.Unversioned)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %s", err, key)
+	}
+	if version > d.opts.Current {
+		return nil, false, fmt.Errorf("%w: %s is at version %d, current is %d", ErrFutureVersion, key, version, d.opts.Current)
+	}
+	migrated := version < d.opts.Current
+	for ; version < d.opts.Current; version++ {
+		m, ok := d.opts.Migrations[version]
+		if !ok {
+			return nil, false, fmt.Errorf("%w: %s from version %d", ErrNoMigration, key, version)
+		}
+		if value, err = m(key, value); err != nil {
+			return nil, false, fmt.Errorf("versioned: migrating %s from version %d: %w", key, version, err)
+		}
+	}
+	return value, migrated, nil
+}
+
+// Children implements Shim
+func (d *Datastore) Children() []ds.Datastore {
+	return []ds.Datastore{d.child}
+}
+
+// Put implements Datastore.Put, writing value at the current version.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	return d.child.Put(key, Encode(d.opts.Current, value))
+}
+
+// Get implements Datastore.Get, upgrading old values.
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	stored, err := d.child.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	value, migrated, err := d.upgrade(key, stored)
+	if err != nil {
+		return nil, err
+	}
+	if migrated && d.opts.Rewrite {
+		_ = d.Put(key, value)
+	}
+	return value, nil
+}
+
+// Has implements Datastore.Has
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	return d.child.Has(key)
+}
+
+// GetSize implements Datastore.GetSize. Since migrations can change a
+// value's size, the value is read and upgraded to measure it.
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	value, err := d.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+// Delete implements Datastore.Delete
+func (d *Datastore) Delete(key ds.Key) error {
+	return d.child.Delete(key)
+}
+
+// Query implements Datastore.Query. Returned values are upgraded and their
+// sizes are those of the upgraded values; keys-only queries report stored
+// sizes. Upgraded values are not rewritten. Filters and orders on values
+// are applied to the upgraded values.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	if q.KeysOnly && len(q.Filters) == 0 && len(q.Orders) == 0 {
+		return d.child.Query(q)
+	}
+
+	// Value filters and orders must see upgraded values, and offsets and
+	// limits apply after them, so only the prefix is pushed down.
+	res, err := d.child.Query(dsq.Query{Prefix: q.Prefix})
+	if err != nil {
+		return nil, err
+	}
+	upgraded := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil {
+				return r, ok
+			}
+			value, _, err := d.upgrade(ds.RawKey(r.Key), r.Value)
+			if err != nil {
+				return dsq.Result{Error: err}, true
+			}
+			r.Value, r.Size = value, len(value)
+			return r, true
+		},
+		Close: res.Close,
+	})
+	return dsq.NaiveQueryApply(q, upgraded), nil
+}
+
+// Sync implements Datastore.Sync
+func (d *Datastore) Sync(prefix ds.Key) error {
+	return d.child.Sync(prefix)
+}
+
+// Batch implements Batching.Batch
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+// Close closes the child.
+func (d *Datastore) Close() error {
+	return d.child.Close()
+}
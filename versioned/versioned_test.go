@@ -0,0 +1,83 @@
+package versioned
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func TestSuite(t *testing.T) {
+	dstest.SubtestAll(t, New(ds.NewMapDatastore(), Options{Current: 1}))
+}
+
+// Version 0 stored names, version 1 upper-cased them and version 2
+// wrapped them in JSON.
+var migrations = map[uint64]Migration{
+	0: func(_ ds.Key, v []byte) ([]byte, error) { return bytes.ToUpper(v), nil },
+	1: func(_ ds.Key, v []byte) ([]byte, error) { return []byte(`{"name":"` + string(v) + `"}`), nil },
+}
+
+func TestMigrate(t *testing.T) {
+	child := ds.NewMapDatastore()
+	child.Put(ds.NewKey("/legacy"), []byte("ada"))
+	child.Put(ds.NewKey("/v1"), Encode(1, []byte("GRACE")))
+
+	d := New(child, Options{Current: 2, Migrations: migrations})
+	for key, want := range map[string]string{
+		"/legacy": `{"name":"ADA"}`,
+		"/v1":     `{"name":"GRACE"}`,
+	} {
+		if v, err := d.Get(ds.NewKey(key)); err != nil || string(v) != want {
+			t.Fatalf("%s: got %q, %v", key, v, err)
+		}
+	}
+
+	res, err := d.Query(dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || string(entries[0].Value) != `{"name":"ADA"}` || entries[0].Size != len(entries[0].Value) {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	// Without Rewrite the stored value is untouched.
+	if v, _ := child.Get(ds.NewKey("/legacy")); string(v) != "ada" {
+		t.Fatalf("value rewritten: %q", v)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	child := ds.NewMapDatastore()
+	child.Put(ds.NewKey("/a"), []byte("ada"))
+	d := New(child, Options{Current: 1, Migrations: migrations, Rewrite: true})
+
+	if _, err := d.Get(ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := child.Get(ds.NewKey("/a"))
+	if version, value, _ := Decode(stored, 0); version != 1 || string(value) != "ADA" {
+		t.Fatalf("rewritten as version %d: %q", version, value)
+	}
+}
+
+func TestVersionErrors(t *testing.T) {
+	child := ds.NewMapDatastore()
+	child.Put(ds.NewKey("/future"), Encode(9, []byte("x")))
+	child.Put(ds.NewKey("/old"), Encode(0, []byte("x")))
+	d := New(child, Options{Current: 2, Migrations: map[uint64]Migration{1: migrations[1]}})
+
+	if _, err := d.Get(ds.NewKey("/future")); !errors.Is(err, ErrFutureVersion) {
+		t.Fatalf("future version: %v", err)
+	}
+	if _, err := d.Get(ds.NewKey("/old")); !errors.Is(err, ErrNoMigration) {
+		t.Fatalf("missing migration: %v", err)
+	}
+}